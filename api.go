@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultLookback is the range searched when a request gives no start.
+const defaultLookback = time.Hour
+
+// apiResponse is the envelope of the Prometheus HTTP API.
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func writeAPIData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, err error, status int) {
+	errorType := "internal"
+	switch status {
+	case http.StatusBadRequest:
+		errorType = "bad_data"
+	case http.StatusUnprocessableEntity:
+		errorType = "execution"
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		errorType = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// parseLabelQuery reads the match[], start and end parameters of the label
+// endpoints.
+func parseLabelQuery(r *http.Request) (storage.LabelQuery, error) {
+	var q storage.LabelQuery
+	if err := r.ParseForm(); err != nil {
+		return q, err
+	}
+	now := time.Now()
+	end, err := parseAPITime(r.Form.Get("end"), now)
+	if err != nil {
+		return q, fmt.Errorf("invalid end: %s", err)
+	}
+	start, err := parseAPITime(r.Form.Get("start"), end.Add(-defaultLookback))
+	if err != nil {
+		return q, fmt.Errorf("invalid start: %s", err)
+	}
+	if end.Before(start) {
+		return q, fmt.Errorf("end is before start")
+	}
+	q.Start = start.UnixNano() / int64(time.Millisecond)
+	q.End = end.UnixNano() / int64(time.Millisecond)
+	for _, selector := range r.Form["match[]"] {
+		matchers, err := storage.ParseSelector(selector)
+		if err != nil {
+			return q, err
+		}
+		q.Selectors = append(q.Selectors, matchers)
+	}
+	return q, nil
+}
+
+// parseTranslateQuery reads the query selector and the start, end and step
+// parameters of /debug/translate.
+func parseTranslateQuery(r *http.Request) (*prompb.Query, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	matchers, err := storage.ParseSelector(r.Form.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseAPITime(r.Form.Get("end"), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid end: %s", err)
+	}
+	start, err := parseAPITime(r.Form.Get("start"), end.Add(-defaultLookback))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start: %s", err)
+	}
+	q := &prompb.Query{
+		StartTimestampMs: start.UnixNano() / int64(time.Millisecond),
+		EndTimestampMs:   end.UnixNano() / int64(time.Millisecond),
+		Matchers:         matchers,
+	}
+	if step := r.Form.Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step: %s", err)
+		}
+		q.Hints = &prompb.ReadHints{StepMs: int64(d / time.Millisecond)}
+	}
+	return q, nil
+}
+
+// parseAPITime parses a unix timestamp in seconds or an RFC3339 time as the
+// Prometheus HTTP API does, an empty s is def.
+func parseAPITime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/storage"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const signatureHeader = "X-Ropee-Signature"
+
+// hmacVerifier rejects requests whose X-Ropee-Signature header isn't the hex
+// encoded HMAC-SHA256 of the request body under secret. A "sha256=" prefix
+// on the header value is accepted. It verifies writes only.
+func hmacVerifier(secret []byte, l log.Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signature := strings.TrimPrefix(r.Header.Get(signatureHeader), "sha256=")
+		if signature == "" {
+			httpError(w, "write", errorTypeAuth, "missing "+signatureHeader+" header", http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			httpError(w, "write", errorTypeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		expected, err := hex.DecodeString(signature)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if err != nil || !hmac.Equal(mac.Sum(nil), expected) {
+			level.Warn(l).Log("msg", "invalid request signature", "remote", r.RemoteAddr)
+			httpError(w, "write", errorTypeAuth, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// splunkContext returns the context of r carrying the Splunk credentials of
+// r, a bearer token or basic auth, and whether r had any. Requests without
+// credentials are run with the token of -splunk-token-file.
+func splunkContext(r *http.Request) (context.Context, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return storage.ContextWithToken(r.Context(), strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))), true
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		return storage.ContextWithCredentials(r.Context(), user, pass), true
+	}
+	return r.Context(), false
+}
+
+// requiredMatchersContext exempts reads of r from -read.required-label-matchers
+// if r authenticates as one of -read.required-label-matchers-exempt-users or,
+// with -read.limit-override, asks to with X-Ropee-Read-Skip-Required-Matchers.
+// Exempt users are only trusted once authenticate, the Splunk login check of
+// the credentials of ctx, accepts their password.
+func requiredMatchersContext(ctx context.Context, r *http.Request, authenticate func(context.Context) error) context.Context {
+	if config.ReadLimitOverride && r.Header.Get("X-Ropee-Read-Skip-Required-Matchers") == "true" {
+		return storage.ContextWithoutRequiredMatchers(ctx)
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		for _, exempt := range splitList(config.ReadRequiredExempt) {
+			if user == exempt && authenticate(ctx) == nil {
+				return storage.ContextWithoutRequiredMatchers(ctx)
+			}
+		}
+	}
+	return ctx
+}
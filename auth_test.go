@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/kebe7jun/ropee/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequiredMatchersContextAuthenticatesExemptUsers(t *testing.T) {
+	defer func(exempt string) { config.ReadRequiredExempt = exempt }(config.ReadRequiredExempt)
+	config.ReadRequiredExempt = "admin"
+	rejected := errors.New("splunk rejected the credentials")
+	for _, c := range []struct {
+		name   string
+		user   string
+		auth   error
+		exempt bool
+	}{
+		{"authenticated exempt user", "admin", nil, true},
+		{"wrong password", "admin", rejected, false},
+		{"other user", "alice", nil, false},
+	} {
+		r := httptest.NewRequest("POST", "/read", nil)
+		r.SetBasicAuth(c.user, "changeme")
+		authenticated := false
+		base := context.Background()
+		ctx := requiredMatchersContext(base, r, func(context.Context) error {
+			authenticated = true
+			return c.auth
+		})
+		// only exemptions wrap the context
+		exempt := ctx != base
+		if exempt != c.exempt {
+			t.Errorf("%s: exempt = %v, want %v", c.name, exempt, c.exempt)
+		}
+		if c.user == "admin" && !authenticated {
+			t.Errorf("%s: exempted without authenticating", c.name)
+		}
+	}
+}
+
+func TestHMACVerifierCountsAuthErrors(t *testing.T) {
+	registry := metrics.NewRegistry()
+	const key = `ropee_request_errors_count{error_type="auth_error",handler="write"}`
+	before, err := metrics.Snapshot(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := hmacVerifier([]byte("secret"), log.NewNopLogger(), func(http.ResponseWriter, *http.Request) {
+		t.Error("passed on a request without a valid signature")
+	})
+	for _, signature := range []string{"", "sha256=00"} {
+		r := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("body"))
+		if signature != "" {
+			r.Header.Set(signatureHeader, signature)
+		}
+		w := httptest.NewRecorder()
+		verify(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("signature %q answered %d, want 401", signature, w.Code)
+		}
+	}
+	after, err := metrics.Snapshot(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := after[key] - before[key]; got != 2 {
+		t.Errorf("%s grew by %v, want 2", key, got)
+	}
+}
@@ -2,14 +2,14 @@
 
 CMD="/usr/local/bin/ropee -log-file-path - "
 
-args="splunk-url splunk-hec-url splunk-hec-token listen-addr splunk-metrics-index splunk-metrics-sourcetype timeout debug"
+args="splunk-url splunk-hec-url splunk-hec-token listen-addr splunk-metrics-index splunk-metrics-sourcetype timeout debug write-backends read-backends write-quorum log-sample-rate splunk-hec-replica-urls splunk-hec-replica-tokens splunk-hec-replica-policy splunk-hec-retries splunk-hec-breaker-failures splunk-hec-breaker-cooldown flatten-k8s-labels write-hmac-secret-file splunk-hec-channel top-n-series push-ttl push-interval coalesce-window-ms coalesce-max-series startup-probe-enabled startup-probe-timeout snappy-format cardinality-window max-labels-per-series dedup-cache-size merge-write-window time-partition-rules-file tenant-limits-file read-timeout-seconds write-timeout-seconds hec-tls-server-name hec-insecure-skip-verify splunk-metric-name-prefix splunk-metric-name-suffix savedsearch-map-file admin-listen-addr forward-client-ip splunk-token-file graphite-listen-addr graphite-mapping-file hec-sourcetype-endpoint-map agent-mode write-latency-slo-p99-ms statsd-listen-addr hec-standby-url hec-standby-token request-id-format merge-summary-quantiles native-histogram-expansion splunk-api-rate-limit-rps splunk-api-rate-limit-max-wait metric-aliases-file http-proxy-url splunk-lookup-file lookup-cache-ttl splunk-field-prefix hec-bundle-events hec-bundle-max-events max-series-per-write truncate-oversized-writes split-rules-file"
 
 for i in $args
 do
     env_arg=$(echo $i | sed 'y/abcdefghijklmnopqrstuvwxyz-/ABCDEFGHIJKLMNOPQRSTUVWXYZ_/')
     anv_arg_value=$(eval "echo \"\${$env_arg}\"")
     if [ ! -z "$anv_arg_value" ]; then
-        CMD=$CMD"-$i $anv_arg_value "
+        CMD=$CMD"-$i=$anv_arg_value "
     fi
 done
 
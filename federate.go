@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"sort"
+)
+
+// writeFederation writes the newest sample of every series of resp in the
+// text exposition format, grouped by metric name.
+func writeFederation(w io.Writer, resp *prompb.ReadResponse) error {
+	families := make(map[string]*dto.MetricFamily)
+	// a series matching several match[] selectors is in several results
+	seen := make(map[string]bool)
+	for _, res := range resp.Results {
+		for _, ts := range res.Timeseries {
+			if len(ts.Samples) == 0 {
+				continue
+			}
+			newest := ts.Samples[0]
+			for _, s := range ts.Samples {
+				if s.Timestamp > newest.Timestamp {
+					newest = s
+				}
+			}
+			name := ""
+			m := &dto.Metric{
+				Untyped:     &dto.Untyped{Value: proto.Float64(newest.Value)},
+				TimestampMs: proto.Int64(newest.Timestamp),
+			}
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" {
+					name = l.Value
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			key := name
+			for _, l := range m.Label {
+				key += "\xff" + l.GetName() + "\xff" + l.GetValue()
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			mf, ok := families[name]
+			if !ok {
+				mf = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+				families[name] = mf
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := expfmt.MetricFamilyToText(w, families[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
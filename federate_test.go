@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+)
+
+func TestWriteFederationDedupesSeriesOfSeveralSelectors(t *testing.T) {
+	up := &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+	}
+	other := &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 0}},
+	}
+	resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{
+		{Timeseries: []*prompb.TimeSeries{up, other}},
+		{Timeseries: []*prompb.TimeSeries{up}},
+	}}
+	var buf bytes.Buffer
+	if err := writeFederation(&buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE up untyped\nup{job=\"api\"} 1 1000\nup{job=\"db\"} 0 1000\n"
+	if buf.String() != want {
+		t.Fatalf("writeFederation() = %q, want %q", buf.String(), want)
+	}
+}
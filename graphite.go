@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/ingest"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net"
+	"time"
+)
+
+// graphiteMaxBatch is the number of lines of a connection written at most
+// at once, lines are also written whenever the sender pauses.
+const graphiteMaxBatch = 1000
+
+// serveGraphite accepts Graphite plaintext protocol connections on ln and
+// writes their lines with write until ln is closed.
+func serveGraphite(ln net.Listener, mapper *ingest.GraphiteMapper, write func(*prompb.WriteRequest) error, l log.Logger) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleGraphite(conn, mapper, write, l)
+	}
+}
+
+func handleGraphite(conn net.Conn, mapper *ingest.GraphiteMapper, write func(*prompb.WriteRequest) error, l log.Logger) {
+	defer conn.Close()
+	l = log.With(l, "remote", conn.RemoteAddr().String())
+	r := bufio.NewReader(conn)
+	lines := make([]string, 0, graphiteMaxBatch)
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+		metrics.WriteRequestCounter.Add(1)
+		series, err := ingest.ParseGraphite(lines, mapper, time.Now())
+		lines = lines[:0]
+		if err != nil {
+			level.Warn(l).Log("msg", "Graphite parse error", "err", err)
+			return
+		}
+		if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+			level.Error(l).Log("msg", "Graphite write error", "err", err)
+		}
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			flush()
+			if err != io.EOF {
+				level.Warn(l).Log("msg", "Graphite connection error", "err", err)
+			}
+			return
+		}
+		if len(lines) >= graphiteMaxBatch || r.Buffered() == 0 {
+			flush()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/kebe7jun/ropee/ingest"
+	"github.com/prometheus/prometheus/prompb"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServeGraphite(t *testing.T) {
+	mapping, err := ioutil.TempFile("", "graphite-mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mapping.Name())
+	fmt.Fprint(mapping, `
+mappings:
+  - match: "servers.*.cpu.*"
+    name: cpu_usage
+    labels:
+      host: "${1}"
+      cpu: "${2}"
+`)
+	mapping.Close()
+	mapper, err := ingest.LoadGraphiteMapper(mapping.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	written := make(chan []prompb.TimeSeries, 10)
+	go serveGraphite(ln, mapper, func(req *prompb.WriteRequest) error {
+		written <- req.Timeseries
+		return nil
+	}, log.NewNopLogger())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "servers.web1.cpu.user 1.5 1500000000\nload.shortterm 0.25 1500000010\n")
+	conn.Close()
+
+	series := make(map[string]prompb.TimeSeries)
+	for len(series) < 2 {
+		select {
+		case ts := <-written:
+			for _, s := range ts {
+				series[labelValue(s.Labels, "__name__")] = s
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("written %v, want cpu_usage and load_shortterm", series)
+		}
+	}
+	cpu := series["cpu_usage"]
+	if labelValue(cpu.Labels, "host") != "web1" || labelValue(cpu.Labels, "cpu") != "user" {
+		t.Errorf("cpu_usage labels %v, want host web1 and cpu user", cpu.Labels)
+	}
+	if len(cpu.Samples) != 1 || cpu.Samples[0].Value != 1.5 || cpu.Samples[0].Timestamp != 1500000000000 {
+		t.Errorf("cpu_usage samples %v", cpu.Samples)
+	}
+	if load := series["load_shortterm"]; len(load.Samples) != 1 || load.Samples[0].Timestamp != 1500000010000 {
+		t.Errorf("load_shortterm samples %v", load.Samples)
+	}
+}
+
+func labelValue(labels []prompb.Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
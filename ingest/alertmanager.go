@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"strconv"
+	"time"
+)
+
+// AlertMetricName is the name of the series alerts of Alertmanager webhooks
+// are written as. It differs from Prometheus' ALERTS so both can be stored.
+const AlertMetricName = "alertmanager_alert"
+
+type alertmanagerMessage struct {
+	Version string `json:"version"`
+	Alerts  []struct {
+		Status string            `json:"status"`
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+// ParseAlertmanager converts an Alertmanager webhook notification into one
+// alertmanager_alert series per alert, labeled with the alert's labels
+// (alertname included) and valued 1 while firing and 0 once resolved.
+func ParseAlertmanager(body []byte, now time.Time) ([]prompb.TimeSeries, error) {
+	var msg alertmanagerMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Version != "" && msg.Version != "4" {
+		return nil, fmt.Errorf("unsupported webhook version %q", msg.Version)
+	}
+	ts := now.UnixNano() / int64(time.Millisecond)
+	set := newSeriesSet()
+	for i, alert := range msg.Alerts {
+		var value float64
+		switch alert.Status {
+		case "firing":
+			value = 1
+		case "resolved":
+			value = 0
+		default:
+			return nil, fmt.Errorf("alert %d: unknown status %s", i+1, strconv.Quote(alert.Status))
+		}
+		labels := []prompb.Label{{Name: "__name__", Value: AlertMetricName}}
+		for name, v := range alert.Labels {
+			if name == "__name__" {
+				continue
+			}
+			labels = append(labels, prompb.Label{Name: SanitizeName(name), Value: v})
+		}
+		set.add(labels, prompb.Sample{Value: value, Timestamp: ts})
+	}
+	return set.series, nil
+}
@@ -0,0 +1,112 @@
+package ingest
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ParseExposition decodes a Prometheus text or delimited protobuf exposition
+// body, the format is picked from contentType. Summaries and histograms are
+// expanded into their quantile/bucket, _sum and _count series. labels are
+// added to every series, overriding exposed labels of the same name.
+// Samples without timestamp use now.
+func ParseExposition(r io.Reader, contentType string, labels []prompb.Label, now time.Time) ([]prompb.TimeSeries, error) {
+	format := expfmt.ResponseFormat(http.Header{"Content-Type": []string{contentType}})
+	decoder := expfmt.NewDecoder(r, format)
+	set := newSeriesSet()
+	for {
+		var mf dto.MetricFamily
+		if err := decoder.Decode(&mf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		addMetricFamily(set, &mf, labels, now.UnixNano()/int64(time.Millisecond))
+	}
+	return set.series, nil
+}
+
+func addMetricFamily(set *seriesSet, mf *dto.MetricFamily, extra []prompb.Label, nowMs int64) {
+	name := mf.GetName()
+	for _, m := range mf.Metric {
+		ts := m.GetTimestampMs()
+		if ts == 0 {
+			ts = nowMs
+		}
+		add := func(name string, value float64, more ...prompb.Label) {
+			labels := []prompb.Label{{Name: "__name__", Value: name}}
+			labels = append(labels, more...)
+			labels = mergeLabels(labels, m.Label, extra)
+			set.add(labels, prompb.Sample{Value: value, Timestamp: ts})
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add(name, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(name, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(name, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.Quantile {
+				add(name, q.GetValue(), prompb.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+			}
+			add(name+"_sum", s.GetSampleSum())
+			add(name+"_count", float64(s.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			infSeen := false
+			for _, b := range h.Bucket {
+				if math.IsInf(b.GetUpperBound(), +1) {
+					infSeen = true
+				}
+				add(name+"_bucket", float64(b.GetCumulativeCount()), prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+			}
+			if !infSeen {
+				add(name+"_bucket", float64(h.GetSampleCount()), prompb.Label{Name: "le", Value: "+Inf"})
+			}
+			add(name+"_sum", h.GetSampleSum())
+			add(name+"_count", float64(h.GetSampleCount()))
+		}
+	}
+}
+
+// mergeLabels appends the exposed labels and then extra to labels, later
+// names replace earlier ones.
+func mergeLabels(labels []prompb.Label, exposed []*dto.LabelPair, extra []prompb.Label) []prompb.Label {
+	index := make(map[string]int, len(labels))
+	set := func(name, value string) {
+		if i, ok := index[name]; ok {
+			labels[i].Value = value
+			return
+		}
+		index[name] = len(labels)
+		labels = append(labels, prompb.Label{Name: name, Value: value})
+	}
+	for i, l := range labels {
+		index[l.Name] = i
+	}
+	for _, l := range exposed {
+		set(l.GetName(), l.GetValue())
+	}
+	for _, l := range extra {
+		set(l.Name, l.Value)
+	}
+	return labels
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,126 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphiteMapper turns dotted Graphite metric paths into Prometheus metric
+// names and labels.
+type GraphiteMapper struct {
+	rules []graphiteRule
+}
+
+type graphiteRule struct {
+	match  *regexp.Regexp
+	name   string
+	labels map[string]string
+}
+
+type graphiteMappingFile struct {
+	Mappings []struct {
+		Match  string            `yaml:"match"`
+		Name   string            `yaml:"name"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"mappings"`
+}
+
+// LoadGraphiteMapper reads mapping rules from a YAML file like
+//
+//	mappings:
+//	  - match: "servers.*.cpu.*"
+//	    name: cpu_usage
+//	    labels:
+//	      host: "${1}"
+//	      cpu: "${2}"
+//
+// Every * matches one component of the path, name and label values may
+// refer to them as ${1}, ${2}... The first matching rule wins.
+func LoadGraphiteMapper(filename string) (*GraphiteMapper, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f graphiteMappingFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	m := &GraphiteMapper{}
+	for i, r := range f.Mappings {
+		if r.Match == "" || r.Name == "" {
+			return nil, fmt.Errorf("mapping %d: match and name are required", i+1)
+		}
+		for name := range r.Labels {
+			if name != SanitizeName(name) {
+				return nil, fmt.Errorf("mapping %d: invalid label name %q", i+1, name)
+			}
+		}
+		pattern := strings.Replace(regexp.QuoteMeta(r.Match), `\*`, `([^.]*)`, -1)
+		m.rules = append(m.rules, graphiteRule{
+			match:  regexp.MustCompile("^" + pattern + "$"),
+			name:   r.Name,
+			labels: r.Labels,
+		})
+	}
+	return m, nil
+}
+
+// Map returns the labels, __name__ included, of the series of path. Paths
+// no rule matches are named after the path with dots replaced by '_'.
+func (m *GraphiteMapper) Map(path string) []prompb.Label {
+	if m != nil {
+		for _, r := range m.rules {
+			groups := r.match.FindStringSubmatchIndex(path)
+			if groups == nil {
+				continue
+			}
+			expand := func(template string) string {
+				return string(r.match.ExpandString(nil, template, path, groups))
+			}
+			labels := []prompb.Label{{Name: "__name__", Value: SanitizeName(expand(r.name))}}
+			for name, value := range r.labels {
+				labels = append(labels, prompb.Label{Name: name, Value: expand(value)})
+			}
+			return labels
+		}
+	}
+	return []prompb.Label{{Name: "__name__", Value: SanitizeName(path)}}
+}
+
+// ParseGraphite converts lines of the Graphite plaintext protocol,
+// "<path> <value> [<timestamp>]", into time series. Timestamps are in
+// seconds, lines without one or with -1 use now.
+func ParseGraphite(lines []string, mapper *GraphiteMapper, now time.Time) ([]prompb.TimeSeries, error) {
+	set := newSeriesSet()
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid line %q: expected path, value and optional timestamp", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q of %s", fields[1], fields[0])
+		}
+		ts := now.UnixNano() / int64(time.Millisecond)
+		if len(fields) == 3 && fields[2] != "-1" {
+			sec, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q of %s", fields[2], fields[0])
+			}
+			ts = int64(math.Round(sec * 1000))
+		}
+		set.add(mapper.Map(fields[0]), prompb.Sample{Value: value, Timestamp: ts})
+	}
+	return set.series, nil
+}
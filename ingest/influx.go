@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var influxPrecisions = map[string]int64{
+	"":   int64(time.Nanosecond),
+	"n":  int64(time.Nanosecond),
+	"ns": int64(time.Nanosecond),
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// ParseInflux converts Influx line protocol into time series. Every numeric
+// or boolean field becomes a series named <measurement>_<field> (just
+// <measurement> for a field called "value") labeled with the line's tags.
+// String fields are skipped. Lines without timestamp use now.
+func ParseInflux(body []byte, precision string, now time.Time) ([]prompb.TimeSeries, error) {
+	unit, ok := influxPrecisions[precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q", precision)
+	}
+	set := newSeriesSet()
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parseInfluxLine(set, line, unit, now); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set.series, nil
+}
+
+func parseInfluxLine(set *seriesSet, line string, unit int64, now time.Time) error {
+	sections := splitUnescaped(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return fmt.Errorf("expected measurement, fields and optional timestamp")
+	}
+	ts := now.UnixNano() / int64(time.Millisecond)
+	if len(sections) == 3 {
+		v, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		ts = v * unit / int64(time.Millisecond)
+	}
+
+	keys := splitUnescaped(sections[0], ',')
+	measurement := unescapeInflux(keys[0])
+	tags := make([]prompb.Label, 0, len(keys)-1)
+	for _, kv := range keys[1:] {
+		parts := splitUnescaped(kv, '=')
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid tag %q", kv)
+		}
+		tags = append(tags, prompb.Label{Name: SanitizeName(unescapeInflux(parts[0])), Value: unescapeInflux(parts[1])})
+	}
+
+	for _, kv := range splitUnescaped(sections[1], ',') {
+		parts := splitUnescaped(kv, '=')
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid field %q", kv)
+		}
+		value, ok, err := parseInfluxValue(parts[1])
+		if err != nil {
+			return fmt.Errorf("field %q: %s", parts[0], err)
+		}
+		if !ok {
+			continue
+		}
+		name := measurement
+		if field := unescapeInflux(parts[0]); field != "value" {
+			name += "_" + field
+		}
+		labels := append([]prompb.Label{{Name: "__name__", Value: SanitizeName(name)}}, tags...)
+		set.add(labels, prompb.Sample{Value: value, Timestamp: ts})
+	}
+	return nil
+}
+
+// parseInfluxValue returns ok=false for string fields, which can't become samples.
+func parseInfluxValue(s string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return 0, false, nil
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return 1, true, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(s, "i") || strings.HasSuffix(s, "u"):
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil, err
+}
+
+// splitUnescaped splits s at sep, ignoring backslash escaped separators and
+// separators inside double quoted strings.
+func splitUnescaped(s string, sep byte) []string {
+	parts := make([]string, 0)
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,48 @@
+// Package ingest converts foreign metric formats into Prometheus time series
+// so they can be forwarded through the regular remote write path.
+package ingest
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"strings"
+)
+
+// SanitizeName maps s to a valid Prometheus metric or label name by
+// replacing every invalid character with '_'.
+func SanitizeName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		b[i] = '_'
+	}
+	return string(b)
+}
+
+// seriesSet collects samples into one time series per distinct label set,
+// keeping the order series were first seen in.
+type seriesSet struct {
+	index  map[string]int
+	series []prompb.TimeSeries
+}
+
+func newSeriesSet() *seriesSet {
+	return &seriesSet{index: make(map[string]int)}
+}
+
+func (s *seriesSet) add(labels []prompb.Label, sample prompb.Sample) {
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Name+"\xff"+l.Value)
+	}
+	key := strings.Join(parts, "\xff")
+	if i, ok := s.index[key]; ok {
+		s.series[i].Samples = append(s.series[i].Samples, sample)
+		return
+	}
+	s.index[key] = len(s.series)
+	s.series = append(s.series, prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{sample}})
+}
@@ -0,0 +1,330 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/kebe7jun/ropee/internal/wire"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OTLP messages are decoded from the protobuf wire format by field
+// number, see opentelemetry/proto/metrics/v1/metrics.proto. The generated
+// go.opentelemetry.io/proto/otlp package needs a newer protobuf runtime and
+// Go than ropee is built with.
+const (
+	otlpTemporalityDelta = 1
+
+	otlpFlagNoRecordedValue = 1
+)
+
+// OTLPResult is what ParseOTLPMetrics made of a request.
+type OTLPResult struct {
+	Series []prompb.TimeSeries
+	// Skipped counts the data points without a Prometheus equivalent:
+	// those of delta sums and histograms, exponential histograms and
+	// summaries, and those flagged as having no recorded value.
+	Skipped int
+}
+
+// ParseOTLPMetrics converts an OTLP ExportMetricsServiceRequest into time
+// series. Gauges and non-monotonic sums become gauges, monotonic sums
+// counters named <name>_total and histograms the <name>_bucket, <name>_sum
+// and <name>_count series of a Prometheus histogram. Data point attributes
+// are labels, service.name and service.instance.id of the resource job and
+// instance.
+func ParseOTLPMetrics(body []byte) (*OTLPResult, error) {
+	set := newSeriesSet()
+	res := &OTLPResult{}
+	err := wire.EachField(body, func(f wire.Field) error {
+		if f.Num != 1 || f.Wire != 2 {
+			return nil
+		}
+		return parseOTLPResourceMetrics(f.Data, set, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Series = set.series
+	return res, nil
+}
+
+func parseOTLPResourceMetrics(msg []byte, set *seriesSet, res *OTLPResult) error {
+	var resource []prompb.Label
+	scopes := make([][]byte, 0)
+	err := wire.EachField(msg, func(f wire.Field) error {
+		switch {
+		case f.Num == 1 && f.Wire == 2:
+			attrs, err := parseOTLPAttributes(f.Data, 1)
+			if err != nil {
+				return err
+			}
+			for _, a := range attrs {
+				switch a.Name {
+				case "service.name":
+					resource = append(resource, prompb.Label{Name: "job", Value: a.Value})
+				case "service.instance.id":
+					resource = append(resource, prompb.Label{Name: "instance", Value: a.Value})
+				}
+			}
+		// 1000 is instrumentation_library_metrics of senders older than
+		// scope_metrics, the message is the same
+		case (f.Num == 2 || f.Num == 1000) && f.Wire == 2:
+			scopes = append(scopes, f.Data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		err := wire.EachField(scope, func(f wire.Field) error {
+			if f.Num != 2 || f.Wire != 2 {
+				return nil
+			}
+			return parseOTLPMetric(f.Data, resource, set, res)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOTLPAttributes returns the KeyValue fields num of msg as labels,
+// named as in OTLP. Values are formatted as strings, arrays, maps and bytes
+// are left out.
+func parseOTLPAttributes(msg []byte, num int) ([]prompb.Label, error) {
+	labels := make([]prompb.Label, 0)
+	err := wire.EachField(msg, func(f wire.Field) error {
+		if f.Num != num || f.Wire != 2 {
+			return nil
+		}
+		var l prompb.Label
+		ok := false
+		err := wire.EachField(f.Data, func(kv wire.Field) error {
+			switch {
+			case kv.Num == 1 && kv.Wire == 2:
+				l.Name = string(kv.Data)
+			case kv.Num == 2 && kv.Wire == 2:
+				return wire.EachField(kv.Data, func(v wire.Field) error {
+					ok = true
+					switch {
+					case v.Num == 1 && v.Wire == 2:
+						l.Value = string(v.Data)
+					case v.Num == 2 && v.Wire == 0:
+						l.Value = strconv.FormatBool(v.Value != 0)
+					case v.Num == 3 && v.Wire == 0:
+						l.Value = strconv.FormatInt(int64(v.Value), 10)
+					case v.Num == 4 && v.Wire == 1:
+						l.Value = strconv.FormatFloat(math.Float64frombits(v.Value), 'f', -1, 64)
+					default:
+						ok = false
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if ok && l.Name != "" {
+			labels = append(labels, l)
+		}
+		return nil
+	})
+	return labels, err
+}
+
+func parseOTLPMetric(msg []byte, resource []prompb.Label, set *seriesSet, res *OTLPResult) error {
+	name := ""
+	return wire.EachField(msg, func(f wire.Field) error {
+		if f.Wire != 2 {
+			return nil
+		}
+		switch f.Num {
+		case 1:
+			name = SanitizeName(string(f.Data))
+		// gauge
+		case 5:
+			return parseOTLPNumberPoints(f.Data, name, resource, set, res)
+		// sum
+		case 7:
+			temporality, monotonic := 0, false
+			wire.EachField(f.Data, func(s wire.Field) error {
+				switch {
+				case s.Num == 2 && s.Wire == 0:
+					temporality = int(s.Value)
+				case s.Num == 3 && s.Wire == 0:
+					monotonic = s.Value != 0
+				}
+				return nil
+			})
+			// delta sums can't be made cumulative without keeping state
+			if temporality == otlpTemporalityDelta {
+				res.Skipped += countOTLPPoints(f.Data)
+				return nil
+			}
+			if monotonic && !strings.HasSuffix(name, "_total") {
+				return parseOTLPNumberPoints(f.Data, name+"_total", resource, set, res)
+			}
+			return parseOTLPNumberPoints(f.Data, name, resource, set, res)
+		// histogram
+		case 9:
+			temporality := 0
+			wire.EachField(f.Data, func(h wire.Field) error {
+				if h.Num == 2 && h.Wire == 0 {
+					temporality = int(h.Value)
+				}
+				return nil
+			})
+			if temporality == otlpTemporalityDelta {
+				res.Skipped += countOTLPPoints(f.Data)
+				return nil
+			}
+			return parseOTLPHistogramPoints(f.Data, name, resource, set, res)
+		// exponential histogram and summary
+		case 10, 11:
+			res.Skipped += countOTLPPoints(f.Data)
+		}
+		return nil
+	})
+}
+
+// countOTLPPoints counts the data_points of a Gauge, Sum, Histogram,
+// ExponentialHistogram or Summary message.
+func countOTLPPoints(msg []byte) int {
+	n := 0
+	wire.EachField(msg, func(f wire.Field) error {
+		if f.Num == 1 && f.Wire == 2 {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// otlpLabels returns the labels of a data point with metric name name.
+func otlpLabels(name string, resource, attrs []prompb.Label) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(resource)+len(attrs)+2)
+	labels = append(labels, prompb.Label{Name: "__name__", Value: name})
+	labels = append(labels, resource...)
+	for _, a := range attrs {
+		labels = append(labels, prompb.Label{Name: SanitizeName(a.Name), Value: a.Value})
+	}
+	return labels
+}
+
+func otlpTimestamp(unixNano uint64) int64 {
+	return int64(unixNano) / int64(time.Millisecond)
+}
+
+// parseOTLPNumberPoints adds the NumberDataPoints of a Gauge or Sum.
+func parseOTLPNumberPoints(msg []byte, name string, resource []prompb.Label, set *seriesSet, res *OTLPResult) error {
+	return wire.EachField(msg, func(f wire.Field) error {
+		if f.Num != 1 || f.Wire != 2 {
+			return nil
+		}
+		var (
+			ts, flags uint64
+			value     float64
+			hasValue  bool
+		)
+		err := wire.EachField(f.Data, func(p wire.Field) error {
+			switch {
+			case p.Num == 3 && p.Wire == 1:
+				ts = p.Value
+			// as_double
+			case p.Num == 4 && p.Wire == 1:
+				value, hasValue = math.Float64frombits(p.Value), true
+			// as_int
+			case p.Num == 6 && p.Wire == 1:
+				value, hasValue = float64(int64(p.Value)), true
+			case p.Num == 8 && p.Wire == 0:
+				flags = p.Value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !hasValue || flags&otlpFlagNoRecordedValue != 0 {
+			res.Skipped++
+			return nil
+		}
+		attrs, err := parseOTLPAttributes(f.Data, 7)
+		if err != nil {
+			return err
+		}
+		set.add(otlpLabels(name, resource, attrs), prompb.Sample{Value: value, Timestamp: otlpTimestamp(ts)})
+		return nil
+	})
+}
+
+// parseOTLPHistogramPoints adds the HistogramDataPoints of a Histogram. OTLP
+// bucket counts are per bucket, Prometheus ones cumulative.
+func parseOTLPHistogramPoints(msg []byte, name string, resource []prompb.Label, set *seriesSet, res *OTLPResult) error {
+	return wire.EachField(msg, func(f wire.Field) error {
+		if f.Num != 1 || f.Wire != 2 {
+			return nil
+		}
+		var (
+			ts, count, flags uint64
+			sum              float64
+			hasSum           bool
+			counts, bounds   []uint64
+		)
+		err := wire.EachField(f.Data, func(p wire.Field) error {
+			switch {
+			case p.Num == 3 && p.Wire == 1:
+				ts = p.Value
+			case p.Num == 4 && p.Wire == 1:
+				count = p.Value
+			case p.Num == 5 && p.Wire == 1:
+				sum, hasSum = math.Float64frombits(p.Value), true
+			case p.Num == 6 && (p.Wire == 1 || p.Wire == 2):
+				counts = append(counts, p.Fixed64s()...)
+			case p.Num == 7 && (p.Wire == 1 || p.Wire == 2):
+				bounds = append(bounds, p.Fixed64s()...)
+			case p.Num == 10 && p.Wire == 0:
+				flags = p.Value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if flags&otlpFlagNoRecordedValue != 0 {
+			res.Skipped++
+			return nil
+		}
+		if len(counts) > 0 && len(counts) != len(bounds)+1 {
+			return fmt.Errorf("histogram %s has %d bucket counts for %d bounds", name, len(counts), len(bounds))
+		}
+		attrs, err := parseOTLPAttributes(f.Data, 9)
+		if err != nil {
+			return err
+		}
+		sample := func(v float64) prompb.Sample {
+			return prompb.Sample{Value: v, Timestamp: otlpTimestamp(ts)}
+		}
+		cumulative := uint64(0)
+		for i, bound := range bounds {
+			if len(counts) > 0 {
+				cumulative += counts[i]
+			}
+			le := strconv.FormatFloat(math.Float64frombits(bound), 'f', -1, 64)
+			labels := append(otlpLabels(name+"_bucket", resource, attrs), prompb.Label{Name: "le", Value: le})
+			set.add(labels, sample(float64(cumulative)))
+		}
+		set.add(append(otlpLabels(name+"_bucket", resource, attrs), prompb.Label{Name: "le", Value: "+Inf"}), sample(float64(count)))
+		if hasSum {
+			set.add(otlpLabels(name+"_sum", resource, attrs), sample(sum))
+		}
+		set.add(otlpLabels(name+"_count", resource, attrs), sample(float64(count)))
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+package ingest
+
+import (
+	"github.com/kebe7jun/ropee/internal/wire"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func otlpAttribute(key, value string) wire.Message {
+	return wire.Message{}.Str(1, key).Bytes(2, wire.Message{}.Str(1, value))
+}
+
+// otlpRequest returns an ExportMetricsServiceRequest of one resource of
+// service api, instance host:9 with metrics.
+func otlpRequest(metrics ...wire.Message) []byte {
+	resource := wire.Message{}.
+		Bytes(1, otlpAttribute("service.name", "api")).
+		Bytes(1, otlpAttribute("service.instance.id", "host:9"))
+	scope := wire.Message{}
+	for _, m := range metrics {
+		scope = scope.Bytes(2, m)
+	}
+	rm := wire.Message{}.Bytes(1, resource).Bytes(2, scope)
+	return wire.Message{}.Bytes(1, rm)
+}
+
+// otlpValues returns the values of the series ParseOTLPMetrics made of
+// body by name and labels, and how many points were skipped.
+func otlpValues(t *testing.T, body []byte) (map[string]float64, int) {
+	res, err := ParseOTLPMetrics(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, ts := range res.Series {
+		name := ""
+		labels := make([]string, 0)
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			labels = append(labels, l.Name+"="+l.Value)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Timestamp != 1000 {
+			t.Fatalf("%s has samples %v", name, ts.Samples)
+		}
+		values[name+"{"+strings.Join(labels, ",")+"}"] = ts.Samples[0].Value
+	}
+	return values, res.Skipped
+}
+
+// 1s in nanoseconds, the time of all data points.
+const otlpTime = uint64(1e9)
+
+func TestParseOTLPGauge(t *testing.T) {
+	double := wire.Message{}.Fixed64(3, otlpTime).Double(4, 21.5).Bytes(7, otlpAttribute("room", "kitchen"))
+	integer := wire.Message{}.Fixed64(3, otlpTime).Fixed64(6, uint64(-3&math.MaxUint64)).Bytes(7, otlpAttribute("room", "cellar"))
+	empty := wire.Message{}.Fixed64(3, otlpTime).Double(4, 1).Varint(8, otlpFlagNoRecordedValue)
+	gauge := wire.Message{}.Str(1, "room.temperature").Bytes(5, wire.Message{}.Bytes(1, double).Bytes(1, integer).Bytes(1, empty))
+	values, skipped := otlpValues(t, otlpRequest(gauge))
+	want := map[string]float64{
+		"room_temperature{instance=host:9,job=api,room=kitchen}": 21.5,
+		"room_temperature{instance=host:9,job=api,room=cellar}":  -3,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped %d points, want the one without a recorded value", skipped)
+	}
+}
+
+func TestParseOTLPSum(t *testing.T) {
+	point := wire.Message{}.Fixed64(3, otlpTime).Double(4, 7)
+	sum := func(name string, temporality uint64, monotonic bool) wire.Message {
+		s := wire.Message{}.Bytes(1, point).Varint(2, temporality)
+		if monotonic {
+			s = s.Varint(3, 1)
+		}
+		return wire.Message{}.Str(1, name).Bytes(7, s)
+	}
+	values, skipped := otlpValues(t, otlpRequest(
+		sum("requests", 2, true),
+		sum("errors_total", 2, true),
+		sum("queue_length", 2, false),
+		sum("bytes", otlpTemporalityDelta, true),
+	))
+	want := map[string]float64{
+		"requests_total{instance=host:9,job=api}": 7,
+		"errors_total{instance=host:9,job=api}":   7,
+		"queue_length{instance=host:9,job=api}":   7,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped %d points, want the one of the delta sum", skipped)
+	}
+}
+
+func TestParseOTLPHistogram(t *testing.T) {
+	point := wire.Message{}.
+		Fixed64(3, otlpTime).
+		Fixed64(4, 6).
+		Double(5, 4.2).
+		Fixed64s(6, 2, 3, 1).
+		Doubles(7, 0.1, 1).
+		Bytes(9, otlpAttribute("path", "/")).
+		Bytes(9, otlpAttribute("method", "GET"))
+	histogram := func(name string, temporality uint64) wire.Message {
+		return wire.Message{}.Str(1, name).Bytes(9, wire.Message{}.Bytes(1, point).Varint(2, temporality))
+	}
+	values, skipped := otlpValues(t, otlpRequest(
+		histogram("http.duration", 2),
+		histogram("rpc.duration", otlpTemporalityDelta),
+	))
+	want := map[string]float64{
+		"http_duration_bucket{instance=host:9,job=api,le=0.1,method=GET,path=/}":  2,
+		"http_duration_bucket{instance=host:9,job=api,le=1,method=GET,path=/}":    5,
+		"http_duration_bucket{instance=host:9,job=api,le=+Inf,method=GET,path=/}": 6,
+		"http_duration_sum{instance=host:9,job=api,method=GET,path=/}":            4.2,
+		"http_duration_count{instance=host:9,job=api,method=GET,path=/}":          6,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped %d points, want the one of the delta histogram", skipped)
+	}
+}
+
+func TestParseOTLPHistogramBucketMismatch(t *testing.T) {
+	point := wire.Message{}.Fixed64(3, otlpTime).Fixed64(4, 1).Fixed64s(6, 1).Doubles(7, 1)
+	histogram := wire.Message{}.Str(1, "latency").Bytes(9, wire.Message{}.Bytes(1, point).Varint(2, 2))
+	if _, err := ParseOTLPMetrics(otlpRequest(histogram)); err == nil {
+		t.Error("parsed a histogram with as many bucket counts as bounds, want an error")
+	}
+}
+
+func TestParseOTLPTruncated(t *testing.T) {
+	gauge := wire.Message{}.Str(1, "up").Bytes(5, wire.Message{}.Bytes(1, wire.Message{}.Fixed64(3, otlpTime).Double(4, 1)))
+	body := otlpRequest(gauge)
+	if _, err := ParseOTLPMetrics(body[:len(body)-3]); err == nil {
+		t.Error("parsed a truncated request, want an error")
+	}
+}
@@ -0,0 +1,207 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdBuckets are the upper bounds, in seconds, of the histograms timers
+// are observed in. They are those of the Prometheus client libraries.
+var statsdBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// StatsD aggregates StatsD metrics the way a StatsD server does and hands
+// them out as Prometheus series: counters (c) add up to a cumulative
+// counter, gauges (g) keep their last value and timers (ms) are observed in
+// seconds in a histogram of name_bucket, name_sum and name_count. Metrics
+// not updated for ttl are forgotten, and lines of new metrics are dropped
+// while maxMetrics are aggregated, as clients may send a name or tag value
+// per request.
+type StatsD struct {
+	mtx        sync.Mutex
+	ttl        time.Duration
+	maxMetrics int
+	metrics    map[string]*statsdMetric
+}
+
+type statsdMetric struct {
+	labels  []prompb.Label
+	kind    string
+	value   float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+	// updated is set when the metric changed since the last Flush.
+	updated bool
+	// seen is when the metric was last updated.
+	seen time.Time
+}
+
+// NewStatsD returns a StatsD forgetting metrics after ttl and aggregating at
+// most maxMetrics, 0 disables either.
+func NewStatsD(ttl time.Duration, maxMetrics int) *StatsD {
+	return &StatsD{ttl: ttl, maxMetrics: maxMetrics, metrics: make(map[string]*statsdMetric)}
+}
+
+// Add parses a packet of newline separated StatsD lines,
+// "<name>:<value>|<type>[|@<rate>][|#<tag>:<value>,...]", and aggregates
+// them. Valid lines are aggregated even if others fail to parse, the error
+// is that of the first invalid line.
+func (s *StatsD) Add(packet []byte) error {
+	var firstErr error
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := s.addLine(line); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *StatsD) addLine(line string) error {
+	parts := strings.Split(line, "|")
+	i := strings.LastIndexByte(parts[0], ':')
+	if len(parts) < 2 || i <= 0 {
+		return fmt.Errorf("invalid line %q: expected <name>:<value>|<type>", line)
+	}
+	name, valueStr, kind := parts[0][:i], parts[0][i+1:], parts[1]
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q of %s", valueStr, name)
+	}
+	rate := 1.0
+	labels := []prompb.Label{{Name: "__name__", Value: SanitizeName(name)}}
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err = strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid sample rate %q of %s", p, name)
+			}
+		case strings.HasPrefix(p, "#"):
+			// DogStatsD tags
+			for _, tag := range strings.Split(p[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					continue
+				}
+				labels = append(labels, prompb.Label{Name: SanitizeName(kv[0]), Value: kv[1]})
+			}
+		}
+	}
+	switch kind {
+	case "c", "g", "ms":
+	default:
+		return fmt.Errorf("unsupported type %q of %s", kind, name)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	m := s.metric(kind, labels)
+	if m == nil {
+		return fmt.Errorf("dropped %s, %d metrics are aggregated already", name, s.maxMetrics)
+	}
+	switch kind {
+	case "c":
+		m.value += value / rate
+	case "g":
+		// a signed value changes the gauge, others set it
+		if valueStr[0] == '+' || valueStr[0] == '-' {
+			m.value += value
+		} else {
+			m.value = value
+		}
+	case "ms":
+		if m.buckets == nil {
+			m.buckets = make([]uint64, len(statsdBuckets))
+		}
+		seconds := value / 1000
+		// a sampled timer stands for 1/rate observations
+		n := uint64(math.Round(1 / rate))
+		for i, le := range statsdBuckets {
+			if seconds <= le {
+				m.buckets[i] += n
+			}
+		}
+		m.count += n
+		m.sum += seconds * float64(n)
+	}
+	return nil
+}
+
+// metric returns the aggregate of kind and labels, marked updated, or nil if
+// it is new and maxMetrics are aggregated.
+func (s *StatsD) metric(kind string, labels []prompb.Label) *statsdMetric {
+	parts := []string{kind}
+	for _, l := range labels {
+		parts = append(parts, l.Name+"\xff"+l.Value)
+	}
+	key := strings.Join(parts, "\xff")
+	m, ok := s.metrics[key]
+	if !ok {
+		if s.maxMetrics > 0 && len(s.metrics) >= s.maxMetrics {
+			return nil
+		}
+		m = &statsdMetric{labels: labels, kind: kind}
+		s.metrics[key] = m
+	}
+	m.updated = true
+	m.seen = time.Now()
+	return m
+}
+
+// Flush returns the series of the metrics updated since the last Flush with
+// their current value at now, and forgets those not updated for ttl.
+func (s *StatsD) Flush(now time.Time) []prompb.TimeSeries {
+	set := newSeriesSet()
+	sample := func(v float64) prompb.Sample {
+		return prompb.Sample{Value: v, Timestamp: now.UnixNano() / int64(time.Millisecond)}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, m := range s.metrics {
+		if s.ttl > 0 && now.Sub(m.seen) > s.ttl {
+			delete(s.metrics, key)
+			continue
+		}
+		if !m.updated {
+			continue
+		}
+		m.updated = false
+		if m.kind != "ms" {
+			set.add(copyLabels(m.labels, "", "", ""), sample(m.value))
+			continue
+		}
+		for i, le := range statsdBuckets {
+			set.add(copyLabels(m.labels, "_bucket", "le", strconv.FormatFloat(le, 'f', -1, 64)), sample(float64(m.buckets[i])))
+		}
+		set.add(copyLabels(m.labels, "_bucket", "le", "+Inf"), sample(float64(m.count)))
+		set.add(copyLabels(m.labels, "_sum", "", ""), sample(m.sum))
+		set.add(copyLabels(m.labels, "_count", "", ""), sample(float64(m.count)))
+	}
+	return set.series
+}
+
+// copyLabels returns a copy of labels with suffix appended to __name__ and
+// the label name=value added unless name is empty.
+func copyLabels(labels []prompb.Label, suffix, name, value string) []prompb.Label {
+	res := make([]prompb.Label, 0, len(labels)+1)
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			l.Value += suffix
+		}
+		res = append(res, l)
+	}
+	if name != "" {
+		res = append(res, prompb.Label{Name: name, Value: value})
+	}
+	return res
+}
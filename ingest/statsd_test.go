@@ -0,0 +1,44 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsDExpiresIdleMetrics(t *testing.T) {
+	s := NewStatsD(time.Minute, 0)
+	if err := s.Add([]byte("requests:1|c\nidle:1|c")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if got := s.Flush(now); len(got) != 2 {
+		t.Fatalf("flushed %d series, want 2", len(got))
+	}
+	if err := s.Add([]byte("requests:1|c")); err != nil {
+		t.Fatal(err)
+	}
+	s.Flush(now.Add(2 * time.Minute))
+	if len(s.metrics) != 0 {
+		t.Fatalf("%d metrics left after the ttl, want none", len(s.metrics))
+	}
+}
+
+func TestStatsDMaxMetrics(t *testing.T) {
+	s := NewStatsD(0, 2)
+	if err := s.Add([]byte("a:1|c\nb:1|g\nc:1|c")); err == nil {
+		t.Error("no error dropping the third metric")
+	}
+	// lines of aggregated metrics are still added
+	if err := s.Add([]byte("a:2|c")); err != nil {
+		t.Fatal(err)
+	}
+	series := s.Flush(time.Now())
+	if len(series) != 2 {
+		t.Fatalf("flushed %v, want a and b", series)
+	}
+	for _, ts := range series {
+		if ts.Labels[0].Value == "a" && ts.Samples[0].Value != 3 {
+			t.Errorf("a = %v, want 3", ts.Samples[0].Value)
+		}
+	}
+}
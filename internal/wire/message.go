@@ -0,0 +1,84 @@
+package wire
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Message encodes the fields of a protobuf message in the order they are
+// appended, the counterpart of EachField. Methods return the message with
+// the field appended, like append.
+type Message []byte
+
+func (m Message) key(num, wire int) Message {
+	return appendUvarint(m, uint64(num<<3|wire))
+}
+
+// Varint appends a varint field, e.g. an int64, uint64 or bool.
+func (m Message) Varint(num int, v uint64) Message {
+	return appendUvarint(m.key(num, 0), v)
+}
+
+// Fixed64 appends a fixed64 field.
+func (m Message) Fixed64(num int, v uint64) Message {
+	return appendFixed64(m.key(num, 1), v)
+}
+
+// Double appends a double field.
+func (m Message) Double(num int, v float64) Message {
+	return m.Fixed64(num, math.Float64bits(v))
+}
+
+// Bytes appends a length delimited field, e.g. bytes or an embedded
+// message.
+func (m Message) Bytes(num int, data []byte) Message {
+	return append(appendUvarint(m.key(num, 2), uint64(len(data))), data...)
+}
+
+// Str appends a string field.
+func (m Message) Str(num int, s string) Message {
+	return m.Bytes(num, []byte(s))
+}
+
+// Varints appends a packed repeated varint field.
+func (m Message) Varints(num int, vs ...uint64) Message {
+	data := make([]byte, 0, len(vs))
+	for _, v := range vs {
+		data = appendUvarint(data, v)
+	}
+	return m.Bytes(num, data)
+}
+
+// Fixed64s appends a packed repeated fixed64 field.
+func (m Message) Fixed64s(num int, vs ...uint64) Message {
+	data := make([]byte, 0, 8*len(vs))
+	for _, v := range vs {
+		data = appendFixed64(data, v)
+	}
+	return m.Bytes(num, data)
+}
+
+// Doubles appends a packed repeated double field.
+func (m Message) Doubles(num int, vs ...float64) Message {
+	bits := make([]uint64, len(vs))
+	for i, v := range vs {
+		bits[i] = math.Float64bits(v)
+	}
+	return m.Fixed64s(num, bits...)
+}
+
+// ZigzagEncode encodes the value of a sint32 or sint64 field, see Zigzag.
+func ZigzagEncode(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
@@ -0,0 +1,109 @@
+// Package wire reads messages of the protobuf wire format by field number,
+// for messages ropee has no generated code of, e.g. native histograms and
+// OTLP metrics.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrTruncated reports a message ending inside of a field.
+var ErrTruncated = errors.New("truncated protobuf message")
+
+// Field is one field of a protobuf message of wire type Wire, Value holds
+// varint and fixed size values, Data length delimited ones.
+type Field struct {
+	Num   int
+	Wire  int
+	Value uint64
+	Data  []byte
+}
+
+// EachField calls fn with each field of msg in order, stopping at the first
+// error.
+func EachField(msg []byte, fn func(f Field) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		msg = msg[n:]
+		f := Field{Num: int(key >> 3), Wire: int(key & 7)}
+		switch f.Wire {
+		case 0:
+			if f.Value, n = binary.Uvarint(msg); n <= 0 {
+				return ErrTruncated
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return ErrTruncated
+			}
+			f.Value, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return ErrTruncated
+			}
+			f.Data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return ErrTruncated
+			}
+			f.Value, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", f.Wire)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Zigzag decodes the value of a sint32 or sint64 field.
+func Zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Varints returns the values of a repeated varint field, packed or not.
+func (f Field) Varints() ([]uint64, error) {
+	if f.Wire == 0 {
+		return []uint64{f.Value}, nil
+	}
+	res := make([]uint64, 0)
+	for b := f.Data; len(b) > 0; {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrTruncated
+		}
+		res, b = append(res, v), b[n:]
+	}
+	return res, nil
+}
+
+// Fixed64s returns the values of a repeated fixed64 or double field, packed
+// or not.
+func (f Field) Fixed64s() []uint64 {
+	if f.Wire == 1 {
+		return []uint64{f.Value}
+	}
+	res := make([]uint64, 0, len(f.Data)/8)
+	for b := f.Data; len(b) >= 8; b = b[8:] {
+		res = append(res, binary.LittleEndian.Uint64(b))
+	}
+	return res
+}
+
+// Doubles returns the values of a repeated double field, packed or not.
+func (f Field) Doubles() []float64 {
+	values := f.Fixed64s()
+	res := make([]float64, len(values))
+	for i, v := range values {
+		res[i] = math.Float64frombits(v)
+	}
+	return res
+}
@@ -0,0 +1,97 @@
+package wire
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEachField(t *testing.T) {
+	msg := []byte{
+		// 1: varint 150
+		0x08, 0x96, 0x01,
+		// 2: bytes "hi"
+		0x12, 0x02, 'h', 'i',
+		// 3: packed varints 1, 300
+		0x1a, 0x03, 0x01, 0xac, 0x02,
+		// 4: fixed64 1.5
+		0x21, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+	}
+	fields := make([]Field, 0)
+	if err := EachField(msg, func(f Field) error {
+		fields = append(fields, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 4 {
+		t.Fatalf("got %d fields, want 4", len(fields))
+	}
+	if fields[0].Num != 1 || fields[0].Value != 150 {
+		t.Errorf("field 1 = %+v", fields[0])
+	}
+	if fields[1].Num != 2 || string(fields[1].Data) != "hi" {
+		t.Errorf("field 2 = %+v", fields[1])
+	}
+	if vs, err := fields[2].Varints(); err != nil || !reflect.DeepEqual(vs, []uint64{1, 300}) {
+		t.Errorf("Varints() = %v, %v", vs, err)
+	}
+	if ds := fields[3].Doubles(); !reflect.DeepEqual(ds, []float64{1.5}) {
+		t.Errorf("Doubles() = %v", ds)
+	}
+}
+
+func TestEachFieldTruncated(t *testing.T) {
+	for _, msg := range [][]byte{
+		{0x08},
+		{0x08, 0x96},
+		{0x12, 0x05, 'h', 'i'},
+		{0x21, 0, 0},
+	} {
+		if err := EachField(msg, func(Field) error { return nil }); err != ErrTruncated {
+			t.Errorf("EachField(%x) = %v, want ErrTruncated", msg, err)
+		}
+	}
+}
+
+func TestZigzag(t *testing.T) {
+	for v, want := range map[uint64]int64{0: 0, 1: -1, 2: 1, 3: -2, 4: 2} {
+		if got := Zigzag(v); got != want {
+			t.Errorf("Zigzag(%d) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg := Message{}.
+		Varint(1, 150).
+		Str(2, "hi").
+		Varints(3, 1, 300).
+		Double(4, 1.5).
+		Doubles(5, 0.5, 2).
+		Varint(6, ZigzagEncode(-3))
+	fields := make([]Field, 0)
+	if err := EachField(msg, func(f Field) error {
+		fields = append(fields, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 6 {
+		t.Fatalf("got %d fields, want 6", len(fields))
+	}
+	if fields[0].Value != 150 || string(fields[1].Data) != "hi" {
+		t.Errorf("fields 1 and 2 = %+v, %+v", fields[0], fields[1])
+	}
+	if vs, err := fields[2].Varints(); err != nil || !reflect.DeepEqual(vs, []uint64{1, 300}) {
+		t.Errorf("Varints() = %v, %v", vs, err)
+	}
+	if ds := fields[3].Doubles(); !reflect.DeepEqual(ds, []float64{1.5}) {
+		t.Errorf("Doubles() of field 4 = %v", ds)
+	}
+	if ds := fields[4].Doubles(); !reflect.DeepEqual(ds, []float64{0.5, 2}) {
+		t.Errorf("Doubles() of field 5 = %v", ds)
+	}
+	if v := Zigzag(fields[5].Value); v != -3 {
+		t.Errorf("Zigzag() = %d, want -3", v)
+	}
+}
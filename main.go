@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
+	"github.com/kebe7jun/ropee/ingest"
 	"github.com/kebe7jun/ropee/metrics"
+	"github.com/kebe7jun/ropee/mux"
+	"github.com/kebe7jun/ropee/push"
 	"github.com/kebe7jun/ropee/storage"
+	"github.com/kebe7jun/ropee/transform"
 	"github.com/lestrrat/go-file-rotatelogs"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/prompb"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,14 +40,162 @@ type Config struct {
 	SplunkMetricsSourceType string
 	SplunkHECURL            string
 	SplunkHECToken          string
+	SplunkHECChannel        string
+	HECBundleEvents         bool
+	HECBundleMaxEvents      int
 	TimeoutSeconds          int
+	ReadTimeoutSeconds      int
+	WriteTimeoutSeconds     int
 	ListenAddr              string
 	LogFilePath             string
 	Debug                   bool
+	MaxNewSeries            int
+	MaxLabelsPerSeries      int
+	MaxSeriesPerWrite       int
+	TruncateOversizedWrites bool
+	DedupCacheSize          int
+	CardinalityWindow       time.Duration
+	SeriesLimitWindow       time.Duration
+	WriteBackends           string
+	ReadBackends            string
+	WriteQuorum             int
+	LogSampleRate           float64
+	HECReplicaURLs          string
+	HECReplicaTokens        string
+	HECReplicaPolicy        string
+	HECSourcetypeEndpoints  string
+	HECTLSServerName        string
+	HTTPProxyURL            string
+	HECInsecureSkipVerify   bool
+	SnappyFormat            string
+	RequestIDFormat         string
+	ReadDownsampling        string
+	ReadDownsamplingAgg     string
+	ReadPushDownFuncs       bool
+	ReadAutoSpanRules       string
+	HECRetries              int
+	HECBreakerFailures      int
+	HECStandbyURL           string
+	HECStandbyToken         string
+	HECBreakerCooldown      time.Duration
+	FlattenK8sLabels        bool
+	SplitRulesFile          string
+	MergeSummaryQuantiles   bool
+	NativeHistogramExpand   bool
+	NativeHistogramRead     bool
+	ForwardClientIP         bool
+	GraphiteListenAddr      string
+	GraphiteMappingFile     string
+	StatsDListenAddr        string
+	StatsDMetricTTL         time.Duration
+	StatsDMaxMetrics        int
+	WriteDryRun             bool
+	WriteHMACSecretFile     string
+	TopNSeries              int
+	PushTTL                 time.Duration
+	PushInterval            time.Duration
+	ReadQueryConcurrency    int
+	ReadMaxRows             int
+	ReadDispatchOptions     string
+	ReadSearchMode          string
+	ReadOutputMode          string
+	ReadMaxSeries           int
+	ReadMaxSamples          int
+	ReadMaxResponseBytes    int
+	ReadLimitOverride       bool
+	ReadRequiredMatchers    string
+	ReadRequiredMode        string
+	ReadRequiredExempt      string
+	ReadIgnoreLabels        string
+	ReadMaxSearches         int
+	ReadSearchQueueTimeout  time.Duration
+	SplunkAPIRateLimit      float64
+	SplunkAPIMaxWait        time.Duration
+	ReadStartBuffer         time.Duration
+	ReadEndBuffer           time.Duration
+	ReadIngestDelay         time.Duration
+	ReadMaxRangePerSearch   time.Duration
+	ReadStrict              bool
+	ReadDedupPolicy         string
+	ReadLabelLimit          int
+	ReadLabelCacheTTL       time.Duration
+	ReadPollInterval        time.Duration
+	ReadPollBackoff         float64
+	ReadPollMaxInterval     time.Duration
+	ReadOneshotThreshold    time.Duration
+	ReadSearchPrefix        string
+	ReadSIDCacheTTL         time.Duration
+	ReadQueryLogFile        string
+	ReadQueryLogMinDuration time.Duration
+	AdminListenAddr         string
+	AgentMode               bool
+	SplunkTokenFile         string
+	MetricNamePrefix        string
+	MetricNameSuffix        string
+	ReadCacheTTL            time.Duration
+	ReadCacheMaxBytes       int
+	ReadCacheMinAge         time.Duration
+	CoalesceWindowMs        int
+	CoalesceMaxSeries       int
+	MergeWriteWindow        time.Duration
+	TimePartitionRulesFile  string
+	SavedSearchMapFile      string
+	MetricAliasesFile       string
+	SplunkLookupFile        string
+	LookupCacheTTL          time.Duration
+	SplunkFieldPrefix       string
+	TenantLimitsFile        string
+	StartupProbeEnabled     bool
+	StartupProbeTimeout     time.Duration
+	WriteLatencySLOP99Ms    int
 }
 
 var config Config
 
+// newRequestID generates the IDs of requests without X-Request-Id.
+var newRequestID = storage.NewUUID
+
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// maskToken returns the last 4 characters of token to tell tokens apart,
+// tokens of 4 characters or fewer are masked whole.
+func maskToken(token string) string {
+	switch {
+	case token == "":
+		return ""
+	case len(token) <= 4:
+		return "<redacted>"
+	}
+	return "..." + token[len(token)-4:]
+}
+
+// logConfig logs the configuration at startup for diagnosing
+// misconfigurations. Of the HEC token at most the last 4 characters are shown,
+// credentials in the Splunk url are left out.
+func logConfig(l log.Logger) {
+	splunkUrl := config.SplunkUrl
+	if u, err := url.Parse(splunkUrl); err == nil && u.User != nil {
+		u.User = nil
+		splunkUrl = u.String()
+	}
+	token := maskToken(config.SplunkHECToken)
+	level.Info(l).Log(
+		"msg", "ropee config",
+		"ropee_version", version,
+		"listen_addr", config.ListenAddr,
+		"splunk_url", splunkUrl,
+		"splunk_index", config.SplunkMetricsIndex,
+		"splunk_sourcetype", config.SplunkMetricsSourceType,
+		"splunk_hec_url", config.SplunkHECURL,
+		"splunk_hec_token", token,
+		"read_timeout_seconds", config.ReadTimeoutSeconds,
+		"write_timeout_seconds", config.WriteTimeoutSeconds,
+		"debug", config.Debug,
+		"log_file_path", config.LogFilePath,
+	)
+}
+
 func loadRotateWriter(logPath, fileName string) *rotatelogs.RotateLogs {
 	writer, _ := rotatelogs.New(
 		path.Join(logPath, fileName)+".%Y%m%d%H%M",
@@ -42,6 +206,14 @@ func loadRotateWriter(logPath, fileName string) *rotatelogs.RotateLogs {
 	return writer
 }
 
+// baseLogger is the leveled logger without the time and caller context,
+// request scoped loggers are derived from it.
+var baseLogger log.Logger
+
+func withContext(logger log.Logger) log.Logger {
+	return log.With(logger, "time", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+}
+
 func loadLogger() log.Logger {
 	var logger log.Logger
 	if config.LogFilePath == "-" {
@@ -55,122 +227,875 @@ func loadLogger() log.Logger {
 	} else {
 		logger = level.NewFilter(logger, level.AllowInfo())
 	}
-	logger = log.With(logger, "time", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
-	return logger
+	baseLogger = logger
+	return withContext(logger)
+}
+
+// infoSuppressor drops info level lines, lines of other levels pass through.
+type infoSuppressor struct {
+	next log.Logger
+}
+
+func (s infoSuppressor) Log(keyvals ...interface{}) error {
+	for i := 1; i < len(keyvals); i += 2 {
+		if keyvals[i-1] == level.Key() && keyvals[i] == level.InfoValue() {
+			metrics.SuppressedLogLinesTotal.Inc()
+			return nil
+		}
+	}
+	return s.next.Log(keyvals...)
+}
+
+// requestLogger returns l for the sampled fraction of requests and a logger
+// suppressing info lines for the rest. The decision is seeded from the
+// request body so retries of the same payload are sampled the same way.
+func requestLogger(l log.Logger, body []byte) log.Logger {
+	if config.LogSampleRate >= 1 {
+		return l
+	}
+	h := fnv.New64a()
+	h.Write(body)
+	if rand.New(rand.NewSource(int64(h.Sum64()))).Float64() < config.LogSampleRate {
+		return l
+	}
+	return withContext(infoSuppressor{next: baseLogger})
+}
+
+// clientIP returns the IP of the client that sent r, the first address of
+// X-Forwarded-For when behind a load balancer.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// firstMetricNames returns the first n distinct metric names of series.
+func firstMetricNames(series []prompb.TimeSeries, n int) []string {
+	names := make([]string, 0, n)
+	seen := make(map[string]bool)
+	for _, ts := range series {
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" && !seen[l.Value] {
+				seen[l.Value] = true
+				names = append(names, l.Value)
+			}
+		}
+		if len(names) == n {
+			break
+		}
+	}
+	return names
+}
+
+func splitList(s string) []string {
+	ls := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ls = append(ls, v)
+		}
+	}
+	return ls
+}
+
+// debugConfig returns the value of every flag, those of tokens and secrets
+// and the passwords of urls, e.g. of -http-proxy-url or any of the comma
+// separated -read-backends, redacted.
+func debugConfig() map[string]string {
+	res := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && !strings.HasSuffix(f.Name, "-file") && (strings.Contains(f.Name, "token") || strings.Contains(f.Name, "secret")) {
+			value = "<redacted>"
+		}
+		values := strings.Split(value, ",")
+		for i, v := range values {
+			if u, err := url.Parse(strings.TrimSpace(v)); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), "redacted")
+					values[i] = u.String()
+				}
+			}
+		}
+		res[f.Name] = strings.Join(values, ",")
+	})
+	return res
 }
 
 func init() {
 	// init config
+	flag.BoolVar(&config.AgentMode, "agent-mode", false, "Only serve writes, e.g. of Prometheus in agent mode. /read and the other read endpoints answer 404 and no read client is created.")
+	flag.StringVar(&config.AdminListenAddr, "admin-listen-addr", "", "Address the admin endpoints like /debug/translate listen on, they are disabled when empty. They require Splunk credentials as basic auth.")
+	flag.StringVar(&config.SplunkTokenFile, "splunk-token-file", "", "File holding the Splunk authentication token reads without credentials are run with. Reads may also pass a token as Authorization: Bearer.")
+	flag.StringVar(&config.GraphiteListenAddr, "graphite-listen-addr", "", "TCP address accepting the Graphite plaintext protocol, disabled when empty.")
+	flag.StringVar(&config.GraphiteMappingFile, "graphite-mapping-file", "", "YAML file mapping dotted Graphite paths to metric names and labels, see README.")
+	flag.StringVar(&config.StatsDListenAddr, "statsd-listen-addr", "", "UDP address accepting StatsD counters, gauges and timers, disabled when empty.")
+	flag.DurationVar(&config.StatsDMetricTTL, "statsd-metric-ttl", 10*time.Minute, "StatsD metrics not updated for this long are no longer written and forgotten. 0 keeps them forever.")
+	flag.IntVar(&config.StatsDMaxMetrics, "statsd-max-metrics", 100000, "Max StatsD metrics aggregated at once, lines of new metrics are dropped beyond it. 0 disables the limit.")
 	flag.StringVar(&config.SplunkUrl, "splunk-url", "https://127.0.0.1:8089", "Splunk Manage Url.")
 	flag.StringVar(&config.SplunkHECURL, "splunk-hec-url", "https://127.0.0.1:8088", "Splunk Http event collector url.")
 	flag.StringVar(&config.SplunkHECToken, "splunk-hec-token", "", "Splunk Http event collector token.")
+	flag.StringVar(&config.SplunkHECChannel, "splunk-hec-channel", "", "Channel GUID sent as X-Splunk-Request-Channel to the Http event collector. Generated per process when empty.")
+	flag.BoolVar(&config.HECBundleEvents, "hec-bundle-events", true, "Post the events of a write to the Http event collector in as few requests as -hec-bundle-max-events allows. When false every sample is posted on its own, which is slower but makes each event visible in HEC indexing.")
+	flag.IntVar(&config.HECBundleMaxEvents, "hec-bundle-max-events", 0, "Max events per Http event collector request when bundling. 0 posts all events of a write in one request.")
+	flag.StringVar(&config.HECReplicaURLs, "splunk-hec-replica-urls", "", "Comma separated Splunk Http event collector urls that receive a copy of every write.")
+	flag.StringVar(&config.HECReplicaTokens, "splunk-hec-replica-tokens", "", "Comma separated tokens for -splunk-hec-replica-urls, in the same order.")
+	flag.StringVar(&config.MetricNamePrefix, "splunk-metric-name-prefix", "", "Prefix of metric names in Splunk, it is stripped from the names of read series and added to the names queried.")
+	flag.StringVar(&config.MetricNameSuffix, "splunk-metric-name-suffix", "", "Suffix of metric names in Splunk, it is stripped from the names of read series and added to the names queried.")
+	flag.StringVar(&config.HECSourcetypeEndpoints, "hec-sourcetype-endpoint-map", "", "YAML file mapping sourcetypes to the Http event collector url and token their events are written to, see README.")
+	flag.StringVar(&config.HECTLSServerName, "hec-tls-server-name", "", "TLS server name of Http event collector connections, e.g. the virtual host of an SNI routing load balancer. Defaults to the host of the url.")
+	flag.BoolVar(&config.HECInsecureSkipVerify, "hec-insecure-skip-verify", false, "Don't verify certificates of Http event collectors, e.g. self-signed ones. Earlier versions didn't verify them, see README.")
+	flag.StringVar(&config.HTTPProxyURL, "http-proxy-url", "", "http://, https:// or socks5:// proxy connections to Http event collectors are made through, e.g. http://proxy:3128. Takes precedence over the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, which apply otherwise.")
+	flag.StringVar(&config.HECReplicaPolicy, "splunk-hec-replica-policy", "all", "Write succeeds when 'all' or 'any' of the Http event collectors accepted it.")
+	flag.IntVar(&config.HECRetries, "splunk-hec-retries", 0, "Retries per Http event collector for a failed write.")
+	flag.StringVar(&config.HECStandbyURL, "hec-standby-url", "", "Http event collector taking over the writes of the primary one, -splunk-hec-url, while its circuit breaker is open. Requires -splunk-hec-breaker-failures.")
+	flag.StringVar(&config.HECStandbyToken, "hec-standby-token", "", "Token of -hec-standby-url.")
+	flag.IntVar(&config.HECBreakerFailures, "splunk-hec-breaker-failures", 0, "Consecutive failures opening an Http event collector's circuit breaker. 0 disables it.")
+	flag.DurationVar(&config.HECBreakerCooldown, "splunk-hec-breaker-cooldown", 30*time.Second, "Time an open circuit breaker waits before trying the Http event collector again.")
 	flag.StringVar(&config.ListenAddr, "listen-addr", "127.0.0.1:9970", "Sopee listen addr.")
-	flag.StringVar(&config.SplunkMetricsIndex, "splunk-metrics-index", "*", "Index name.")
+	flag.StringVar(&config.SplunkMetricsIndex, "splunk-metrics-index", "*", "Comma separated index names, wildcards allowed. Reads search all of them, writes go to the first.")
 	flag.StringVar(&config.SplunkMetricsSourceType, "splunk-metrics-sourcetype", "DaoCloud_promu_metrics", "The prometheus sourcetype name.")
 	flag.StringVar(&config.LogFilePath, "log-file-path", "/var/log", "Log files path.")
-	flag.IntVar(&config.TimeoutSeconds, "timeout", 60, "API timeout seconds.")
+	flag.IntVar(&config.TimeoutSeconds, "timeout", 60, "Deprecated, use -read-timeout-seconds and -write-timeout-seconds. Sets those of them not given.")
+	flag.IntVar(&config.ReadTimeoutSeconds, "read-timeout-seconds", 60, "Timeout of Splunk searches and remote read backends in seconds.")
+	flag.IntVar(&config.WriteTimeoutSeconds, "write-timeout-seconds", 5, "Timeout of HEC posts and remote write backends in seconds.")
+	flag.IntVar(&config.WriteLatencySLOP99Ms, "write-latency-slo-p99-ms", 500, "Latency 99% of /write requests should stay below, in milliseconds. Its burn rates over 1h and 5m are exported as ropee_write_latency_slo_burn_rate_1h and _5m. 0 disables them.")
 	flag.BoolVar(&config.Debug, "debug", false, "Debug mode.")
+	flag.BoolVar(&config.FlattenK8sLabels, "flatten-k8s-labels", false, "Strip app.kubernetes.io/ and beta.kubernetes.io/ prefixes of label names written to Splunk and replace the characters invalid in Prometheus label names, e.g. '/', '.' and '-', with '_'. -write-backends get the labels as sent.")
+	flag.StringVar(&config.SplitRulesFile, "split-rules-file", "", "YAML file of rules splitting the series of high cardinality metrics into a series per split_on label, see README.")
+	flag.BoolVar(&config.NativeHistogramExpand, "native-histogram-expansion", false, "Write native histograms of remote writes as classic histograms, <name>_bucket series per le of their populated buckets with <name>_sum and <name>_count. Otherwise they are dropped.")
+	flag.BoolVar(&config.NativeHistogramRead, "native-histogram-read", false, "Answer reads of a metric name without series with native histograms rebuilt of its <name>_bucket, <name>_sum and <name>_count series, e.g. those written by -native-histogram-expansion. Responses then aren't streamed. Custom bucket histograms, those of bounds other than powers of two, need Prometheus 3.0 or later.")
+	flag.BoolVar(&config.MergeSummaryQuantiles, "merge-summary-quantiles", false, "Write the quantile series of each summary as one Splunk metric event per timestamp with a <name>.p50, <name>.p99, ... measurement per quantile. Every series with a quantile label between 0 and 1 is taken as a summary quantile. They can't be read back as quantile series.")
+	flag.BoolVar(&config.ForwardClientIP, "forward-client-ip", false, "Add the IP of the remote write sender, the first of X-Forwarded-For or the peer address, to written series as the prometheus_sender label.")
+	flag.Float64Var(&config.LogSampleRate, "log-sample-rate", 1.0, "Fraction (0.0-1.0) of requests whose info level lines are logged, errors are always logged.")
+	flag.StringVar(&config.WriteHMACSecretFile, "write-hmac-secret-file", "", "File holding the secret /write requests must be signed with (HMAC-SHA256 of the body in the X-Ropee-Signature header).")
+	flag.DurationVar(&config.PushTTL, "push-ttl", 24*time.Hour, "Pushed metrics are no longer written after not being pushed again for this long. 0 keeps them forever.")
+	flag.DurationVar(&config.PushInterval, "push-interval", time.Minute, "Interval in which the last pushed value of every /push series is written again.")
+	flag.IntVar(&config.TopNSeries, "top-n-series", 10, "Number of metric_name/instance combinations tracked by ropee_samples_per_label_set_count.")
+	flag.StringVar(&config.ReadDownsampling, "read.downsampling", "auto", "'auto' aggregates samples at the step of the PromQL query, 'off' always returns them at 10s resolution.")
+	flag.StringVar(&config.ReadDownsamplingAgg, "read.downsampling-aggregation", "latest", "Aggregation of gauges when downsampling, 'latest', 'avg', 'max' or 'min'. Counters always use latest.")
+	flag.BoolVar(&config.ReadPushDownFuncs, "read.push-down-functions", false, "Aggregate the samples of max_over_time and min_over_time selectors per step in Splunk when their range is a whole multiple of the step and the evaluation times are multiples of it, falling back to raw samples otherwise. Needs the range hints of Prometheus 2.16 or later and -read.downsampling=auto.")
+	flag.StringVar(&config.ReadAutoSpanRules, "read.auto-span-rules", "", "Comma separated >range:span rules, e.g. >7d:5m,>30d:1h, downsampling queries over longer ranges to the largest span of the matching rules, also without a step hint. Only with -read.downsampling=auto. Reads with X-Ropee-Raw: true are never downsampled.")
+	flag.IntVar(&config.ReadMaxRows, "read.max-rows", 1000000, "Max rows a Splunk search of a remote read query may return, larger searches fail instead of returning partial data. 0 disables the limit.")
+	flag.StringVar(&config.ReadDispatchOptions, "read.dispatch-options", "adhoc_search_level=fast", "Comma separated key=value parameters Splunk search jobs of reads are dispatched with, e.g. adhoc_search_level=fast,max_time=60,ttl=120. adhoc_search_level, max_count, max_time and ttl are validated, other keys are passed on as they are. A max_count lowers -read.max-rows.")
+	flag.StringVar(&config.ReadSearchPrefix, "read.search-prefix", "", "SPL filter, e.g. a macro expanding to index=metrics sourcetype=prometheus, searched instead of the -splunk-metrics-index indexes by reads. It becomes part of the where clause of mstats and mcatalog searches, so it can't contain a pipe, see README.")
+	flag.StringVar(&config.ReadSearchMode, "read.search-mode", "job", "'job' dispatches a Splunk search job and pages through its results, 'export' streams results from the export endpoint.")
+	flag.StringVar(&config.ReadOutputMode, "read.output-mode", storage.OutputModeAuto, "Output mode search results are fetched in, 'json_rows' with the field names once per page, 'json' with an object per result, or 'auto' for json_rows from Splunk 7 on, detected from /services/server/info.")
+	flag.DurationVar(&config.ReadCacheTTL, "read.cache-ttl", 0, "Time remote read query results are cached. 0 disables the cache.")
+	flag.IntVar(&config.ReadCacheMaxBytes, "read.cache-max-bytes", 64<<20, "Max size of the remote read cache.")
+	flag.DurationVar(&config.ReadCacheMinAge, "read.cache-min-age", time.Minute, "Only queries ending at least this long ago are cached, use about twice the scrape interval.")
+	flag.IntVar(&config.ReadMaxSeries, "read.max-series", 0, "Max series a remote read request may return, larger reads fail with 422. 0 disables the limit.")
+	flag.IntVar(&config.ReadMaxSamples, "read.max-samples", 0, "Max samples a remote read request may return, larger reads fail with 422. 0 disables the limit.")
+	flag.IntVar(&config.ReadMaxResponseBytes, "read.max-response-bytes", 0, "Max size of a remote read response before compression, larger reads fail with 422. Streamed responses, which are never held in memory marshaled, aren't limited. 0 disables the limit.")
+	flag.BoolVar(&config.ReadLimitOverride, "read.limit-override", false, "Let requests override -read.max-series and -read.max-samples with the X-Ropee-Read-Max-Series and X-Ropee-Read-Max-Samples headers, and skip -read.required-label-matchers with X-Ropee-Read-Skip-Required-Matchers: true. Only enable it when all readers are trusted.")
+	flag.StringVar(&config.ReadRequiredMatchers, "read.required-label-matchers", "", "Comma separated labels read queries must have a matcher on, = on a non-empty value or =~ not matching the empty string. Others fail with 422.")
+	flag.StringVar(&config.ReadRequiredMode, "read.required-label-matchers-mode", "any", "'any' requires a matcher on any of -read.required-label-matchers, 'all' on each of them.")
+	flag.StringVar(&config.ReadRequiredExempt, "read.required-label-matchers-exempt-users", "", "Comma separated Splunk users, of basic auth, whose reads needn't have -read.required-label-matchers.")
+	flag.StringVar(&config.ReadIgnoreLabels, "read.ignore-labels", "", "Comma separated labels, e.g. the external labels prometheus_replica,prometheus, whose matchers are removed from read queries. They are left out of the returned series and set to the values of their = matchers, series differing only in them are read as one. With -forward-client-ip prometheus_sender is ignored too.")
+	flag.IntVar(&config.ReadMaxSearches, "read.max-concurrent-searches", 10, "Max Splunk searches and catalog lookups run at the same time by all remote reads, keep it below the search quota of the Splunk role. 0 disables the limit.")
+	flag.Float64Var(&config.SplunkAPIRateLimit, "splunk-api-rate-limit-rps", 0, "Max Splunk REST API calls per second of remote reads, dispatching, polling and fetching searches. 0 disables the limit.")
+	flag.DurationVar(&config.SplunkAPIMaxWait, "splunk-api-rate-limit-max-wait", 10*time.Second, "Time a Splunk REST API call queues for -splunk-api-rate-limit-rps before the read fails with 503 and a Retry-After header.")
+	flag.DurationVar(&config.ReadSearchQueueTimeout, "read.search-queue-timeout", 30*time.Second, "Time a query waits for a free search when -read.max-concurrent-searches are running before the read fails with 429.")
+	flag.DurationVar(&config.ReadStartBuffer, "read.start-buffer", 0, "Search this much before the start of queries, returned samples are still limited to the queried range.")
+	flag.DurationVar(&config.ReadEndBuffer, "read.end-buffer", 0, "Search this much after the end of queries, returned samples are still limited to the queried range.")
+	flag.DurationVar(&config.ReadIngestDelay, "read.ingest-delay", 0, "Queries end at most at now minus this delay, so data not yet searchable in Splunk doesn't show as a dip.")
+	flag.BoolVar(&config.ReadStrict, "read.strict", false, "Fail queries whose result rows were all skipped for lacking a value or metric name, e.g. of non-metric events. Otherwise such rows are skipped and counted in ropee_read_skipped_events_count.")
+	flag.DurationVar(&config.ReadMaxRangePerSearch, "read.max-range-per-search", 0, "Split queries over longer ranges into sequential searches of at most this range, e.g. 168h, so long reads don't hit the Splunk job runtime quota. 0 searches any range at once.")
+	flag.StringVar(&config.ReadDedupPolicy, "read.dedup-policy", "first", "Sample kept when Splunk returns different values for one timestamp of a series: 'first', 'last' or 'max'. Identical samples are always deduplicated.")
+	flag.IntVar(&config.ReadLabelLimit, "read.label-limit", 10000, "Maximum number of label names or values returned by /api/v1/labels and /api/v1/label/<name>/values. 0 means no limit.")
+	flag.DurationVar(&config.ReadLabelCacheTTL, "read.label-cache-ttl", time.Minute, "Time label names and values found by searches are cached. 0 disables the cache.")
+	flag.DurationVar(&config.ReadPollInterval, "read.poll-interval", 100*time.Millisecond, "Time between the first polls of a search job for completion, it is polled right after dispatch. Polls are sooner when its progress suggests it is done before.")
+	flag.Float64Var(&config.ReadPollBackoff, "read.poll-backoff", 2, "Factor the time between polls of a search job grows by.")
+	flag.DurationVar(&config.ReadPollMaxInterval, "read.poll-max-interval", 2*time.Second, "Maximum time between polls of a search job.")
+	flag.DurationVar(&config.ReadOneshotThreshold, "read.oneshot-threshold", 0, "Run searches of reads over ranges of at most this duration, e.g. 15m, as blocking oneshot searches instead of polled search jobs. Only applies to -read.search-mode=job. 0 always dispatches jobs.")
+	flag.DurationVar(&config.ReadSIDCacheTTL, "read.sid-cache-ttl", 0, "Identical searches of a user within this time fetch the results of the first one's job instead of dispatching a new one. 0 disables it.")
+	flag.StringVar(&config.ReadQueryLogFile, "read.query-log-file", "", "File remote reads are logged to as JSON lines, with who read which matchers, the searches run, result sizes and status. It is rotated like the main log, - logs to stdout. Empty disables the query log.")
+	flag.DurationVar(&config.ReadQueryLogMinDuration, "read.query-log-min-duration", 0, "Log only remote reads taking at least this long to the query log.")
+	flag.IntVar(&config.ReadQueryConcurrency, "read.query-concurrency", 4, "Max queries of one remote read request searched in Splunk at the same time.")
+	flag.IntVar(&config.CoalesceWindowMs, "coalesce-window-ms", 0, "Coalesce writes arriving within this many milliseconds into one Splunk write, each is answered once that is written. 0 disables coalescing.")
+	flag.IntVar(&config.CoalesceMaxSeries, "coalesce-max-series", 10000, "Write coalesced writes early, in the request filling them, once this many series are pending.")
+	flag.DurationVar(&config.MergeWriteWindow, "merge-write-window", 0, "Merge writes of several Prometheus servers arriving within this window into one write without duplicate series and samples. 0 disables merging.")
+	flag.StringVar(&config.SavedSearchMapFile, "savedsearch-map-file", "", "YAML file mapping metric name regexes to Splunk saved searches answering their queries, see README.")
+	flag.StringVar(&config.MetricAliasesFile, "metric-aliases-file", "", "YAML file mapping old names of renamed metrics to their new names. Series of new names are written under the old names too, reads of old names read the new ones. See README.")
+	flag.StringVar(&config.SplunkLookupFile, "splunk-lookup-file", "", "YAML file naming Splunk lookup tables, CSV files, whose fields are added to written series by the value of one of their labels, see README.")
+	flag.DurationVar(&config.LookupCacheTTL, "lookup-cache-ttl", 5*time.Minute, "Time after which the lookup tables of -splunk-lookup-file are read again. 0 reads them once at startup.")
+	flag.StringVar(&config.SplunkFieldPrefix, "splunk-field-prefix", "", "Prefix of the Splunk dimensions of labels, e.g. prom. to keep them apart from the fields of other collectors. Written label names get it, reads strip it and ignore dimensions without it.")
+	flag.StringVar(&config.TimePartitionRulesFile, "time-partition-rules-file", "", "YAML file routing writes to indexes by UTC time of day, see README.")
+	flag.StringVar(&config.TenantLimitsFile, "tenant-limits-file", "", "YAML file with write_rps and read_rps limits of the tenants named in the X-Scope-OrgID header, see README.")
+	flag.BoolVar(&config.StartupProbeEnabled, "startup-probe-enabled", true, "Check the Http event collectors and their tokens at startup and exit when they fail.")
+	flag.DurationVar(&config.StartupProbeTimeout, "startup-probe-timeout", 10*time.Second, "Timeout of the startup probe.")
+	flag.BoolVar(&config.WriteDryRun, "write.dry-run", false, "Run the whole write pipeline and update metrics but never send events to Splunk.")
+	flag.IntVar(&config.MaxNewSeries, "write.max-new-series", 0, "Max distinct series written per series limit window, samples of new series beyond it are dropped. 0 disables the limit.")
+	flag.IntVar(&config.MaxLabelsPerSeries, "max-labels-per-series", 64, "Max labels of a written series, __name__ and the alphabetically first other labels are kept. 0 disables trimming.")
+	flag.IntVar(&config.MaxSeriesPerWrite, "max-series-per-write", 10000, "Max series of a remote write request, e.g. against a scrape target suddenly exposing millions of series, a native histogram counts as one. Larger requests are rejected with 400, which Prometheus doesn't retry. 0 disables the limit.")
+	flag.BoolVar(&config.TruncateOversizedWrites, "truncate-oversized-writes", false, "Write the first -max-series-per-write series of larger remote write requests instead of rejecting them.")
+	flag.IntVar(&config.DedupCacheSize, "dedup-cache-size", 0, "Number of recently written samples remembered to drop exact duplicates (same series and timestamp). 0 disables deduplication.")
+	flag.DurationVar(&config.CardinalityWindow, "cardinality-window", 5*time.Minute, "Window over which /cardinality counts distinct series per metric.")
+	flag.StringVar(&config.WriteBackends, "write-backends", "", "Comma separated Prometheus remote write urls that receive every write besides Splunk.")
+	flag.StringVar(&config.ReadBackends, "read-backends", "", "Comma separated Prometheus remote read urls queried besides Splunk, results are merged.")
+	flag.IntVar(&config.WriteQuorum, "write-quorum", 0, "Number of backends (Splunk included) that must accept a write. 0 means all.")
+	flag.DurationVar(&config.SeriesLimitWindow, "write.series-limit-window", time.Hour, "Window over which distinct series are counted for -write.max-new-series.")
+	flag.StringVar(&config.RequestIDFormat, "request-id-format", storage.RequestIDUUID4, "Format of the IDs of requests without X-Request-Id, uuid4 or counter. They are logged and sent to HEC as X-Request-ID.")
+	flag.StringVar(&config.SnappyFormat, "snappy-format", "auto", "Snappy format of request bodies: 'block', 'stream' or 'auto' to detect it.")
+}
+
+// parseFlags parses the command line into config. It isn't done in init, so
+// tests of package main can run with the flags of go test.
+func parseFlags() {
 	flag.Parse()
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if given["timeout"] && !given["read-timeout-seconds"] {
+		config.ReadTimeoutSeconds = config.TimeoutSeconds
+	}
+	if given["timeout"] && !given["write-timeout-seconds"] {
+		config.WriteTimeoutSeconds = config.TimeoutSeconds
+	}
+}
+
+// readLimits returns the configured read limits, overridden by the request's
+// X-Ropee-Read-Max-Series and X-Ropee-Read-Max-Samples headers.
+func readLimits(r *http.Request) storage.ReadLimits {
+	limits := storage.ReadLimits{MaxSeries: config.ReadMaxSeries, MaxSamples: config.ReadMaxSamples}
+	if n, err := strconv.Atoi(r.Header.Get("X-Ropee-Read-Max-Series")); err == nil {
+		limits.MaxSeries = n
+	}
+	if n, err := strconv.Atoi(r.Header.Get("X-Ropee-Read-Max-Samples")); err == nil {
+		limits.MaxSamples = n
+	}
+	return limits
+}
+
+// requestedTimeout returns the timeout the request asks for with X-Ropee-Timeout,
+// a duration like 10s or seconds, at most max. It is 0 without the header.
+func requestedTimeout(r *http.Request, max time.Duration) time.Duration {
+	value := r.Header.Get("X-Ropee-Timeout")
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0
+	}
+	if timeout > max {
+		return max
+	}
+	return timeout
+}
+
+// exceededTimeout names the timeout a read whose requestedTimeout is timeout
+// exceeded, -read-timeout-seconds (max) caps X-Ropee-Timeout.
+func exceededTimeout(timeout, max time.Duration) string {
+	if timeout < max {
+		return "the X-Ropee-Timeout deadline of " + timeout.String()
+	}
+	return "the -read-timeout-seconds deadline of " + max.String()
+}
+
+// readErrorStatus maps errors of reads to the http status they are answered
+// with.
+func readErrorStatus(err error) int {
+	switch err.(type) {
+	case *storage.QueryError:
+		return http.StatusBadRequest
+	case *storage.LimitError:
+		return http.StatusUnprocessableEntity
+	case *storage.ThrottleError:
+		return http.StatusTooManyRequests
+	case *storage.AuthError:
+		return http.StatusUnauthorized
+	case *storage.ForbiddenError:
+		return http.StatusForbidden
+	case *storage.SearchError:
+		return http.StatusBadGateway
+	case *storage.UnavailableError:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Causes of failed requests, the error_type label of
+// ropee_request_errors_count.
+const (
+	errorTypeDecode    = "decode_error"
+	errorTypeUnmarshal = "unmarshal_error"
+	errorTypeSplunk    = "splunk_error"
+	errorTypeTimeout   = "timeout"
+	errorTypeInvalid   = "invalid_request"
+	errorTypeLimit     = "limit_exceeded"
+	errorTypeAuth      = "auth_error"
+	errorTypeInternal  = "internal_error"
+)
+
+// httpError answers like http.Error and counts the error by handler, write,
+// read, admin or metrics, and errorType.
+func httpError(w http.ResponseWriter, handler, errorType, msg string, code int) {
+	metrics.RequestErrorsTotal.WithLabelValues(handler, errorType).Inc()
+	http.Error(w, msg, code)
+}
+
+// backendErrorType returns the error_type of requests failing with err of
+// Splunk or a read backend.
+func backendErrorType(err error) string {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return errorTypeTimeout
+	}
+	switch err.(type) {
+	case *storage.TimeoutError:
+		return errorTypeTimeout
+	case *storage.QueryError:
+		return errorTypeInvalid
+	case *storage.LimitError:
+		return errorTypeLimit
+	case *storage.AuthError, *storage.ForbiddenError:
+		return errorTypeAuth
+	}
+	return errorTypeSplunk
+}
+
+// setRetryAfter tells the client of a read failing with err when to retry.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if e, ok := err.(*storage.UnavailableError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
 }
 
 func main() {
+	parseFlags()
 	l := loadLogger()
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
+	logConfig(l)
+	metrics.SetTopNSeries(config.TopNSeries)
+	if config.SnappyFormat != "auto" && config.SnappyFormat != "block" && config.SnappyFormat != "stream" {
+		level.Error(l).Log("msg", "-snappy-format must be auto, block or stream", "format", config.SnappyFormat)
+		os.Exit(1)
+	}
+	if config.ReadDownsampling != "auto" && config.ReadDownsampling != "off" {
+		level.Error(l).Log("msg", "-read.downsampling must be auto or off", "downsampling", config.ReadDownsampling)
+		os.Exit(1)
+	}
+	if agg := config.ReadDownsamplingAgg; agg != "latest" && agg != "avg" && agg != "max" && agg != "min" {
+		level.Error(l).Log("msg", "-read.downsampling-aggregation must be latest, avg, max or min", "aggregation", config.ReadDownsamplingAgg)
+		os.Exit(1)
+	}
+	generateRequestID, err := storage.RequestIDGenerator(config.RequestIDFormat)
+	if err != nil {
+		level.Error(l).Log("msg", "Invalid -request-id-format", "err", err)
+		os.Exit(1)
+	}
+	newRequestID = generateRequestID
+	if config.ReadRequiredMode != "any" && config.ReadRequiredMode != "all" {
+		level.Error(l).Log("msg", "-read.required-label-matchers-mode must be any or all", "mode", config.ReadRequiredMode)
+		os.Exit(1)
+	}
+	if config.ReadSearchMode != storage.SearchModeJob && config.ReadSearchMode != storage.SearchModeExport {
+		level.Error(l).Log("msg", "-read.search-mode must be job or export", "mode", config.ReadSearchMode)
+		os.Exit(1)
+	}
+	if err := storage.ValidateOutputMode(config.ReadOutputMode); err != nil {
+		level.Error(l).Log("msg", "Invalid -read.output-mode", "err", err)
+		os.Exit(1)
+	}
+	if config.ReadDedupPolicy != storage.DedupPolicyFirst && config.ReadDedupPolicy != storage.DedupPolicyLast && config.ReadDedupPolicy != storage.DedupPolicyMax {
+		level.Error(l).Log("msg", "-read.dedup-policy must be first, last or max", "policy", config.ReadDedupPolicy)
+		os.Exit(1)
+	}
+	if config.ReadPollInterval <= 0 || config.ReadPollMaxInterval < config.ReadPollInterval {
+		level.Error(l).Log("msg", "-read.poll-interval must be positive and at most -read.poll-max-interval")
+		os.Exit(1)
+	}
+	readTimeout := time.Second * time.Duration(config.ReadTimeoutSeconds)
+	writeTimeout := time.Second * time.Duration(config.WriteTimeoutSeconds)
+	var tenants *tenantLimiters
+	if config.TenantLimitsFile != "" {
+		var err error
+		tenants, err = loadTenantLimiters(config.TenantLimitsFile, l)
 		if err != nil {
-			level.Error(l).Log("msg", "Read error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			level.Error(l).Log("msg", "Load tenant limits error", "err", err)
+			os.Exit(1)
 		}
-
-		reqBuf, err := snappy.Decode(nil, compressed)
+	}
+	if config.WriteLatencySLOP99Ms > 0 {
+		go metrics.TrackWriteLatencySLO(time.Duration(config.WriteLatencySLOP99Ms)*time.Millisecond, 30*time.Second)
+	}
+	registry := metrics.NewRegistry()
+	http.Handle("/metrics", metrics.Handler(registry))
+	http.HandleFunc("/metrics/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := metrics.Snapshot(registry)
 		if err != nil {
-			level.Error(l).Log("msg", "Decode error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httpError(w, "metrics", errorTypeInternal, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		metrics.ReadRequestCounter.Add(1)
-		var req prompb.ReadRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			level.Error(l).Log("msg", "Unmarshal error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	})
+	if err := storage.ValidateFieldPrefix(config.SplunkFieldPrefix); err != nil {
+		level.Error(l).Log("msg", "Invalid field prefix", "err", err)
+		os.Exit(1)
+	}
+	var aliases *storage.MetricAliases
+	if config.MetricAliasesFile != "" {
+		if aliases, err = storage.LoadMetricAliases(config.MetricAliasesFile); err != nil {
+			level.Error(l).Log("msg", "Load metric aliases error", "err", err)
+			os.Exit(1)
 		}
-		user, pass, _ := r.BasicAuth()
-		readClient, _ := storage.NewClient(
-			config.SplunkUrl,
-			user,
-			pass,
-			config.SplunkMetricsIndex,
-			config.SplunkMetricsSourceType,
-			config.SplunkHECURL, config.SplunkHECToken,
-			time.Second*time.Duration(config.TimeoutSeconds),
-			l,
-		)
-		resp, err := readClient.Read(&req)
+	}
+	if config.AgentMode {
+		level.Info(l).Log("msg", "agent mode, read endpoints are disabled")
+		http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
+			level.Warn(l).Log("msg", "read request in agent mode", "remote", r.RemoteAddr)
+			http.NotFound(w, r)
+		})
+	} else {
+		serveReads(l, tenants, aliases, readTimeout)
+	}
+	var writeOpts []storage.Option
+	replicaURLs, replicaTokens := splitList(config.HECReplicaURLs), splitList(config.HECReplicaTokens)
+	if len(replicaURLs) != len(replicaTokens) {
+		level.Error(l).Log("msg", "-splunk-hec-replica-urls and -splunk-hec-replica-tokens must have the same length")
+		os.Exit(1)
+	}
+	if config.HECReplicaPolicy != "all" && config.HECReplicaPolicy != "any" {
+		level.Error(l).Log("msg", "-splunk-hec-replica-policy must be all or any", "policy", config.HECReplicaPolicy)
+		os.Exit(1)
+	}
+	destinations := []*storage.HECDestination{
+		storage.NewHECDestination(config.SplunkHECURL, config.SplunkHECToken, config.HECRetries, config.HECBreakerFailures, config.HECBreakerCooldown),
+	}
+	for i, u := range replicaURLs {
+		destinations = append(destinations, storage.NewHECDestination(u, replicaTokens[i], config.HECRetries, config.HECBreakerFailures, config.HECBreakerCooldown))
+	}
+	probed := append([]*storage.HECDestination(nil), destinations...)
+	if config.HECSourcetypeEndpoints != "" {
+		endpoints, err := storage.LoadHECEndpoints(config.HECSourcetypeEndpoints)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			level.Error(l).Log("msg", "Load hec sourcetype endpoints error", "err", err)
+			os.Exit(1)
 		}
-
-		data, err := proto.Marshal(resp)
+		sourcetypeDests := make(map[string]*storage.HECDestination, len(endpoints))
+		for sourcetype, e := range endpoints {
+			sourcetypeDests[sourcetype] = storage.NewHECDestination(e.URL, e.Token, config.HECRetries, config.HECBreakerFailures, config.HECBreakerCooldown)
+			probed = append(probed, sourcetypeDests[sourcetype])
+		}
+		writeOpts = append(writeOpts, storage.WithSourcetypeDestinations(sourcetypeDests))
+	}
+	hecTLS := storage.HECTLS{ServerName: config.HECTLSServerName, InsecureSkipVerify: config.HECInsecureSkipVerify}
+	if config.HTTPProxyURL != "" {
+		proxy, err := storage.ParseProxyURL(config.HTTPProxyURL)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			level.Error(l).Log("msg", "Invalid -http-proxy-url", "err", err)
+			os.Exit(1)
 		}
-
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		w.Header().Set("Content-Encoding", "snappy")
-
-		compressed = snappy.Encode(nil, data)
-		if _, err := w.Write(compressed); err != nil {
-			level.Warn(l).Log("msg", "Error executing query", "query", req, "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		hecTLS.Proxy = proxy
+	}
+	if hecTLS.InsecureSkipVerify {
+		level.Warn(l).Log("msg", "certificates of Http event collectors are not verified, -hec-insecure-skip-verify is set")
+	}
+	if config.StartupProbeEnabled && !config.WriteDryRun {
+		for _, dest := range probed {
+			if err := dest.Probe(config.StartupProbeTimeout, hecTLS); err != nil {
+				level.Error(l).Log("msg", "HEC startup probe failed", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	writeOpts = append(writeOpts, storage.WithHECDestinations(config.HECReplicaPolicy == "all", destinations...))
+	if config.HECStandbyURL != "" {
+		if config.HECBreakerFailures <= 0 {
+			level.Error(l).Log("msg", "-hec-standby-url requires -splunk-hec-breaker-failures, the standby takes over when the breaker opens")
+			os.Exit(1)
+		}
+		standby := storage.NewHECDestination(config.HECStandbyURL, config.HECStandbyToken, config.HECRetries, config.HECBreakerFailures, config.HECBreakerCooldown)
+		writeOpts = append(writeOpts, storage.WithHECStandby(standby))
+	}
+	writeOpts = append(writeOpts, storage.WithHECTLS(hecTLS))
+	writeOpts = append(writeOpts, storage.WithHECBundling(config.HECBundleEvents, config.HECBundleMaxEvents))
+	if config.SplunkHECChannel != "" {
+		writeOpts = append(writeOpts, storage.WithHECChannel(config.SplunkHECChannel))
+	}
+	if config.WriteDryRun {
+		level.Warn(l).Log("msg", "write dry run mode is on, nothing will be sent to Splunk")
+		metrics.DryRunEnabled.Set(1)
+		writeOpts = append(writeOpts, storage.WithDryRun())
+	}
+	writeOpts = append(writeOpts, storage.WithMaxLabels(config.MaxLabelsPerSeries))
+	if config.FlattenK8sLabels {
+		writeOpts = append(writeOpts, storage.WithKubernetesLabelFlattening())
+	}
+	writeOpts = append(writeOpts, storage.WithRequestIDs(newRequestID))
+	if config.TimePartitionRulesFile != "" {
+		rules, err := storage.LoadTimePartitionRules(config.TimePartitionRulesFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Load time partition rules error", "err", err)
+			os.Exit(1)
 		}
+		writeOpts = append(writeOpts, storage.WithTimePartitionRules(rules))
+	}
+	if config.MergeSummaryQuantiles {
+		writeOpts = append(writeOpts, storage.WithSummaryQuantileMerging())
+	}
+	writeOpts = append(writeOpts, storage.WithMetricAliases(aliases))
+	writeOpts = append(writeOpts, storage.WithFieldPrefix(config.SplunkFieldPrefix))
+	if config.SplunkLookupFile != "" {
+		lookups, err := storage.LoadLookups(config.SplunkLookupFile, config.LookupCacheTTL, l)
+		if err != nil {
+			level.Error(l).Log("msg", "Load lookups error", "err", err)
+			os.Exit(1)
+		}
+		writeOpts = append(writeOpts, storage.WithLookups(lookups))
+	}
+	if config.DedupCacheSize > 0 {
+		writeOpts = append(writeOpts, storage.WithDeduplicator(storage.NewDeduplicator(config.DedupCacheSize)))
+	}
+	cardinality := storage.NewCardinalityTracker(config.CardinalityWindow)
+	writeOpts = append(writeOpts, storage.WithCardinalityTracker(cardinality))
+	http.HandleFunc("/cardinality", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cardinality.Report())
 	})
-	writeClient, _ := storage.NewClient(
+	if config.MaxNewSeries > 0 {
+		writeOpts = append(writeOpts, storage.WithSeriesLimiter(storage.NewSeriesLimiter(config.MaxNewSeries, config.SeriesLimitWindow)))
+	}
+	writeClient, err := storage.NewClient(
 		config.SplunkUrl,
 		"",
 		"",
 		config.SplunkMetricsIndex,
 		config.SplunkMetricsSourceType,
 		config.SplunkHECURL, config.SplunkHECToken,
-		time.Second*time.Duration(config.TimeoutSeconds),
+		writeTimeout,
 		l,
+		writeOpts...,
 	)
-	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+	if err != nil {
+		level.Error(l).Log("msg", "Create write client error", "err", err)
+		os.Exit(1)
+	}
+	if urls := splitList(config.WriteBackends); len(urls) > 0 {
+		backends := []storage.RemoteClient{writeClient}
+		for _, u := range urls {
+			backends = append(backends, storage.NewRemoteBackend(u, "", writeTimeout))
+		}
+		writeClient = storage.NewFanoutClient(config.WriteQuorum, backends...)
+	}
+	var coalescer *storage.Coalescer
+	if config.CoalesceWindowMs > 0 {
+		coalescer = storage.NewCoalescer(writeClient, time.Duration(config.CoalesceWindowMs)*time.Millisecond, config.CoalesceMaxSeries, l)
+	}
+	// forward hands req to Splunk. Coalesced and merged writes are written
+	// in batches of several requests which get request IDs of their own.
+	forward := func(ctx context.Context, req *prompb.WriteRequest) error {
+		if coalescer != nil {
+			return coalescer.Add(req)
+		}
+		return storage.WriteContext(ctx, writeClient, req)
+	}
+	var merger *mux.Merger
+	if config.MergeWriteWindow > 0 {
+		merger = mux.NewMerger(config.MergeWriteWindow, func(req *prompb.WriteRequest) error {
+			return forward(context.Background(), req)
+		}, l)
+	}
+	var splitRules *transform.SplitRules
+	if config.SplitRulesFile != "" {
+		splitRules, err = transform.LoadSplitRules(config.SplitRulesFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Load split rules error", "err", err)
+			os.Exit(1)
+		}
+	}
+	// writeContext runs the write path transforms and hands req to Splunk
+	// with the request ID of ctx.
+	writeContext := func(ctx context.Context, req *prompb.WriteRequest) error {
+		if splitRules != nil {
+			req.Timeseries = splitRules.Split(req.Timeseries)
+		}
+		if merger != nil {
+			return merger.Write(req)
+		}
+		return forward(ctx, req)
+	}
+	// write is writeContext for ingestion endpoints without request IDs.
+	write := func(req *prompb.WriteRequest) error {
+		return writeContext(context.Background(), req)
+	}
+	writeHandler := func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		defer func() {
+			metrics.ObserveWriteDuration(time.Since(started))
+		}()
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			level.Error(l).Log("msg", "Read error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, "write", errorTypeDecode, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		rl := log.With(requestLogger(l, compressed), "request_id", requestID)
+
+		reqBuf, err := decodeSnappy(config.SnappyFormat, compressed)
 		if err != nil {
-			level.Error(l).Log("msg", "Decode error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			level.Error(rl).Log("msg", "Decode error", "err", err.Error())
+			httpError(w, "write", errorTypeDecode, err.Error(), http.StatusBadRequest)
 			return
 		}
 		metrics.WriteRequestCounter.Add(1)
 		var req prompb.WriteRequest
 		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			level.Error(l).Log("msg", "Unmarshal error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			level.Error(rl).Log("msg", "Unmarshal error", "err", err.Error())
+			httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = writeClient.Write(&req)
+		level.Info(rl).Log("msg", "write request", "series", len(req.Timeseries))
+		// the series are limited as Prometheus sent them, a native
+		// histogram counts once and is expanded whole or not at all
+		maxSeries := 0
+		if config.MaxSeriesPerWrite > 0 && len(req.Timeseries) > config.MaxSeriesPerWrite {
+			names := firstMetricNames(req.Timeseries, 5)
+			if !config.TruncateOversizedWrites {
+				level.Error(rl).Log("msg", "write request has too many series", "series", len(req.Timeseries), "max_series", config.MaxSeriesPerWrite, "metrics", strings.Join(names, ","))
+				httpError(w, "write", errorTypeLimit, fmt.Sprintf("write request of %d series exceeds the limit of %d series, metrics include %s", len(req.Timeseries), config.MaxSeriesPerWrite, strings.Join(names, ", ")), http.StatusBadRequest)
+				return
+			}
+			metrics.TruncatedWriteRequestsTotal.Inc()
+			level.Warn(rl).Log("msg", "write request has too many series, truncating it", "series", len(req.Timeseries), "max_series", config.MaxSeriesPerWrite, "metrics", strings.Join(names, ","))
+			req.Timeseries = req.Timeseries[:config.MaxSeriesPerWrite]
+			maxSeries = config.MaxSeriesPerWrite
+		}
+		if config.NativeHistogramExpand {
+			histograms, err := storage.ExpandNativeHistograms(reqBuf, maxSeries)
+			if err != nil {
+				level.Error(rl).Log("msg", "Native histogram error", "err", err.Error())
+				httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Timeseries = append(req.Timeseries, histograms...)
+		}
+		if config.ForwardClientIP {
+			ip := clientIP(r)
+			for i := range req.Timeseries {
+				transform.SetLabel(&req.Timeseries[i], "prometheus_sender", ip)
+			}
+		}
+		err = writeContext(storage.ContextWithRequestID(context.Background(), requestID), &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			level.Error(rl).Log("msg", "write error", "err", err)
+			httpError(w, "write", backendErrorType(err), err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(200)
 		if _, err := w.Write([]byte("ok")); err != nil {
-			level.Error(l).Log("action", "write", "err", err)
+			level.Error(rl).Log("action", "write", "err", err)
 		}
-	})
+	}
+	if config.WriteHMACSecretFile != "" {
+		secret, err := ioutil.ReadFile(config.WriteHMACSecretFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Read hmac secret file error", "err", err)
+			os.Exit(1)
+		}
+		writeHandler = hmacVerifier(bytes.TrimSpace(secret), l, writeHandler)
+	}
+	http.HandleFunc("/write", tenants.wrapWrite(writeHandler))
+	if config.GraphiteListenAddr != "" {
+		var mapper *ingest.GraphiteMapper
+		if config.GraphiteMappingFile != "" {
+			mapper, err = ingest.LoadGraphiteMapper(config.GraphiteMappingFile)
+			if err != nil {
+				level.Error(l).Log("msg", "Load graphite mapping error", "err", err)
+				os.Exit(1)
+			}
+		}
+		ln, err := net.Listen("tcp", config.GraphiteListenAddr)
+		if err != nil {
+			level.Error(l).Log("msg", "Graphite listen error", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := serveGraphite(ln, mapper, write, l); err != nil {
+				level.Error(l).Log("action", "serve graphite", "err", err)
+			}
+		}()
+	}
+	if config.StatsDListenAddr != "" {
+		conn, err := net.ListenPacket("udp", config.StatsDListenAddr)
+		if err != nil {
+			level.Error(l).Log("msg", "StatsD listen error", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := serveStatsD(conn, config.StatsDMetricTTL, config.StatsDMaxMetrics, write, l); err != nil {
+				level.Error(l).Log("action", "serve statsd", "err", err)
+			}
+		}()
+	}
+	http.HandleFunc("/write/influx", tenants.wrapWrite(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			if mt, _, _ := mime.ParseMediaType(ct); mt != "text/plain" && mt != "application/x-www-form-urlencoded" {
+				httpError(w, "write", errorTypeInvalid, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				httpError(w, "write", errorTypeDecode, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			reader = gz
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			level.Error(l).Log("msg", "Read error", "err", err.Error())
+			httpError(w, "write", errorTypeDecode, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rl := requestLogger(l, body)
+		metrics.WriteRequestCounter.Add(1)
+		series, err := ingest.ParseInflux(body, r.URL.Query().Get("precision"), time.Now())
+		if err != nil {
+			level.Error(rl).Log("msg", "Influx parse error", "err", err.Error())
+			httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(rl).Log("msg", "influx write request", "series", len(series))
+		if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+			httpError(w, "write", backendErrorType(err), err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	http.HandleFunc("/write/otlp", tenants.wrapWrite(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, "write", errorTypeInvalid, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/x-protobuf" {
+			httpError(w, "write", errorTypeInvalid, "unsupported content type "+r.Header.Get("Content-Type")+", only OTLP protobuf is accepted", http.StatusUnsupportedMediaType)
+			return
+		}
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				httpError(w, "write", errorTypeDecode, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			reader = gz
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			level.Error(l).Log("msg", "Read error", "err", err.Error())
+			httpError(w, "write", errorTypeDecode, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rl := requestLogger(l, body)
+		metrics.WriteRequestCounter.Add(1)
+		res, err := ingest.ParseOTLPMetrics(body)
+		if err != nil {
+			level.Error(rl).Log("msg", "OTLP parse error", "err", err.Error())
+			httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(rl).Log("msg", "otlp write request", "series", len(res.Series), "skipped_points", res.Skipped)
+		if len(res.Series) > 0 {
+			if err := write(&prompb.WriteRequest{Timeseries: res.Series}); err != nil {
+				httpError(w, "write", backendErrorType(err), err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(otlpResponse(res.Skipped))
+	}))
+	http.HandleFunc("/webhook", tenants.wrapWrite(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, "write", errorTypeInvalid, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			level.Error(l).Log("msg", "Read error", "err", err.Error())
+			httpError(w, "write", errorTypeDecode, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rl := requestLogger(l, body)
+		metrics.WriteRequestCounter.Add(1)
+		series, err := ingest.ParseAlertmanager(body, time.Now())
+		if err != nil {
+			level.Error(rl).Log("msg", "Alertmanager webhook parse error", "err", err.Error())
+			httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(rl).Log("msg", "alertmanager webhook", "alerts", len(series))
+		if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+			httpError(w, "write", backendErrorType(err), err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	pushStore := push.NewStore(config.PushTTL)
+	http.HandleFunc("/push/", tenants.wrapWrite(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/push/"), "/"), "/")
+		if parts[0] == "" || len(parts)%2 != 1 {
+			httpError(w, "write", errorTypeInvalid, "expected /push/<job>{/<label>/<value>}", http.StatusBadRequest)
+			return
+		}
+		labels := []prompb.Label{{Name: "job", Value: parts[0]}}
+		for i := 1; i < len(parts); i += 2 {
+			labels = append(labels, prompb.Label{Name: parts[i], Value: parts[i+1]})
+		}
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+		case http.MethodDelete:
+			pushStore.Delete(labels)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		default:
+			httpError(w, "write", errorTypeInvalid, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		metrics.WriteRequestCounter.Add(1)
+		series, err := ingest.ParseExposition(r.Body, r.Header.Get("Content-Type"), labels, time.Now())
+		if err != nil {
+			level.Error(l).Log("msg", "Exposition parse error", "job", parts[0], "err", err.Error())
+			httpError(w, "write", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushStore.Push(labels, series, r.Method == http.MethodPut)
+		level.Info(l).Log("msg", "push request", "job", parts[0], "series", len(series))
+		if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+			httpError(w, "write", backendErrorType(err), err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	if config.PushInterval > 0 {
+		go func() {
+			for range time.Tick(config.PushInterval) {
+				series := pushStore.Snapshot(time.Now())
+				if len(series) == 0 {
+					continue
+				}
+				if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+					level.Error(l).Log("action", "push-rewrite", "err", err)
+				}
+			}
+		}()
+	}
 	level.Info(l).Log("msg", "starting server...", "listen", config.ListenAddr)
 	if err := http.ListenAndServe(config.ListenAddr, nil); err != nil {
 		level.Error(l).Log("action", "serve", "err", err)
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var SamplesPerLabelSetTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ropee_samples_per_label_set_count",
+	},
+	[]string{"metric_name", "instance"},
+)
+
+// labelSetLRU bounds the label sets exported by SamplesPerLabelSetTotal,
+// the least recently written one is deleted when a new one doesn't fit.
+type labelSetLRU struct {
+	mtx     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[[2]string]*list.Element
+}
+
+var labelSets = &labelSetLRU{
+	size:    10,
+	order:   list.New(),
+	entries: make(map[[2]string]*list.Element),
+}
+
+// SetTopNSeries sets how many metric_name/instance combinations are tracked.
+func SetTopNSeries(n int) {
+	labelSets.mtx.Lock()
+	labelSets.size = n
+	labelSets.mtx.Unlock()
+}
+
+// CountLabelSetSamples adds samples to the counter of metricName/instance.
+func CountLabelSetSamples(metricName, instance string, samples int) {
+	key := [2]string{metricName, instance}
+	labelSets.mtx.Lock()
+	defer labelSets.mtx.Unlock()
+	if labelSets.size <= 0 {
+		return
+	}
+	if e, ok := labelSets.entries[key]; ok {
+		labelSets.order.MoveToFront(e)
+	} else {
+		for labelSets.order.Len() >= labelSets.size {
+			oldest := labelSets.order.Back()
+			k := labelSets.order.Remove(oldest).([2]string)
+			delete(labelSets.entries, k)
+			SamplesPerLabelSetTotal.DeleteLabelValues(k[0], k[1])
+		}
+		labelSets.entries[key] = labelSets.order.PushFront(key)
+	}
+	SamplesPerLabelSetTotal.WithLabelValues(metricName, instance).Add(float64(samples))
+}
+
+func init() {
+	register(SamplesPerLabelSetTotal)
+}
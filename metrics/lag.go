@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	newestWrittenMs int64
+
+	queuedMtx    sync.Mutex
+	queuedNextId int64
+	queued       = make(map[int64]int64)
+
+	WriteNewestSampleTimestamp = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ropee_write_newest_sample_timestamp_seconds",
+		},
+		func() float64 {
+			return float64(atomic.LoadInt64(&newestWrittenMs)) / 1000
+		},
+	)
+	WriteLag = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ropee_write_lag_seconds",
+		},
+		func() float64 {
+			return msAge(atomic.LoadInt64(&newestWrittenMs))
+		},
+	)
+	WriteQueuedOldestSampleAge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ropee_write_queued_oldest_sample_age_seconds",
+		},
+		func() float64 {
+			queuedMtx.Lock()
+			defer queuedMtx.Unlock()
+			var oldest int64
+			for _, ts := range queued {
+				if oldest == 0 || ts < oldest {
+					oldest = ts
+				}
+			}
+			return msAge(oldest)
+		},
+	)
+)
+
+func msAge(ms int64) float64 {
+	if ms == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, ms*int64(time.Millisecond))).Seconds()
+}
+
+// ObserveWrittenSample records the timestamp (ms) of a sample Splunk accepted.
+func ObserveWrittenSample(ms int64) {
+	for {
+		cur := atomic.LoadInt64(&newestWrittenMs)
+		if ms <= cur || atomic.CompareAndSwapInt64(&newestWrittenMs, cur, ms) {
+			return
+		}
+	}
+}
+
+// TrackQueued registers samples whose oldest timestamp (ms) is oldestMs as
+// waiting to be written. The returned func must be called once they left the
+// queue, either written or dropped.
+func TrackQueued(oldestMs int64) func() {
+	queuedMtx.Lock()
+	queuedNextId++
+	id := queuedNextId
+	queued[id] = oldestMs
+	queuedMtx.Unlock()
+	return func() {
+		queuedMtx.Lock()
+		delete(queued, id)
+		queuedMtx.Unlock()
+	}
+}
+
+func init() {
+	register(WriteNewestSampleTimestamp)
+	register(WriteLag)
+	register(WriteQueuedOldestSampleAge)
+}
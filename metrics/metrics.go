@@ -29,17 +29,288 @@ var (
 			Name: "ropee_splunk_events_wrote_failed_count",
 		},
 	)
+	SeriesLimitDroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_series_limit_dropped_samples_count",
+		},
+	)
+	SuppressedLogLinesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_suppressed_log_lines_count",
+		},
+	)
+	HECDestinationEventsWrote = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_hec_destination_events_wrote_count",
+		},
+		[]string{"destination"},
+	)
+	HECDestinationEventsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_hec_destination_events_wrote_failed_count",
+		},
+		[]string{"destination"},
+	)
+	HECDestinationNewestSample = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ropee_hec_destination_newest_sample_timestamp_seconds",
+		},
+		[]string{"destination"},
+	)
+	HECDestinationBreakerOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ropee_hec_destination_circuit_breaker_open",
+		},
+		[]string{"destination"},
+	)
+	DryRunEnabled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_write_dry_run",
+	})
+	DryRunEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_write_dry_run_events_count",
+		},
+	)
+	DryRunBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_write_dry_run_bytes_count",
+		},
+	)
+	SplunkRESTConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_rest_connections_count",
+		},
+		[]string{"reused"},
+	)
+	DedupDroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_dedup_dropped_samples_count",
+		},
+	)
+	HECRequestSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_hec_request_size_bytes",
+		Buckets: prometheus.ExponentialBuckets(512, 2, 18),
+	})
+	ReadCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_cache_hits_count",
+		},
+	)
+	ReadCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_cache_misses_count",
+		},
+	)
+	ReadCacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_cache_evictions_count",
+		},
+	)
+	SplunkResultPages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_result_pages_count",
+		},
+	)
+	SplunkResultsTruncated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_results_truncated_count",
+		},
+	)
+	TrimmedLabelCountTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_trimmed_label_series_count",
+		},
+	)
+	CoalescedWriteRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_coalesced_write_ratio",
+	})
+	ReadLimitExceeded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_limit_exceeded_count",
+		},
+	)
+	MergedDuplicateSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_merged_duplicate_samples_count",
+		},
+	)
+	SplunkJobsCancelled = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_jobs_cancelled_count",
+		},
+	)
+	SplunkSearchQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_splunk_search_queue_wait_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	TenantRateLimitTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_tenant_rate_limited_count",
+		},
+		[]string{"tenant"},
+	)
+	ReadDedupedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_deduped_samples_count",
+		},
+	)
+	SplunkJobDoneSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_splunk_job_dispatch_to_done_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	SplunkJobsDispatched = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_jobs_dispatched_count",
+		},
+	)
+	SplunkJobsReused = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_jobs_reused_count",
+		},
+	)
+	SplunkOneshotSearches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_splunk_oneshot_searches_count",
+		},
+	)
+	StatsDPacketsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_statsd_packets_count",
+		},
+	)
+	ReadSkippedEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_read_skipped_events_count",
+		},
+		[]string{"reason"},
+	)
+	HECFailoverTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_hec_failover_count",
+		},
+	)
+	HECActiveBackend = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_hec_active_backend",
+	})
+	ReadRequiredMatcherRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_read_required_matcher_rejections_count",
+		},
+		[]string{"label"},
+	)
+	SplunkAPIRateLimitWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_splunk_api_rate_limit_wait_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	ReadSeriesPerQuery = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_read_series_per_query",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	ReadSamplesPerQuery = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_read_samples_per_query",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 12),
+	})
+	ReadResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ropee_read_response_bytes",
+			Buckets: prometheus.ExponentialBuckets(512, 4, 12),
+		},
+		[]string{"encoding"},
+	)
+	ReadScannedEvents = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_read_scanned_events",
+		Buckets: prometheus.ExponentialBuckets(100, 4, 12),
+	})
+	ReadDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_read_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+	ReadPhaseSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ropee_read_phase_duration_seconds",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+		[]string{"phase"},
+	)
+	TruncatedWriteRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_truncated_write_requests_count",
+		},
+	)
+	ReadDeadlineExceeded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_deadline_exceeded_count",
+		},
+	)
+	RequestErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ropee_request_errors_count",
+		},
+		[]string{"handler", "error_type"},
+	)
+	ReadPushedDownQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ropee_read_pushed_down_queries_count",
+		},
+	)
 	uptime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ropee_uptime",
 	})
 )
 
 func init() {
-	prometheus.MustRegister(WriteRequestCounter)
-	prometheus.MustRegister(ReadRequestCounter)
-	prometheus.MustRegister(SplunkJobLatency)
-	prometheus.MustRegister(SplunkEventsWrote)
-	prometheus.MustRegister(SplunkEventsWroteFailed)
-	prometheus.MustRegister(uptime)
+	register(WriteRequestCounter)
+	register(ReadRequestCounter)
+	register(SplunkJobLatency)
+	register(SplunkEventsWrote)
+	register(SplunkEventsWroteFailed)
+	register(SeriesLimitDroppedSamples)
+	register(SuppressedLogLinesTotal)
+	register(HECDestinationEventsWrote)
+	register(HECDestinationEventsFailed)
+	register(HECDestinationNewestSample)
+	register(HECDestinationBreakerOpen)
+	register(DryRunEnabled)
+	register(DryRunEvents)
+	register(DryRunBytes)
+	register(SplunkRESTConnections)
+	register(CoalescedWriteRatio)
+	register(TrimmedLabelCountTotal)
+	register(SplunkResultPages)
+	register(SplunkResultsTruncated)
+	register(DedupDroppedSamples)
+	register(HECRequestSizeBytes)
+	register(ReadCacheHits)
+	register(ReadCacheMisses)
+	register(ReadCacheEvictions)
+	register(ReadLimitExceeded)
+	register(MergedDuplicateSamples)
+	register(SplunkJobsCancelled)
+	register(SplunkConcurrentSearches)
+	register(SplunkConcurrentSearchesPeak)
+	register(SplunkSearchQueueWait)
+	register(TenantRateLimitTotal)
+	register(ReadDedupedSamples)
+	register(SplunkJobDoneSeconds)
+	register(SplunkJobsDispatched)
+	register(SplunkJobsReused)
+	register(SplunkOneshotSearches)
+	register(StatsDPacketsTotal)
+	register(ReadSkippedEvents)
+	register(HECFailoverTotal)
+	register(HECActiveBackend)
+	register(ReadRequiredMatcherRejections)
+	register(SplunkAPIRateLimitWaitSeconds)
+	register(ReadSeriesPerQuery)
+	register(ReadSamplesPerQuery)
+	register(ReadResponseBytes)
+	register(ReadScannedEvents)
+	register(ReadDurationSeconds)
+	register(ReadPhaseSeconds)
+	register(TruncatedWriteRequestsTotal)
+	register(ReadDeadlineExceeded)
+	register(RequestErrorsTotal)
+	register(ReadPushedDownQueries)
+	register(uptime)
 	uptime.SetToCurrentTime()
 }
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenMetricsContentType is the content type of the OpenMetrics text format.
+const OpenMetricsContentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+// Handler serves what g gathers in the OpenMetrics text format to clients
+// preferring it, e.g. Prometheus 2.5 and later, and through promhttp in the
+// Prometheus text format to all others. The client library ropee is built
+// with can't write OpenMetrics itself.
+func Handler(g prometheus.Gatherer) http.Handler {
+	text := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !prefersOpenMetrics(r.Header.Get("Accept")) {
+			text.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, "error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteOpenMetrics(&buf, mfs); err != nil {
+			http.Error(w, "error encoding metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// prefersOpenMetrics reports whether the Accept header ranks the OpenMetrics
+// text format at least as high as the Prometheus text format.
+func prefersOpenMetrics(accept string) bool {
+	openMetrics, text := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.TrimSpace(params[0]) {
+		case "application/openmetrics-text":
+			openMetrics = math.Max(openMetrics, q)
+		case "text/plain", "text/*", "*/*":
+			text = math.Max(text, q)
+		}
+	}
+	return openMetrics > 0 && openMetrics >= text
+}
+
+var openMetricsTypes = map[dto.MetricType]string{
+	dto.MetricType_COUNTER:   "counter",
+	dto.MetricType_GAUGE:     "gauge",
+	dto.MetricType_SUMMARY:   "summary",
+	dto.MetricType_HISTOGRAM: "histogram",
+	dto.MetricType_UNTYPED:   "unknown",
+}
+
+// WriteOpenMetrics writes mfs in the OpenMetrics text format. Counter
+// families are named without the _total suffix their samples carry.
+func WriteOpenMetrics(w io.Writer, mfs []*dto.MetricFamily) error {
+	bw := bufio.NewWriter(w)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if mf.GetType() == dto.MetricType_COUNTER {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		if mf.GetHelp() != "" {
+			bw.WriteString("# HELP " + name + " " + escapeOpenMetrics(mf.GetHelp()) + "\n")
+		}
+		bw.WriteString("# TYPE " + name + " " + openMetricsTypes[mf.GetType()] + "\n")
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				writeOpenMetricsSample(bw, name+"_total", m, "", "", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				writeOpenMetricsSample(bw, name, m, "", "", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				writeOpenMetricsSample(bw, name, m, "", "", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					writeOpenMetricsSample(bw, name, m, "quantile", formatOpenMetricsFloat(q.GetQuantile()), q.GetValue())
+				}
+				writeOpenMetricsSample(bw, name+"_sum", m, "", "", s.GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, "", "", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.Bucket {
+					writeOpenMetricsSample(bw, name+"_bucket", m, "le", formatOpenMetricsFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+				}
+				// OpenMetrics requires the +Inf bucket
+				if !inf {
+					writeOpenMetricsSample(bw, name+"_bucket", m, "le", "+Inf", float64(h.GetSampleCount()))
+				}
+				writeOpenMetricsSample(bw, name+"_sum", m, "", "", h.GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, "", "", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// writeOpenMetricsSample writes one sample line of m, with the extra label,
+// e.g. le of a bucket, unless extraName is empty.
+func writeOpenMetricsSample(w *bufio.Writer, name string, m *dto.Metric, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	pairs := make([]string, 0, len(m.Label)+1)
+	for _, p := range m.Label {
+		pairs = append(pairs, p.GetName()+"=\""+escapeOpenMetrics(p.GetValue())+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatOpenMetricsFloat(value))
+	if m.TimestampMs != nil {
+		// OpenMetrics timestamps are in seconds
+		w.WriteString(" " + strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+	w.WriteString("\n")
+}
+
+func formatOpenMetricsFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeOpenMetrics(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
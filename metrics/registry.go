@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectors are all metrics of ropee, they are added to every registry.
+var collectors []prometheus.Collector
+
+func register(cs ...prometheus.Collector) {
+	collectors = append(collectors, cs...)
+}
+
+// Registry exposes the metrics of ropee and of the Go runtime and process,
+// separate from prometheus.DefaultRegisterer.
+type Registry struct {
+	*prometheus.Registry
+}
+
+// NewRegistry returns a registry with all metrics of ropee. Metrics may be
+// in several registries, so it can be called more than once per process.
+func NewRegistry() *Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	r.MustRegister(collectors...)
+	return &Registry{Registry: r}
+}
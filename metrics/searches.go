@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	searchesMtx     sync.Mutex
+	searchesCurrent int
+	searchesPeak    int
+
+	SplunkConcurrentSearches = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ropee_splunk_concurrent_searches",
+		},
+		func() float64 {
+			searchesMtx.Lock()
+			defer searchesMtx.Unlock()
+			return float64(searchesCurrent)
+		},
+	)
+	// SplunkConcurrentSearchesPeak is the most searches run at once since
+	// the last scrape, so short bursts between scrapes show.
+	SplunkConcurrentSearchesPeak = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ropee_splunk_concurrent_searches_peak",
+		},
+		func() float64 {
+			searchesMtx.Lock()
+			defer searchesMtx.Unlock()
+			peak := searchesPeak
+			searchesPeak = searchesCurrent
+			return float64(peak)
+		},
+	)
+)
+
+// AddConcurrentSearches adds n, 1 or -1, to the running searches.
+func AddConcurrentSearches(n int) {
+	searchesMtx.Lock()
+	searchesCurrent += n
+	if searchesCurrent > searchesPeak {
+		searchesPeak = searchesCurrent
+	}
+	searchesMtx.Unlock()
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	WriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ropee_write_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	SLOBurnRateWindow1h = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_write_latency_slo_burn_rate_1h",
+	})
+	SLOBurnRateWindow5m = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ropee_write_latency_slo_burn_rate_5m",
+	})
+
+	// writes and slowWrites count the writes observed by WriteDuration and
+	// those of them slower than sloThresholdNs. The histogram's buckets are
+	// fixed, the threshold is configured.
+	writes, slowWrites int64
+	sloThresholdNs     int64
+)
+
+// sloTarget is the fraction of writes that have to be faster than the
+// threshold, the p99 of the write duration.
+const sloTarget = 0.99
+
+// ObserveWriteDuration records the duration of a write request.
+func ObserveWriteDuration(d time.Duration) {
+	WriteDuration.Observe(d.Seconds())
+	atomic.AddInt64(&writes, 1)
+	if t := atomic.LoadInt64(&sloThresholdNs); t > 0 && int64(d) > t {
+		atomic.AddInt64(&slowWrites, 1)
+	}
+}
+
+// TrackWriteLatencySLO updates the burn rate gauges of the SLO "99% of
+// writes take less than threshold" every interval, it never returns. A burn
+// rate of 1 uses up the error budget of 1% slow writes exactly, 14.4 over 1h
+// and 5m is the usual page of multi-window alerting.
+func TrackWriteLatencySLO(threshold, interval time.Duration) {
+	atomic.StoreInt64(&sloThresholdNs, int64(threshold))
+	type counts struct{ writes, slow int64 }
+	// counts at the start and every tick of the last hour, oldest first
+	window := int(time.Hour / interval)
+	history := []counts{{atomic.LoadInt64(&writes), atomic.LoadInt64(&slowWrites)}}
+	burnRate := func(ticks int) float64 {
+		now := history[len(history)-1]
+		// until the window is full it covers the writes since the start
+		then := history[0]
+		if ticks < len(history) {
+			then = history[len(history)-1-ticks]
+		}
+		total := now.writes - then.writes
+		if total <= 0 {
+			return 0
+		}
+		return float64(now.slow-then.slow) / float64(total) / (1 - sloTarget)
+	}
+	for range time.Tick(interval) {
+		history = append(history, counts{atomic.LoadInt64(&writes), atomic.LoadInt64(&slowWrites)})
+		if len(history) > window+1 {
+			history = history[1:]
+		}
+		SLOBurnRateWindow1h.Set(burnRate(window))
+		SLOBurnRateWindow5m.Set(burnRate(int(5 * time.Minute / interval)))
+	}
+}
+
+func init() {
+	register(WriteDuration)
+	register(SLOBurnRateWindow1h)
+	register(SLOBurnRateWindow5m)
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Snapshot flattens everything g gathers into a name -> value map. Labeled
+// series are keyed like name{label="value"}, histograms and summaries are
+// reduced to their _sum and _count. NaN and infinite values, which JSON
+// can't represent, are left out.
+func Snapshot(g prometheus.Gatherer) (map[string]float64, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]float64)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := formatLabels(m.Label)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				res[name+labels] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				res[name+labels] = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				res[name+labels] = m.GetUntyped().GetValue()
+			case dto.MetricType_SUMMARY:
+				res[name+"_sum"+labels] = m.GetSummary().GetSampleSum()
+				res[name+"_count"+labels] = float64(m.GetSummary().GetSampleCount())
+			case dto.MetricType_HISTOGRAM:
+				res[name+"_sum"+labels] = m.GetHistogram().GetSampleSum()
+				res[name+"_count"+labels] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	for k, v := range res {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			delete(res, k)
+		}
+	}
+	return res, nil
+}
+
+func formatLabels(pairs []*dto.LabelPair) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	ls := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		ls = append(ls, p.GetName()+"=\""+p.GetValue()+"\"")
+	}
+	sort.Strings(ls)
+	return "{" + strings.Join(ls, ",") + "}"
+}
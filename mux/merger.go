@@ -0,0 +1,111 @@
+package mux
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Merger fans in writes of several Prometheus servers sending the same
+// series, e.g. federating ones. Writes arriving within the window are merged
+// into one request in which every series and every sample of it occurs once.
+// Unlike coalescing, each writer waits for the merged write and gets its
+// error, so a failed write is retried by all of them.
+type Merger struct {
+	mtx    sync.Mutex
+	next   func(*prompb.WriteRequest) error
+	window time.Duration
+	log    log.Logger
+	batch  *batch
+}
+
+type batch struct {
+	index    map[string]int
+	series   []prompb.TimeSeries
+	seen     []map[int64]struct{}
+	requests int
+	done     chan struct{}
+	err      error
+}
+
+func NewMerger(window time.Duration, next func(*prompb.WriteRequest) error, log log.Logger) *Merger {
+	return &Merger{
+		next:   next,
+		window: window,
+		log:    log,
+	}
+}
+
+// Write merges req into the pending batch and returns the result of the
+// batch's write once the window expired.
+func (m *Merger) Write(req *prompb.WriteRequest) error {
+	m.mtx.Lock()
+	if m.batch == nil {
+		m.batch = &batch{
+			index: make(map[string]int),
+			done:  make(chan struct{}),
+		}
+		time.AfterFunc(m.window, m.flush)
+	}
+	b := m.batch
+	duplicates := b.add(req)
+	m.mtx.Unlock()
+	if duplicates > 0 {
+		metrics.MergedDuplicateSamples.Add(float64(duplicates))
+	}
+	<-b.done
+	return b.err
+}
+
+func (m *Merger) flush() {
+	m.mtx.Lock()
+	b := m.batch
+	m.batch = nil
+	m.mtx.Unlock()
+	b.err = m.next(&prompb.WriteRequest{Timeseries: b.series})
+	if b.err != nil {
+		level.Error(m.log).Log("action", "merged-write", "requests", b.requests, "series", len(b.series), "err", b.err)
+	}
+	close(b.done)
+}
+
+// add merges the series of req into the batch and returns the number of
+// samples already in it.
+func (b *batch) add(req *prompb.WriteRequest) int {
+	duplicates := 0
+	b.requests++
+	for _, ts := range req.Timeseries {
+		key := seriesKey(ts.Labels)
+		i, ok := b.index[key]
+		if !ok {
+			i = len(b.series)
+			b.index[key] = i
+			b.series = append(b.series, prompb.TimeSeries{Labels: ts.Labels})
+			b.seen = append(b.seen, make(map[int64]struct{}))
+		}
+		for _, s := range ts.Samples {
+			if _, ok := b.seen[i][s.Timestamp]; ok {
+				duplicates++
+				continue
+			}
+			b.seen[i][s.Timestamp] = struct{}{}
+			b.series[i].Samples = append(b.series[i].Samples, s)
+		}
+	}
+	return duplicates
+}
+
+// seriesKey identifies a series by its label pairs regardless of their order.
+func seriesKey(labels []prompb.Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + "\xff" + l.Value
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
@@ -0,0 +1,71 @@
+package mux
+
+import (
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mergerSeries(samples ...int64) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}}
+	for _, t := range samples {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: 1, Timestamp: t})
+	}
+	return ts
+}
+
+func TestMergerDedupsSamples(t *testing.T) {
+	var written []*prompb.WriteRequest
+	m := NewMerger(100*time.Millisecond, func(req *prompb.WriteRequest) error {
+		written = append(written, req)
+		return nil
+	}, log.NewNopLogger())
+	// the same series of two Prometheus servers, its labels in another order
+	reversed := mergerSeries(2000, 3000)
+	reversed.Labels[0], reversed.Labels[1] = reversed.Labels[1], reversed.Labels[0]
+	var wg sync.WaitGroup
+	for _, req := range []*prompb.WriteRequest{
+		{Timeseries: []prompb.TimeSeries{mergerSeries(1000, 2000)}},
+		{Timeseries: []prompb.TimeSeries{reversed}},
+	} {
+		wg.Add(1)
+		go func(req *prompb.WriteRequest) {
+			defer wg.Done()
+			if err := m.Write(req); err != nil {
+				t.Error(err)
+			}
+		}(req)
+	}
+	wg.Wait()
+	if len(written) != 1 || len(written[0].Timeseries) != 1 {
+		t.Fatalf("written %v, want one request of one series", written)
+	}
+	seen := make(map[int64]int)
+	for _, s := range written[0].Timeseries[0].Samples {
+		seen[s.Timestamp]++
+	}
+	if len(seen) != 3 || seen[1000] != 1 || seen[2000] != 1 || seen[3000] != 1 {
+		t.Fatalf("samples at %v, want each of 1000, 2000 and 3000 once", seen)
+	}
+}
+
+func TestMergerReturnsWriteErrorToAll(t *testing.T) {
+	failed := errors.New("splunk is down")
+	m := NewMerger(10*time.Millisecond, func(*prompb.WriteRequest) error {
+		return failed
+	}, log.NewNopLogger())
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- m.Write(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{mergerSeries(1000)}})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != failed {
+			t.Errorf("err = %v, want %v", err, failed)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// otlpResponse encodes the ExportMetricsServiceResponse of an OTLP write,
+// with a partial_success naming the data points rejected as skipped.
+func otlpResponse(skipped int) []byte {
+	if skipped == 0 {
+		return nil
+	}
+	msg := "data points of delta sums and histograms, exponential histograms, summaries and without recorded value are not supported"
+	partial := proto.NewBuffer(nil)
+	// rejected_data_points and error_message
+	partial.EncodeVarint(1<<3 | 0)
+	partial.EncodeVarint(uint64(skipped))
+	partial.EncodeVarint(2<<3 | 2)
+	partial.EncodeStringBytes(msg)
+	resp := proto.NewBuffer(nil)
+	resp.EncodeVarint(1<<3 | 2)
+	resp.EncodeRawBytes(partial.Bytes())
+	return resp.Bytes()
+}
@@ -0,0 +1,112 @@
+// Package push keeps the metrics batch jobs pushed to ropee, Pushgateway
+// style, so they can be written to Splunk periodically until they expire.
+package push
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type group struct {
+	labels  []prompb.Label
+	metrics map[string][]prompb.TimeSeries
+	updated time.Time
+}
+
+// Store holds the last pushed series per grouping key. Groups not pushed to
+// for ttl are dropped.
+type Store struct {
+	mtx    sync.Mutex
+	ttl    time.Duration
+	groups map[string]*group
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{ttl: ttl, groups: make(map[string]*group)}
+}
+
+// GroupingKey returns the key identifying the group of the given labels.
+func GroupingKey(labels []prompb.Label) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Name+"\xff"+l.Value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\xff")
+}
+
+// Push stores series for the group identified by labels. With replace (PUT)
+// all previous metrics of the group are dropped, otherwise (POST) only
+// metrics with the same name are replaced.
+func (s *Store) Push(labels []prompb.Label, series []prompb.TimeSeries, replace bool) {
+	key := GroupingKey(labels)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	g, ok := s.groups[key]
+	if !ok || replace {
+		g = &group{labels: labels, metrics: make(map[string][]prompb.TimeSeries)}
+		s.groups[key] = g
+	}
+	pushed := make(map[string][]prompb.TimeSeries)
+	for _, ts := range series {
+		name := metricFamily(ts)
+		pushed[name] = append(pushed[name], ts)
+	}
+	for name, ts := range pushed {
+		g.metrics[name] = ts
+	}
+	g.updated = time.Now()
+}
+
+// Delete drops the group identified by labels.
+func (s *Store) Delete(labels []prompb.Label) {
+	s.mtx.Lock()
+	delete(s.groups, GroupingKey(labels))
+	s.mtx.Unlock()
+}
+
+// Snapshot expires groups older than ttl and returns the last value of every
+// remaining series stamped with now.
+func (s *Store) Snapshot(now time.Time) []prompb.TimeSeries {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	res := make([]prompb.TimeSeries, 0)
+	for key, g := range s.groups {
+		if s.ttl > 0 && now.Sub(g.updated) > s.ttl {
+			delete(s.groups, key)
+			continue
+		}
+		for _, series := range g.metrics {
+			for _, ts := range series {
+				if len(ts.Samples) == 0 {
+					continue
+				}
+				// the labels are copied, the write path rewrites them in place
+				res = append(res, prompb.TimeSeries{
+					Labels:  append([]prompb.Label(nil), ts.Labels...),
+					Samples: []prompb.Sample{{Value: ts.Samples[len(ts.Samples)-1].Value, Timestamp: ms}},
+				})
+			}
+		}
+	}
+	return res
+}
+
+// metricFamily strips the histogram and summary suffixes, so all series of
+// one family are replaced together.
+func metricFamily(ts prompb.TimeSeries) string {
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			name := l.Value
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				name = strings.TrimSuffix(name, suffix)
+			}
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package push
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+	"time"
+)
+
+func TestSnapshotCopiesLabels(t *testing.T) {
+	s := NewStore(time.Minute)
+	job := []prompb.Label{{Name: "job", Value: "backup"}}
+	s.Push(job, []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "backup_duration_seconds"}, {Name: "job", Value: "backup"}},
+		Samples: []prompb.Sample{{Value: 42, Timestamp: 1000}},
+	}}, true)
+	first := s.Snapshot(time.Now())
+	if len(first) != 1 {
+		t.Fatalf("snapshot = %v, want one series", first)
+	}
+	// the write path rewrites labels in place
+	first[0].Labels[1].Value = "rewritten"
+	second := s.Snapshot(time.Now())
+	if got := second[0].Labels[1].Value; got != "backup" {
+		t.Fatalf("job = %q after the last snapshot was rewritten, want backup", got)
+	}
+}
+
+func TestSnapshotExpiresGroups(t *testing.T) {
+	s := NewStore(time.Minute)
+	s.Push([]prompb.Label{{Name: "job", Value: "backup"}}, []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "backup_duration_seconds"}},
+		Samples: []prompb.Sample{{Value: 42, Timestamp: 1000}},
+	}}, true)
+	if got := s.Snapshot(time.Now().Add(2 * time.Minute)); len(got) != 0 {
+		t.Fatalf("snapshot = %v after the ttl, want none", got)
+	}
+}
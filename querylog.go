@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueryLogValue and maxQueryLogSearch cap the label values and
+	// searches in query log entries, longer ones are truncated.
+	maxQueryLogValue  = 256
+	maxQueryLogSearch = 4096
+)
+
+// queryLog writes a JSON line per remote read, who read what, the searches
+// run for it and how it went, for investigating abusive reads.
+type queryLog struct {
+	logger      log.Logger
+	minDuration time.Duration
+}
+
+// newQueryLog returns a query log written to file, rotated like the main log,
+// or to stdout for -. Reads faster than minDuration aren't logged.
+func newQueryLog(file string, minDuration time.Duration) *queryLog {
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		w = loadRotateWriter(path.Dir(file), path.Base(file))
+	}
+	return &queryLog{logger: log.NewJSONLogger(log.NewSyncWriter(w)), minDuration: minDuration}
+}
+
+// queryLogEntry is filled in by the read handler with the request and its
+// response, if it gets that far.
+type queryLogEntry struct {
+	req   *prompb.ReadRequest
+	resp  *prompb.ReadResponse
+	trace *storage.SearchTrace
+	// streamed are the series and samples of streamed results by query
+	mtx      sync.Mutex
+	streamed map[int][2]int
+}
+
+type queryLogEntryKey struct{}
+
+// loggedRead returns the query log entry of the read of ctx, nil if reads
+// aren't logged.
+func loggedRead(ctx context.Context) *queryLogEntry {
+	e, _ := ctx.Value(queryLogEntryKey{}).(*queryLogEntry)
+	return e
+}
+
+func (e *queryLogEntry) setRequest(req *prompb.ReadRequest) {
+	if e != nil {
+		e.req = req
+	}
+}
+
+func (e *queryLogEntry) setResponse(resp *prompb.ReadResponse) {
+	if e != nil {
+		e.resp = resp
+	}
+}
+
+// setQueryResult records the size of the result of query i, streamed
+// results aren't in the response.
+func (e *queryLogEntry) setQueryResult(i int, res *prompb.QueryResult) {
+	if e == nil {
+		return
+	}
+	samples := 0
+	for _, ts := range res.Timeseries {
+		samples += len(ts.Samples)
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.streamed == nil {
+		e.streamed = make(map[int][2]int)
+	}
+	e.streamed[i] = [2]int{len(res.Timeseries), samples}
+}
+
+// wrap logs the reads next serves.
+func (ql *queryLog) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if ql == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		entry := &queryLogEntry{trace: &storage.SearchTrace{}}
+		ctx := context.WithValue(r.Context(), queryLogEntryKey{}, entry)
+		ctx = storage.ContextWithSearchTrace(ctx, entry.trace)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+		duration := time.Since(started)
+		if duration < ql.minDuration {
+			return
+		}
+		claimed, token := requestIdentity(r)
+		kvs := []interface{}{
+			"time", started.UTC().Format(time.RFC3339Nano),
+			"request_id", w.Header().Get("X-Request-Id"),
+			"claimed_identity", claimed,
+			"token", token,
+			"client_ip", clientIP(r),
+			"queries", entry.queries(),
+			"duration_seconds", duration.Seconds(),
+			"status", rec.status,
+		}
+		if rec.err != "" {
+			kvs = append(kvs, "error", rec.err)
+		}
+		ql.logger.Log(kvs...)
+	}
+}
+
+type queryLogQuery struct {
+	Matchers []string `json:"matchers"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Search   string   `json:"search,omitempty"`
+	SIDs     []string `json:"sids,omitempty"`
+	Series   int      `json:"series"`
+	Samples  int      `json:"samples"`
+}
+
+func (e *queryLogEntry) queries() []queryLogQuery {
+	if e.req == nil {
+		return []queryLogQuery{}
+	}
+	res := make([]queryLogQuery, 0, len(e.req.Queries))
+	for i, q := range e.req.Queries {
+		lq := queryLogQuery{
+			Matchers: make([]string, 0, len(q.Matchers)),
+			Start:    time.Unix(0, q.StartTimestampMs*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano),
+			End:      time.Unix(0, q.EndTimestampMs*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano),
+		}
+		for _, m := range q.Matchers {
+			lq.Matchers = append(lq.Matchers, m.Name+matcherOps[m.Type]+strconv.Quote(truncate(m.Value, maxQueryLogValue)))
+		}
+		if s, ok := e.trace.Search(q); ok {
+			lq.Search, lq.SIDs = truncate(s.Search, maxQueryLogSearch), s.SIDs
+		}
+		if e.resp != nil && i < len(e.resp.Results) && e.resp.Results[i] != nil {
+			lq.Series = len(e.resp.Results[i].Timeseries)
+			for _, ts := range e.resp.Results[i].Timeseries {
+				lq.Samples += len(ts.Samples)
+			}
+		} else if n, ok := e.streamed[i]; ok {
+			lq.Series, lq.Samples = n[0], n[1]
+		}
+		res = append(res, lq)
+	}
+	return res
+}
+
+var matcherOps = map[prompb.LabelMatcher_Type]string{
+	prompb.LabelMatcher_EQ:  "=",
+	prompb.LabelMatcher_NEQ: "!=",
+	prompb.LabelMatcher_RE:  "=~",
+	prompb.LabelMatcher_NRE: "!~",
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+// requestIdentity returns who r claims to be: the basic auth user or the
+// subject of a JWT bearer token, as Splunk tokens are, and a hash of bearer
+// tokens. Neither is verified here, Splunk does when they're used, so the
+// subject of a token only means something along with its hash.
+func requestIdentity(r *http.Request) (claimed, token string) {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user, ""
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", ""
+	}
+	bearer := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	sum := sha256.Sum256([]byte(bearer))
+	token = hex.EncodeToString(sum[:8])
+	if parts := strings.Split(bearer, "."); len(parts) == 3 {
+		var claims struct {
+			Sub string `json:"sub"`
+		}
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Unmarshal(payload, &claims) == nil {
+			claimed = claims.Sub
+		}
+	}
+	return claimed, token
+}
+
+// statusRecorder keeps the status and error message of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	err    string
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status >= http.StatusBadRequest && rec.err == "" {
+		rec.err = truncate(strings.TrimSpace(string(b)), maxQueryLogValue)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
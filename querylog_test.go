@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIdentity(t *testing.T) {
+	jwt := func(sub string) string {
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + sub + `"}`))
+		return "eyJhbGciOiJIUzI1NiJ9." + claims + ".c2lnbmF0dXJl"
+	}
+	r := httptest.NewRequest("GET", "/read", nil)
+	r.SetBasicAuth("alice", "secret")
+	if claimed, token := requestIdentity(r); claimed != "alice" || token != "" {
+		t.Errorf("basic auth: identity = %q, %q, want alice without a token", claimed, token)
+	}
+
+	r = httptest.NewRequest("GET", "/read", nil)
+	r.Header.Set("Authorization", "Bearer "+jwt("alice"))
+	claimed, token := requestIdentity(r)
+	if claimed != "alice" || token == "" {
+		t.Errorf("jwt: identity = %q, %q, want alice with a token hash", claimed, token)
+	}
+	// anyone can claim to be alice, the hash tells the tokens apart
+	r.Header.Set("Authorization", "Bearer "+jwt("alice")+"forged")
+	if _, forged := requestIdentity(r); forged == token {
+		t.Errorf("a forged token of alice has the hash %s of hers", forged)
+	}
+
+	r = httptest.NewRequest("GET", "/read", nil)
+	r.Header.Set("Authorization", "Bearer opaque")
+	if claimed, token := requestIdentity(r); claimed != "" || token == "" {
+		t.Errorf("opaque token: identity = %q, %q, want only a token hash", claimed, token)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/kebe7jun/ropee/storage"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveReads creates the read client and registers the endpoints reading
+// from Splunk, they are left out in agent mode.
+func serveReads(l log.Logger, tenants *tenantLimiters, aliases *storage.MetricAliases, readTimeout time.Duration) {
+	readBackends := make([]storage.RemoteClient, 0)
+	for _, u := range splitList(config.ReadBackends) {
+		readBackends = append(readBackends, storage.NewRemoteBackend("", u, readTimeout))
+	}
+	dispatch, err := storage.ParseDispatchOptions(config.ReadDispatchOptions)
+	if err != nil {
+		level.Error(l).Log("msg", "Invalid -read.dispatch-options", "err", err)
+		os.Exit(1)
+	}
+	ignored := storage.IgnoredLabels(splitList(config.ReadIgnoreLabels))
+	if ignored.Contains("__name__") {
+		level.Error(l).Log("msg", "-read.ignore-labels can't include __name__")
+		os.Exit(1)
+	}
+	// series written by HA replicas differ in their sender too, it is
+	// ignored with their external labels for them to be read as one
+	if len(ignored) > 0 && config.ForwardClientIP && !ignored.Contains("prometheus_sender") {
+		ignored = append(ignored, "prometheus_sender")
+	}
+	if config.ReadSearchPrefix != "" {
+		if err := storage.ValidateSearchPrefix(config.ReadSearchPrefix); err != nil {
+			level.Error(l).Log("msg", "Invalid -read.search-prefix", "err", err)
+			os.Exit(1)
+		}
+	}
+	autoSpan, err := storage.ParseAutoSpanRules(config.ReadAutoSpanRules)
+	if err != nil {
+		level.Error(l).Log("msg", "Invalid -read.auto-span-rules", "err", err)
+		os.Exit(1)
+	}
+	maxRows := config.ReadMaxRows
+	// a bounded max_count fails larger searches like -read.max-rows rather
+	// than truncating their results
+	if n, err := strconv.Atoi(dispatch["max_count"]); err == nil && n > 0 && (maxRows == 0 || n < maxRows) {
+		maxRows = n
+	}
+	readOpts := []storage.Option{
+		storage.WithQueryConcurrency(config.ReadQueryConcurrency),
+		storage.WithMaxResultRows(maxRows),
+		storage.WithDispatchOptions(dispatch),
+		storage.WithSearchMode(config.ReadSearchMode),
+		storage.WithOutputMode(config.ReadOutputMode),
+		storage.WithSearchPrefix(config.ReadSearchPrefix),
+		storage.WithReadDedupPolicy(config.ReadDedupPolicy),
+		storage.WithStrictRead(config.ReadStrict),
+		storage.WithRequiredMatchers(storage.RequiredMatchers{
+			Labels: splitList(config.ReadRequiredMatchers),
+			All:    config.ReadRequiredMode == "all",
+		}),
+		storage.WithIgnoredLabels(ignored),
+		storage.WithMetricAliases(aliases),
+		storage.WithLabelSearch(config.ReadLabelLimit, config.ReadLabelCacheTTL),
+		storage.WithSIDCache(config.ReadSIDCacheTTL),
+		storage.WithJobPolling(storage.JobPolling{
+			Interval:    config.ReadPollInterval,
+			Backoff:     config.ReadPollBackoff,
+			MaxInterval: config.ReadPollMaxInterval,
+		}),
+		storage.WithOneshotThreshold(config.ReadOneshotThreshold),
+		storage.WithMetricNames(storage.MetricNames{Prefix: config.MetricNamePrefix, Suffix: config.MetricNameSuffix}),
+		storage.WithFieldPrefix(config.SplunkFieldPrefix),
+		storage.WithReadLimits(storage.ReadLimits{MaxSeries: config.ReadMaxSeries, MaxSamples: config.ReadMaxSamples}),
+		storage.WithDownsampling(storage.Downsampling{
+			Enabled:     config.ReadDownsampling == "auto",
+			Aggregation: config.ReadDownsamplingAgg,
+			AutoSpan:    autoSpan,
+			PushDown:    config.ReadPushDownFuncs,
+		}),
+		storage.WithReadWindow(storage.ReadWindow{
+			StartBuffer:       config.ReadStartBuffer,
+			EndBuffer:         config.ReadEndBuffer,
+			IngestDelay:       config.ReadIngestDelay,
+			MaxRangePerSearch: config.ReadMaxRangePerSearch,
+		}),
+	}
+	if config.SplunkTokenFile != "" {
+		token, err := ioutil.ReadFile(config.SplunkTokenFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Read splunk token file error", "err", err)
+			os.Exit(1)
+		}
+		readOpts = append(readOpts, storage.WithToken(string(bytes.TrimSpace(token))))
+	}
+	if config.SavedSearchMapFile != "" {
+		savedSearches, err := storage.LoadSavedSearches(config.SavedSearchMapFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Load saved search map error", "err", err)
+			os.Exit(1)
+		}
+		readOpts = append(readOpts, storage.WithSavedSearches(savedSearches))
+	}
+	if config.TimePartitionRulesFile != "" {
+		rules, err := storage.LoadTimePartitionRules(config.TimePartitionRulesFile)
+		if err != nil {
+			level.Error(l).Log("msg", "Load time partition rules error", "err", err)
+			os.Exit(1)
+		}
+		readOpts = append(readOpts, storage.WithTimePartitionRules(rules))
+	}
+	if config.SplunkAPIRateLimit > 0 {
+		readOpts = append(readOpts, storage.WithAPIRateLimiter(storage.NewAPIRateLimiter(config.SplunkAPIRateLimit, config.SplunkAPIMaxWait)))
+	}
+	if config.ReadMaxSearches > 0 {
+		readOpts = append(readOpts, storage.WithSearchLimiter(storage.NewSearchLimiter(config.ReadMaxSearches, config.ReadSearchQueueTimeout)))
+	}
+	if config.NativeHistogramRead {
+		readOpts = append(readOpts, storage.WithNativeHistogramRead())
+	}
+	readClient, err := storage.NewClient(
+		config.SplunkUrl,
+		"",
+		"",
+		config.SplunkMetricsIndex,
+		config.SplunkMetricsSourceType,
+		config.SplunkHECURL, config.SplunkHECToken,
+		readTimeout,
+		l,
+		readOpts...,
+	)
+	if err != nil {
+		level.Error(l).Log("msg", "Create read client error", "err", err)
+		os.Exit(1)
+	}
+	// label searches and translations go to Splunk only, the read backends
+	// can't answer them
+	labelSearcher := readClient.(storage.LabelSearcher)
+	splunkReader := readClient.(*storage.Client)
+	if config.AdminListenAddr != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/debug/translate", func(w http.ResponseWriter, r *http.Request) {
+			ctx, ok := splunkContext(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ropee"`)
+				httpError(w, "admin", errorTypeAuth, "splunk credentials required", http.StatusUnauthorized)
+				return
+			}
+			q, err := parseTranslateQuery(r)
+			if err != nil {
+				httpError(w, "admin", errorTypeInvalid, err.Error(), http.StatusBadRequest)
+				return
+			}
+			t, err := splunkReader.Translate(ctx, q)
+			if err != nil {
+				setRetryAfter(w, err)
+				httpError(w, "admin", backendErrorType(err), err.Error(), readErrorStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t)
+		})
+		admin.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+			ctx, ok := splunkContext(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ropee"`)
+				httpError(w, "admin", errorTypeAuth, "splunk credentials required", http.StatusUnauthorized)
+				return
+			}
+			if err := splunkReader.Authenticate(ctx); err != nil {
+				setRetryAfter(w, err)
+				httpError(w, "admin", backendErrorType(err), err.Error(), readErrorStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(debugConfig())
+		})
+		go func() {
+			if err := http.ListenAndServe(config.AdminListenAddr, admin); err != nil {
+				level.Error(l).Log("action", "serve admin", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if len(readBackends) > 0 {
+		readClient = storage.NewFanoutClient(0, append([]storage.RemoteClient{readClient}, readBackends...)...)
+	}
+	if config.ReadCacheTTL > 0 {
+		cache := storage.NewReadCache(readClient, config.ReadCacheTTL, config.ReadCacheMaxBytes, config.ReadCacheMinAge)
+		readClient = cache
+		http.HandleFunc("/read/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				httpError(w, "read", errorTypeInvalid, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// anyone Splunk accepts may flush, but not anonymous callers
+			ctx, ok := splunkContext(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ropee"`)
+				httpError(w, "read", errorTypeAuth, "splunk credentials required", http.StatusUnauthorized)
+				return
+			}
+			if err := splunkReader.Authenticate(ctx); err != nil {
+				setRetryAfter(w, err)
+				httpError(w, "read", backendErrorType(err), err.Error(), readErrorStatus(err))
+				return
+			}
+			cache.Flush()
+			level.Info(l).Log("msg", "read cache flushed")
+		})
+	}
+	var ql *queryLog
+	if config.ReadQueryLogFile != "" {
+		ql = newQueryLog(config.ReadQueryLogFile, config.ReadQueryLogMinDuration)
+	}
+	http.HandleFunc("/read", tenants.wrapRead(ql.wrap(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			level.Error(l).Log("msg", "Read error", "err", err.Error())
+			httpError(w, "read", errorTypeDecode, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		rl := log.With(requestLogger(l, compressed), "request_id", requestID)
+
+		reqBuf, err := decodeSnappy(config.SnappyFormat, compressed)
+		if err != nil {
+			level.Error(rl).Log("msg", "Decode error", "err", err.Error())
+			httpError(w, "read", errorTypeDecode, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metrics.ReadRequestCounter.Add(1)
+		defer func() {
+			metrics.ReadDurationSeconds.Observe(time.Since(started).Seconds())
+		}()
+		var req prompb.ReadRequest
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			level.Error(rl).Log("msg", "Unmarshal error", "err", err.Error())
+			httpError(w, "read", errorTypeUnmarshal, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(rl).Log("msg", "read request", "queries", len(req.Queries))
+		loggedRead(r.Context()).setRequest(&req)
+		ctx, _ := splunkContext(r)
+		ctx = storage.ContextWithRequestID(ctx, requestID)
+		ctx = requiredMatchersContext(ctx, r, splunkReader.Authenticate)
+		if config.ReadLimitOverride {
+			ctx = storage.ContextWithReadLimits(ctx, readLimits(r))
+		}
+		raw := r.Header.Get("X-Ropee-Raw") == "true"
+		if raw {
+			ctx = storage.ContextWithRawSamples(ctx)
+		}
+		if config.ReadPushDownFuncs {
+			ctx = storage.ContextWithHintRanges(ctx, reqBuf)
+		}
+		timeout := requestedTimeout(r, readTimeout)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if !raw && config.ReadDownsampling == "auto" {
+			// the largest span of a rule coarser than the step of its query
+			span := time.Duration(0)
+			for _, q := range req.Queries {
+				s := autoSpan.Span(q)
+				if q.Hints != nil && time.Duration(q.Hints.StepMs)*time.Millisecond >= s {
+					continue
+				}
+				if s > span {
+					span = s
+				}
+			}
+			if span > 0 {
+				w.Header().Set("X-Ropee-Downsampled", span.String())
+				level.Info(rl).Log("msg", "read downsampled by auto span rules", "span", span)
+			}
+		}
+		// Splunk results are streamed as each query completes, the results of
+		// read backends and cached ones once all are merged
+		var cw *storage.ChunkedWriter
+		// native histograms have no XOR chunks, their responses are samples
+		streamed := storage.AcceptsStreamedChunks(reqBuf) && !config.NativeHistogramRead
+		if _, direct := readClient.(*storage.Client); streamed && direct {
+			// errors before the first frame replace the content type
+			w.Header().Set("Content-Type", storage.StreamedContentType)
+			cw = storage.NewChunkedWriter(w)
+			ctx = storage.ContextWithQueryResults(ctx, func(i int, res *prompb.QueryResult) error {
+				observeQueryResult(res)
+				loggedRead(r.Context()).setQueryResult(i, res)
+				return cw.WriteQueryResult(i, res)
+			})
+		}
+		resp, err := readClient.Read(ctx, &req)
+		if err != nil && cw != nil && cw.Written() {
+			// the response is under way, its status can't change anymore
+			level.Error(rl).Log("msg", "Read error after streaming started", "err", err)
+			return
+		}
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			// the searches are cancelled as they fail
+			metrics.ReadDeadlineExceeded.Inc()
+			level.Error(rl).Log("msg", "Read deadline exceeded", "err", err)
+			httpError(w, "read", errorTypeTimeout, "read exceeded "+exceededTimeout(timeout, readTimeout)+": "+err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			level.Error(rl).Log("msg", "Read error", "err", err)
+			setRetryAfter(w, err)
+			httpError(w, "read", backendErrorType(err), err.Error(), readErrorStatus(err))
+			return
+		}
+		if cw != nil {
+			return
+		}
+		loggedRead(r.Context()).setResponse(resp)
+		for _, res := range resp.Results {
+			observeQueryResult(res)
+		}
+		if streamed {
+			w.Header().Set("Content-Type", storage.StreamedContentType)
+			cw := storage.NewChunkedWriter(w)
+			for i, res := range resp.Results {
+				// cached results are shared, the writer consumes its own
+				res = &prompb.QueryResult{Timeseries: append([]*prompb.TimeSeries(nil), res.Timeseries...)}
+				if err := cw.WriteQueryResult(i, res); err != nil {
+					level.Warn(rl).Log("msg", "Error streaming query result", "query", i, "err", err)
+					return
+				}
+			}
+			return
+		}
+
+		var out sizedMarshaler = resp
+		if config.NativeHistogramRead {
+			if out, err = storage.EncodeNativeHistograms(&req, resp); err != nil {
+				level.Error(rl).Log("msg", "Encode native histograms error", "err", err)
+				httpError(w, "read", errorTypeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		size := out.Size()
+		if config.ReadMaxResponseBytes > 0 && size > config.ReadMaxResponseBytes {
+			metrics.ReadLimitExceeded.Inc()
+			level.Error(rl).Log("msg", "Read response too large", "bytes", size, "max_bytes", config.ReadMaxResponseBytes)
+			httpError(w, "read", errorTypeLimit, fmt.Sprintf("read response of %d bytes exceeds the limit of %d bytes, narrow the query or its time range", size, config.ReadMaxResponseBytes), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+
+		encoded, err := writeSnappyProto(w, out, size)
+		if err != nil {
+			level.Warn(rl).Log("msg", "Error executing query", "query", req, "err", err)
+			httpError(w, "read", errorTypeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		metrics.ReadResponseBytes.WithLabelValues("none").Observe(float64(size))
+		metrics.ReadResponseBytes.WithLabelValues("snappy").Observe(float64(encoded))
+	})))
+	http.HandleFunc("/federate", tenants.wrapRead(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			httpError(w, "read", errorTypeInvalid, err.Error(), http.StatusBadRequest)
+			return
+		}
+		selectors := r.Form["match[]"]
+		if len(selectors) == 0 {
+			httpError(w, "read", errorTypeInvalid, "at least one match[] is required", http.StatusBadRequest)
+			return
+		}
+		// like Prometheus, series without samples in the last 5 minutes
+		// are stale and not federated
+		end := time.Now().UnixNano() / int64(time.Millisecond)
+		start := end - int64(5*time.Minute/time.Millisecond)
+		var req prompb.ReadRequest
+		for _, selector := range selectors {
+			matchers, err := storage.ParseSelector(selector)
+			if err != nil {
+				httpError(w, "read", errorTypeInvalid, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Queries = append(req.Queries, &prompb.Query{StartTimestampMs: start, EndTimestampMs: end, Matchers: matchers})
+		}
+		ctx, _ := splunkContext(r)
+		resp, err := readClient.Read(requiredMatchersContext(ctx, r, splunkReader.Authenticate), &req)
+		if err != nil {
+			level.Error(l).Log("msg", "Federate error", "err", err)
+			setRetryAfter(w, err)
+			httpError(w, "read", backendErrorType(err), err.Error(), readErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		if err := writeFederation(w, resp); err != nil {
+			level.Error(l).Log("msg", "Write federation error", "err", err)
+		}
+	}))
+	http.HandleFunc("/api/v1/labels", tenants.wrapRead(func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseLabelQuery(r)
+		if err != nil {
+			writeAPIError(w, err, http.StatusBadRequest)
+			return
+		}
+		ctx, _ := splunkContext(r)
+		names, err := labelSearcher.SearchLabelNames(ctx, q)
+		if err != nil {
+			level.Error(l).Log("msg", "Search label names error", "err", err)
+			setRetryAfter(w, err)
+			writeAPIError(w, err, readErrorStatus(err))
+			return
+		}
+		writeAPIData(w, names)
+	}))
+	http.HandleFunc("/api/v1/label/", tenants.wrapRead(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+		if !strings.HasSuffix(name, "/values") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/values")
+		q, err := parseLabelQuery(r)
+		if err != nil {
+			writeAPIError(w, err, http.StatusBadRequest)
+			return
+		}
+		ctx, _ := splunkContext(r)
+		values, err := labelSearcher.SearchLabelValues(ctx, name, q)
+		if err != nil {
+			level.Error(l).Log("msg", "Search label values error", "err", err, "label", name)
+			setRetryAfter(w, err)
+			writeAPIError(w, err, readErrorStatus(err))
+			return
+		}
+		writeAPIData(w, values)
+	}))
+}
+
+// observeQueryResult counts the series and samples of the result of a query
+// of a read.
+func observeQueryResult(res *prompb.QueryResult) {
+	samples := 0
+	for _, ts := range res.Timeseries {
+		samples += len(ts.Samples)
+	}
+	metrics.ReadSeriesPerQuery.Observe(float64(len(res.Timeseries)))
+	metrics.ReadSamplesPerQuery.Observe(float64(samples))
+}
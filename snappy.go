@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// snappyStreamMagic is the stream identifier chunk every snappy framing
+// format stream starts with.
+const snappyStreamMagic = "\xff\x06\x00\x00sNaPpY"
+
+// decodeSnappy decompresses a request body in the given format: "block",
+// "stream" or "auto". Auto picks the framing format when the body starts
+// with its stream identifier and falls back to block format when that fails.
+func decodeSnappy(format string, compressed []byte) ([]byte, error) {
+	switch format {
+	case "block":
+		return snappy.Decode(nil, compressed)
+	case "stream":
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(compressed)))
+	case "auto":
+		if bytes.HasPrefix(compressed, []byte(snappyStreamMagic)) {
+			if buf, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(compressed))); err == nil {
+				return buf, nil
+			}
+		}
+		return snappy.Decode(nil, compressed)
+	}
+	return nil, fmt.Errorf("unknown snappy format %q", format)
+}
+
+// snappyBuffers pool the buffers responses are marshaled and compressed
+// into. Buffers larger than maxPooledBuffer are left to the garbage
+// collector rather than kept for the next response.
+var snappyBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+const maxPooledBuffer = 64 << 20
+
+// sizedMarshaler is a gogo protobuf message, e.g. a prompb.ReadResponse.
+type sizedMarshaler interface {
+	Size() int
+	MarshalTo([]byte) (int, error)
+}
+
+// writeSnappyProto marshals m, whose Size is size, and writes it snappy
+// block encoded to w, using pooled buffers for both copies. It returns the
+// encoded size.
+func writeSnappyProto(w io.Writer, m sizedMarshaler, size int) (int, error) {
+	raw := pooledBuffer(size)
+	defer releaseBuffer(raw)
+	n, err := m.MarshalTo(*raw)
+	if err != nil {
+		return 0, err
+	}
+	encoded := pooledBuffer(snappy.MaxEncodedLen(n))
+	defer releaseBuffer(encoded)
+	return w.Write(snappy.Encode(*encoded, (*raw)[:n]))
+}
+
+func pooledBuffer(size int) *[]byte {
+	buf := snappyBuffers.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func releaseBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledBuffer {
+		snappyBuffers.Put(buf)
+	}
+}
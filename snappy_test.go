@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+// readResponse returns a response of one query of n series of 10 samples.
+func readResponse(n int) *prompb.ReadResponse {
+	res := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0, n)}
+	for i := 0; i < n; i++ {
+		ts := &prompb.TimeSeries{Labels: []prompb.Label{
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "instance", Value: "web-" + strconv.Itoa(i%100)},
+			{Name: "path", Value: "/api/v1/items/" + strconv.Itoa(i)},
+		}}
+		for j := 0; j < 10; j++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: int64(j) * 15000, Value: float64(i + j)})
+		}
+		res.Timeseries = append(res.Timeseries, ts)
+	}
+	return &prompb.ReadResponse{Results: []*prompb.QueryResult{res}}
+}
+
+func TestWriteSnappyProto(t *testing.T) {
+	resp := readResponse(100)
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		n, err := writeSnappyProto(&buf, resp, resp.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != buf.Len() {
+			t.Errorf("returned %d bytes written, wrote %d", n, buf.Len())
+		}
+		data, err := snappy.Decode(nil, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got prompb.ReadResponse
+		if err := proto.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Results) != 1 || len(got.Results[0].Timeseries) != 100 {
+			t.Fatalf("decoded %v of a response of 100 series", got.Results)
+		}
+		if last := got.Results[0].Timeseries[99]; last.Labels[2].Value != "/api/v1/items/99" || last.Samples[9].Value != 108 {
+			t.Errorf("last series decoded as %v", last)
+		}
+	}
+}
+
+// BenchmarkReadResponseUnpooled encodes a 100k series response as reads
+// did before, into a fresh slice for each copy.
+func BenchmarkReadResponseUnpooled(b *testing.B) {
+	resp := readResponse(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := proto.Marshal(resp)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.Discard.Write(snappy.Encode(nil, data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadResponsePooled encodes a 100k series response into pooled
+// buffers as non-streamed reads do.
+func BenchmarkReadResponsePooled(b *testing.B) {
+	resp := readResponse(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writeSnappyProto(ioutil.Discard, resp, resp.Size()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/ingest"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"net"
+	"time"
+)
+
+const (
+	// statsdFlushInterval is how often aggregated StatsD metrics are
+	// written, the default flush interval of StatsD servers.
+	statsdFlushInterval = 10 * time.Second
+	// statsdMaxPacket is the largest UDP payload. Clients send packets
+	// larger than the MTU as IP fragments, which the kernel reassembles,
+	// so a packet is read whole as long as the buffer fits it.
+	statsdMaxPacket = 65535
+)
+
+// serveStatsD aggregates the StatsD packets received on conn and writes
+// them with write every statsdFlushInterval until conn is closed. Metrics
+// are forgotten after ttl, at most maxMetrics are aggregated.
+func serveStatsD(conn net.PacketConn, ttl time.Duration, maxMetrics int, write func(*prompb.WriteRequest) error, l log.Logger) error {
+	agg := ingest.NewStatsD(ttl, maxMetrics)
+	go func() {
+		for now := range time.Tick(statsdFlushInterval) {
+			series := agg.Flush(now)
+			if len(series) == 0 {
+				continue
+			}
+			metrics.WriteRequestCounter.Add(1)
+			if err := write(&prompb.WriteRequest{Timeseries: series}); err != nil {
+				level.Error(l).Log("msg", "StatsD write error", "err", err)
+			}
+		}
+	}()
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		metrics.StatsDPacketsTotal.Inc()
+		if err := agg.Add(buf[:n]); err != nil {
+			level.Warn(l).Log("msg", "StatsD parse error", "remote", addr.String(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/kebe7jun/ropee/metrics"
+	"golang.org/x/time/rate"
+	"math"
+	"time"
+)
+
+// APIRateLimiter bounds the rate of Splunk REST API calls, dispatching,
+// polling and fetching searches alike, so reads stay within the API quota
+// of the search head. Calls queue for at most maxWait.
+type APIRateLimiter struct {
+	limiter *rate.Limiter
+	maxWait time.Duration
+}
+
+func NewAPIRateLimiter(rps float64, maxWait time.Duration) *APIRateLimiter {
+	return &APIRateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(rps), int(math.Ceil(rps))),
+		maxWait: maxWait,
+	}
+}
+
+// WithAPIRateLimiter limits the REST API calls of the client by l, which
+// may be shared by several clients.
+func WithAPIRateLimiter(l *APIRateLimiter) Option {
+	return func(c *Client) {
+		c.apiLimiter = l
+	}
+}
+
+// wait blocks until a call may be made. Calls that would have to wait longer
+// than maxWait fail with an UnavailableError right away.
+func (l *APIRateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	reservation := l.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > l.maxWait {
+		reservation.Cancel()
+		return &UnavailableError{
+			msg:        fmt.Sprintf("Splunk API rate limit reached, a call would wait %s", delay.Round(time.Millisecond)),
+			RetryAfter: delay,
+		}
+	}
+	metrics.SplunkAPIRateLimitWaitSeconds.Observe(delay.Seconds())
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"strings"
+	"time"
+)
+
+// AutoSpanRule aggregates samples of queries over ranges longer than
+// MinRange at Span.
+type AutoSpanRule struct {
+	MinRange, Span time.Duration
+}
+
+// AutoSpanRules downsample queries by their range, also when Prometheus
+// doesn't hint their step, e.g. before 2.x or for raw selectors: samples of
+// a 30 day query are of no use at 10s resolution.
+type AutoSpanRules []AutoSpanRule
+
+// ParseAutoSpanRules parses comma separated >range:span rules, e.g.
+// >7d:5m,>30d:1h. Durations take Prometheus units like 30d or 1w.
+func ParseAutoSpanRules(s string) (AutoSpanRules, error) {
+	rules := make(AutoSpanRules, 0)
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(rule, ">"), ":", 2)
+		if !strings.HasPrefix(rule, ">") || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid auto span rule %q, expected >range:span", rule)
+		}
+		minRange, err := model.ParseDuration(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range of auto span rule %q: %s", rule, err)
+		}
+		span, err := model.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || time.Duration(span) < time.Second {
+			return nil, fmt.Errorf("invalid span of auto span rule %q, it must be at least 1s", rule)
+		}
+		rules = append(rules, AutoSpanRule{MinRange: time.Duration(minRange), Span: time.Duration(span)})
+	}
+	return rules, nil
+}
+
+// Span returns the largest span of the rules matching the range of q, 0 if
+// none does.
+func (r AutoSpanRules) Span(q *prompb.Query) time.Duration {
+	queried := time.Duration(q.EndTimestampMs-q.StartTimestampMs) * time.Millisecond
+	span := time.Duration(0)
+	for _, rule := range r {
+		if queried > rule.MinRange && rule.Span > span {
+			span = rule.Span
+		}
+	}
+	return span
+}
+
+type rawSamplesKey struct{}
+
+// ContextWithRawSamples reads samples at the finest resolution, neither at
+// the hinted step nor at the span of auto span rules, e.g. to investigate
+// spikes aggregation hides.
+func ContextWithRawSamples(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawSamplesKey{}, true)
+}
+
+func rawSamples(ctx context.Context) bool {
+	raw, _ := ctx.Value(rawSamplesKey{}).(bool)
+	return raw
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker opens after threshold consecutive failures and lets a trial
+// request through (half-open) once cooldown has passed since it opened.
+// A zero threshold disables the breaker.
+type circuitBreaker struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	return time.Since(b.openedAt) >= b.cooldown
+}
+
+// Open reports whether the breaker currently rejects requests.
+func (b *circuitBreaker) Open() bool {
+	return !b.Allow()
+}
+
+func (b *circuitBreaker) Success() {
+	b.mtx.Lock()
+	b.failures = 0
+	b.mtx.Unlock()
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mtx.Lock()
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+	b.mtx.Unlock()
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MetricCardinality is the number of distinct series of a metric.
+type MetricCardinality struct {
+	MetricName  string `json:"metric_name"`
+	Cardinality int    `json:"cardinality"`
+}
+
+// CardinalityTracker counts the distinct series written per metric name.
+// Counts start over every window.
+type CardinalityTracker struct {
+	mtx         sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+	series      map[string]map[uint64]struct{}
+}
+
+func NewCardinalityTracker(window time.Duration) *CardinalityTracker {
+	return &CardinalityTracker{
+		window:      window,
+		windowStart: time.Now(),
+		series:      make(map[string]map[uint64]struct{}),
+	}
+}
+
+// Observe records a written series.
+func (t *CardinalityTracker) Observe(labels []prompb.Label) {
+	metricName := ""
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			metricName = l.Value
+			break
+		}
+	}
+	h := seriesHash(labels)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rotate()
+	set, ok := t.series[metricName]
+	if !ok {
+		set = make(map[uint64]struct{})
+		t.series[metricName] = set
+	}
+	set[h] = struct{}{}
+}
+
+// Report returns the cardinality of every metric written in the current
+// window, highest first.
+func (t *CardinalityTracker) Report() []MetricCardinality {
+	t.mtx.Lock()
+	t.rotate()
+	res := make([]MetricCardinality, 0, len(t.series))
+	for name, set := range t.series {
+		res = append(res, MetricCardinality{MetricName: name, Cardinality: len(set)})
+	}
+	t.mtx.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Cardinality != res[j].Cardinality {
+			return res[i].Cardinality > res[j].Cardinality
+		}
+		return res[i].MetricName < res[j].MetricName
+	})
+	return res
+}
+
+func (t *CardinalityTracker) rotate() {
+	if now := time.Now(); now.Sub(t.windowStart) >= t.window {
+		t.series = make(map[string]map[uint64]struct{})
+		t.windowStart = now
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// The prompb package of the Prometheus version ropee builds against predates
+// streamed remote read (Prometheus 2.13), so the few messages involved are
+// encoded by hand here, following prompb/remote.proto and prompb/types.proto.
+const (
+	// ReadRequest.accepted_response_types
+	readRequestAcceptedTypesField = 2
+	// ReadRequest_STREAMED_XOR_CHUNKS
+	responseTypeStreamedXORChunks = 1
+	// Chunk_XOR
+	chunkEncodingXOR = 1
+
+	// StreamedContentType is the content type of streamed read responses.
+	StreamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+	// maxSamplesPerChunk matches what Prometheus puts into one XOR chunk.
+	maxSamplesPerChunk = 120
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// AcceptsStreamedChunks reports whether the raw (decompressed) ReadRequest
+// lists STREAMED_XOR_CHUNKS among its accepted response types.
+func AcceptsStreamedChunks(reqBuf []byte) bool {
+	b := proto.NewBuffer(reqBuf)
+	for {
+		key, err := b.DecodeVarint()
+		if err != nil {
+			return false
+		}
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			v, err := b.DecodeVarint()
+			if err != nil {
+				return false
+			}
+			if field == readRequestAcceptedTypesField && v == responseTypeStreamedXORChunks {
+				return true
+			}
+		case 1:
+			if _, err := b.DecodeFixed64(); err != nil {
+				return false
+			}
+		case 2:
+			raw, err := b.DecodeRawBytes(false)
+			if err != nil {
+				return false
+			}
+			if field != readRequestAcceptedTypesField {
+				continue
+			}
+			packed := proto.NewBuffer(raw)
+			for {
+				v, err := packed.DecodeVarint()
+				if err != nil {
+					break
+				}
+				if v == responseTypeStreamedXORChunks {
+					return true
+				}
+			}
+		case 5:
+			if _, err := b.DecodeFixed32(); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// ChunkedWriter writes query results as ChunkedReadResponse frames, each
+// prefixed by its uvarint size and CRC32 (Castagnoli), flushing every frame.
+// It is safe for concurrent use, the frames of a query result aren't
+// interleaved with those of others.
+type ChunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	mtx     sync.Mutex
+	written bool
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	flusher, _ := w.(http.Flusher)
+	return &ChunkedWriter{w: w, flusher: flusher}
+}
+
+// WriteQueryResult writes one frame per series of res, sorted by labels as
+// the protocol requires. res is consumed: its series are sorted and released
+// one by one as their frames are written, so their samples can be freed
+// before the rest are encoded.
+func (cw *ChunkedWriter) WriteQueryResult(queryIndex int, res *prompb.QueryResult) error {
+	series := res.Timeseries
+	sort.Slice(series, func(i, j int) bool { return labelsLess(series[i].Labels, series[j].Labels) })
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	for i, ts := range series {
+		data, err := encodeChunkedSeries(ts)
+		if err != nil {
+			return err
+		}
+		series[i] = nil
+		frame := proto.NewBuffer(nil)
+		frame.EncodeVarint(1<<3 | 2)
+		frame.EncodeRawBytes(data)
+		frame.EncodeVarint(2<<3 | 0)
+		frame.EncodeVarint(uint64(queryIndex))
+		if err := cw.writeFrame(frame.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Written reports whether any frame was written, the response can't be
+// answered with an error anymore then.
+func (cw *ChunkedWriter) Written() bool {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	return cw.written
+}
+
+func labelsLess(a, b []prompb.Label) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return a[i].Name < b[i].Name
+		}
+		if a[i].Value != b[i].Value {
+			return a[i].Value < b[i].Value
+		}
+	}
+	return len(a) < len(b)
+}
+
+type queryResultsKey struct{}
+
+// ContextWithQueryResults hands the result of each query of reads with ctx
+// to fn as soon as the query is done, e.g. to stream it with a
+// ChunkedWriter, instead of keeping it until all are. The results of the
+// response are empty then. fn is called concurrently for different queries,
+// its error fails the read.
+func ContextWithQueryResults(ctx context.Context, fn func(queryIndex int, res *prompb.QueryResult) error) context.Context {
+	return context.WithValue(ctx, queryResultsKey{}, fn)
+}
+
+func queryResultsFunc(ctx context.Context) func(int, *prompb.QueryResult) error {
+	fn, _ := ctx.Value(queryResultsKey{}).(func(int, *prompb.QueryResult) error)
+	return fn
+}
+
+func (cw *ChunkedWriter) writeFrame(data []byte) error {
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, castagnoliTable))
+	cw.written = true
+	if _, err := cw.w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(data); err != nil {
+		return err
+	}
+	if cw.flusher != nil {
+		cw.flusher.Flush()
+	}
+	return nil
+}
+
+func encodeChunkedSeries(ts *prompb.TimeSeries) ([]byte, error) {
+	b := proto.NewBuffer(nil)
+	for _, l := range ts.Labels {
+		label := proto.NewBuffer(nil)
+		label.EncodeVarint(1<<3 | 2)
+		label.EncodeStringBytes(l.Name)
+		label.EncodeVarint(2<<3 | 2)
+		label.EncodeStringBytes(l.Value)
+		b.EncodeVarint(1<<3 | 2)
+		b.EncodeRawBytes(label.Bytes())
+	}
+	samples := ts.Samples
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	for len(samples) > 0 {
+		n := maxSamplesPerChunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		chunk, err := encodeXORChunk(samples[:n])
+		if err != nil {
+			return nil, err
+		}
+		b.EncodeVarint(2<<3 | 2)
+		b.EncodeRawBytes(chunk)
+		samples = samples[n:]
+	}
+	return b.Bytes(), nil
+}
+
+func encodeXORChunk(samples []prompb.Sample) ([]byte, error) {
+	c := chunkenc.NewXORChunk()
+	app, err := c.Appender()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range samples {
+		app.Append(s.Timestamp, s.Value)
+	}
+	b := proto.NewBuffer(nil)
+	b.EncodeVarint(1<<3 | 0)
+	b.EncodeVarint(uint64(samples[0].Timestamp))
+	b.EncodeVarint(2<<3 | 0)
+	b.EncodeVarint(uint64(samples[len(samples)-1].Timestamp))
+	b.EncodeVarint(3<<3 | 0)
+	b.EncodeVarint(chunkEncodingXOR)
+	b.EncodeVarint(4<<3 | 2)
+	b.EncodeRawBytes(c.Bytes())
+	return b.Bytes(), nil
+}
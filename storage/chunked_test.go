@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/kebe7jun/ropee/internal/wire"
+	"github.com/prometheus/prometheus/prompb"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkedFrames returns the query index of each frame of a streamed
+// response.
+func chunkedFrames(t *testing.T, data []byte) []int {
+	res := make([]int, 0)
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || len(data) < n+4+int(size) {
+			t.Fatalf("truncated frame")
+		}
+		crc := binary.BigEndian.Uint32(data[n:])
+		frame := data[n+4 : n+4+int(size)]
+		if crc32.Checksum(frame, castagnoliTable) != crc {
+			t.Fatalf("frame checksum mismatch")
+		}
+		index := 0
+		wire.EachField(frame, func(f wire.Field) error {
+			if f.Num == 2 {
+				index = int(f.Value)
+			}
+			return nil
+		})
+		res = append(res, index)
+		data = data[n+4+int(size):]
+	}
+	return res
+}
+
+func TestChunkedWriterSortsSeries(t *testing.T) {
+	var buf bytes.Buffer
+	cw := NewChunkedWriter(&buf)
+	series := func(job string) *prompb.TimeSeries {
+		return &prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+		}
+	}
+	res := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{series("b"), series("a")}}
+	if err := cw.WriteQueryResult(0, res); err != nil {
+		t.Fatal(err)
+	}
+	if frames := chunkedFrames(t, buf.Bytes()); len(frames) != 2 {
+		t.Fatalf("wrote %d frames, want 2", len(frames))
+	}
+	if a, b := bytes.Index(buf.Bytes(), []byte("a")), bytes.LastIndex(buf.Bytes(), []byte("b")); a > b {
+		t.Fatal("series aren't sorted by labels")
+	}
+	for _, ts := range res.Timeseries {
+		if ts != nil {
+			t.Fatal("a written series wasn't released")
+		}
+	}
+}
+
+func TestReadStreamsEachQueryWhenDone(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		streamed []int
+		// streamedBefore is how many queries were streamed when the search
+		// of each began
+		streamedBefore = make(map[string]int)
+	)
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		name := "first"
+		if strings.Contains(search, "second") {
+			name = "second"
+		}
+		mtx.Lock()
+		if _, ok := streamedBefore[name]; !ok {
+			streamedBefore[name] = len(streamed)
+		}
+		mtx.Unlock()
+		return metricRows(), [][]string{{rfc3339(1000), name, "1"}}
+	})
+	defer f.Close()
+	c := f.client()
+	var buf bytes.Buffer
+	cw := NewChunkedWriter(&buf)
+	ctx := ContextWithQueryResults(context.Background(), func(i int, res *prompb.QueryResult) error {
+		mtx.Lock()
+		streamed = append(streamed, i)
+		mtx.Unlock()
+		return cw.WriteQueryResult(i, res)
+	})
+	query := func(name string) *prompb.Query {
+		return &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 60000, Matchers: []*prompb.LabelMatcher{{Name: "__name__", Value: name}}}
+	}
+	resp, err := c.Read(ctx, &prompb.ReadRequest{Queries: []*prompb.Query{query("first"), query("second")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// queries run one at a time, the one searched last has to see the
+	// other streamed already
+	if streamedBefore["first"]+streamedBefore["second"] != 1 {
+		t.Fatalf("queries streamed before each search began %v, want one streamed before the other", streamedBefore)
+	}
+	if frames := chunkedFrames(t, buf.Bytes()); len(frames) != 2 || frames[0] == frames[1] {
+		t.Fatalf("frames of queries %v, want one of each", frames)
+	}
+	for i, res := range resp.Results {
+		if len(res.Timeseries) != 0 {
+			t.Fatalf("result %d of the response has the streamed series", i)
+		}
+	}
+}
+
+func TestReadStreamsExportSeries(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		return metricRows("job"), [][]string{
+			{rfc3339(1000), "up", "1", "b"},
+			{rfc3339(1000), "up", "1", "a"},
+			{rfc3339(2000), "up", "0", "b"},
+			{rfc3339(2000), "up", "1", "a"},
+		}
+	})
+	defer f.Close()
+	f.dimensions = []string{"job"}
+	c := f.client(WithSearchMode(SearchModeExport))
+	var buf bytes.Buffer
+	cw := NewChunkedWriter(&buf)
+	series := 0
+	ctx := ContextWithQueryResults(context.Background(), func(i int, res *prompb.QueryResult) error {
+		series += len(res.Timeseries)
+		return cw.WriteQueryResult(i, res)
+	})
+	resp, err := c.Read(ctx, &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(f.lastSearch(), "mstats") {
+		t.Fatalf("export search %q", f.lastSearch())
+	}
+	if series != 2 {
+		t.Fatalf("streamed %d series, want 2", series)
+	}
+	if frames := chunkedFrames(t, buf.Bytes()); len(frames) != 2 {
+		t.Fatalf("wrote %d frames, want 2", len(frames))
+	}
+	if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 0 {
+		t.Fatal("the response has the streamed series")
+	}
+}
@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -9,19 +8,23 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/kebe7jun/ropee/metrics"
+	"github.com/kebe7jun/ropee/transform"
 	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/sync/errgroup"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type RemoteClient interface {
-	Read(*prompb.ReadRequest) (*prompb.ReadResponse, error)
+	Read(context.Context, *prompb.ReadRequest) (*prompb.ReadResponse, error)
 	Write(*prompb.WriteRequest) error
 	MetricLabels(string) []string
 	LabelValues(string) []string
@@ -31,23 +34,155 @@ type Client struct {
 	url              string
 	user             string
 	password         string
+	token            string
 	client           *http.Client
+	hecClient        *http.Client
 	timeout          time.Duration
 	index            string
 	hecUrl, hecToken string
 	sourcetype       string
 	log              log.Logger
+	seriesLimiter    *SeriesLimiter
+	cardinality      *CardinalityTracker
+	maxLabels        int
+	maxResultRows    int
+	deduplicator     *Deduplicator
+	searchMode       string
+	outputMode       *outputMode
+	readLimits       ReadLimits
+	timePartitions   *TimePartitionRules
+	searchLimiter    *SearchLimiter
+	readWindow       ReadWindow
+	readDedupPolicy  string
+	metricNames      MetricNames
+	savedSearches    *SavedSearches
+	labelLimit       int
+	labelCache       *labelCache
+	jobPolling       JobPolling
+	sidCache         *sidCache
+
+	destinations           []*HECDestination
+	sourcetypeDestinations map[string]*HECDestination
+	hecStandby             *HECDestination
+	newRequestID           func() string
+	strictRead             bool
+	requiredMatchers       RequiredMatchers
+	ignoredLabels          IgnoredLabels
+	metricAliases          *MetricAliases
+	oneshotThreshold       time.Duration
+	searchPrefix           string
+	lookups                *Lookups
+	fieldPrefix            FieldPrefix
+	hecBatchSize           int
+	mergeSummaryQuantiles  bool
+	flattenK8sLabels       bool
+	dispatchOptions        DispatchOptions
+	apiLimiter             *APIRateLimiter
+	hecActive              int32
+	requireAllDestinations bool
+	dryRun                 bool
+	hecChannel             string
+	queryConcurrency       int
+	downsampling           Downsampling
+	nativeHistogramRead    bool
+}
+
+// Option configures optional behaviour of a Client.
+type Option func(*Client)
+
+// WithQueryConcurrency sets how many queries of one read run at once.
+func WithQueryConcurrency(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.queryConcurrency = n
+		}
+	}
+}
+
+// WithDownsampling sets how samples of read queries are aggregated.
+func WithDownsampling(ds Downsampling) Option {
+	return func(c *Client) {
+		c.downsampling = ds
+	}
+}
+
+// WithSeriesLimiter drops samples of new series once the limiter is exhausted.
+func WithSeriesLimiter(l *SeriesLimiter) Option {
+	return func(c *Client) {
+		c.seriesLimiter = l
+	}
+}
+
+// WithMaxLabels trims series to at most n labels, __name__ included.
+func WithMaxLabels(n int) Option {
+	return func(c *Client) {
+		c.maxLabels = n
+	}
+}
+
+// WithMaxResultRows fails searches returning more than n rows instead of
+// answering with partial data. 0 means no limit.
+func WithMaxResultRows(n int) Option {
+	return func(c *Client) {
+		c.maxResultRows = n
+	}
+}
+
+// WithSearchMode selects how searches are run, SearchModeJob or
+// SearchModeExport.
+func WithSearchMode(mode string) Option {
+	return func(c *Client) {
+		c.searchMode = mode
+	}
+}
+
+// WithSummaryQuantileMerging writes the quantile series of each summary as
+// one event per timestamp with a field per percentile, see
+// SummaryQuantilesToEvent, instead of an event per quantile series.
+func WithSummaryQuantileMerging() Option {
+	return func(c *Client) {
+		c.mergeSummaryQuantiles = true
+	}
+}
+
+// WithKubernetesLabelFlattening writes series with their hierarchical
+// Kubernetes label names flattened, see transform.FlattenKubernetesLabels.
+// Other backends of a fanout get the labels as sent.
+func WithKubernetesLabelFlattening() Option {
+	return func(c *Client) {
+		c.flattenK8sLabels = true
+	}
+}
+
+// WithDeduplicator drops samples d has seen written before.
+func WithDeduplicator(d *Deduplicator) Option {
+	return func(c *Client) {
+		c.deduplicator = d
+	}
+}
+
+// WithCardinalityTracker records every written series in t.
+func WithCardinalityTracker(t *CardinalityTracker) Option {
+	return func(c *Client) {
+		c.cardinality = t
+	}
+}
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
+		MaxIdleConnsPerHost: 16,                                    // the client is shared by all requests
+	}
 }
 
 func NewClient(
 	url, user, password,
 	index, sourcetype string,
 	hecUrl, hecToken string,
-	timeout time.Duration, log log.Logger) (RemoteClient, error) {
-	transCfg := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
-	}
-	return &Client{
+	timeout time.Duration, log log.Logger, opts ...Option) (RemoteClient, error) {
+	transCfg := newTransport()
+	c := &Client{
 		url:        url,
 		user:       user,
 		password:   password,
@@ -58,155 +193,552 @@ func NewClient(
 		hecToken:   hecToken,
 		sourcetype: sourcetype,
 		log:        log,
-	}, nil
+	}
+	c.hecClient = c.client
+	c.destinations = []*HECDestination{NewHECDestination(hecUrl, hecToken, 0, 0, 0)}
+	c.requireAllDestinations = true
+	c.hecChannel = processHECChannel
+	c.newRequestID = NewUUID
+	c.queryConcurrency = 1
+	c.searchMode = SearchModeJob
+	c.jobPolling = JobPolling{Interval: 100 * time.Millisecond, Backoff: 2, MaxInterval: 2 * time.Second}
+	c.downsampling = Downsampling{Enabled: true, Aggregation: "latest"}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 type jobResultPreview struct {
-	Fields []string   `json:"fields"`
-	Rows   [][]string `json:"rows"`
+	Fields []string    `json:"fields"`
+	Rows   []resultRow `json:"rows"`
 }
 
 func (c *Client) Write(req *prompb.WriteRequest) error {
+	return c.WriteContext(context.Background(), req)
+}
+
+// WriteContext writes req, its HEC posts carry the request ID of ctx or a
+// new one.
+func (c *Client) WriteContext(ctx context.Context, req *prompb.WriteRequest) error {
+	id := requestID(ctx)
+	if id == "" {
+		id = c.newRequestID()
+	}
 	events := make([]SplunkMetricEvent, 0)
-	for _, series := range req.Timeseries {
+	dropped, trimmed, duplicates := 0, 0, 0
+	written := make([]prompb.TimeSeries, 0)
+	// kept are the series left to write when summary quantiles are merged
+	kept := make([]prompb.TimeSeries, 0)
+	for _, series := range c.metricAliases.expand(req.Timeseries) {
+		if c.flattenK8sLabels {
+			series = *transform.FlattenKubernetesLabels(&series)
+		}
+		series.Labels = c.lookups.enrich(series.Labels)
+		if c.maxLabels > 0 && len(series.Labels) > c.maxLabels {
+			series.Labels = trimLabels(series.Labels, c.maxLabels)
+			trimmed++
+		}
+		if c.seriesLimiter != nil && !c.seriesLimiter.Allow(series.Labels) {
+			dropped += len(series.Samples)
+			continue
+		}
+		if c.deduplicator != nil {
+			samples := c.deduplicator.Filter(series)
+			duplicates += len(series.Samples) - len(samples)
+			if len(samples) == 0 {
+				continue
+			}
+			series.Samples = samples
+			written = append(written, series)
+		}
+		if c.cardinality != nil {
+			c.cardinality.Observe(series.Labels)
+		}
+		countLabelSetSamples(series)
+		if c.mergeSummaryQuantiles {
+			kept = append(kept, series)
+			continue
+		}
+		series.Labels = c.fieldPrefix.labels(series.Labels)
 		es := TimeSeriesToPromMetrics(series)
 		events = append(events, es...)
-		// todo slice events
 	}
-	err := c.splunkHECEvents(events)
+	if c.mergeSummaryQuantiles {
+		rest, quantiles := transform.MergeSummaryQuantiles(kept)
+		for _, series := range rest {
+			series.Labels = c.fieldPrefix.labels(series.Labels)
+			events = append(events, TimeSeriesToPromMetrics(series)...)
+		}
+		for _, q := range quantiles {
+			q.Labels = c.fieldPrefix.labels(q.Labels)
+			events = append(events, SummaryQuantilesToEvent(q))
+		}
+	}
+	if trimmed > 0 {
+		metrics.TrimmedLabelCountTotal.Add(float64(trimmed))
+		level.Warn(c.log).Log("msg", "series have too many labels, trimming them", "trimmed_series", trimmed, "max_labels", c.maxLabels)
+	}
+	if duplicates > 0 {
+		metrics.DedupDroppedSamples.Add(float64(duplicates))
+	}
+	if dropped > 0 {
+		metrics.SeriesLimitDroppedSamples.Add(float64(dropped))
+		level.Warn(c.log).Log("msg", "series limit exceeded, dropping samples of new series", "dropped_samples", dropped)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	oldest, newest := events[0].Time, events[0].Time
+	for _, e := range events {
+		if e.Time < oldest {
+			oldest = e.Time
+		}
+		if e.Time > newest {
+			newest = e.Time
+		}
+	}
+	done := metrics.TrackQueued(oldest)
+	defer done()
+	level.Debug(c.log).Log("request_id", id, "msg", "hec write", "events", len(events))
+	err := c.splunkHECEvents(id, events)
 	if err != nil {
 		metrics.SplunkEventsWroteFailed.Add(float64(len(events)))
 		return err
 	}
 	metrics.SplunkEventsWrote.Add(float64(len(events)))
+	metrics.ObserveWrittenSample(newest)
+	for _, series := range written {
+		c.deduplicator.Remember(series)
+	}
 	return nil
 }
 
-func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
-	queryResults := make([]*prompb.QueryResult, 0)
-	for _, q := range req.Queries {
-		search, err := MakeSPL(q, c, c.index)
-		if err != nil {
-			level.Error(c.log).Log("msg", err)
-			return nil, err
+func countLabelSetSamples(series prompb.TimeSeries) {
+	var metricName, instance string
+	for _, l := range series.Labels {
+		switch l.Name {
+		case "__name__":
+			metricName = l.Value
+		case "instance":
+			instance = l.Value
 		}
-		level.Debug(c.log).Log("rendered_search", search, "earliest", q.StartTimestampMs, "latest", q.EndTimestampMs)
-		timeStarted := time.Now()
-		res, err := c.runSearchWithResult(search, q.StartTimestampMs, q.EndTimestampMs)
-		if err != nil {
-			level.Error(c.log).Log("msg", err)
-			return nil, err
+	}
+	metrics.CountLabelSetSamples(metricName, instance, len(series.Samples))
+}
+
+// trimLabels keeps __name__ and the alphabetically first of the other labels,
+// max labels in total. __name__ is kept even when it alone exceeds max.
+func trimLabels(labels []prompb.Label, max int) []prompb.Label {
+	ls := make([]prompb.Label, 0, len(labels))
+	res := make([]prompb.Label, 0, max)
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			res = append(res, l)
+			continue
 		}
-		metrics.SplunkJobLatency.Observe(float64(time.Now().Sub(timeStarted) / time.Second))
-		var resPreview jobResultPreview
-		json.Unmarshal(res, &resPreview)
-		if len(resPreview.Fields) == 0 {
-			break
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	keep := max - len(res)
+	if keep < 0 {
+		keep = 0
+	}
+	if keep > len(ls) {
+		keep = len(ls)
+	}
+	return append(res, ls[:keep]...)
+}
+
+func (c *Client) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	return c.withCredentials(ctx).read(ctx, req)
+}
+
+func (c *Client) read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	// Prometheus matches results to queries by position, so every query
+	// gets its slot and any failure fails the whole request.
+	queryResults := make([]*prompb.QueryResult, len(req.Queries))
+	for i, q := range req.Queries {
+		if err := c.requiredMatchers.check(ctx, q); err != nil {
+			return nil, &LimitError{msg: fmt.Sprintf("query %d of %d: %s", i+1, len(req.Queries), err)}
 		}
-		keysMap := make(map[string]*prompb.TimeSeries)
-
-		for _, values := range resPreview.Rows {
-			var labelValueList []string
-			key := ""
-			l := make([]prompb.Label, 0)
-			var t time.Time
-			var value float64
-			for i, v := range values {
-				k := resPreview.Fields[i]
-				if k == CommonMetricName {
-					k = "__name__"
+	}
+	sem := make(chan struct{}, c.queryConcurrency)
+	budget := c.newReadBudget(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+	for i, q := range req.Queries {
+		i, q := i, q
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res, err := c.runQuery(withTracedQuery(ctx, q), q, budget)
+			if hq := histogramQuery(q); err == nil && c.nativeHistogramRead && len(res.Timeseries) == 0 && hq != nil {
+				res, err = c.runQuery(withTracedQuery(ctx, hq), hq, budget)
+			}
+			if err != nil {
+				level.Error(c.log).Log("msg", err, "query", i)
+				if _, ok := err.(*QueryError); ok {
+					return queryErrorf("query %d of %d: %s", i+1, len(req.Queries), err)
 				}
-				if k == "_time" {
-					t, _ = time.Parse(time.RFC3339, v)
-					continue
+				switch err.(type) {
+				case *LimitError, *ThrottleError:
+					return err
 				}
-				if k == CommonMetricValue {
-					value, _ = strconv.ParseFloat(v, 64)
-					continue
+				if isTimeout(err) {
+					return &TimeoutError{msg: fmt.Sprintf("query %d of %d: %s", i+1, len(req.Queries), err)}
 				}
-				l = append(l, prompb.Label{
-					Name:  k,
-					Value: v,
-				})
-				labelValueList = append(labelValueList, v)
+				return fmt.Errorf("query %d of %d: %s", i+1, len(req.Queries), err)
 			}
-			key = strings.Join(labelValueList, ",")
-			if _, ok := keysMap[key]; !ok {
-				tv := make([]prompb.Sample, 0)
-				tv = append(tv, prompb.Sample{Timestamp: t.Unix() * 1000, Value: value})
-				keysMap[key] = &prompb.TimeSeries{
-					Labels:  l,
-					Samples: tv,
+			if fn := queryResultsFunc(ctx); fn != nil {
+				if err := fn(i, res); err != nil {
+					return err
 				}
-			} else {
-				s := keysMap[key]
-				s.Samples = append(keysMap[key].Samples, prompb.Sample{Timestamp: t.Unix() * 1000, Value: value})
-				keysMap[key] = s
+				res = &prompb.QueryResult{}
 			}
-		}
-		timeSeries := make([]*prompb.TimeSeries, 0)
-		for _, value := range keysMap {
-			timeSeries = append(timeSeries, value)
-		}
-		queryResults = append(queryResults, &prompb.QueryResult{
-			Timeseries: timeSeries,
+			queryResults[i] = res
+			return nil
 		})
 	}
+	if err := g.Wait(); err != nil {
+		if _, ok := err.(*LimitError); ok {
+			metrics.ReadLimitExceeded.Inc()
+		}
+		return nil, err
+	}
 	return &prompb.ReadResponse{
 		Results: queryResults,
 	}, nil
 }
 
-func urlJoin(baseUrl, reqPath string) (string, error) {
-	u, err := url.Parse(baseUrl)
-	if err != nil {
-		return "", err
+func (c *Client) runQuery(ctx context.Context, q *prompb.Query, budget *readBudget) (*prompb.QueryResult, error) {
+	ds := c.downsampling
+	ds.rangeMs = hintRange(ctx, q)
+	q, attach := c.ignoredLabels.strip(q)
+	q, alias := c.metricAliases.translate(q)
+	if rawSamples(ctx) {
+		ds.Enabled = false
 	}
-	u.Path = path.Join(u.Path, reqPath)
-	return u.String(), nil
+	savedSearch, metricName := c.savedSearches.find(q)
+	search := ""
+	if savedSearch == "" {
+		var err error
+		search, err = MakeSPL(q, c, c.searchBase(), ds, c.metricNames, c.fieldPrefix)
+		if err != nil {
+			return nil, err
+		}
+		level.Debug(c.log).Log("request_id", requestID(ctx), "rendered_search", search, "earliest", q.StartTimestampMs, "latest", q.EndTimestampMs)
+		traceSearch(ctx, search)
+	} else {
+		level.Debug(c.log).Log("request_id", requestID(ctx), "saved_search", savedSearch, "earliest", q.StartTimestampMs, "latest", q.EndTimestampMs)
+		traceSearch(ctx, "| savedsearch "+savedSearch)
+	}
+	if c.searchLimiter != nil {
+		release, err := c.searchLimiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	start, end, searchStart, searchEnd := c.readWindow.bounds(q.StartTimestampMs, q.EndTimestampMs, time.Now())
+	b := newSeriesBuilder(budget, start, end, c.readDedupPolicy, c.metricNames)
+	b.ignored, b.attach = c.ignoredLabels, attach
+	b.fields = c.fieldPrefix
+	if _, ok := ds.pushDown(q); ok && savedSearch == "" {
+		metrics.ReadPushedDownQueries.Inc()
+		b.stampOffset = ds.span(q)*1000 - 1
+	}
+	if end < start {
+		return b.result(), nil
+	}
+	chunks := c.readWindow.chunks(searchStart, searchEnd, ds.span(q)*1000)
+	if len(chunks) > 1 {
+		level.Debug(c.log).Log("request_id", requestID(ctx), "msg", "searching in chunks", "chunks", len(chunks))
+	}
+	timeStarted := time.Now()
+	// every chunk has to succeed, a query never answers with part of its
+	// range
+	for i, chunk := range chunks {
+		if err := c.searchRange(ctx, search, savedSearch, metricName, chunk[0], chunk[1], b); err != nil {
+			if len(chunks) > 1 {
+				level.Debug(c.log).Log("request_id", requestID(ctx), "msg", "chunk failed", "chunk", i+1, "chunks", len(chunks), "err", err)
+			}
+			return nil, err
+		}
+	}
+	metrics.SplunkJobLatency.Observe(float64(time.Now().Sub(timeStarted) / time.Second))
+	converted := time.Now()
+	res := b.result()
+	metrics.ReadPhaseSeconds.WithLabelValues("convert").Observe((b.converting + time.Since(converted)).Seconds())
+	if len(b.skipped) > 0 {
+		kvs := []interface{}{"request_id", requestID(ctx), "msg", "skipped result rows", "rows", b.rows, "example", b.skippedExample}
+		for reason, n := range b.skipped {
+			kvs = append(kvs, reason, n)
+		}
+		level.Debug(c.log).Log(kvs...)
+		if c.strictRead && b.allSkipped() {
+			return nil, fmt.Errorf("all %d result rows were skipped as not metric data, e.g. %q", b.rows, b.skippedExample)
+		}
+	}
+	if savedSearch != "" {
+		if err := matchSeries(res, q); err != nil {
+			return nil, err
+		}
+	}
+	if alias != "" {
+		for _, ts := range res.Timeseries {
+			setMetricName(ts.Labels, alias)
+		}
+	}
+	return res, nil
 }
 
-func (c *Client) splunkHECEvents(events []SplunkMetricEvent) error {
-	var buffer bytes.Buffer
-	var reqUrl string
-	if _url, err := urlJoin(c.hecUrl, "/services/collector"); err == nil {
-		reqUrl = _url
+// searchRange runs the search or saved search over [start, end] and adds the
+// rows found to b.
+func (c *Client) searchRange(ctx context.Context, search, savedSearch, metricName string, start, end int64, b *seriesBuilder) error {
+	if savedSearch == "" && c.searchMode == SearchModeExport {
+		return c.runExportSearch(ctx, search, start, end, b)
+	}
+	var resPreview *jobResultPreview
+	var err error
+	if savedSearch != "" {
+		resPreview, err = c.runSavedSearch(ctx, savedSearch, metricName, start, end)
 	} else {
+		resPreview, err = c.runSearchWithResult(ctx, search, start, end)
+	}
+	if err != nil {
 		return err
 	}
-	for _, event := range events {
-		e, _ := json.Marshal(map[string]string{
-			"index":      c.index,
-			"sourcetype": c.sourcetype,
-			"time":       strconv.FormatFloat(float64(event.Time)/1000.0, 'f', -1, 64),
-			"event":      event.MetricStr,
-			"source":     "ropee-client/1.0",
+	// the job is done and its results fetched, it is left to the sid cache
+	// even if they exceed the read budget
+	started := time.Now()
+	for _, values := range resPreview.Rows {
+		if err := b.add(resPreview.Fields, values); err != nil {
+			return err
+		}
+	}
+	b.converting += time.Since(started)
+	return nil
+}
+
+// seriesBuilder groups search result rows into series, failing once they
+// exceed the budget of the read. Rows are stamped with the start of their
+// span, or stampOffset milliseconds later, rows stamped outside [start, end]
+// are dropped, so a span starting before start belongs to the read of the
+// window before only.
+type seriesBuilder struct {
+	series      map[string]*prompb.TimeSeries
+	budget      *readBudget
+	start, end  int64
+	stampOffset int64
+	dedupPolicy string
+	deduped     int
+	names       MetricNames
+	// ignored labels are left out of the series, attach set on each of them,
+	// rows differing only in ignored labels make up one series.
+	ignored IgnoredLabels
+	attach  []prompb.Label
+	// fields are stripped of the field prefix, those lacking it skipped.
+	fields FieldPrefix
+	// rows counts the rows added, skipped those left out per reason, of
+	// which skippedExample is the last value or row.
+	rows           int
+	skipped        map[string]int
+	skippedExample string
+	// converting is the time spent adding rows of search results.
+	converting time.Duration
+}
+
+func newSeriesBuilder(budget *readBudget, start, end int64, dedupPolicy string, names MetricNames) *seriesBuilder {
+	return &seriesBuilder{
+		series:      make(map[string]*prompb.TimeSeries),
+		budget:      budget,
+		start:       start,
+		end:         end,
+		dedupPolicy: dedupPolicy,
+		names:       names,
+		skipped:     make(map[string]int),
+	}
+}
+
+func (b *seriesBuilder) add(fields, values []string) error {
+	b.rows++
+	if len(values) != len(fields) {
+		b.skip(skipMalformedRow, strings.Join(values, ","))
+		return nil
+	}
+	l := make([]prompb.Label, 0)
+	var t time.Time
+	var value float64
+	hasValue, hasName := false, false
+	for i, v := range values {
+		k := fields[i]
+		if k == CommonMetricName {
+			k = "__name__"
+			v, _ = b.names.prometheus(v)
+			hasName = v != ""
+		}
+		if k == "_time" {
+			t, _ = time.Parse(time.RFC3339, v)
+			continue
+		}
+		if k == CommonMetricValue {
+			var reason string
+			if value, reason = parseSampleValue(v); reason != "" {
+				b.skip(reason, v)
+				return nil
+			}
+			hasValue = true
+			continue
+		}
+		if k != "__name__" {
+			name, ok := b.fields.prometheus(k)
+			if !ok {
+				continue
+			}
+			k = name
+		}
+		// an empty value is a missing label, e.g. a dimension of only
+		// some of the indexes searched
+		if b.ignored.Contains(k) || v == "" {
+			continue
+		}
+		l = append(l, prompb.Label{
+			Name:  k,
+			Value: v,
 		})
-		buffer.Write(e)
 	}
-	httpReq, err := http.NewRequest("POST", reqUrl, strings.NewReader(buffer.String()))
-	if err != nil {
-		level.Error(c.log).Log("type", "hec-events", "err", err)
+	// a single bad row doesn't fail the query
+	if !hasValue {
+		b.skip(skipMissingValue, strings.Join(values, ","))
+		return nil
 	}
-	httpReq.Header.Set("User-Agent", "ropee client/1.0")
-	httpReq.SetBasicAuth("x", c.hecToken)
+	if !hasName {
+		b.skip(skipMissingMetricName, strings.Join(values, ","))
+		return nil
+	}
+	l = append(l, b.attach...)
+	// rows of several indexes or sourcetypes, chunks and searches make up
+	// one series if their label sets are the same
+	key := labelsKey(l)
+	ts := t.UnixNano()/int64(time.Millisecond) + b.stampOffset
+	if ts < b.start || ts > b.end {
+		return nil
+	}
+	if _, ok := b.series[key]; !ok {
+		if err := b.budget.addSample(); err != nil {
+			return err
+		}
+		if err := b.budget.addSeries(); err != nil {
+			return err
+		}
+		tv := make([]prompb.Sample, 0)
+		tv = append(tv, prompb.Sample{Timestamp: ts, Value: value})
+		b.series[key] = &prompb.TimeSeries{
+			Labels:  l,
+			Samples: tv,
+		}
+	} else {
+		s := b.series[key]
+		samples, added := appendSample(s.Samples, prompb.Sample{Timestamp: ts, Value: value}, b.dedupPolicy)
+		if !added {
+			b.deduped++
+			return nil
+		}
+		if err := b.budget.addSample(); err != nil {
+			return err
+		}
+		s.Samples = samples
+	}
+	return nil
+}
+
+// result returns the series with samples in increasing timestamp order as
+// remote read requires. Splunk may return rows in any order, e.g. descending
+// _time, sorting them here is cheaper than a sort stage on the search head
+// which has to hold all rows before sending the first.
+func (b *seriesBuilder) result() *prompb.QueryResult {
+	timeSeries := make([]*prompb.TimeSeries, 0)
+	for _, value := range b.series {
+		b.sortSamples(value)
+		timeSeries = append(timeSeries, value)
+	}
+	if b.deduped > 0 {
+		metrics.ReadDedupedSamples.Add(float64(b.deduped))
+	}
+	for reason, n := range b.skipped {
+		metrics.ReadSkippedEvents.WithLabelValues(reason).Add(float64(n))
+	}
+	return &prompb.QueryResult{
+		Timeseries: timeSeries,
+	}
+}
 
-	ctx := context.Background()
+func (b *seriesBuilder) skip(reason, example string) {
+	b.skipped[reason]++
+	b.skippedExample = example
+}
 
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
+// allSkipped reports whether there were rows and all of them were skipped.
+func (b *seriesBuilder) allSkipped() bool {
+	n := 0
+	for _, c := range b.skipped {
+		n += c
+	}
+	return b.rows > 0 && n == b.rows
+}
+
+// sortSamples sorts the samples of series by timestamp, keeping the order
+// they were returned in for equal timestamps, and deduplicates the ones that
+// only became adjacent by sorting.
+func (b *seriesBuilder) sortSamples(series *prompb.TimeSeries) {
+	samples := series.Samples
+	if sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+		return
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	res := samples[:0]
+	for _, s := range samples {
+		var added bool
+		if res, added = appendSample(res, s, b.dedupPolicy); !added {
+			b.deduped++
+		}
+	}
+	series.Samples = res
+}
+
+// splunkTime formats a millisecond timestamp as fractional epoch seconds
+// for earliest_time and latest_time. Splunk's latest_time is exclusive, pass
+// end+1 to include samples at end as Prometheus does.
+func splunkTime(ms int64) string {
+	return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+}
 
-	httpResp, err := c.client.Do(httpReq.WithContext(ctx))
+func urlJoin(baseUrl, reqPath string) (string, error) {
+	u, err := url.Parse(baseUrl)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if httpResp.StatusCode >= 400 {
-		level.Warn(c.log).Log("type", "hec-events-resp", "status", httpResp.StatusCode)
+	u.Path = path.Join(u.Path, reqPath)
+	return u.String(), nil
+}
+
+func (c *Client) splunkRESTRequest(ctx context.Context, method, reqPath string, params, body map[string]string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	httpResp, err := c.splunkRESTResponse(ctx, method, reqPath, params, body)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer httpResp.Body.Close()
+	return ioutil.ReadAll(httpResp.Body)
 }
 
-func (c *Client) splunkRESTRequest(method, reqPath string, params, body map[string]string) ([]byte, error) {
+// splunkRESTResponse sends a request to the Splunk REST api and returns the
+// response, whose body the caller has to read and close before ctx is done.
+func (c *Client) splunkRESTResponse(ctx context.Context, method, reqPath string, params, body map[string]string) (*http.Response, error) {
+	if err := c.apiLimiter.wait(ctx); err != nil {
+		return nil, err
+	}
 	var b io.Reader = nil
 	if body != nil {
 		p := url.Values{}
@@ -222,29 +754,33 @@ func (c *Client) splunkRESTRequest(method, reqPath string, params, body map[stri
 		return nil, err
 	}
 	httpReq, err := http.NewRequest(method, reqUrl, b)
-	httpReq.SetBasicAuth(c.user, c.password)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		httpReq.SetBasicAuth(c.user, c.password)
+	}
 	q := httpReq.URL.Query()
 	if _, ok := params["output_mode"]; !ok {
 		q.Add("output_mode", "json")
 	}
-	q.Add("count", "50000")
+	if _, ok := params["count"]; !ok {
+		q.Add("count", "50000")
+	}
 	for k, v := range params {
 		q.Add(k, v)
 	}
 	httpReq.URL.RawQuery = q.Encode()
 	httpReq.Header.Set("User-Agent", "ropee client/1.0")
 
-	ctx := context.Background()
-
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
-
-	httpResp, err := c.client.Do(httpReq.WithContext(ctx))
-	if err != nil {
-		return nil, err
-	}
-	defer httpResp.Body.Close()
-	return ioutil.ReadAll(httpResp.Body)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.SplunkRESTConnections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	})
+	return c.client.Do(httpReq.WithContext(ctx))
 }
 
 type Metric struct {
@@ -259,93 +795,409 @@ type LabelValue struct {
 	Name string `json:"name"`
 }
 
-func (c *Client) GetMetrics() []string {
-	var params = map[string]string{
-		"filter": "index=" + c.index,
+// indexes returns the indexes of the comma separated -splunk-metrics-index,
+// each may contain wildcards.
+func (c *Client) indexes() []string {
+	res := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, index := range strings.Split(c.index, ",") {
+		if index = strings.TrimSpace(index); index != "" && !seen[index] {
+			seen[index] = true
+			res = append(res, index)
+		}
 	}
-
-	res, _ := c.splunkRESTRequest("GET", "/services/catalog/metricstore/metrics", params, nil)
-	var result map[string][]Metric
-	json.Unmarshal(res, &result)
-	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		ls = append(ls, result["entry"][l].Name)
+	// samples written by time partition rules are in their indexes
+	if c.timePartitions != nil {
+		for _, index := range c.timePartitions.Indexes() {
+			if !seen[index] {
+				seen[index] = true
+				res = append(res, index)
+			}
+		}
 	}
-	return ls
+	return res
 }
 
-func (c *Client) MetricLabels(metricName string) []string {
-	var params = map[string]string{
-		"filter":      "index=" + c.index,
-		"metric_name": metricName,
+// writeIndex is the index events are written to, the first one configured.
+func (c *Client) writeIndex() string {
+	if indexes := c.indexes(); len(indexes) > 0 {
+		return indexes[0]
 	}
+	return c.index
+}
 
-	res, _ := c.splunkRESTRequest("GET", "/services/catalog/metricstore/dimensions", params, nil)
-	var result map[string][]MetricLabel
-	json.Unmarshal(res, &result)
+// catalog runs fn for every index and returns the distinct names it found.
+// The catalog calls take a slot of the search limiter, none are made if there
+// is no free one.
+func (c *Client) catalog(fn func(index string) []string) []string {
+	seen := make(map[string]struct{})
 	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		if result["entry"][l].Name == "source" || result["entry"][l].Name == "sourcetype" {
-			continue
+	if c.searchLimiter != nil {
+		release, err := c.searchLimiter.acquire(context.Background())
+		if err != nil {
+			level.Warn(c.log).Log("msg", "catalog lookup skipped", "err", err)
+			return ls
+		}
+		defer release()
+	}
+	for _, index := range c.indexes() {
+		for _, name := range fn(index) {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				ls = append(ls, name)
+			}
 		}
-		ls = append(ls, result["entry"][l].Name)
 	}
 	return ls
 }
 
+func (c *Client) GetMetrics() []string {
+	return c.catalog(func(index string) []string {
+		var params = map[string]string{
+			"filter": "index=" + index,
+		}
+
+		res, _ := c.splunkRESTRequest(context.Background(), "GET", "/services/catalog/metricstore/metrics", params, nil)
+		var result map[string][]Metric
+		json.Unmarshal(res, &result)
+		ls := make([]string, 0)
+		for l := 0; l < len(result["entry"]); l++ {
+			if name, ok := c.metricNames.prometheus(result["entry"][l].Name); ok {
+				ls = append(ls, name)
+			}
+		}
+		return ls
+	})
+}
+
+func (c *Client) MetricLabels(metricName string) []string {
+	return c.catalog(func(index string) []string {
+		var params = map[string]string{
+			"filter":      "index=" + index,
+			"metric_name": metricName,
+		}
+
+		res, _ := c.splunkRESTRequest(context.Background(), "GET", "/services/catalog/metricstore/dimensions", params, nil)
+		var result map[string][]MetricLabel
+		json.Unmarshal(res, &result)
+		ls := make([]string, 0)
+		for l := 0; l < len(result["entry"]); l++ {
+			if result["entry"][l].Name == "source" || result["entry"][l].Name == "sourcetype" {
+				continue
+			}
+			ls = append(ls, result["entry"][l].Name)
+		}
+		return ls
+	})
+}
+
 func (c *Client) LabelValues(labelName string) []string {
 	if labelName == "__name__" {
 		return c.GetMetrics()
 	}
-	var params = map[string]string{
-		"filter":      "index=" + c.index,
-		"metric_name": "*",
+	return c.catalog(func(index string) []string {
+		var params = map[string]string{
+			"filter":      "index=" + index,
+			"metric_name": "*",
+		}
+
+		res, _ := c.splunkRESTRequest(context.Background(), "GET",
+			"/services/catalog/metricstore/dimensions/"+c.fieldPrefix.splunk(labelName)+"/values", params, nil)
+		var result map[string][]LabelValue
+		json.Unmarshal(res, &result)
+		ls := make([]string, 0)
+		for l := 0; l < len(result["entry"]); l++ {
+			ls = append(ls, result["entry"][l].Name)
+		}
+		return ls
+	})
+}
+
+// resultsPageSize is the number of rows fetched per results call, Splunk
+// caps it at maxresultrows which defaults to 50000.
+const resultsPageSize = 50000
+
+// cancelJob cancels the search job sid of an aborted read, so it doesn't keep
+// running on the search head. The read's context may be done already, the
+// request gets a short timeout of its own.
+func (c *Client) cancelJob(sid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := c.splunkRESTRequest(ctx, "POST", "/services/search/jobs/"+sid+"/control", nil, map[string]string{"action": "cancel"})
+	if err != nil {
+		level.Warn(c.log).Log("msg", "cancel search job error", "sid", sid, "err", err)
+		return
+	}
+	metrics.SplunkJobsCancelled.Inc()
+	level.Info(c.log).Log("msg", "cancelled search job", "sid", sid)
+}
+
+// JobPolling controls how often search jobs are polled until done. Polling
+// starts at Interval, each poll waits Backoff times longer than the one
+// before up to MaxInterval.
+type JobPolling struct {
+	Interval    time.Duration
+	Backoff     float64
+	MaxInterval time.Duration
+}
+
+// WithJobPolling sets how search jobs are polled.
+func WithJobPolling(p JobPolling) Option {
+	return func(c *Client) {
+		c.jobPolling = p
+	}
+}
+
+// minPollWait is the least time between two polls of a search job.
+const minPollWait = 10 * time.Millisecond
+
+// pollWait returns the time until a search job is polled again, interval or
+// less if the job, going on as fast as in the runDuration seconds it ran so
+// far, is done sooner.
+func pollWait(interval time.Duration, doneProgress, runDuration float64) time.Duration {
+	if doneProgress > 0 && doneProgress < 1 && runDuration > 0 {
+		remaining := time.Duration(runDuration * (1 - doneProgress) / doneProgress * float64(time.Second))
+		if remaining < interval {
+			interval = remaining
+		}
+	}
+	if interval < minPollWait {
+		return minPollWait
 	}
+	return interval
+}
 
-	res, _ := c.splunkRESTRequest("GET",
-		"/services/catalog/metricstore/dimensions/"+labelName+"/values", params, nil)
-	var result map[string][]LabelValue
-	json.Unmarshal(res, &result)
-	ls := make([]string, 0)
-	for l := 0; l < len(result["entry"]); l++ {
-		ls = append(ls, result["entry"][l].Name)
+func (p JobPolling) next(interval time.Duration) time.Duration {
+	if p.Backoff > 1 {
+		interval = time.Duration(float64(interval) * p.Backoff)
 	}
-	return ls
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
 }
 
-func (c *Client) runSearchWithResult(search string, start, end int64) ([]byte, error) {
+// jobDispatchTTL is how long Splunk keeps a finished job's results, they are
+// fetched right away so there's no need for the default of 10 minutes.
+const jobDispatchTTL = time.Minute
+
+func (c *Client) runSearchWithResult(ctx context.Context, search string, start, end int64) (*jobResultPreview, error) {
 	body := map[string]string{
 		"search":        search,
-		"latest_time":   strconv.FormatInt(int64(end)/1000, 10),
-		"earliest_time": strconv.FormatInt(int64(start)/1000, 10),
+		"latest_time":   splunkTime(end + 1),
+		"earliest_time": splunkTime(start),
+		"timeout":       strconv.Itoa(int(c.sidCache.dispatchTTL() / time.Second)),
+	}
+	c.dispatchOptions.apply(body, "", "timeout", c.sidCache.dispatchTTL())
+	if c.maxResultRows > 0 {
+		// one more than allowed, so a search over the limit is noticed
+		body["max_count"] = strconv.Itoa(c.maxResultRows + 1)
+	}
+	if c.oneshotThreshold > 0 && end-start <= int64(c.oneshotThreshold/time.Millisecond) {
+		return c.runOneshotSearch(ctx, body)
+	}
+	key := c.sidCacheKey(body)
+	if sid, ok := c.sidCache.get(key); ok {
+		res, err := c.jobResults(ctx, sid, true)
+		if err == nil {
+			metrics.SplunkJobsReused.Inc()
+			return res, nil
+		}
+		if _, ok := err.(*QueryError); ok || ctx.Err() != nil {
+			return nil, err
+		}
+		// the job may be gone already, e.g. deleted by an admin
+		level.Debug(c.log).Log("msg", "reusing search job failed, dispatching a new one", "sid", sid, "err", err)
+		c.sidCache.remove(key)
 	}
-	var result map[string]string
-	res, err := c.splunkRESTRequest("POST", "/services/search/jobs", nil, body)
+	dispatchStarted := time.Now()
+	res, err := c.splunkRESTRequest(ctx, "POST", "/services/search/jobs", nil, body)
 	if err != nil {
 		return nil, err
 	}
-	json.Unmarshal(res, &result)
-	sid := result["sid"]
-	for {
-		time.Sleep(100 * time.Millisecond)
-		var jobResult map[string][]map[string]map[string]bool
-		res, _ := c.splunkRESTRequest("GET", "/services/search/jobs/"+sid, nil, body)
+	metrics.ReadPhaseSeconds.WithLabelValues("dispatch").Observe(time.Since(dispatchStarted).Seconds())
+	var result struct {
+		SID string `json:"sid"`
+	}
+	if json.Unmarshal(res, &result); result.SID == "" {
+		// searches Splunk refuses to run, e.g. malformed or over the
+		// concurrency quota, fail on dispatch
+		return nil, searchError("dispatch search failed", splunkMessages(res))
+	}
+	metrics.SplunkJobsDispatched.Inc()
+	preview, err := c.jobResults(ctx, result.SID, false)
+	if err != nil {
+		return nil, err
+	}
+	c.sidCache.put(key, result.SID)
+	return preview, nil
+}
+
+// WithOneshotThreshold runs searches over ranges of at most d as oneshot
+// searches, which Splunk answers with their results once done, instead of
+// dispatching a job and polling it. Their results aren't reused. 0 never
+// runs oneshot searches.
+func WithOneshotThreshold(d time.Duration) Option {
+	return func(c *Client) {
+		c.oneshotThreshold = d
+	}
+}
 
+// runOneshotSearch runs the search of the dispatch request body as a oneshot
+// search, blocking until its results are returned. It all counts as waiting
+// for the search.
+func (c *Client) runOneshotSearch(ctx context.Context, body map[string]string) (*jobResultPreview, error) {
+	body["exec_mode"] = "oneshot"
+	// there is no job to keep
+	delete(body, "timeout")
+	params := map[string]string{"output_mode": c.resultsOutputMode(ctx), "count": "0"}
+	if c.maxResultRows > 0 {
+		params["count"] = strconv.Itoa(c.maxResultRows + 1)
+	}
+	started := time.Now()
+	res, err := c.splunkRESTRequest(ctx, "POST", "/services/search/jobs", params, body)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ReadPhaseSeconds.WithLabelValues("wait").Observe(time.Since(started).Seconds())
+	metrics.SplunkOneshotSearches.Inc()
+	var result jobResultPreview
+	rows, messages, err := decodeResults(params["output_mode"], res, &result)
+	if err != nil {
+		return nil, fmt.Errorf("decode results of oneshot search: %s", err)
+	}
+	if rows == 0 {
+		for _, m := range messages {
+			if m.isError() {
+				return nil, searchError("oneshot search failed", messages)
+			}
+		}
+	}
+	c.logSearchWarnings(ctx, "", messages)
+	if err := c.checkResultRows(rows); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// checkResultRows fails searches returning more than maxResultRows rows.
+func (c *Client) checkResultRows(rows int) error {
+	if c.maxResultRows > 0 && rows > c.maxResultRows {
+		metrics.SplunkResultsTruncated.Inc()
+		return queryErrorf("search matched more than %d rows, narrow the query or its time range", c.maxResultRows)
+	}
+	return nil
+}
+
+// jobResults waits for the search job sid to finish and fetches its results,
+// the job is cancelled when that fails. Jobs reused of the sid cache aren't
+// observed in the job histograms, they ran for an earlier read.
+func (c *Client) jobResults(ctx context.Context, sid string, reused bool) (_ *jobResultPreview, err error) {
+	defer func() {
+		if err != nil && sid != "" {
+			go c.cancelJob(sid)
+		}
+	}()
+	traceSID(ctx, sid)
+	var resultCount int
+	dispatched, polled := time.Now(), time.Now()
+	interval := c.jobPolling.Interval
+	// the job is polled right away, quick searches are often done by then
+	for {
+		var jobResult struct {
+			Entry []struct {
+				Content struct {
+					DispatchState string          `json:"dispatchState"`
+					DoneProgress  float64         `json:"doneProgress"`
+					RunDuration   float64         `json:"runDuration"`
+					IsDone        bool            `json:"isDone"`
+					IsFailed      bool            `json:"isFailed"`
+					IsFinalized   bool            `json:"isFinalized"`
+					ResultCount   int             `json:"resultCount"`
+					ScanCount     int             `json:"scanCount"`
+					Messages      []splunkMessage `json:"messages"`
+				} `json:"content"`
+			} `json:"entry"`
+		}
+		res, err := c.splunkRESTRequest(ctx, "GET", "/services/search/jobs/"+sid, nil, nil)
+		if err != nil {
+			return nil, err
+		}
 		json.Unmarshal(res, &jobResult)
-		jobs := jobResult["entry"]
+		jobs := jobResult.Entry
 		if len(jobs) < 1 {
 			return nil, fmt.Errorf("get job error")
 		}
-		if jobs[0]["content"]["isDone"] {
+		content := jobs[0].Content
+		if content.IsFailed || content.DispatchState == "FAILED" {
+			return nil, searchError("search job "+sid+" failed", content.Messages)
+		}
+		if content.IsFinalized {
+			// finalized jobs, e.g. by the runtime quota, have partial results
+			return nil, fmt.Errorf("search job %s was finalized before it finished, its results are partial", sid)
+		}
+		if content.IsDone || content.DispatchState == "DONE" {
+			metrics.ReadPhaseSeconds.WithLabelValues("wait").Observe(time.Since(polled).Seconds())
+			if !reused {
+				metrics.SplunkJobDoneSeconds.Observe(time.Since(dispatched).Seconds())
+				metrics.ReadScannedEvents.Observe(float64(content.ScanCount))
+			}
+			resultCount = content.ResultCount
+			// e.g. an index the user can't search leaves the job done
+			// without results and an error message
+			for _, m := range content.Messages {
+				if m.isError() && resultCount == 0 {
+					return nil, searchError("search job "+sid+" failed", content.Messages)
+				}
+			}
+			c.logSearchWarnings(ctx, sid, content.Messages)
 			break
 		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollWait(interval, content.DoneProgress, content.RunDuration)):
+		}
+		interval = c.jobPolling.next(interval)
 	}
-	return c.splunkRESTRequest(
-		"GET",
-		"/servicesNS/nobody/-/search/jobs/"+sid+"/results_preview",
-		map[string]string{
-			"output_mode": "json_rows",
-		},
-		nil,
-	)
+	if err := c.checkResultRows(resultCount); err != nil {
+		return nil, err
+	}
+	// a search without results is an empty answer, not an error
+	results := jobResultPreview{}
+	if resultCount == 0 {
+		return &results, nil
+	}
+	fetchStarted := time.Now()
+	defer func() {
+		if err == nil {
+			metrics.ReadPhaseSeconds.WithLabelValues("fetch").Observe(time.Since(fetchStarted).Seconds())
+		}
+	}()
+	mode := c.resultsOutputMode(ctx)
+	for offset := 0; ; offset += resultsPageSize {
+		res, err := c.splunkRESTRequest(
+			ctx,
+			"GET",
+			"/servicesNS/nobody/-/search/jobs/"+sid+"/results",
+			map[string]string{
+				"output_mode": mode,
+				"offset":      strconv.Itoa(offset),
+				"count":       strconv.Itoa(resultsPageSize),
+			},
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		metrics.SplunkResultPages.Inc()
+		rows, _, err := decodeResults(mode, res, &results)
+		if err != nil {
+			return nil, fmt.Errorf("decode results of search job %s: %s", sid, err)
+		}
+		if rows < resultsPageSize || len(results.Rows) >= resultCount {
+			break
+		}
+	}
+	return &results, nil
 }
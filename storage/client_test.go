@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/prompb"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rfc3339 formats a millisecond timestamp as Splunk formats _time.
+func rfc3339(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+func TestSeriesBuilderAbuttingWindows(t *testing.T) {
+	// buckets of a minute span, read in windows starting and ending inside
+	// of buckets
+	buckets := []int64{0, 60000, 120000, 180000}
+	windows := [][2]int64{{10000, 70000}, {70001, 130000}, {130001, 190000}}
+	reads := make(map[int64]int)
+	for _, w := range windows {
+		b := newSeriesBuilder(&readBudget{}, w[0], w[1], "", MetricNames{})
+		for _, ts := range buckets {
+			if err := b.add(metricRows(), []string{rfc3339(ts), "up", "1"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, s := range b.result().Timeseries {
+			for _, sample := range s.Samples {
+				if sample.Timestamp < w[0] || sample.Timestamp > w[1] {
+					t.Errorf("window %v returned the bucket at %d", w, sample.Timestamp)
+				}
+				reads[sample.Timestamp]++
+			}
+		}
+	}
+	for _, ts := range buckets[1:] {
+		if reads[ts] != 1 {
+			t.Errorf("bucket at %d was read %d times, want once", ts, reads[ts])
+		}
+	}
+}
+
+func TestTrimLabels(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: "job", Value: "api"},
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: "a:9090"},
+		{Name: "env", Value: "prod"},
+	}
+	for _, c := range []struct {
+		labels []prompb.Label
+		max    int
+		want   []string
+	}{
+		{labels, 3, []string{"__name__", "env", "instance"}},
+		{labels, 1, []string{"__name__"}},
+		{labels, 10, []string{"__name__", "env", "instance", "job"}},
+		// a duplicated __name__ alone exceeds max
+		{append([]prompb.Label{{Name: "__name__", Value: "up"}}, labels...), 1, []string{"__name__", "__name__"}},
+	} {
+		var got []string
+		for _, l := range trimLabels(c.labels, c.max) {
+			got = append(got, l.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("trimLabels(%d) = %v, want %v", c.max, got, c.want)
+		}
+	}
+}
+
+// hecEvents is a HEC endpoint keeping the event strings posted to it and
+// their sourcetypes.
+type hecEvents struct {
+	*httptest.Server
+	mtx         sync.Mutex
+	events      []string
+	sourcetypes []string
+}
+
+func newHECEvents() *hecEvents {
+	h := &hecEvents{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		for {
+			var e struct {
+				Event      string `json:"event"`
+				Sourcetype string `json:"sourcetype"`
+			}
+			if err := dec.Decode(&e); err != nil {
+				break
+			}
+			h.events = append(h.events, e.Event)
+			h.sourcetypes = append(h.sourcetypes, e.Sourcetype)
+		}
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	return h
+}
+
+// eventLabel matches the labels of prometheus sourcetype event strings.
+var eventLabel = regexp.MustCompile(`([A-Za-z0-9_.\-/]+)="([^"]*)"`)
+
+func TestFlattenedKubernetesLabelsRoundTrip(t *testing.T) {
+	hec := newHECEvents()
+	defer hec.Close()
+	// Splunk indexes the events written and filters them by part_of="shop"
+	// if the search does
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		rows := make([][]string, 0)
+		for _, e := range hec.events {
+			labels := map[string]string{}
+			for _, m := range eventLabel.FindAllStringSubmatch(e, -1) {
+				labels[m[1]] = m[2]
+			}
+			if strings.Contains(search, `part_of="shop"`) && labels["part_of"] != "shop" {
+				continue
+			}
+			rows = append(rows, []string{rfc3339(1000), "kube_pod_labels", "1", labels["job"], labels["part_of"]})
+		}
+		return metricRows("job", "part_of"), rows
+	})
+	defer f.Close()
+	f.dimensions = []string{"job", "part_of"}
+	c, _ := NewClient(f.URL, "admin", "changeme", "metrics", "prometheus", hec.URL, "token", 5*time.Second, log.NewNopLogger(),
+		WithKubernetesLabelFlattening(),
+		WithJobPolling(JobPolling{Interval: time.Millisecond, Backoff: 1, MaxInterval: time.Millisecond}),
+	)
+	req := &prompb.WriteRequest{}
+	for _, partOf := range []string{"shop", "billing"} {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "kube_pod_labels"},
+				{Name: "app.kubernetes.io/part-of", Value: partOf},
+				{Name: "job", Value: "kube-state-metrics"},
+			},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+		})
+	}
+	if err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if want := `kube_pod_labels{job="kube-state-metrics",part_of="shop"} 1`; len(hec.events) != 2 || hec.events[0] != want {
+		t.Fatalf("wrote %q, want %s first", hec.events, want)
+	}
+	// other backends of a fanout get the labels as sent
+	if name := req.Timeseries[0].Labels[1].Name; name != "app.kubernetes.io/part-of" {
+		t.Fatalf("the write request's label became %s", name)
+	}
+	resp, err := c.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{{
+		EndTimestampMs: 60000,
+		Matchers: []*prompb.LabelMatcher{
+			{Name: "__name__", Value: "kube_pod_labels"},
+			{Name: "part_of", Value: "shop"},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if series := resp.Results[0].Timeseries; len(series) != 1 || seriesLabel(series[0], "part_of") != "shop" || seriesLabel(series[0], "job") != "kube-state-metrics" {
+		t.Fatalf("read %v, want the series of part_of=shop", series)
+	}
+}
+
+func TestSummaryQuantilesMergedAcrossWrites(t *testing.T) {
+	hec := newHECEvents()
+	defer hec.Close()
+	c, _ := NewClient("", "", "", "metrics", "prometheus", hec.URL, "token", 5*time.Second, log.NewNopLogger(), WithSummaryQuantileMerging())
+	series := func(name string, labels ...string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}, {Name: "job", Value: "api"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+		}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+		}
+		return ts
+	}
+	// Prometheus sent the quantiles and the _sum and _count of the summary
+	// in requests of different shards
+	for _, req := range []*prompb.WriteRequest{
+		{Timeseries: []prompb.TimeSeries{
+			series("rpc_duration_seconds", "quantile", "0.5"),
+			series("rpc_duration_seconds", "quantile", "0.99"),
+		}},
+		{Timeseries: []prompb.TimeSeries{
+			series("rpc_duration_seconds_sum"),
+			series("rpc_duration_seconds_count"),
+		}},
+	} {
+		if err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"metric", `rpc_duration_seconds_sum{job="api"} 1`, `rpc_duration_seconds_count{job="api"} 1`}
+	if !reflect.DeepEqual(hec.events, want) {
+		t.Errorf("wrote %q, want %q", hec.events, want)
+	}
+}
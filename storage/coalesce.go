@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+	"time"
+)
+
+// Coalescer accumulates write requests and hands them to the next client as
+// one request when the window expired or maxSeries series are pending. Add
+// returns once the coalesced write is done, with its error.
+type Coalescer struct {
+	mtx       sync.Mutex
+	next      RemoteClient
+	window    time.Duration
+	maxSeries int
+	log       log.Logger
+
+	pending *coalescedBatch
+	// requests and writes are the totals of coalesced requests and the
+	// writes they were coalesced into.
+	requests, writes int
+}
+
+// coalescedBatch is the series of the requests coalesced into one write,
+// done is closed once it is written with err.
+type coalescedBatch struct {
+	series   []prompb.TimeSeries
+	requests int
+	queued   []func()
+	done     chan struct{}
+	err      error
+}
+
+func newCoalescedBatch() *coalescedBatch {
+	return &coalescedBatch{done: make(chan struct{})}
+}
+
+func NewCoalescer(next RemoteClient, window time.Duration, maxSeries int, log log.Logger) *Coalescer {
+	c := &Coalescer{
+		next:      next,
+		window:    window,
+		maxSeries: maxSeries,
+		log:       log,
+		pending:   newCoalescedBatch(),
+	}
+	go c.run()
+	return c
+}
+
+// Add deposits the series of req for the next flush and waits for it. A
+// request filling the batch to maxSeries writes it right away, in the
+// caller's goroutine, so pending series never grow much beyond maxSeries
+// and writers are slowed down to the pace of Splunk.
+func (c *Coalescer) Add(req *prompb.WriteRequest) error {
+	if len(req.Timeseries) == 0 {
+		return nil
+	}
+	var oldest int64
+	for _, ts := range req.Timeseries {
+		for _, s := range ts.Samples {
+			if oldest == 0 || s.Timestamp < oldest {
+				oldest = s.Timestamp
+			}
+		}
+	}
+	c.mtx.Lock()
+	b := c.pending
+	b.series = append(b.series, req.Timeseries...)
+	b.requests++
+	b.queued = append(b.queued, metrics.TrackQueued(oldest))
+	full := c.maxSeries > 0 && len(b.series) >= c.maxSeries
+	if full {
+		c.pending = newCoalescedBatch()
+	}
+	c.mtx.Unlock()
+	if full {
+		c.write(b)
+	}
+	<-b.done
+	return b.err
+}
+
+func (c *Coalescer) run() {
+	ticker := time.NewTicker(c.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mtx.Lock()
+		b := c.pending
+		if b.requests > 0 {
+			c.pending = newCoalescedBatch()
+		}
+		c.mtx.Unlock()
+		if b.requests > 0 {
+			c.write(b)
+		}
+	}
+}
+
+// write writes the batch b and wakes up its requests.
+func (c *Coalescer) write(b *coalescedBatch) {
+	defer close(b.done)
+	defer func() {
+		for _, done := range b.queued {
+			done()
+		}
+	}()
+	c.mtx.Lock()
+	c.requests += b.requests
+	c.writes++
+	metrics.CoalescedWriteRatio.Set(float64(c.requests) / float64(c.writes))
+	c.mtx.Unlock()
+	if b.err = c.next.Write(&prompb.WriteRequest{Timeseries: b.series}); b.err != nil {
+		level.Error(c.log).Log("action", "coalesced-write", "requests", b.requests, "series", len(b.series), "err", b.err)
+	}
+}
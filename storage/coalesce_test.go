@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingClient records the series of its writes and fails them with err.
+type recordingClient struct {
+	RemoteClient
+	err error
+
+	mtx    sync.Mutex
+	writes []int
+}
+
+func (c *recordingClient) Write(req *prompb.WriteRequest) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.writes = append(c.writes, len(req.Timeseries))
+	return c.err
+}
+
+func coalescedRequest(series int) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	for i := 0; i < series; i++ {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		})
+	}
+	return req
+}
+
+func TestCoalescerReturnsWriteError(t *testing.T) {
+	next := &recordingClient{err: errors.New("splunk is down")}
+	c := NewCoalescer(next, 10*time.Millisecond, 0, log.NewNopLogger())
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Add(coalescedRequest(1))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != next.err {
+			t.Errorf("request %d: err = %v, want %v", i, err, next.err)
+		}
+	}
+}
+
+func TestCoalescerWritesFullBatches(t *testing.T) {
+	next := &recordingClient{}
+	c := NewCoalescer(next, time.Hour, 4, log.NewNopLogger())
+	done := make(chan error)
+	go func() {
+		done <- c.Add(coalescedRequest(2))
+	}()
+	// the first request waits for the window until the second fills the batch
+	for i := 0; i < 100; i++ {
+		c.mtx.Lock()
+		n := len(c.pending.series)
+		c.mtx.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Add(coalescedRequest(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(next.writes) != 1 || next.writes[0] != 4 {
+		t.Fatalf("writes = %v, want one of 4 series", next.writes)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending.series) != 0 {
+		t.Fatalf("%d series pending after a full batch was written", len(c.pending.series))
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+type credentialsKey struct{}
+
+type credentials struct {
+	user, password string
+	// token is a Splunk authentication token, used instead of user and
+	// password when set.
+	token string
+}
+
+// ContextWithCredentials attaches the Splunk user a read is run as, so a
+// single long-lived client can serve requests of many users.
+func ContextWithCredentials(ctx context.Context, user, password string) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials{user: user, password: password})
+}
+
+// ContextWithToken attaches the Splunk authentication token a read is run
+// with, it is sent as a bearer token.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials{token: token})
+}
+
+// WithToken sets the authentication token of reads whose context carries no
+// credentials.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// withCredentials returns a shallow copy of c using the credentials of ctx.
+// The copy shares the http client and thereby its connection pool.
+func (c *Client) withCredentials(ctx context.Context) *Client {
+	creds, ok := ctx.Value(credentialsKey{}).(credentials)
+	if !ok {
+		return c
+	}
+	rc := *c
+	rc.user, rc.password, rc.token = creds.user, creds.password, creds.token
+	return &rc
+}
+
+// credentials returns the credentials c runs searches with.
+func (c *Client) credentials() credentials {
+	return credentials{user: c.user, password: c.password, token: c.token}
+}
+
+// cacheKey identifies the credentials in cache keys, tokens and passwords
+// are only kept hashed. The password is part of it, a wrong one must not hit
+// entries cached for the right one before Splunk checks it.
+func (creds credentials) cacheKey() string {
+	if creds.token != "" {
+		sum := sha256.Sum256([]byte(creds.token))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(creds.user + "\x00" + creds.password))
+	return creds.user + ":" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"container/list"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+	"time"
+)
+
+type sampleKey struct {
+	series    uint64
+	timestamp int64
+}
+
+// Deduplicator drops samples that were already written, e.g. by HA Prometheus
+// pairs or retried remote writes. It remembers the last size samples exactly,
+// keyed by series hash and timestamp, and evicts the least recently seen.
+type Deduplicator struct {
+	mtx     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[sampleKey]*list.Element
+}
+
+type dedupEntry struct {
+	key sampleKey
+	// lastSeen is when the sample was last written or found duplicate.
+	lastSeen time.Time
+}
+
+func NewDeduplicator(size int) *Deduplicator {
+	return &Deduplicator{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[sampleKey]*list.Element),
+	}
+}
+
+// Filter returns the samples of series that weren't written before.
+func (d *Deduplicator) Filter(series prompb.TimeSeries) []prompb.Sample {
+	h := seriesHash(series.Labels)
+	now := time.Now()
+	res := make([]prompb.Sample, 0, len(series.Samples))
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, s := range series.Samples {
+		if e, ok := d.entries[sampleKey{series: h, timestamp: s.Timestamp}]; ok {
+			e.Value.(*dedupEntry).lastSeen = now
+			d.order.MoveToFront(e)
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// Remember records the samples of series as written. It is called once
+// Splunk accepted them, so samples of a failed write pass Filter on retry.
+func (d *Deduplicator) Remember(series prompb.TimeSeries) {
+	h := seriesHash(series.Labels)
+	now := time.Now()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, s := range series.Samples {
+		key := sampleKey{series: h, timestamp: s.Timestamp}
+		if _, ok := d.entries[key]; ok {
+			continue
+		}
+		for d.order.Len() >= d.size {
+			oldest := d.order.Back()
+			delete(d.entries, d.order.Remove(oldest).(*dedupEntry).key)
+		}
+		d.entries[key] = d.order.PushFront(&dedupEntry{key: key, lastSeen: now})
+	}
+}
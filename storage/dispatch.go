@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DispatchOptions are the parameters search jobs of reads are dispatched
+// with, named like the dispatch settings of saved searches without the
+// dispatch. prefix, e.g. adhoc_search_level=fast or ttl=60. Keys ropee
+// doesn't know are passed to Splunk as they are.
+type DispatchOptions map[string]string
+
+// reservedDispatchOptions are set by ropee for every search.
+var reservedDispatchOptions = map[string]bool{
+	"search":        true,
+	"earliest_time": true,
+	"latest_time":   true,
+	"time_format":   true,
+	"output_mode":   true,
+}
+
+// ParseDispatchOptions parses comma separated key=value pairs and validates
+// the values of the keys ropee knows.
+func ParseDispatchOptions(s string) (DispatchOptions, error) {
+	opts := make(DispatchOptions)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid dispatch option %q, expected key=value", pair)
+		}
+		key, value := strings.TrimPrefix(strings.TrimSpace(kv[0]), "dispatch."), strings.TrimSpace(kv[1])
+		if err := validateDispatchOption(key, value); err != nil {
+			return nil, err
+		}
+		opts[key] = value
+	}
+	return opts, nil
+}
+
+func validateDispatchOption(key, value string) error {
+	if reservedDispatchOptions[key] {
+		return fmt.Errorf("dispatch option %s is set by ropee for every search", key)
+	}
+	switch key {
+	case "adhoc_search_level":
+		if value != "fast" && value != "smart" && value != "verbose" {
+			return fmt.Errorf("dispatch option adhoc_search_level must be fast, smart or verbose, got %q", value)
+		}
+	case "max_count", "max_time", "ttl":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("dispatch option %s must be a non-negative integer, got %q", key, value)
+		}
+	}
+	return nil
+}
+
+// WithDispatchOptions sets the parameters search jobs are dispatched with.
+// They take precedence over ropee's defaults, except for max_count which is
+// replaced by that of WithMaxResultRows, when set, to notice truncated
+// results.
+func WithDispatchOptions(opts DispatchOptions) Option {
+	return func(c *Client) {
+		c.dispatchOptions = opts
+	}
+}
+
+// apply sets the options in the body of a dispatch request, with prefix
+// prepended to their keys and ttl as ttlParam, which is dropped if empty.
+// A ttl below minTTL is raised to it, jobs have to outlive the sid cache
+// entries reusing them.
+func (o DispatchOptions) apply(body map[string]string, prefix, ttlParam string, minTTL time.Duration) {
+	for key, value := range o {
+		if key == "ttl" {
+			if ttlParam == "" {
+				continue
+			}
+			if ttl, err := strconv.Atoi(value); err == nil && time.Duration(ttl)*time.Second < minTTL {
+				value = strconv.Itoa(int(minTTL / time.Second))
+			}
+			body[ttlParam] = value
+			continue
+		}
+		body[prefix+key] = value
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDispatchOptionsTTLOutlivesSIDCache(t *testing.T) {
+	for _, c := range []struct {
+		ttl    string
+		minTTL time.Duration
+		want   string
+	}{
+		{"30", 5 * time.Minute, "300"},
+		{"600", 5 * time.Minute, "600"},
+		{"30", 0, "30"},
+	} {
+		body := make(map[string]string)
+		DispatchOptions{"ttl": c.ttl}.apply(body, "", "timeout", c.minTTL)
+		if body["timeout"] != c.want {
+			t.Errorf("ttl=%s with a sid cache ttl of %s: timeout = %s, want %s", c.ttl, c.minTTL, body["timeout"], c.want)
+		}
+	}
+}
+
+func TestDispatchOptionsTTLDropped(t *testing.T) {
+	body := make(map[string]string)
+	DispatchOptions{"ttl": "30", "max_time": "60"}.apply(body, "dispatch.", "", time.Minute)
+	if len(body) != 1 || body["dispatch.max_time"] != "60" {
+		t.Fatalf("body = %v, want only dispatch.max_time", body)
+	}
+}
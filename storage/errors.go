@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// QueryError reports a read query ropee can't run as asked, it is the
+// client's fault and should be answered with 400.
+type QueryError struct {
+	msg string
+}
+
+func (e *QueryError) Error() string {
+	return e.msg
+}
+
+func queryErrorf(format string, args ...interface{}) error {
+	return &QueryError{msg: fmt.Sprintf(format, args...)}
+}
+
+// LimitError reports a read exceeding the series or samples limit, it should
+// be answered with 422 as Prometheus does for queries over its limits.
+type LimitError struct {
+	msg string
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+// ThrottleError reports a read that waited too long for a free Splunk
+// search slot, it should be answered with 429.
+type ThrottleError struct {
+	msg string
+}
+
+func (e *ThrottleError) Error() string {
+	return e.msg
+}
+
+// UnavailableError reports a read ropee can't serve right now, it should
+// be answered with 503 and a Retry-After of RetryAfter.
+type UnavailableError struct {
+	msg        string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return e.msg
+}
+
+// AuthError reports credentials Splunk rejected, it should be answered
+// with 401.
+type AuthError struct {
+	msg string
+}
+
+func (e *AuthError) Error() string {
+	return e.msg
+}
+
+// ForbiddenError reports a search Splunk refused for lack of permissions,
+// e.g. on an index, it should be answered with 403.
+type ForbiddenError struct {
+	msg string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.msg
+}
+
+// SearchError reports a search Splunk failed for other reasons, with its
+// messages, it should be answered with 502.
+type SearchError struct {
+	msg string
+}
+
+func (e *SearchError) Error() string {
+	return e.msg
+}
+
+// TimeoutError reports a request to Splunk or a read backend that timed out.
+// It is a net.Error, Timeout tells it apart from other errors.
+type TimeoutError struct {
+	msg string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.msg
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// isTimeout reports whether err is a timeout, e.g. of a deadline of the
+// context or of a connection.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
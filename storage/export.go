@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kebe7jun/ropee/metrics"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// SearchModeJob dispatches a search job, polls it and pages through
+	// its results.
+	SearchModeJob = "job"
+	// SearchModeExport streams results from the export endpoint while the
+	// search runs.
+	SearchModeExport = "export"
+)
+
+// exportMessage is one line of the export endpoint's json output.
+type exportMessage struct {
+	Preview  bool                   `json:"preview"`
+	Result   map[string]interface{} `json:"result"`
+	Messages []splunkMessage        `json:"messages"`
+}
+
+// runExportSearch runs search on the export endpoint and feeds the rows to b
+// as they arrive. Rows of a transforming search come ordered by time, so no
+// series is complete before the stream ends, the streamed remote read
+// protocol needs each series whole before the next. Streamed reads get the
+// series of the query right then, without waiting for other queries, and
+// release each once encoded. All of it counts as fetching the results.
+func (c *Client) runExportSearch(ctx context.Context, search string, start, end int64, b *seriesBuilder) error {
+	body := map[string]string{
+		"search":        search,
+		"latest_time":   splunkTime(end + 1),
+		"earliest_time": splunkTime(start),
+	}
+	// export results are streamed, there is no job to keep
+	c.dispatchOptions.apply(body, "", "", 0)
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	started := time.Now()
+	httpResp, err := c.splunkRESTResponse(ctx, "POST", "/services/search/jobs/export", nil, body)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(httpResp.Body)
+		return searchError("export search failed: "+httpResp.Status, splunkMessages(msg))
+	}
+	rows := 0
+	dec := json.NewDecoder(httpResp.Body)
+	for {
+		var msg exportMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		for _, m := range msg.Messages {
+			if m.isError() {
+				return searchError("export search failed", msg.Messages)
+			}
+		}
+		c.logSearchWarnings(ctx, "", msg.Messages)
+		// preview rows of a transforming search are superseded by the
+		// final ones, only those are used
+		if msg.Preview || msg.Result == nil {
+			continue
+		}
+		rows++
+		if err := c.checkResultRows(rows); err != nil {
+			return err
+		}
+		fields, values := exportRow(msg.Result)
+		if err := b.add(fields, values); err != nil {
+			return err
+		}
+	}
+	metrics.ReadPhaseSeconds.WithLabelValues("fetch").Observe(time.Since(started).Seconds())
+	return nil
+}
+
+// exportRow flattens an exported result into fields sorted by name, leaving
+// out the internal fields except _time. Of multivalue fields the values are
+// joined by commas.
+func exportRow(result map[string]interface{}) ([]string, []string) {
+	fields := make([]string, 0, len(result))
+	for k := range result {
+		if strings.HasPrefix(k, "_") && k != "_time" {
+			continue
+		}
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	values := make([]string, len(fields))
+	for i, k := range fields {
+		switch v := result[k].(type) {
+		case string:
+			values[i] = v
+		case []interface{}:
+			vs := make([]string, len(v))
+			for j := range v {
+				vs[j] = fmt.Sprint(v[j])
+			}
+			values[i] = strings.Join(vs, ",")
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return fields, values
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeSplunk is a Splunk REST api answering searches with the rows of
+// results, enough of it for the read path.
+type fakeSplunk struct {
+	*httptest.Server
+	// results answers a search with its fields and rows.
+	results func(search string) ([]string, [][]string)
+	// dimensions are the catalog dimensions of every metric.
+	dimensions []string
+	// passwords are the users accepted with basic auth, any are if nil.
+	passwords map[string]string
+
+	mtx        sync.Mutex
+	searches   []string
+	dispatched int
+	polls      int
+	cancelled  []string
+	jobs       map[string]string
+}
+
+// newFakeSplunk starts a fake Splunk, callers have to Close it.
+func newFakeSplunk(results func(search string) ([]string, [][]string)) *fakeSplunk {
+	f := &fakeSplunk{results: results, jobs: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// client returns a read client of f.
+func (f *fakeSplunk) client(opts ...Option) *Client {
+	opts = append([]Option{WithJobPolling(JobPolling{Interval: time.Millisecond, Backoff: 1, MaxInterval: time.Millisecond})}, opts...)
+	c, _ := NewClient(f.URL, "admin", "changeme", "metrics", "prometheus", "", "", 5*time.Second, log.NewNopLogger(), opts...)
+	return c.(*Client)
+}
+
+func (f *fakeSplunk) searchCount() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.searches)
+}
+
+func (f *fakeSplunk) lastSearch() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if len(f.searches) == 0 {
+		return ""
+	}
+	return f.searches[len(f.searches)-1]
+}
+
+func (f *fakeSplunk) serve(w http.ResponseWriter, r *http.Request) {
+	if f.passwords != nil {
+		user, pass, _ := r.BasicAuth()
+		if want, ok := f.passwords[user]; !ok || want != pass {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"messages":[{"type":"WARN","text":"call not properly authenticated"}]}`)
+			return
+		}
+	}
+	// the client doesn't set a form content type, the body is parsed here
+	data, _ := ioutil.ReadAll(r.Body)
+	form, _ := url.ParseQuery(string(data))
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	path := r.URL.Path
+	switch {
+	case path == "/services/search/jobs" && r.Method == http.MethodPost:
+		search := form.Get("search")
+		f.searches = append(f.searches, search)
+		if form.Get("exec_mode") == "oneshot" {
+			fields, rows := f.results(search)
+			writeRows(w, fields, rows)
+			return
+		}
+		f.dispatched++
+		sid := "sid" + strconv.Itoa(f.dispatched)
+		f.jobs[sid] = search
+		fmt.Fprintf(w, `{"sid":%q}`, sid)
+	case path == "/services/search/jobs/export":
+		search := form.Get("search")
+		f.searches = append(f.searches, search)
+		fields, rows := f.results(search)
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			result := make(map[string]string, len(fields))
+			for i, field := range fields {
+				result[field] = row[i]
+			}
+			enc.Encode(map[string]interface{}{"preview": false, "result": result})
+		}
+	case strings.HasPrefix(path, "/services/search/jobs/") && strings.HasSuffix(path, "/control"):
+		f.cancelled = append(f.cancelled, strings.Split(path, "/")[4])
+		fmt.Fprint(w, `{}`)
+	case strings.HasPrefix(path, "/services/search/jobs/"):
+		f.polls++
+		_, rows := f.results(f.jobs[strings.TrimPrefix(path, "/services/search/jobs/")])
+		fmt.Fprintf(w, `{"entry":[{"content":{"dispatchState":"DONE","isDone":true,"doneProgress":1,"resultCount":%d,"scanCount":%d}}]}`, len(rows), 10*len(rows))
+	case strings.HasPrefix(path, "/servicesNS/nobody/-/search/jobs/") && strings.HasSuffix(path, "/results"):
+		sid := strings.Split(path, "/")[6]
+		fields, rows := f.results(f.jobs[sid])
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		if offset > len(rows) {
+			offset = len(rows)
+		}
+		if count > 0 && offset+count < len(rows) {
+			rows = rows[offset : offset+count]
+		} else {
+			rows = rows[offset:]
+		}
+		writeRows(w, fields, rows)
+	case path == "/services/catalog/metricstore/dimensions":
+		entries := make([]map[string]string, 0, len(f.dimensions))
+		for _, d := range f.dimensions {
+			entries = append(entries, map[string]string{"name": d})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"entry": entries})
+	case path == "/services/server/info":
+		fmt.Fprint(w, `{"entry":[{"content":{"version":"9.1.2"}}]}`)
+	default:
+		fmt.Fprint(w, `{"entry":[]}`)
+	}
+}
+
+func writeRows(w http.ResponseWriter, fields []string, rows [][]string) {
+	if rows == nil {
+		rows = [][]string{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"fields": fields, "rows": rows})
+}
+
+// metricRows returns the fields of mstats rows of the labels and rows of
+// _time, metric name, value and the label values.
+func metricRows(labels ...string) []string {
+	return append([]string{"_time", CommonMetricName, CommonMetricValue}, labels...)
+}
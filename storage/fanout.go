@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/sync/errgroup"
+	"sort"
+	"strings"
+)
+
+// FanoutClient forwards every request to all of its backends concurrently.
+// Writes succeed when at least quorum backends accepted them (all backends
+// when quorum is 0), reads merge the de-duplicated results of all backends.
+type FanoutClient struct {
+	backends []RemoteClient
+	quorum   int
+}
+
+func NewFanoutClient(quorum int, backends ...RemoteClient) RemoteClient {
+	if quorum <= 0 || quorum > len(backends) {
+		quorum = len(backends)
+	}
+	return &FanoutClient{backends: backends, quorum: quorum}
+}
+
+func (f *FanoutClient) Write(req *prompb.WriteRequest) error {
+	return f.WriteContext(context.Background(), req)
+}
+
+func (f *FanoutClient) WriteContext(ctx context.Context, req *prompb.WriteRequest) error {
+	var g errgroup.Group
+	errs := make([]error, len(f.backends))
+	for i, b := range f.backends {
+		i, b := i, b
+		g.Go(func() error {
+			errs[i] = WriteContext(ctx, b, req)
+			return nil
+		})
+	}
+	g.Wait()
+	failed := make([]string, 0)
+	timedOut := false
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+			timedOut = timedOut || isTimeout(err)
+		}
+	}
+	if len(f.backends)-len(failed) < f.quorum && timedOut {
+		return &TimeoutError{msg: fmt.Sprintf("write quorum not reached, %d of %d backends failed: %s",
+			len(failed), len(f.backends), strings.Join(failed, "; "))}
+	}
+	if len(f.backends)-len(failed) < f.quorum {
+		return fmt.Errorf("write quorum not reached, %d of %d backends failed: %s",
+			len(failed), len(f.backends), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (f *FanoutClient) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	var g errgroup.Group
+	resps := make([]*prompb.ReadResponse, len(f.backends))
+	for i, b := range f.backends {
+		i, b := i, b
+		g.Go(func() error {
+			resp, err := b.Read(ctx, req)
+			resps[i] = resp
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	results := make([]*prompb.QueryResult, len(req.Queries))
+	for i := range results {
+		parts := make([]*prompb.QueryResult, 0, len(resps))
+		for _, resp := range resps {
+			if i < len(resp.Results) {
+				parts = append(parts, resp.Results[i])
+			}
+		}
+		results[i] = mergeQueryResults(parts)
+	}
+	return &prompb.ReadResponse{Results: results}, nil
+}
+
+func (f *FanoutClient) MetricLabels(metricName string) []string {
+	return f.collect(func(b RemoteClient) []string { return b.MetricLabels(metricName) })
+}
+
+func (f *FanoutClient) LabelValues(labelName string) []string {
+	return f.collect(func(b RemoteClient) []string { return b.LabelValues(labelName) })
+}
+
+func (f *FanoutClient) collect(fn func(RemoteClient) []string) []string {
+	seen := make(map[string]bool)
+	ls := make([]string, 0)
+	for _, b := range f.backends {
+		for _, v := range fn(b) {
+			if !seen[v] {
+				seen[v] = true
+				ls = append(ls, v)
+			}
+		}
+	}
+	return ls
+}
+
+// mergeQueryResults joins series with identical label sets, whatever the
+// order of their labels, keeping one sample per timestamp in ascending order.
+// Of samples of one timestamp the one of the earliest part is kept.
+func mergeQueryResults(parts []*prompb.QueryResult) *prompb.QueryResult {
+	keysMap := make(map[string]*prompb.TimeSeries)
+	keys := make([]string, 0)
+	for _, part := range parts {
+		for _, ts := range part.Timeseries {
+			key := labelsKey(ts.Labels)
+			if s, ok := keysMap[key]; ok {
+				s.Samples = mergeSamples(s.Samples, sortedSamples(ts.Samples))
+				continue
+			}
+			keysMap[key] = &prompb.TimeSeries{
+				Labels:  ts.Labels,
+				Samples: mergeSamples(nil, sortedSamples(ts.Samples)),
+			}
+			keys = append(keys, key)
+		}
+	}
+	timeSeries := make([]*prompb.TimeSeries, 0, len(keys))
+	for _, key := range keys {
+		timeSeries = append(timeSeries, keysMap[key])
+	}
+	return &prompb.QueryResult{Timeseries: timeSeries}
+}
+
+// sortedSamples returns samples in ascending timestamp order, as they are
+// unless a backend returned them out of order.
+func sortedSamples(samples []prompb.Sample) []prompb.Sample {
+	if sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+		return samples
+	}
+	sorted := append([]prompb.Sample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+	return sorted
+}
+
+// mergeSamples merges the ascending samples a and b into a new slice with
+// one sample per timestamp, that of a if both have one.
+func mergeSamples(a, b []prompb.Sample) []prompb.Sample {
+	res := make([]prompb.Sample, 0, len(a)+len(b))
+	add := func(s prompb.Sample) {
+		if len(res) > 0 && res[len(res)-1].Timestamp == s.Timestamp {
+			return
+		}
+		res = append(res, s)
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if j == len(b) || i < len(a) && a[i].Timestamp <= b[j].Timestamp {
+			add(a[i])
+			i++
+		} else {
+			add(b[j])
+			j++
+		}
+	}
+	return res
+}
+
+// labelsKey fingerprints a label set independent of the order of its labels.
+func labelsKey(labels []prompb.Label) string {
+	ls := make([]string, 0, len(labels))
+	for _, l := range labels {
+		ls = append(ls, l.Name+"\xfe"+l.Value)
+	}
+	sort.Strings(ls)
+	return strings.Join(ls, "\xff")
+}
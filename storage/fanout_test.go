@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"testing"
+)
+
+// staticClient answers every read with its results.
+type staticClient struct {
+	RemoteClient
+	results []*prompb.QueryResult
+}
+
+func (c *staticClient) Read(context.Context, *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	return &prompb.ReadResponse{Results: c.results}, nil
+}
+
+func fanoutSeries(job string, timestamps ...int64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}}}
+	for _, t := range timestamps {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(t), Timestamp: t})
+	}
+	return ts
+}
+
+func sampleTimestamps(ts *prompb.TimeSeries) []int64 {
+	res := make([]int64, 0, len(ts.Samples))
+	for _, s := range ts.Samples {
+		res = append(res, s.Timestamp)
+	}
+	return res
+}
+
+func TestFanoutReadMergesOverlappingResults(t *testing.T) {
+	// Splunk has the older samples of api, the other backend the newer ones,
+	// both have those in between and only one has web
+	splunk := &staticClient{results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+		fanoutSeries("api", 1000, 2000, 3000),
+	}}}}
+	reversed := fanoutSeries("api", 4000, 2000, 3000)
+	reversed.Labels[0], reversed.Labels[1] = reversed.Labels[1], reversed.Labels[0]
+	backend := &staticClient{results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+		reversed,
+		fanoutSeries("web", 1000),
+	}}}}
+	resp, err := NewFanoutClient(0, splunk, backend).Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := resp.Results[0].Timeseries
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want api and web", len(series))
+	}
+	if got := sampleTimestamps(series[0]); !reflect.DeepEqual(got, []int64{1000, 2000, 3000, 4000}) {
+		t.Errorf("api samples at %v, want each once in order", got)
+	}
+	if got := sampleTimestamps(series[1]); !reflect.DeepEqual(got, []int64{1000}) {
+		t.Errorf("web samples at %v", got)
+	}
+}
+
+func TestMergeSamples(t *testing.T) {
+	samples := func(timestamps ...int64) []prompb.Sample {
+		res := make([]prompb.Sample, 0, len(timestamps))
+		for _, t := range timestamps {
+			res = append(res, prompb.Sample{Timestamp: t})
+		}
+		return res
+	}
+	for _, c := range []struct {
+		a, b []prompb.Sample
+		want []int64
+	}{
+		{nil, samples(1, 2), []int64{1, 2}},
+		{samples(1, 3), samples(2, 4), []int64{1, 2, 3, 4}},
+		{samples(1, 2, 3), samples(2, 3, 4), []int64{1, 2, 3, 4}},
+		{samples(1, 2), samples(1, 2), []int64{1, 2}},
+	} {
+		ts := &prompb.TimeSeries{Samples: mergeSamples(c.a, c.b)}
+		if got := sampleTimestamps(ts); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("mergeSamples(%v, %v) at %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"strings"
+)
+
+// FieldPrefix is prepended to label names to make up the Splunk dimensions
+// of written series, e.g. prom. to keep them apart from the fields other
+// collectors write to the same indexes. Reads strip it again, dimensions
+// without it aren't labels.
+type FieldPrefix string
+
+// ValidateFieldPrefix checks that prefix makes valid Splunk field names of
+// label names.
+func ValidateFieldPrefix(prefix string) error {
+	if prefix != "" && !isSplunkFieldName(prefix) {
+		return fmt.Errorf("invalid field prefix %q, only letters, digits, _ and . are allowed and it must start with a letter or _", prefix)
+	}
+	return nil
+}
+
+// WithFieldPrefix prepends prefix to the label names of written series and
+// strips it from the dimensions of read ones.
+func WithFieldPrefix(prefix string) Option {
+	return func(c *Client) {
+		c.fieldPrefix = FieldPrefix(prefix)
+	}
+}
+
+// splunk returns the Splunk field of the label name.
+func (p FieldPrefix) splunk(name string) string {
+	return string(p) + name
+}
+
+// prometheus returns the label name of the Splunk field, false if field
+// lacks the prefix.
+func (p FieldPrefix) prometheus(field string) (string, bool) {
+	if !strings.HasPrefix(field, string(p)) || len(field) == len(p) {
+		return field, false
+	}
+	return field[len(p):], true
+}
+
+// labels returns a copy of labels with the prefix prepended to all names but
+// __name__, labels as they are without a prefix.
+func (p FieldPrefix) labels(labels []prompb.Label) []prompb.Label {
+	if p == "" {
+		return labels
+	}
+	res := make([]prompb.Label, len(labels))
+	for i, l := range labels {
+		if l.Name != "__name__" {
+			l.Name = p.splunk(l.Name)
+		}
+		res[i] = l
+	}
+	return res
+}
+
+// evalField returns field as a field name of eval expressions like where
+// stages, in which a . concatenates.
+func evalField(field string) string {
+	if strings.Contains(field, ".") {
+		return "'" + field + "'"
+	}
+	return field
+}
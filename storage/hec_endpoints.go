@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+)
+
+// HECEndpoint is the collector url and token events of a sourcetype are
+// written with.
+type HECEndpoint struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// HECEndpoints maps sourcetypes to the collectors their events are routed
+// to, e.g. for indexer routing by sourcetype.
+type HECEndpoints map[string]HECEndpoint
+
+// LoadHECEndpoints reads the mapping from a YAML file like
+//
+//	prometheus:metrics:
+//	  url: https://hec-metrics.example.com:8088
+//	  token: 00000000-0000-0000-0000-000000000000
+func LoadHECEndpoints(filename string) (HECEndpoints, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints HECEndpoints
+	if err := yaml.UnmarshalStrict(data, &endpoints); err != nil {
+		return nil, err
+	}
+	for sourcetype, e := range endpoints {
+		if e.URL == "" || e.Token == "" {
+			return nil, fmt.Errorf("sourcetype %s: url and token are required", sourcetype)
+		}
+	}
+	return endpoints, nil
+}
+
+// WithSourcetypeDestinations writes events of the sourcetypes of dests to
+// their destination instead of the primary one, the first of
+// WithHECDestinations. Other destinations, the replicas, get them as usual,
+// the standby of WithHECStandby only takes over writes of the primary.
+func WithSourcetypeDestinations(dests map[string]*HECDestination) Option {
+	return func(c *Client) {
+		c.sourcetypeDestinations = dests
+	}
+}
+
+// hecRoute is the events of a write going to the same destinations.
+type hecRoute struct {
+	destinations []*HECDestination
+	events       []SplunkMetricEvent
+	newest       int64
+}
+
+// routeEvents groups events by the destinations of their sourcetype, in the
+// order the sourcetypes first appear.
+func (c *Client) routeEvents(events []SplunkMetricEvent) []*hecRoute {
+	routes := make([]*hecRoute, 0, 1)
+	bySourcetype := make(map[string]*hecRoute)
+	for _, e := range events {
+		sourcetype := c.eventSourcetype(e)
+		if _, ok := c.sourcetypeDestinations[sourcetype]; !ok {
+			sourcetype = ""
+		}
+		route, ok := bySourcetype[sourcetype]
+		if !ok {
+			route = &hecRoute{destinations: c.destinations, newest: e.Time}
+			if dest, ok := c.sourcetypeDestinations[sourcetype]; ok {
+				route.destinations = append([]*HECDestination{dest}, c.destinations[1:]...)
+			}
+			bySourcetype[sourcetype] = route
+			routes = append(routes, route)
+		}
+		route.events = append(route.events, e)
+		if e.Time > route.newest {
+			route.newest = e.Time
+		}
+	}
+	return routes
+}
+
+// eventSourcetype returns the sourcetype e is written with.
+func (c *Client) eventSourcetype(e SplunkMetricEvent) string {
+	if e.Sourcetype != "" {
+		return e.Sourcetype
+	}
+	return c.sourcetype
+}
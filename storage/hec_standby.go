@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+	"sync/atomic"
+)
+
+// Values of Client.hecActive and ropee_hec_active_backend.
+const (
+	hecPrimary = 0
+	hecStandby = 1
+)
+
+// WithHECStandby makes standby take over the writes of the first HEC
+// destination, the primary, while its circuit breaker is open.
+func WithHECStandby(standby *HECDestination) Option {
+	return func(c *Client) {
+		c.hecStandby = standby
+	}
+}
+
+// writeWithStandby writes to primary, or to the standby while the circuit
+// breaker of primary is open. A write failing over isn't lost, it goes to the
+// standby. Once the breaker lets a trial through, writes go to primary again
+// and the standby only stays active until one of them succeeded.
+func (c *Client) writeWithStandby(id string, primary *HECDestination, body []byte, count int, newest int64) error {
+	if c.hecStandby == nil {
+		return c.writeDestination(id, primary, body, count, newest)
+	}
+	active := atomic.LoadInt32(&c.hecActive)
+	if active == hecPrimary || primary.breaker.Allow() {
+		err := c.writeDestination(id, primary, body, count, newest)
+		if err == nil {
+			if active == hecStandby && atomic.CompareAndSwapInt32(&c.hecActive, hecStandby, hecPrimary) {
+				metrics.HECActiveBackend.Set(hecPrimary)
+				level.Info(c.log).Log("msg", "primary HEC recovered, reverting from standby", "primary", primary.Name)
+			}
+			return nil
+		}
+		// failures below the breaker threshold are retried by the sender
+		if !primary.breaker.Open() {
+			return err
+		}
+	}
+	if atomic.CompareAndSwapInt32(&c.hecActive, hecPrimary, hecStandby) {
+		metrics.HECFailoverTotal.Inc()
+		metrics.HECActiveBackend.Set(hecStandby)
+		level.Warn(c.log).Log("msg", "primary HEC circuit breaker open, promoting standby", "primary", primary.Name, "standby", c.hecStandby.Name)
+	}
+	return c.writeDestination(id, c.hecStandby, body, count, newest)
+}
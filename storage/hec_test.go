@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// hecWrite is a write of one sample.
+var hecWrite = &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+	Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+	Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+}}}
+
+func TestHECTLSVerification(t *testing.T) {
+	hec := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer hec.Close()
+	write := func(opts ...Option) error {
+		c, _ := NewClient("", "", "", "metrics", "prometheus", hec.URL, "token", 5*time.Second, log.NewNopLogger(), opts...)
+		return c.Write(hecWrite)
+	}
+	if err := write(); err != nil {
+		t.Fatalf("write without WithHECTLS failed, certificates were verified: %s", err)
+	}
+	if err := write(WithHECTLS(HECTLS{InsecureSkipVerify: true})); err != nil {
+		t.Fatalf("write skipping verification failed: %s", err)
+	}
+	if err := write(WithHECTLS(HECTLS{})); err == nil {
+		t.Fatal("write accepted the self-signed certificate with verification on")
+	}
+}
+
+func TestSourcetypeDestinations(t *testing.T) {
+	primary, replica, routed := newHECEvents(), newHECEvents(), newHECEvents()
+	defer primary.Close()
+	defer replica.Close()
+	defer routed.Close()
+	c, _ := NewClient("", "", "", "metrics", "prometheus", "", "", 5*time.Second, log.NewNopLogger(),
+		WithHECDestinations(true, NewHECDestination(primary.URL, "token", 0, 0, 0), NewHECDestination(replica.URL, "token", 0, 0, 0)),
+		WithSourcetypeDestinations(map[string]*HECDestination{"prometheus": NewHECDestination(routed.URL, "token", 0, 0, 0)}),
+	)
+	// events without a sourcetype of their own have that of the client
+	err := c.(*Client).splunkHECEvents("id", []SplunkMetricEvent{
+		{Time: 1000, MetricStr: "a 1"},
+		{Time: 1000, MetricStr: "b 1", Sourcetype: "statsd"},
+		{Time: 2000, MetricStr: "c 1", Sourcetype: "prometheus"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		hec         *hecEvents
+		name        string
+		sourcetypes []string
+	}{
+		{routed, "mapped collector", []string{"prometheus", "prometheus"}},
+		{primary, "primary", []string{"statsd"}},
+		{replica, "replica", []string{"prometheus", "prometheus", "statsd"}},
+	} {
+		if !reflect.DeepEqual(c.hec.sourcetypes, c.sourcetypes) {
+			t.Errorf("%s got events of %v, want %v", c.name, c.hec.sourcetypes, c.sourcetypes)
+		}
+	}
+}
+
+func TestTimeoutErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	c, _ := NewClient(slow.URL, "admin", "changeme", "metrics", "prometheus", slow.URL, "token", 50*time.Millisecond, log.NewNopLogger())
+	if err := c.Write(hecWrite); !isTimeout(err) {
+		t.Fatalf("write error %v isn't a timeout", err)
+	} else if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("write error %T isn't a TimeoutError", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.Read(ctx, &prompb.ReadRequest{Queries: []*prompb.Query{{
+		EndTimestampMs: 60000,
+		Matchers:       []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}})
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("read error %v isn't a TimeoutError", err)
+	}
+}
+
+func BenchmarkHECBundling(b *testing.B) {
+	hec := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer hec.Close()
+	req := &prompb.WriteRequest{}
+	for i := 0; i < 1000; i++ {
+		ts := prompb.TimeSeries{Labels: []prompb.Label{
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "instance", Value: "host-" + strconv.Itoa(i)},
+		}}
+		for j := 0; j < 60; j++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: int64(j) * 15000, Value: float64(j)})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	for _, bundle := range []bool{true, false} {
+		b.Run("bundle="+strconv.FormatBool(bundle), func(b *testing.B) {
+			c, _ := NewClient("", "", "", "metrics", "prometheus", hec.URL, "token", 5*time.Second, log.NewNopLogger(), WithHECBundling(bundle, 0))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Write(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
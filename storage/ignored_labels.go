@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+)
+
+// IgnoredLabels are labels read queries aren't filtered by, typically the
+// external labels Prometheus adds as matchers to every remote read, e.g.
+// prometheus_replica of an HA pair whose replicas both write to Splunk.
+// Their matchers are removed from queries before the search is built, they
+// are left out of the returned series and the values of their = matchers are
+// set on each of them, so the series of all replicas answer the read of
+// each as one series.
+type IgnoredLabels []string
+
+// WithIgnoredLabels sets the labels read queries aren't filtered by.
+func WithIgnoredLabels(labels IgnoredLabels) Option {
+	return func(c *Client) {
+		c.ignoredLabels = labels
+	}
+}
+
+// strip returns q without the matchers on the ignored labels and the values
+// of their = matchers as labels sorted by name, which are set on the series
+// of q's result. q is returned as it is if it has no such matchers.
+func (l IgnoredLabels) strip(q *prompb.Query) (*prompb.Query, []prompb.Label) {
+	if len(l) == 0 {
+		return q, nil
+	}
+	matchers := make([]*prompb.LabelMatcher, 0, len(q.Matchers))
+	attach := make([]prompb.Label, 0)
+	for _, m := range q.Matchers {
+		if !l.Contains(m.Name) {
+			matchers = append(matchers, m)
+			continue
+		}
+		if m.Type == prompb.LabelMatcher_EQ && m.Value != "" {
+			attach = append(attach, prompb.Label{Name: m.Name, Value: m.Value})
+		}
+	}
+	if len(matchers) == len(q.Matchers) {
+		return q, nil
+	}
+	sort.Slice(attach, func(i, j int) bool { return attach[i].Name < attach[j].Name })
+	stripped := *q
+	stripped.Matchers = matchers
+	return &stripped, attach
+}
+
+// Contains reports whether name is one of the ignored labels.
+func (l IgnoredLabels) Contains(name string) bool {
+	for _, n := range l {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
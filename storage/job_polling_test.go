@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobPollingNext(t *testing.T) {
+	p := JobPolling{Interval: 100 * time.Millisecond, Backoff: 2, MaxInterval: time.Second}
+	want := []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	interval := p.Interval
+	for i, w := range want {
+		if interval = p.next(interval); interval != w {
+			t.Fatalf("poll %d waits %s, want %s", i+2, interval, w)
+		}
+	}
+	// no backoff keeps the interval
+	p.Backoff = 1
+	if got := p.next(p.Interval); got != p.Interval {
+		t.Errorf("without backoff the next poll waits %s, want %s", got, p.Interval)
+	}
+}
+
+func TestPollWait(t *testing.T) {
+	for _, c := range []struct {
+		progress, runDuration float64
+		want                  time.Duration
+	}{
+		// nothing known of the job yet
+		{0, 0, time.Second},
+		// half done after 200ms, the rest is likely done in 200ms
+		{0.5, 0.2, 200 * time.Millisecond},
+		// slower than the interval
+		{0.1, 1, time.Second},
+		// almost done, but not polled in a busy loop
+		{0.999, 1, minPollWait},
+		{1, 1, time.Second},
+	} {
+		if got := pollWait(time.Second, c.progress, c.runDuration); got != c.want {
+			t.Errorf("pollWait at progress %v after %vs = %s, want %s", c.progress, c.runDuration, got, c.want)
+		}
+	}
+}
+
+func TestReadPollsDoneJobRightAway(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) {
+		return metricRows(), [][]string{{rfc3339(1000), "up", "1"}}
+	})
+	defer f.Close()
+	interval := time.Second
+	c := f.client(WithJobPolling(JobPolling{Interval: interval, Backoff: 2, MaxInterval: 2 * interval}))
+	started := time.Now()
+	res := readQuery(t, c)
+	if took := time.Since(started); took > interval/4 {
+		t.Errorf("read of an instantly done search took %s, want well under the poll interval of %s", took, interval)
+	}
+	if len(res.Timeseries) != 1 {
+		t.Fatalf("got %d series, want 1", len(res.Timeseries))
+	}
+	if f.polls != 1 {
+		t.Errorf("polled the job %d times, want once", f.polls)
+	}
+}
+
+func TestReadOneshotBelowThreshold(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) {
+		return metricRows(), [][]string{{rfc3339(1000), "up", "1"}}
+	})
+	defer f.Close()
+	// the read range of readQuery is a minute
+	for _, c := range []struct {
+		threshold  time.Duration
+		dispatched int
+	}{
+		{time.Hour, 0},
+		{time.Second, 1},
+	} {
+		f.dispatched = 0
+		res := readQuery(t, f.client(WithOneshotThreshold(c.threshold)))
+		if len(res.Timeseries) != 1 {
+			t.Fatalf("threshold %s: got %d series, want 1", c.threshold, len(res.Timeseries))
+		}
+		if f.dispatched != c.dispatched {
+			t.Errorf("threshold %s: dispatched %d jobs, want %d", c.threshold, f.dispatched, c.dispatched)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LabelQuery selects the series whose label names or values are searched.
+type LabelQuery struct {
+	// Selectors match series by any of them, none matches all series.
+	Selectors  [][]*prompb.LabelMatcher
+	Start, End int64
+}
+
+// LabelSearcher finds label names and values of series in a time range,
+// unlike the metric catalog which knows them only for all time.
+type LabelSearcher interface {
+	SearchLabelNames(ctx context.Context, q LabelQuery) ([]string, error)
+	SearchLabelValues(ctx context.Context, name string, q LabelQuery) ([]string, error)
+}
+
+// WithLabelSearch returns at most limit label names or values per search and
+// caches them for cacheTTL, 0 disables the cache.
+func WithLabelSearch(limit int, cacheTTL time.Duration) Option {
+	return func(c *Client) {
+		c.labelLimit = limit
+		if cacheTTL > 0 {
+			c.labelCache = &labelCache{ttl: cacheTTL, entries: make(map[string]labelCacheEntry)}
+		}
+	}
+}
+
+func (c *Client) SearchLabelNames(ctx context.Context, q LabelQuery) ([]string, error) {
+	values, err := c.withCredentials(ctx).searchCatalog(ctx, "_dims", q)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{"__name__"}
+	for _, v := range values {
+		if v == "source" || v == "sourcetype" {
+			continue
+		}
+		if name, ok := c.fieldPrefix.prometheus(v); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *Client) SearchLabelValues(ctx context.Context, name string, q LabelQuery) ([]string, error) {
+	if name == "__name__" {
+		values, err := c.withCredentials(ctx).searchCatalog(ctx, "metric_name", q)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(values))
+		for _, v := range values {
+			if name, ok := c.metricNames.prometheus(v); ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	if !isLabelName(name, false) {
+		return nil, queryErrorf("invalid label name %q", name)
+	}
+	return c.withCredentials(ctx).searchCatalog(ctx, c.fieldPrefix.splunk(name), q)
+}
+
+// searchCatalog returns the sorted distinct values of field in the metric
+// catalog of the series matching q. They may be cached, callers must not
+// modify them.
+func (c *Client) searchCatalog(ctx context.Context, field string, q LabelQuery) ([]string, error) {
+	filter, err := c.selectorsFilter(q.Selectors)
+	if err != nil {
+		return nil, err
+	}
+	// multivalue fields don't fit json_rows, values are expanded to rows
+	search := "| mcatalog values(" + field + ") as value where " + indexFilter(c.indexes()) + filter + " | mvexpand value"
+	if c.labelLimit > 0 {
+		search += " | head " + strconv.Itoa(c.labelLimit)
+	}
+	key := c.credentials().cacheKey() + "\xff" + search + "\xff" + strconv.FormatInt(q.Start/1000, 10) + "\xff" + strconv.FormatInt(q.End/1000, 10)
+	if values, ok := c.labelCache.get(key); ok {
+		return values, nil
+	}
+	if c.searchLimiter != nil {
+		release, err := c.searchLimiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	res, err := c.runSearchWithResult(ctx, search, q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+	col := -1
+	for i, f := range res.Fields {
+		if f == "value" {
+			col = i
+		}
+	}
+	values := make([]string, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		if col >= 0 && col < len(row) {
+			values = append(values, row[col])
+		}
+	}
+	sort.Strings(values)
+	c.labelCache.put(key, values)
+	return values, nil
+}
+
+// selectorsFilter translates selectors into a where clause matching series
+// of any of them. mcatalog can't match regexes, only = and != are allowed,
+// and can't compare exactly, values with the * wildcard are rejected.
+func (c *Client) selectorsFilter(selectors [][]*prompb.LabelMatcher) (string, error) {
+	ors := make([]string, 0, len(selectors))
+	for _, matchers := range selectors {
+		ands := make([]string, 0, len(matchers))
+		for _, m := range matchers {
+			name, value := m.Name, m.Value
+			if name == "__name__" {
+				name, value = "metric_name", c.metricNames.splunk(value)
+			} else if !isLabelName(name, false) {
+				return "", queryErrorf("invalid label name %q", name)
+			} else {
+				name = c.fieldPrefix.splunk(name)
+			}
+			if strings.Contains(value, "*") {
+				return "", queryErrorf("label values with * can't be searched, it is a wildcard in Splunk")
+			}
+			switch {
+			case m.Type == prompb.LabelMatcher_EQ && value == "":
+				ands = append(ands, "NOT "+name+"=*")
+			case m.Type == prompb.LabelMatcher_EQ:
+				ands = append(ands, name+"="+splString(value))
+			case m.Type == prompb.LabelMatcher_NEQ && value == "":
+				ands = append(ands, name+"=*")
+			case m.Type == prompb.LabelMatcher_NEQ:
+				ands = append(ands, "NOT "+name+"="+splString(value))
+			default:
+				return "", queryErrorf("only = and != matchers are supported when searching labels")
+			}
+		}
+		if len(ands) > 0 {
+			ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+		}
+	}
+	if len(ors) < len(selectors) || len(ors) == 0 {
+		// a selector without matchers matches all series
+		return "", nil
+	}
+	return " AND (" + strings.Join(ors, " OR ") + ")", nil
+}
+
+// labelCache keeps label search results briefly, e.g. for Grafana variables
+// refreshed by every dashboard load.
+type labelCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]labelCacheEntry
+}
+
+type labelCacheEntry struct {
+	values  []string
+	expires time.Time
+}
+
+func (lc *labelCache) get(key string) ([]string, bool) {
+	if lc == nil {
+		return nil, false
+	}
+	lc.mtx.Lock()
+	defer lc.mtx.Unlock()
+	e, ok := lc.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.values, true
+}
+
+func (lc *labelCache) put(key string, values []string) {
+	if lc == nil {
+		return
+	}
+	now := time.Now()
+	lc.mtx.Lock()
+	defer lc.mtx.Unlock()
+	for k, e := range lc.entries {
+		if now.After(e.expires) {
+			delete(lc.entries, k)
+		}
+	}
+	lc.entries[key] = labelCacheEntry{values: values, expires: now.Add(lc.ttl)}
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLabelCacheKeyedByPassword(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		return []string{"value"}, [][]string{{"up"}}
+	})
+	defer f.Close()
+	f.passwords = map[string]string{"alice": "secret"}
+	c := f.client(WithLabelSearch(0, time.Minute))
+	q := LabelQuery{Start: 0, End: 60000}
+	search := func(password string) error {
+		_, err := c.SearchLabelValues(ContextWithCredentials(context.Background(), "alice", password), "__name__", q)
+		return err
+	}
+	if err := search("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := search("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.searchCount(); n != 1 {
+		t.Fatalf("searches = %d after a repeated search, want 1", n)
+	}
+	if err := search("wrong"); err == nil {
+		t.Fatal("a wrong password was answered from the cache")
+	}
+}
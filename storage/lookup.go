@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lookups add the fields of Splunk lookup tables, CSV files with a header
+// row, to written series as labels, e.g. the team and env of their pod_name.
+// The tables are read again once older than ttl.
+type Lookups struct {
+	lookups []*lookup
+	ttl     time.Duration
+	log     log.Logger
+}
+
+type lookup struct {
+	// Label is looked up in the KeyField column of File, Label by default.
+	Label    string   `yaml:"label"`
+	File     string   `yaml:"file"`
+	KeyField string   `yaml:"key_field"`
+	Fields   []string `yaml:"fields"`
+
+	mtx    sync.Mutex
+	loaded time.Time
+	rows   map[string][]prompb.Label
+}
+
+type lookupsFile struct {
+	Lookups []*lookup `yaml:"lookups"`
+}
+
+// LoadLookups reads the lookups of a YAML file like
+//
+//	lookups:
+//	  - label: pod_name
+//	    file: /etc/ropee/pods.csv
+//	    fields: [team, env]
+//
+// and their tables.
+func LoadLookups(filename string, ttl time.Duration, logger log.Logger) (*Lookups, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f lookupsFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	for i, l := range f.Lookups {
+		if l.Label == "" || l.File == "" || len(l.Fields) == 0 {
+			return nil, fmt.Errorf("lookup %d: label, file and fields are required", i+1)
+		}
+		for _, field := range l.Fields {
+			if !isLabelName(field, false) {
+				return nil, fmt.Errorf("lookup %d: field %q is no valid label name", i+1, field)
+			}
+		}
+		if l.KeyField == "" {
+			l.KeyField = l.Label
+		}
+		if err := l.load(); err != nil {
+			return nil, fmt.Errorf("lookup %d: %s", i+1, err)
+		}
+	}
+	return &Lookups{lookups: f.Lookups, ttl: ttl, log: logger}, nil
+}
+
+// WithLookups adds the fields of the lookup tables of l to written series.
+func WithLookups(l *Lookups) Option {
+	return func(c *Client) {
+		c.lookups = l
+	}
+}
+
+// load reads the table of l, keeping the fields of the first row of each
+// key.
+func (l *lookup) load() error {
+	f, err := os.Open(l.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("read header of %s: %s", l.File, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	key, ok := columns[l.KeyField]
+	if !ok {
+		return fmt.Errorf("%s has no column %s", l.File, l.KeyField)
+	}
+	for _, field := range l.Fields {
+		if _, ok := columns[field]; !ok {
+			return fmt.Errorf("%s has no column %s", l.File, field)
+		}
+	}
+	rows := make(map[string][]prompb.Label)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %s", l.File, err)
+		}
+		if _, ok := rows[record[key]]; ok {
+			continue
+		}
+		labels := make([]prompb.Label, 0, len(l.Fields))
+		for _, field := range l.Fields {
+			if value := record[columns[field]]; value != "" {
+				labels = append(labels, prompb.Label{Name: field, Value: value})
+			}
+		}
+		rows[record[key]] = labels
+	}
+	l.mtx.Lock()
+	l.rows, l.loaded = rows, time.Now()
+	l.mtx.Unlock()
+	return nil
+}
+
+// fields returns the fields of the row of value, reading the table again
+// first if it is older than ttl. A table failing to be read again is used
+// as it is until the next attempt after ttl.
+func (l *lookup) fields(value string, ttl time.Duration, logger log.Logger) []prompb.Label {
+	l.mtx.Lock()
+	stale := ttl > 0 && time.Since(l.loaded) > ttl
+	if stale {
+		// other writes keep using the table while it is read
+		l.loaded = time.Now()
+	}
+	l.mtx.Unlock()
+	if stale {
+		if err := l.load(); err != nil {
+			level.Warn(logger).Log("msg", "reload lookup table error, keeping the previous one", "file", l.File, "err", err)
+		}
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.rows[value]
+}
+
+// enrich returns labels with the fields of the rows of their values in the
+// lookup tables, labels already present aren't overwritten.
+func (ls *Lookups) enrich(labels []prompb.Label) []prompb.Label {
+	if ls == nil {
+		return labels
+	}
+	res := labels
+	for _, l := range ls.lookups {
+		value, ok := labelValue(labels, l.Label)
+		if !ok {
+			continue
+		}
+		for _, field := range l.fields(value, ls.ttl, ls.log) {
+			if _, ok := labelValue(res, field.Name); ok {
+				continue
+			}
+			if len(res) == len(labels) {
+				// copy, the series may be shared with other clients
+				res = append([]prompb.Label(nil), labels...)
+			}
+			res = append(res, field)
+		}
+	}
+	return res
+}
+
+func labelValue(labels []prompb.Label, name string) (string, bool) {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value, true
+		}
+	}
+	return "", false
+}
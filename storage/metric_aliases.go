@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+)
+
+// MetricAliases keep metrics readable under their old names while they are
+// renamed. Series of a new name are also written under its old names, and
+// queries of an old name read the series of the new one.
+type MetricAliases struct {
+	// renamed maps old names to new ones, aliases new ones to old ones.
+	renamed map[string]string
+	aliases map[string][]string
+}
+
+type metricAliasesFile struct {
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+// LoadMetricAliases reads the old and new metric names from a YAML file like
+//
+//	aliases:
+//	  http_requests_total: http_server_requests_total
+//
+// A new name can't be renamed itself.
+func LoadMetricAliases(filename string) (*MetricAliases, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f metricAliasesFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	res := &MetricAliases{
+		renamed: make(map[string]string),
+		aliases: make(map[string][]string),
+	}
+	for old, renamed := range f.Aliases {
+		if !isLabelName(old, true) || !isLabelName(renamed, true) {
+			return nil, fmt.Errorf("alias %s: %s: invalid metric name", old, renamed)
+		}
+		if old == renamed {
+			return nil, fmt.Errorf("alias %s: renamed to itself", old)
+		}
+		if _, ok := f.Aliases[renamed]; ok {
+			return nil, fmt.Errorf("alias %s: %s is renamed too", old, renamed)
+		}
+		res.renamed[old] = renamed
+		res.aliases[renamed] = append(res.aliases[renamed], old)
+	}
+	for _, olds := range res.aliases {
+		sort.Strings(olds)
+	}
+	return res, nil
+}
+
+// WithMetricAliases writes and reads the metrics renamed in a under their
+// old names too.
+func WithMetricAliases(a *MetricAliases) Option {
+	return func(c *Client) {
+		c.metricAliases = a
+	}
+}
+
+// expand returns series with a copy of each series of a renamed metric per
+// old name, after the series.
+func (a *MetricAliases) expand(series []prompb.TimeSeries) []prompb.TimeSeries {
+	if a == nil {
+		return series
+	}
+	res := series[:len(series):len(series)]
+	for _, ts := range series {
+		for _, old := range a.aliases[metricName(ts.Labels)] {
+			alias := prompb.TimeSeries{Labels: append([]prompb.Label(nil), ts.Labels...), Samples: ts.Samples}
+			setMetricName(alias.Labels, old)
+			res = append(res, alias)
+		}
+	}
+	return res
+}
+
+// translate returns q with an = matcher on an old metric name replaced by
+// one on its new name, and the old name, which the series of q's result are
+// renamed back to. q is returned as it is if it doesn't query an old name.
+func (a *MetricAliases) translate(q *prompb.Query) (*prompb.Query, string) {
+	if a == nil {
+		return q, ""
+	}
+	for i, m := range q.Matchers {
+		if m.Name != "__name__" || m.Type != prompb.LabelMatcher_EQ {
+			continue
+		}
+		renamed, ok := a.renamed[m.Value]
+		if !ok {
+			continue
+		}
+		translated := *q
+		translated.Matchers = append([]*prompb.LabelMatcher(nil), q.Matchers...)
+		translated.Matchers[i] = &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: renamed}
+		return &translated, m.Value
+	}
+	return q, ""
+}
+
+func metricName(labels []prompb.Label) string {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// setMetricName replaces the value of the __name__ label of labels, which
+// needn't be sorted.
+func setMetricName(labels []prompb.Label, name string) {
+	for i := range labels {
+		if labels[i].Name == "__name__" {
+			labels[i].Value = name
+		}
+	}
+}
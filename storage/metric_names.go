@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// MetricNames maps Prometheus metric names to the names stored in Splunk,
+// e.g. under a namespace prefix added at ingestion.
+type MetricNames struct {
+	Prefix, Suffix string
+}
+
+// WithMetricNames sets how metric names read from Splunk are mapped.
+func WithMetricNames(n MetricNames) Option {
+	return func(c *Client) {
+		c.metricNames = n
+	}
+}
+
+// splunk returns the Splunk name of the Prometheus metric name.
+func (n MetricNames) splunk(name string) string {
+	return n.Prefix + name + n.Suffix
+}
+
+// prometheus returns the Prometheus name of the Splunk metric name, false if
+// name lacks the prefix or suffix and can't be queried.
+func (n MetricNames) prometheus(name string) (string, bool) {
+	if len(name) < len(n.Prefix)+len(n.Suffix) || !strings.HasPrefix(name, n.Prefix) || !strings.HasSuffix(name, n.Suffix) {
+		return name, false
+	}
+	return name[len(n.Prefix) : len(name)-len(n.Suffix)], true
+}
+
+// maxNamePatterns bounds the wildcard patterns a metric name regex is
+// narrowed to, more are searched as one *.
+const maxNamePatterns = 16
+
+// namePatterns returns Splunk wildcard patterns together matching at least
+// the names matched by the fully anchored regex re, e.g. node_cpu_* for
+// node_cpu_.+ or node_cpu_* and node_memory_* for node_(cpu|memory)_.*.
+// Anything but literals becomes *, so the regex still has to be applied to
+// the matching names.
+func namePatterns(re string) []string {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return []string{"*"}
+	}
+	patterns := wildcards(parsed.Simplify())
+	for _, p := range patterns {
+		if p == "*" {
+			return []string{"*"}
+		}
+	}
+	return patterns
+}
+
+func wildcards(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return []string{string(re.Rune)}
+		}
+	case syntax.OpCapture:
+		return wildcards(re.Sub[0])
+	case syntax.OpAlternate:
+		res := make([]string, 0, len(re.Sub))
+		for _, sub := range re.Sub {
+			res = append(res, wildcards(sub)...)
+		}
+		if len(res) <= maxNamePatterns {
+			return res
+		}
+	case syntax.OpConcat:
+		res := []string{""}
+		for _, sub := range re.Sub {
+			next := make([]string, 0, len(res))
+			for _, prefix := range res {
+				for _, p := range wildcards(sub) {
+					next = append(next, joinWildcards(prefix, p))
+				}
+			}
+			if len(next) > maxNamePatterns {
+				return []string{"*"}
+			}
+			res = next
+		}
+		return res
+	}
+	return []string{"*"}
+}
+
+// joinWildcards concatenates two patterns, merging adjacent *.
+func joinWildcards(a, b string) string {
+	if strings.HasSuffix(a, "*") && strings.HasPrefix(b, "*") {
+		return a + b[1:]
+	}
+	return a + b
+}
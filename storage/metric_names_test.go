@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNamePatterns(t *testing.T) {
+	for re, want := range map[string][]string{
+		// prefix
+		"node_cpu.*":  {"node_cpu*"},
+		"node_cpu_.+": {"node_cpu_*"},
+		// suffix
+		".*_total":        {"*_total"},
+		".+_bucket":       {"*_bucket"},
+		"node_.*_seconds": {"node_*_seconds"},
+		// alternation
+		"up|probe_success":     {"up", "probe_success"},
+		"node_(cpu|memory)_.*": {"node_cpu_*", "node_memory_*"},
+		"(?i)up":               {"*"},
+		".*":                   {"*"},
+	} {
+		if got := namePatterns(re); !reflect.DeepEqual(got, want) {
+			t.Errorf("namePatterns(%q) = %q, want %q", re, got, want)
+		}
+	}
+}
+
+func TestMakeSPLMetricNameRegex(t *testing.T) {
+	for re, want := range map[string][]string{
+		"node_cpu.*": {`metric_name="node_cpu*"`, `| where match(metric_name, "^(?:(?:node_cpu.*))\\z")`},
+		".*_total":   {`metric_name="*_total"`, `| where match(metric_name, "^(?:(?:.*_total))\\z")`},
+		"node_(cpu|memory)_.*": {
+			`(metric_name="node_cpu_*" OR metric_name="node_memory_*")`,
+			`| where match(metric_name, "^(?:(?:node_(cpu|memory)_.*))\\z")`,
+		},
+	} {
+		q := &prompb.Query{EndTimestampMs: 60000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: re}}}
+		search, err := MakeSPL(q, dimensionsClient{}, "index=metrics", Downsampling{}, MetricNames{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range want {
+			if !strings.Contains(search, w) {
+				t.Errorf("search of __name__=~%q = %s, want it to contain %s", re, search, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kebe7jun/ropee/internal/wire"
+	"github.com/kebe7jun/ropee/transform"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The prompb package ropee builds against predates native histograms
+// (Prometheus 2.40), unmarshaling a WriteRequest drops them. They are
+// decoded from the raw request here, following the Histogram and
+// BucketSpan messages of prompb/types.proto.
+const (
+	// WriteRequest.timeseries
+	writeRequestTimeseriesField = 1
+	// TimeSeries.labels and TimeSeries.histograms
+	timeSeriesLabelsField     = 1
+	timeSeriesHistogramsField = 4
+
+	// customBucketsSchema is the schema of histograms with the explicit
+	// bounds of Histogram.custom_values.
+	customBucketsSchema = -53
+)
+
+// nativeHistogram is one sample of a native histogram.
+type nativeHistogram struct {
+	count, sum, zeroThreshold, zeroCount float64
+	schema                               int32
+	timestamp                            int64
+	positive, negative                   []nativeBucket
+	customValues                         []float64
+}
+
+// nativeBucket is a populated bucket with its count, index i covers
+// (base^(i-1), base^i] of positive and [-base^i, -base^(i-1)) of negative
+// values.
+type nativeBucket struct {
+	index int32
+	count float64
+}
+
+// ExpandNativeHistograms returns the native histograms of the raw, decoded
+// WriteRequest reqBuf as the series of classic histograms: <name>_bucket
+// with cumulative counts per le, the upper bounds of the populated buckets
+// and the zero bucket, and <name>_sum and <name>_count. Counts and sums are
+// kept as they are, the +Inf bucket holds the total count. Only the first
+// maxSeries series of the request are expanded, all with 0.
+func ExpandNativeHistograms(reqBuf []byte, maxSeries int) ([]prompb.TimeSeries, error) {
+	res := make([]prompb.TimeSeries, 0)
+	series := 0
+	err := wire.EachField(reqBuf, func(f wire.Field) error {
+		if f.Num != writeRequestTimeseriesField || f.Wire != 2 {
+			return nil
+		}
+		if series++; maxSeries > 0 && series > maxSeries {
+			return nil
+		}
+		labels, histograms, err := decodeHistogramSeries(f.Data)
+		if err != nil || len(histograms) == 0 {
+			return err
+		}
+		res = append(res, expandHistograms(labels, histograms)...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode native histograms: %s", err)
+	}
+	return res, nil
+}
+
+// decodeHistogramSeries returns the labels and native histograms of a raw
+// TimeSeries.
+func decodeHistogramSeries(msg []byte) ([]prompb.Label, []nativeHistogram, error) {
+	labels := make([]prompb.Label, 0)
+	histograms := make([]nativeHistogram, 0)
+	err := wire.EachField(msg, func(f wire.Field) error {
+		if f.Wire != 2 {
+			return nil
+		}
+		switch f.Num {
+		case timeSeriesLabelsField:
+			var l prompb.Label
+			err := wire.EachField(f.Data, func(lf wire.Field) error {
+				switch {
+				case lf.Num == 1 && lf.Wire == 2:
+					l.Name = string(lf.Data)
+				case lf.Num == 2 && lf.Wire == 2:
+					l.Value = string(lf.Data)
+				}
+				return nil
+			})
+			labels = append(labels, l)
+			return err
+		case timeSeriesHistogramsField:
+			h, err := decodeNativeHistogram(f.Data)
+			histograms = append(histograms, h)
+			return err
+		}
+		return nil
+	})
+	return labels, histograms, err
+}
+
+func decodeNativeHistogram(msg []byte) (nativeHistogram, error) {
+	var (
+		h                              nativeHistogram
+		positiveSpans, negativeSpans   [][2]int64
+		positiveDeltas, negativeDeltas []int64
+		positiveCounts, negativeCounts []float64
+	)
+	err := wire.EachField(msg, func(f wire.Field) error {
+		switch f.Num {
+		// count_int and count_float
+		case 1:
+			h.count = float64(f.Value)
+		case 2:
+			h.count = math.Float64frombits(f.Value)
+		case 3:
+			h.sum = math.Float64frombits(f.Value)
+		case 4:
+			h.schema = int32(wire.Zigzag(f.Value))
+		case 5:
+			h.zeroThreshold = math.Float64frombits(f.Value)
+		// zero_count_int and zero_count_float
+		case 6:
+			h.zeroCount = float64(f.Value)
+		case 7:
+			h.zeroCount = math.Float64frombits(f.Value)
+		case 8, 11:
+			var span [2]int64
+			err := wire.EachField(f.Data, func(sf wire.Field) error {
+				switch sf.Num {
+				case 1:
+					span[0] = wire.Zigzag(sf.Value)
+				case 2:
+					span[1] = int64(sf.Value)
+				}
+				return nil
+			})
+			if f.Num == 8 {
+				negativeSpans = append(negativeSpans, span)
+			} else {
+				positiveSpans = append(positiveSpans, span)
+			}
+			return err
+		case 9, 12:
+			vs, err := f.Varints()
+			for _, v := range vs {
+				if f.Num == 9 {
+					negativeDeltas = append(negativeDeltas, wire.Zigzag(v))
+				} else {
+					positiveDeltas = append(positiveDeltas, wire.Zigzag(v))
+				}
+			}
+			return err
+		case 10:
+			negativeCounts = append(negativeCounts, f.Doubles()...)
+		case 13:
+			positiveCounts = append(positiveCounts, f.Doubles()...)
+		case 15:
+			h.timestamp = int64(f.Value)
+		case 16:
+			h.customValues = append(h.customValues, f.Doubles()...)
+		}
+		return nil
+	})
+	if err != nil {
+		return h, err
+	}
+	if h.positive, err = nativeBuckets(positiveSpans, positiveDeltas, positiveCounts); err != nil {
+		return h, err
+	}
+	h.negative, err = nativeBuckets(negativeSpans, negativeDeltas, negativeCounts)
+	return h, err
+}
+
+// nativeBuckets resolves the spans of a histogram into its buckets. Integer
+// histograms delta encode the counts of consecutive buckets, float ones
+// carry absolute counts.
+func nativeBuckets(spans [][2]int64, deltas []int64, counts []float64) ([]nativeBucket, error) {
+	values := counts
+	if len(deltas) > 0 {
+		values = make([]float64, len(deltas))
+		current := int64(0)
+		for i, d := range deltas {
+			current += d
+			values[i] = float64(current)
+		}
+	}
+	buckets := make([]nativeBucket, 0, len(values))
+	index := int64(0)
+	for i, span := range spans {
+		// the offset of the first span is the index of its first bucket,
+		// those of others the gap to the previous span
+		if i == 0 {
+			index = span[0]
+		} else {
+			index += span[0]
+		}
+		for j := int64(0); j < span[1]; j++ {
+			if len(buckets) >= len(values) {
+				return nil, errors.New("histogram spans cover more buckets than it has counts")
+			}
+			buckets = append(buckets, nativeBucket{index: int32(index), count: values[len(buckets)]})
+			index++
+		}
+	}
+	return buckets, nil
+}
+
+// upperBound returns the upper bound of the positive bucket index of h.
+func (h nativeHistogram) upperBound(index int32) float64 {
+	if h.schema == customBucketsSchema {
+		if int(index) < len(h.customValues) && index >= 0 {
+			return h.customValues[index]
+		}
+		return math.Inf(1)
+	}
+	return exponentialBound(index, h.schema)
+}
+
+// bucketCounts returns the upper bounds of the buckets of h with their
+// counts, ordered by bound: the negative buckets, the zero bucket and the
+// positive buckets.
+func (h nativeHistogram) bucketCounts() []nativeBound {
+	res := make([]nativeBound, 0, len(h.negative)+len(h.positive)+1)
+	for i := len(h.negative) - 1; i >= 0; i-- {
+		b := h.negative[i]
+		res = append(res, nativeBound{le: -h.upperBound(b.index - 1), count: b.count})
+	}
+	if h.schema != customBucketsSchema {
+		res = append(res, nativeBound{le: h.zeroThreshold, count: h.zeroCount})
+	}
+	for _, b := range h.positive {
+		res = append(res, nativeBound{le: h.upperBound(b.index), count: b.count})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].le < res[j].le })
+	return res
+}
+
+type nativeBound struct {
+	le, count float64
+}
+
+// expandHistograms returns the classic histogram series of the samples of
+// one native histogram series. Its buckets may differ from sample to
+// sample, every sample gets the cumulative count of each bound of any of
+// them.
+func expandHistograms(labels []prompb.Label, histograms []nativeHistogram) []prompb.TimeSeries {
+	name := ""
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+		}
+	}
+	counts := make([][]nativeBound, len(histograms))
+	bounds := make(map[float64]bool)
+	for i, h := range histograms {
+		counts[i] = h.bucketCounts()
+		for _, b := range counts[i] {
+			if !math.IsInf(b.le, 1) {
+				bounds[b.le] = true
+			}
+		}
+	}
+	les := make([]float64, 0, len(bounds))
+	for le := range bounds {
+		les = append(les, le)
+	}
+	sort.Float64s(les)
+	series := func(suffix, le string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{Labels: append([]prompb.Label(nil), labels...)}
+		transform.SetLabel(&ts, "__name__", name+suffix)
+		if le != "" {
+			transform.SetLabel(&ts, "le", le)
+		}
+		return ts
+	}
+	res := make([]prompb.TimeSeries, 0, len(les)+3)
+	for _, le := range les {
+		ts := series("_bucket", strconv.FormatFloat(le, 'g', -1, 64))
+		for i, h := range histograms {
+			cumulative := 0.0
+			for _, b := range counts[i] {
+				if b.le > le {
+					break
+				}
+				cumulative += b.count
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: cumulative, Timestamp: h.timestamp})
+		}
+		res = append(res, ts)
+	}
+	inf, sum, count := series("_bucket", "+Inf"), series("_sum", ""), series("_count", "")
+	for _, h := range histograms {
+		inf.Samples = append(inf.Samples, prompb.Sample{Value: h.count, Timestamp: h.timestamp})
+		sum.Samples = append(sum.Samples, prompb.Sample{Value: h.sum, Timestamp: h.timestamp})
+		count.Samples = append(count.Samples, prompb.Sample{Value: h.count, Timestamp: h.timestamp})
+	}
+	return append(res, inf, sum, count)
+}
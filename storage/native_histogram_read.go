@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Native histograms are written as classic histograms, see
+// ExpandNativeHistograms. Prometheus selects them by their own name, which
+// has no series, so reads of a name without any fall back to its classic
+// series, and responses carry the Histogram messages rebuilt of them. The
+// prompb package ropee builds against has no Histogram, they are encoded
+// by hand, following prompb/types.proto.
+const (
+	// ReadResponse.results
+	readResponseResultsField = 1
+	// QueryResult.timeseries
+	queryResultTimeseriesField = 1
+
+	// the schemas of exponential buckets, of bases 2^16 to 2^(2^-8)
+	minExponentialSchema = -4
+	maxExponentialSchema = 8
+)
+
+// WithNativeHistogramRead answers queries of a metric name without series
+// with the classic histogram series of the name, <name>_bucket, <name>_sum
+// and <name>_count, for EncodeNativeHistograms to turn into native
+// histograms.
+func WithNativeHistogramRead() Option {
+	return func(c *Client) {
+		c.nativeHistogramRead = true
+	}
+}
+
+// histogramName returns the metric name q selects by an = matcher if it may
+// be that of a native histogram, "" otherwise.
+func histogramName(q *prompb.Query) string {
+	for _, m := range q.Matchers {
+		if m.Name != "__name__" || m.Type != prompb.LabelMatcher_EQ {
+			continue
+		}
+		for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+			if strings.HasSuffix(m.Value, suffix) {
+				return ""
+			}
+		}
+		return m.Value
+	}
+	return ""
+}
+
+// histogramQuery returns q selecting the classic histogram series of its
+// metric name instead, nil if q doesn't select a native histogram.
+func histogramQuery(q *prompb.Query) *prompb.Query {
+	name := histogramName(q)
+	if name == "" {
+		return nil
+	}
+	hq := *q
+	hq.Matchers = make([]*prompb.LabelMatcher, 0, len(q.Matchers))
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" && m.Type == prompb.LabelMatcher_EQ {
+			m = &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: regexp.QuoteMeta(name) + "_(?:bucket|count|sum)"}
+		}
+		hq.Matchers = append(hq.Matchers, m)
+	}
+	return &hq
+}
+
+// EncodedResponse is a hand encoded ReadResponse.
+type EncodedResponse []byte
+
+func (r EncodedResponse) Size() int {
+	return len(r)
+}
+
+func (r EncodedResponse) MarshalTo(b []byte) (int, error) {
+	return copy(b, r), nil
+}
+
+// EncodeNativeHistograms returns resp encoded with the classic histogram
+// series of each query of req selecting a native histogram by name as
+// native histogram series. Histograms with bounds that are all powers of
+// the base of an exponential schema get that schema, e.g. those expanded of
+// exponential native histograms, with the lowest non-negative bound as
+// their zero threshold. Other histograms get the custom buckets schema of
+// their bounds. Series with neither a _count nor an le="+Inf" _bucket stay
+// float series.
+func EncodeNativeHistograms(req *prompb.ReadRequest, resp *prompb.ReadResponse) (EncodedResponse, error) {
+	b := proto.NewBuffer(nil)
+	for i, res := range resp.Results {
+		name := ""
+		if i < len(req.Queries) {
+			name = histogramName(req.Queries[i])
+		}
+		floats, groups := histogramGroups(name, res.Timeseries)
+		data, err := proto.Marshal(&prompb.QueryResult{Timeseries: floats})
+		if err != nil {
+			return nil, err
+		}
+		result := proto.NewBuffer(data)
+		for _, g := range groups {
+			result.EncodeVarint(queryResultTimeseriesField<<3 | 2)
+			result.EncodeRawBytes(encodeHistogramSeries(g.labels, g.histograms()))
+		}
+		b.EncodeVarint(readResponseResultsField<<3 | 2)
+		b.EncodeRawBytes(result.Bytes())
+	}
+	return EncodedResponse(b.Bytes()), nil
+}
+
+// classicHistogram holds the classic histogram series of one label set by
+// their samples per timestamp.
+type classicHistogram struct {
+	labels     []prompb.Label
+	buckets    map[float64]map[int64]float64
+	sum, count map[int64]float64
+	series     []*prompb.TimeSeries
+}
+
+// histogramGroups returns the series of a query result that stay float
+// series and the classic histograms of name among them.
+func histogramGroups(name string, series []*prompb.TimeSeries) ([]*prompb.TimeSeries, []*classicHistogram) {
+	if name == "" {
+		return series, nil
+	}
+	floats := make([]*prompb.TimeSeries, 0, len(series))
+	groups := make([]*classicHistogram, 0)
+	byLabels := make(map[string]*classicHistogram)
+	for _, ts := range series {
+		suffix, le, labels := "", "", make([]prompb.Label, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				suffix = strings.TrimPrefix(l.Value, name)
+				if suffix == l.Value {
+					suffix = ""
+				}
+				labels = append(labels, prompb.Label{Name: l.Name, Value: name})
+			case "le":
+				le = l.Value
+			default:
+				labels = append(labels, l)
+			}
+		}
+		bound, err := strconv.ParseFloat(le, 64)
+		if suffix != "_bucket" && suffix != "_sum" && suffix != "_count" || suffix == "_bucket" && err != nil {
+			floats = append(floats, ts)
+			continue
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		key := make([]string, 0, 2*len(labels))
+		for _, l := range labels {
+			key = append(key, l.Name, l.Value)
+		}
+		g, ok := byLabels[strings.Join(key, "\xff")]
+		if !ok {
+			g = &classicHistogram{labels: labels, buckets: make(map[float64]map[int64]float64), sum: make(map[int64]float64), count: make(map[int64]float64)}
+			byLabels[strings.Join(key, "\xff")] = g
+			groups = append(groups, g)
+		}
+		g.series = append(g.series, ts)
+		values := g.sum
+		switch suffix {
+		case "_count":
+			values = g.count
+		case "_bucket":
+			if values = g.buckets[bound]; values == nil {
+				values = make(map[int64]float64)
+				g.buckets[bound] = values
+			}
+		}
+		for _, s := range ts.Samples {
+			values[s.Timestamp] = s.Value
+		}
+	}
+	res := groups[:0]
+	for _, g := range groups {
+		if len(g.count) == 0 && len(g.buckets[math.Inf(1)]) == 0 {
+			floats = append(floats, g.series...)
+			continue
+		}
+		res = append(res, g)
+	}
+	return floats, res
+}
+
+// histograms returns the native histograms of g, one per timestamp of its
+// count.
+func (g *classicHistogram) histograms() []nativeHistogram {
+	counts := g.count
+	if len(counts) == 0 {
+		counts = g.buckets[math.Inf(1)]
+	}
+	timestamps := make([]int64, 0, len(counts))
+	for t := range counts {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	les := make([]float64, 0, len(g.buckets))
+	for le := range g.buckets {
+		if !math.IsInf(le, 1) {
+			les = append(les, le)
+		}
+	}
+	sort.Float64s(les)
+	cumulative := make([][]float64, len(timestamps))
+	exponential := true
+	for i, t := range timestamps {
+		// buckets missing a sample hold as many as the bucket below
+		cumulative[i] = make([]float64, len(les))
+		previous := 0.0
+		for j, le := range les {
+			if v, ok := g.buckets[le][t]; ok {
+				previous = v
+			}
+			cumulative[i][j] = previous
+		}
+		exponential = exponential && counts[t] == previous
+	}
+	schema, zero, ok := exponentialSchema(les)
+	res := make([]nativeHistogram, len(timestamps))
+	for i, t := range timestamps {
+		h := nativeHistogram{count: counts[t], sum: g.sum[t], timestamp: t}
+		if ok && exponential {
+			h.schema, h.zeroThreshold = schema, les[zero]
+			for j, le := range les {
+				count := cumulative[i][j]
+				if j > 0 {
+					count -= cumulative[i][j-1]
+				}
+				switch {
+				case j < zero:
+					h.negative = append(h.negative, nativeBucket{index: bucketIndex(-le, schema) + 1, count: count})
+				case j == zero:
+					h.zeroCount = count
+				default:
+					h.positive = append(h.positive, nativeBucket{index: bucketIndex(le, schema), count: count})
+				}
+			}
+		} else {
+			h.schema, h.customValues = customBucketsSchema, les
+			previous := 0.0
+			for j := range les {
+				h.positive = append(h.positive, nativeBucket{index: int32(j), count: cumulative[i][j] - previous})
+				previous = cumulative[i][j]
+			}
+			h.positive = append(h.positive, nativeBucket{index: int32(len(les)), count: h.count - previous})
+		}
+		res[i] = h
+	}
+	return res
+}
+
+// exponentialSchema returns the coarsest exponential schema whose buckets
+// have the bounds les, but for the lowest non-negative one at index zero,
+// the threshold of its zero bucket. Buckets must not overlap the zero bucket.
+func exponentialSchema(les []float64) (int32, int, bool) {
+	zero := sort.SearchFloat64s(les, 0)
+	if zero == len(les) {
+		return 0, 0, false
+	}
+	threshold := les[zero]
+	for schema := int32(minExponentialSchema); schema <= maxExponentialSchema; schema++ {
+		ok := true
+		for j, le := range les {
+			if j == zero {
+				continue
+			}
+			abs := math.Abs(le)
+			index := bucketIndex(abs, schema)
+			switch {
+			case abs < threshold || exponentialBound(index, schema) != abs:
+				ok = false
+			case j == zero+1 && exponentialBound(index-1, schema) < threshold:
+				// the lowest positive bucket overlaps the zero bucket
+				ok = false
+			}
+		}
+		if ok {
+			return schema, zero, true
+		}
+	}
+	return 0, 0, false
+}
+
+// exponentialBound returns the upper bound of the positive bucket index of
+// schema, base^index with base 2^(2^-schema).
+func exponentialBound(index, schema int32) float64 {
+	return math.Exp2(math.Ldexp(float64(index), -int(schema)))
+}
+
+// bucketIndex returns the index of the positive bucket of schema with the
+// upper bound le.
+func bucketIndex(le float64, schema int32) int32 {
+	return int32(math.Round(math.Ldexp(math.Log2(le), int(schema))))
+}
+
+// encodeHistogramSeries encodes a TimeSeries of the labels and native
+// histograms.
+func encodeHistogramSeries(labels []prompb.Label, histograms []nativeHistogram) []byte {
+	b := proto.NewBuffer(nil)
+	for _, l := range labels {
+		label := proto.NewBuffer(nil)
+		label.EncodeVarint(1<<3 | 2)
+		label.EncodeStringBytes(l.Name)
+		label.EncodeVarint(2<<3 | 2)
+		label.EncodeStringBytes(l.Value)
+		b.EncodeVarint(timeSeriesLabelsField<<3 | 2)
+		b.EncodeRawBytes(label.Bytes())
+	}
+	for _, h := range histograms {
+		b.EncodeVarint(timeSeriesHistogramsField<<3 | 2)
+		b.EncodeRawBytes(encodeNativeHistogram(h))
+	}
+	return b.Bytes()
+}
+
+// encodeNativeHistogram encodes h as a float Histogram, the field numbers
+// are those decodeNativeHistogram reads.
+func encodeNativeHistogram(h nativeHistogram) []byte {
+	b := proto.NewBuffer(nil)
+	double := func(field uint64, v float64) {
+		b.EncodeVarint(field<<3 | 1)
+		b.EncodeFixed64(math.Float64bits(v))
+	}
+	doubles := func(field uint64, vs []float64) {
+		packed := proto.NewBuffer(nil)
+		for _, v := range vs {
+			packed.EncodeFixed64(math.Float64bits(v))
+		}
+		b.EncodeVarint(field<<3 | 2)
+		b.EncodeRawBytes(packed.Bytes())
+	}
+	buckets := func(spansField, countsField uint64, buckets []nativeBucket) {
+		if len(buckets) == 0 {
+			return
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].index < buckets[j].index })
+		counts := make([]float64, len(buckets))
+		start := 0
+		for i := range buckets {
+			counts[i] = buckets[i].count
+			if i+1 < len(buckets) && buckets[i+1].index == buckets[i].index+1 {
+				continue
+			}
+			// the offset of the first span is the index of its first
+			// bucket, those of others the gap to the previous span
+			offset := buckets[start].index
+			if start > 0 {
+				offset -= buckets[start-1].index + 1
+			}
+			span := proto.NewBuffer(nil)
+			span.EncodeVarint(1<<3 | 0)
+			span.EncodeZigzag32(uint64(offset))
+			span.EncodeVarint(2<<3 | 0)
+			span.EncodeVarint(uint64(i + 1 - start))
+			b.EncodeVarint(spansField<<3 | 2)
+			b.EncodeRawBytes(span.Bytes())
+			start = i + 1
+		}
+		doubles(countsField, counts)
+	}
+	double(2, h.count)
+	double(3, h.sum)
+	b.EncodeVarint(4<<3 | 0)
+	b.EncodeZigzag32(uint64(h.schema))
+	if h.schema != customBucketsSchema {
+		double(5, h.zeroThreshold)
+		double(7, h.zeroCount)
+	}
+	buckets(8, 10, h.negative)
+	buckets(11, 13, h.positive)
+	b.EncodeVarint(15<<3 | 0)
+	b.EncodeVarint(uint64(h.timestamp))
+	if len(h.customValues) > 0 {
+		doubles(16, h.customValues)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/internal/wire"
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// latencyRead is a request of one query of latency.
+var latencyRead = &prompb.ReadRequest{Queries: []*prompb.Query{{
+	EndTimestampMs: 60000,
+	Matchers:       []*prompb.LabelMatcher{{Name: "__name__", Value: "latency"}},
+}}}
+
+// encodedHistograms returns the float series and the native histograms of
+// the series of the one result of EncodeNativeHistograms of resp.
+func encodedHistograms(t *testing.T, resp *prompb.ReadResponse) ([]*prompb.TimeSeries, map[string][]nativeHistogram) {
+	encoded, err := EncodeNativeHistograms(latencyRead, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded prompb.ReadResponse
+	if err := proto.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Results) != 1 {
+		t.Fatalf("decoded %d results of one", len(decoded.Results))
+	}
+	floats := make([]*prompb.TimeSeries, 0)
+	for _, ts := range decoded.Results[0].Timeseries {
+		if len(ts.Samples) > 0 {
+			floats = append(floats, ts)
+		}
+	}
+	histograms := make(map[string][]nativeHistogram)
+	err = wire.EachField(encoded, func(f wire.Field) error {
+		return wire.EachField(f.Data, func(series wire.Field) error {
+			labels, hs, err := decodeHistogramSeries(series.Data)
+			if len(hs) == 0 {
+				return err
+			}
+			key := make([]string, 0, len(labels))
+			for _, l := range labels {
+				key = append(key, l.Name+"="+l.Value)
+			}
+			histograms[strings.Join(key, ",")] = hs
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return floats, histograms
+}
+
+// expandedResponse returns a response of the series ExpandNativeHistograms
+// makes of the raw native histogram h.
+func expandedResponse(t *testing.T, h wire.Message) *prompb.ReadResponse {
+	series, err := ExpandNativeHistograms(histogramWrite(h), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &prompb.QueryResult{}
+	for i := range series {
+		res.Timeseries = append(res.Timeseries, &series[i])
+	}
+	return &prompb.ReadResponse{Results: []*prompb.QueryResult{res}}
+}
+
+func TestEncodeNativeHistogramsExponential(t *testing.T) {
+	// buckets (1, 2] and (2, 4] of schema 0 with 1 and 2 samples, 1 in
+	// the zero bucket, and a negative bucket [-2, -1) with 1
+	span := wire.Message{}.Varint(1, wire.ZigzagEncode(1)).Varint(2, 2)
+	negative := wire.Message{}.Varint(1, wire.ZigzagEncode(1)).Varint(2, 1)
+	h := wire.Message{}.
+		Double(2, 5).
+		Double(3, 8).
+		Varint(4, wire.ZigzagEncode(0)).
+		Double(5, 0.001).
+		Double(7, 1).
+		Bytes(8, negative).
+		Doubles(10, 1).
+		Bytes(11, span).
+		Doubles(13, 1, 2).
+		Varint(15, 1000)
+	floats, histograms := encodedHistograms(t, expandedResponse(t, h))
+	if len(floats) != 0 {
+		t.Errorf("kept the float series %v", floats)
+	}
+	want := []nativeHistogram{{
+		count:         5,
+		sum:           8,
+		zeroThreshold: 0.001,
+		zeroCount:     1,
+		timestamp:     1000,
+		positive:      []nativeBucket{{index: 1, count: 1}, {index: 2, count: 2}},
+		negative:      []nativeBucket{{index: 1, count: 1}},
+	}}
+	if got := histograms["__name__=latency"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rebuilt %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeNativeHistogramsCustomBuckets(t *testing.T) {
+	series := func(name, le string, v float64) *prompb.TimeSeries {
+		ts := &prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}, {Name: "job", Value: "api"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: v}},
+		}
+		if le != "" {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: "le", Value: le})
+		}
+		return ts
+	}
+	resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+		series("latency_bucket", "0.1", 1),
+		series("latency_bucket", "0.5", 3),
+		series("latency_bucket", "+Inf", 4),
+		series("latency_sum", "", 1.2),
+		series("latency_count", "", 4),
+		// another metric's series are kept as they are
+		series("latency_seconds", "", 7),
+	}}}}
+	floats, histograms := encodedHistograms(t, resp)
+	if len(floats) != 1 || seriesLabel(floats[0], "__name__") != "latency_seconds" {
+		t.Errorf("kept the float series %v, want latency_seconds", floats)
+	}
+	want := []nativeHistogram{{
+		count:        4,
+		sum:          1.2,
+		schema:       customBucketsSchema,
+		timestamp:    1000,
+		positive:     []nativeBucket{{index: 0, count: 1}, {index: 1, count: 2}, {index: 2, count: 1}},
+		negative:     []nativeBucket{},
+		customValues: []float64{0.1, 0.5},
+	}}
+	if got := histograms["__name__=latency,job=api"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rebuilt %+v, want %+v", got, want)
+	}
+}
+
+func TestExponentialSchema(t *testing.T) {
+	for _, c := range []struct {
+		les    []float64
+		schema int32
+		ok     bool
+	}{
+		{[]float64{0, 2, 4}, 0, true},
+		// sqrt(2) is a bound of schema 1 only
+		{[]float64{0, math.Exp2(0.5), 2}, 1, true},
+		{[]float64{0, 16, 65536}, -2, true},
+		// the bucket (2^-16, 1] of schema -4 would overlap the zero bucket
+		{[]float64{0.5, 1}, 0, true},
+		{[]float64{-4, 0.001, 2}, 0, true},
+		{[]float64{0.005, 0.01, 0.025}, 0, false},
+		{[]float64{-2, -1}, 0, false},
+	} {
+		schema, _, ok := exponentialSchema(c.les)
+		if ok != c.ok || ok && schema != c.schema {
+			t.Errorf("exponentialSchema(%v) = %d, %v, want %d, %v", c.les, schema, ok, c.schema, c.ok)
+		}
+	}
+}
+
+func TestReadNativeHistogramFallsBackToClassicSeries(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		if !strings.Contains(search, `metric_name="latency_bucket"`) {
+			return metricRows("le"), nil
+		}
+		return metricRows("le"), [][]string{
+			{rfc3339(1000), "latency_bucket", "3", "0.5"},
+			{rfc3339(1000), "latency_bucket", "4", "+Inf"},
+			{rfc3339(1000), "latency_count", "4", ""},
+			{rfc3339(1000), "latency_sum", "1.5", ""},
+		}
+	})
+	defer f.Close()
+	f.dimensions = []string{"le"}
+	resp, err := f.client(WithNativeHistogramRead()).Read(context.Background(), latencyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.searchCount() != 2 {
+		t.Fatalf("ran %d searches, want that of latency and that of its classic series", f.searchCount())
+	}
+	for _, name := range []string{"latency_bucket", "latency_count", "latency_sum"} {
+		if !strings.Contains(f.lastSearch(), `metric_name="`+name+`"`) {
+			t.Errorf("search %s doesn't search %s", f.lastSearch(), name)
+		}
+	}
+	_, histograms := encodedHistograms(t, resp)
+	got := histograms["__name__=latency"]
+	if len(got) != 1 || got[0].count != 4 || got[0].sum != 1.5 || !reflect.DeepEqual(got[0].customValues, []float64{0.5}) {
+		t.Errorf("rebuilt %+v, want a custom buckets histogram of 4 samples", got)
+	}
+}
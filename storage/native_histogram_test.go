@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"github.com/kebe7jun/ropee/internal/wire"
+	"reflect"
+	"testing"
+)
+
+// histogramWrite returns a raw WriteRequest of a series named latency with
+// the raw native histogram h.
+func histogramWrite(h wire.Message) []byte {
+	label := wire.Message{}.Str(1, "__name__").Str(2, "latency")
+	series := wire.Message{}.Bytes(timeSeriesLabelsField, label).Bytes(timeSeriesHistogramsField, h)
+	return wire.Message{}.Bytes(writeRequestTimeseriesField, series)
+}
+
+// expandedValues returns the value of each series of ExpandNativeHistograms
+// of reqBuf by its name and le.
+func expandedValues(t *testing.T, reqBuf []byte) map[string]float64 {
+	series, err := ExpandNativeHistograms(reqBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]float64)
+	for _, ts := range series {
+		key := ""
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				key = l.Value + key
+			case "le":
+				key += "{le=" + l.Value + "}"
+			}
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Timestamp != 1000 {
+			t.Fatalf("%s has samples %v", key, ts.Samples)
+		}
+		res[key] = ts.Samples[0].Value
+	}
+	return res
+}
+
+func TestExpandIntegerNativeHistogram(t *testing.T) {
+	// buckets (1, 2] and (2, 4] of schema 0 with 1 and 2 samples, delta
+	// encoded, and 1 in the zero bucket
+	span := wire.Message{}.Varint(1, wire.ZigzagEncode(1)).Varint(2, 2)
+	h := wire.Message{}.
+		Varint(1, 4).
+		Double(3, 10).
+		Varint(4, wire.ZigzagEncode(0)).
+		Double(5, 0.001).
+		Varint(6, 1).
+		Bytes(11, span).
+		Varints(12, wire.ZigzagEncode(1), wire.ZigzagEncode(1)).
+		Varint(15, 1000)
+	want := map[string]float64{
+		"latency_bucket{le=0.001}": 1,
+		"latency_bucket{le=2}":     2,
+		"latency_bucket{le=4}":     4,
+		"latency_bucket{le=+Inf}":  4,
+		"latency_sum":              10,
+		"latency_count":            4,
+	}
+	if got := expandedValues(t, histogramWrite(h)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded %v, want %v", got, want)
+	}
+}
+
+func TestExpandCustomBucketsNativeHistogram(t *testing.T) {
+	// float counts of the custom buckets (-Inf, 0.5] and (0.5, 1]
+	span := wire.Message{}.Varint(1, wire.ZigzagEncode(0)).Varint(2, 2)
+	h := wire.Message{}.
+		Double(2, 4).
+		Double(3, 2.5).
+		Varint(4, wire.ZigzagEncode(customBucketsSchema)).
+		Bytes(11, span).
+		Doubles(13, 3, 1).
+		Varint(15, 1000).
+		Doubles(16, 0.5, 1)
+	want := map[string]float64{
+		"latency_bucket{le=0.5}":  3,
+		"latency_bucket{le=1}":    4,
+		"latency_bucket{le=+Inf}": 4,
+		"latency_sum":             2.5,
+		"latency_count":           4,
+	}
+	if got := expandedValues(t, histogramWrite(h)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded %v, want %v", got, want)
+	}
+}
+
+func TestExpandNativeHistogramsTruncated(t *testing.T) {
+	reqBuf := histogramWrite(wire.Message{}.Varint(1, 4))
+	if _, err := ExpandNativeHistograms(reqBuf[:len(reqBuf)-1], 0); err == nil {
+		t.Fatal("a truncated request was expanded")
+	}
+}
+
+func TestExpandNativeHistogramsMaxSeries(t *testing.T) {
+	h := wire.Message{}.Varint(1, 4).Double(3, 10).Varint(15, 1000)
+	reqBuf := append(histogramWrite(h), histogramWrite(h)...)
+	all, err := ExpandNativeHistograms(reqBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ExpandNativeHistograms(reqBuf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a histogram is expanded whole or not at all
+	if len(first) == 0 || 2*len(first) != len(all) {
+		t.Fatalf("expanded %d series of the first histogram, %d of both", len(first), len(all))
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// OutputModeJSONRows fetches search results as json_rows, the field
+	// names once and a row of values per result. It's about half the
+	// work of json to parse for wide results.
+	OutputModeJSONRows = "json_rows"
+	// OutputModeJSON fetches search results as json, an object per
+	// result, which every Splunk version answers alike.
+	OutputModeJSON = "json"
+	// OutputModeAuto uses json_rows from Splunk 7 on and json otherwise,
+	// the version is read from /services/server/info once.
+	OutputModeAuto = "auto"
+)
+
+const (
+	// jsonRowsMinVersion is the first major Splunk version OutputModeAuto
+	// uses json_rows with.
+	jsonRowsMinVersion = 7
+	// versionRetryInterval is how long reads use json after detecting the
+	// version failed, before it is detected again.
+	versionRetryInterval = time.Minute
+)
+
+// ValidateOutputMode checks that mode is one of the output modes.
+func ValidateOutputMode(mode string) error {
+	switch mode {
+	case OutputModeJSONRows, OutputModeJSON, OutputModeAuto:
+		return nil
+	}
+	return fmt.Errorf("invalid output mode %q, must be json_rows, json or auto", mode)
+}
+
+// WithOutputMode selects the output mode search results are fetched in,
+// OutputModeJSONRows, OutputModeJSON or OutputModeAuto. Export searches
+// always stream json.
+func WithOutputMode(mode string) Option {
+	return func(c *Client) {
+		c.outputMode = &outputMode{mode: mode}
+	}
+}
+
+// outputMode is shared by the copies of a client, so the version is
+// detected once.
+type outputMode struct {
+	mode      string
+	mtx       sync.Mutex
+	detected  string
+	detecting bool
+	retryAt   time.Time
+}
+
+// resultsOutputMode returns the output mode of search results. Of
+// OutputModeAuto the version of Splunk is detected on first use, reads fall
+// back to json while it is detected and for versionRetryInterval after it
+// failed, so they neither wait for each other nor all ask Splunk again.
+func (c *Client) resultsOutputMode(ctx context.Context) string {
+	if c.outputMode == nil {
+		return OutputModeJSONRows
+	}
+	if c.outputMode.mode != OutputModeAuto {
+		return c.outputMode.mode
+	}
+	m := c.outputMode
+	m.mtx.Lock()
+	if m.detected != "" || m.detecting || time.Now().Before(m.retryAt) {
+		defer m.mtx.Unlock()
+		if m.detected != "" {
+			return m.detected
+		}
+		return OutputModeJSON
+	}
+	m.detecting = true
+	m.mtx.Unlock()
+
+	version, err := c.serverVersion(ctx)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.detecting = false
+	if err != nil {
+		m.retryAt = time.Now().Add(versionRetryInterval)
+		level.Warn(c.log).Log("msg", "Detect Splunk version error, fetching results as json", "retry_in", versionRetryInterval, "err", err)
+		return OutputModeJSON
+	}
+	m.detected = OutputModeJSON
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err == nil && major >= jsonRowsMinVersion {
+		m.detected = OutputModeJSONRows
+	}
+	level.Info(c.log).Log("msg", "Detected Splunk version", "version", version, "output_mode", m.detected)
+	return m.detected
+}
+
+// serverVersion returns the version of the Splunk server, e.g. 9.1.2.
+func (c *Client) serverVersion(ctx context.Context) (string, error) {
+	res, err := c.splunkRESTRequest(ctx, "GET", "/services/server/info", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Entry []struct {
+			Content struct {
+				Version string `json:"version"`
+			} `json:"content"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(res, &info); err != nil || len(info.Entry) == 0 || info.Entry[0].Content.Version == "" {
+		return "", searchError("get server info failed", splunkMessages(res))
+	}
+	return info.Entry[0].Content.Version, nil
+}
+
+// decodeResults decodes a page of search results in mode and appends its
+// rows to res, returning the number of rows and the messages of the page.
+func decodeResults(mode string, data []byte, res *jobResultPreview) (int, []splunkMessage, error) {
+	if mode != OutputModeJSON {
+		var page struct {
+			jobResultPreview
+			Messages []splunkMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, nil, err
+		}
+		if res.Fields == nil {
+			res.Fields = page.Fields
+		}
+		res.Rows = append(res.Rows, page.Rows...)
+		return len(page.Rows), page.Messages, nil
+	}
+	var page struct {
+		Results  []map[string]interface{} `json:"results"`
+		Messages []splunkMessage          `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &page); err != nil {
+		return 0, nil, err
+	}
+	res.appendResults(page.Results)
+	return len(page.Results), page.Messages, nil
+}
+
+// appendResults appends json results as rows of res.Fields. Fields not seen
+// before are added to them and the rows are padded with empty values, which
+// are missing fields as of json_rows.
+func (res *jobResultPreview) appendResults(results []map[string]interface{}) {
+	cols := make(map[string]int, len(res.Fields))
+	for i, f := range res.Fields {
+		cols[f] = i
+	}
+	fields := len(res.Fields)
+	for _, result := range results {
+		names, values := exportRow(result)
+		row := make(resultRow, len(res.Fields))
+		for i, name := range names {
+			col, ok := cols[name]
+			if !ok {
+				col = len(res.Fields)
+				cols[name] = col
+				res.Fields = append(res.Fields, name)
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = values[i]
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	if len(res.Fields) == fields {
+		return
+	}
+	for i, row := range res.Rows {
+		for len(row) < len(res.Fields) {
+			row = append(row, "")
+		}
+		res.Rows[i] = row
+	}
+}
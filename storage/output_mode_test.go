@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutputModeRetriesDetection(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) { return nil, nil })
+	defer f.Close()
+	// Splunk rejects the credentials until they are fixed
+	f.passwords = map[string]string{"admin": "fixed"}
+	c := f.client(WithOutputMode(OutputModeAuto))
+	ctx := context.Background()
+	if got := c.resultsOutputMode(ctx); got != OutputModeJSON {
+		t.Fatalf("output mode = %s while the version is unknown, want json", got)
+	}
+	f.passwords = nil
+	if got := c.resultsOutputMode(ctx); got != OutputModeJSON {
+		t.Fatalf("output mode = %s, the version was detected again right after failing", got)
+	}
+	c.outputMode.mtx.Lock()
+	c.outputMode.retryAt = time.Now()
+	c.outputMode.mtx.Unlock()
+	if got := c.resultsOutputMode(ctx); got != OutputModeJSONRows {
+		t.Fatalf("output mode = %s after the backoff, want json_rows of Splunk 9", got)
+	}
+}
+
+func TestOutputModeDetectsOutsideTheLock(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) { return nil, nil })
+	defer f.Close()
+	c := f.client(WithOutputMode(OutputModeAuto))
+	// a slow Splunk holds the first detection, other reads go on with json
+	block := make(chan struct{})
+	handler := f.Config.Handler
+	f.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/services/server/info" {
+			<-block
+		}
+		handler.ServeHTTP(w, r)
+	})
+	done := make(chan string)
+	go func() {
+		done <- c.resultsOutputMode(context.Background())
+	}()
+	for {
+		c.outputMode.mtx.Lock()
+		detecting := c.outputMode.detecting
+		c.outputMode.mtx.Unlock()
+		if detecting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := c.resultsOutputMode(context.Background()); got != OutputModeJSON {
+		t.Errorf("output mode = %s during detection, want json", got)
+	}
+	close(block)
+	if got := <-done; got != OutputModeJSONRows {
+		t.Errorf("detected output mode = %s, want json_rows", got)
+	}
+}
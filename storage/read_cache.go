@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+	"time"
+)
+
+// ReadCache answers repeated remote read queries, e.g. of refreshing
+// dashboards, from memory. Only queries ending at least minAge ago are
+// cached, so recent data still arriving in Splunk is always searched.
+// Results are kept marshaled for ttl, the least recently used are evicted
+// once they take more than maxBytes.
+type ReadCache struct {
+	RemoteClient
+	ttl      time.Duration
+	maxBytes int
+	minAge   time.Duration
+
+	mtx     sync.Mutex
+	bytes   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func NewReadCache(inner RemoteClient, ttl time.Duration, maxBytes int, minAge time.Duration) *ReadCache {
+	return &ReadCache{
+		RemoteClient: inner,
+		ttl:          ttl,
+		maxBytes:     maxBytes,
+		minAge:       minAge,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+}
+
+func (rc *ReadCache) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	results := make([]*prompb.QueryResult, len(req.Queries))
+	keys := make([]string, len(req.Queries))
+	missed := make([]int, 0, len(req.Queries))
+	for i, q := range req.Queries {
+		if time.Now().Add(-rc.minAge).UnixNano()/int64(time.Millisecond) >= q.EndTimestampMs {
+			if key, err := readCacheKey(ctx, q); err == nil {
+				keys[i] = key
+				if res := rc.get(key); res != nil {
+					metrics.ReadCacheHits.Inc()
+					results[i] = res
+					continue
+				}
+				metrics.ReadCacheMisses.Inc()
+			}
+		}
+		missed = append(missed, i)
+	}
+	if len(missed) > 0 {
+		sub := &prompb.ReadRequest{Queries: make([]*prompb.Query, len(missed))}
+		for j, i := range missed {
+			sub.Queries[j] = req.Queries[i]
+		}
+		resp, err := rc.RemoteClient.Read(ctx, sub)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range missed {
+			results[i] = resp.Results[j]
+			if keys[i] != "" {
+				rc.put(keys[i], resp.Results[j])
+			}
+		}
+	}
+	return &prompb.ReadResponse{Results: results}, nil
+}
+
+// Flush drops all cached results.
+func (rc *ReadCache) Flush() {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.order.Init()
+	rc.entries = make(map[string]*list.Element)
+	rc.bytes = 0
+}
+
+// readCacheKey identifies a query, including its hints, of the Splunk user
+// running it: users may be allowed to search different indexes.
+func readCacheKey(ctx context.Context, q *prompb.Query) (string, error) {
+	data, err := proto.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	creds, _ := ctx.Value(credentialsKey{}).(credentials)
+	key := creds.cacheKey() + "\xff" + string(data)
+	if rawSamples(ctx) {
+		key += "\xffraw"
+	}
+	return key, nil
+}
+
+func (rc *ReadCache) get(key string) *prompb.QueryResult {
+	rc.mtx.Lock()
+	e, ok := rc.entries[key]
+	if !ok {
+		rc.mtx.Unlock()
+		return nil
+	}
+	entry := e.Value.(*readCacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.remove(e)
+		rc.mtx.Unlock()
+		return nil
+	}
+	rc.order.MoveToFront(e)
+	rc.mtx.Unlock()
+	var res prompb.QueryResult
+	if err := proto.Unmarshal(entry.data, &res); err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (rc *ReadCache) put(key string, res *prompb.QueryResult) {
+	data, err := proto.Marshal(res)
+	if err != nil || len(key)+len(data) > rc.maxBytes {
+		return
+	}
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if e, ok := rc.entries[key]; ok {
+		rc.remove(e)
+	}
+	entry := &readCacheEntry{key: key, data: data, expires: time.Now().Add(rc.ttl)}
+	rc.entries[key] = rc.order.PushFront(entry)
+	rc.bytes += entry.size()
+	for rc.bytes > rc.maxBytes {
+		rc.remove(rc.order.Back())
+		metrics.ReadCacheEvictions.Inc()
+	}
+}
+
+func (rc *ReadCache) remove(e *list.Element) {
+	entry := rc.order.Remove(e).(*readCacheEntry)
+	delete(rc.entries, entry.key)
+	rc.bytes -= entry.size()
+}
+
+func (e *readCacheEntry) size() int {
+	return len(e.key) + len(e.data)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+	"time"
+)
+
+// countingClient answers every query with one series and counts the reads.
+type countingClient struct {
+	RemoteClient
+	reads int
+}
+
+func (c *countingClient) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	c.reads++
+	resp := &prompb.ReadResponse{}
+	for range req.Queries {
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}}})
+	}
+	return resp, nil
+}
+
+func TestReadCacheKeyedByPassword(t *testing.T) {
+	inner := &countingClient{}
+	cache := NewReadCache(inner, time.Minute, 1<<20, 0)
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}}
+	read := func(ctx context.Context) {
+		if _, err := cache.Read(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read(ContextWithCredentials(context.Background(), "alice", "secret"))
+	read(ContextWithCredentials(context.Background(), "alice", "secret"))
+	if inner.reads != 1 {
+		t.Fatalf("reads = %d after a repeated query, want 1", inner.reads)
+	}
+	read(ContextWithCredentials(context.Background(), "alice", "wrong"))
+	if inner.reads != 2 {
+		t.Fatalf("reads = %d, a wrong password hit the cache", inner.reads)
+	}
+	read(ContextWithToken(context.Background(), "token"))
+	if inner.reads != 3 {
+		t.Fatalf("reads = %d, a token hit the cache of a password", inner.reads)
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Policies for samples of a series Splunk returns twice for one timestamp
+// with different values.
+const (
+	DedupPolicyFirst = "first"
+	DedupPolicyLast  = "last"
+	DedupPolicyMax   = "max"
+)
+
+// WithReadDedupPolicy sets which of the conflicting samples returned for one
+// timestamp of a series is kept, DedupPolicyFirst, DedupPolicyLast or
+// DedupPolicyMax.
+func WithReadDedupPolicy(policy string) Option {
+	return func(c *Client) {
+		c.readDedupPolicy = policy
+	}
+}
+
+// appendSample appends s to samples unless its timestamp equals the one of
+// the previous sample, e.g. of an event Splunk returns twice after index
+// replication or a retried HEC write. Returns false if s was deduplicated.
+func appendSample(samples []prompb.Sample, s prompb.Sample, policy string) ([]prompb.Sample, bool) {
+	if len(samples) == 0 || samples[len(samples)-1].Timestamp != s.Timestamp {
+		return append(samples, s), true
+	}
+	prev := &samples[len(samples)-1]
+	switch policy {
+	case DedupPolicyLast:
+		prev.Value = s.Value
+	case DedupPolicyMax:
+		if s.Value > prev.Value {
+			prev.Value = s.Value
+		}
+	}
+	return samples, false
+}
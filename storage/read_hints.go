@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/kebe7jun/ropee/internal/wire"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Prometheus 2.16 and later hint the range of the function a selector is
+// the argument of, e.g. 5m of max_over_time(x[5m]). The prompb package of
+// the version ropee builds against has no field for it, so it is decoded by
+// hand, following prompb/types.proto.
+const (
+	// ReadRequest.queries
+	readRequestQueriesField = 1
+	// Query.hints
+	queryHintsField = 4
+	// ReadHints.range_ms
+	readHintsRangeField = 7
+)
+
+// pushDownFuncs are the functions whose result is the same over the
+// aggregates of whole steps as over their samples, by the mstats function
+// aggregating them.
+var pushDownFuncs = map[string]string{
+	"max_over_time": "max",
+	"min_over_time": "min",
+}
+
+type hintRangesKey struct{}
+
+// ContextWithHintRanges returns ctx carrying the range hints of the queries
+// of the raw (decompressed) ReadRequest reqBuf. Queries are told apart by
+// their known fields, as read caches and fanouts may pass on only some of
+// them.
+func ContextWithHintRanges(ctx context.Context, reqBuf []byte) context.Context {
+	ranges := make(map[string]int64)
+	wire.EachField(reqBuf, func(f wire.Field) error {
+		if f.Num != readRequestQueriesField || f.Wire != 2 {
+			return nil
+		}
+		rangeMs := int64(0)
+		wire.EachField(f.Data, func(q wire.Field) error {
+			if q.Num != queryHintsField || q.Wire != 2 {
+				return nil
+			}
+			return wire.EachField(q.Data, func(h wire.Field) error {
+				if h.Num == readHintsRangeField && h.Wire == 0 {
+					rangeMs = int64(h.Value)
+				}
+				return nil
+			})
+		})
+		var q prompb.Query
+		if rangeMs <= 0 || proto.Unmarshal(f.Data, &q) != nil {
+			return nil
+		}
+		if key, err := proto.Marshal(&q); err == nil {
+			ranges[string(key)] = rangeMs
+		}
+		return nil
+	})
+	if len(ranges) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, hintRangesKey{}, ranges)
+}
+
+// hintRange returns the range hinted for q, 0 if there is none.
+func hintRange(ctx context.Context, q *prompb.Query) int64 {
+	ranges, _ := ctx.Value(hintRangesKey{}).(map[string]int64)
+	if ranges == nil {
+		return 0
+	}
+	key, err := proto.Marshal(q)
+	if err != nil {
+		return 0
+	}
+	return ranges[string(key)]
+}
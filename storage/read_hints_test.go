@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"strings"
+	"testing"
+)
+
+// hintedReadRequest returns the raw ReadRequest of q with the range hint
+// rangeMs, which prompb can't encode. It is sent as hints of their own,
+// which protobuf merges into those of q.
+func hintedReadRequest(t *testing.T, q *prompb.Query, rangeMs int64) []byte {
+	query, err := proto.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proto.NewBuffer(nil)
+	h.EncodeVarint(readHintsRangeField << 3)
+	h.EncodeVarint(uint64(rangeMs))
+	b := proto.NewBuffer(query)
+	b.EncodeVarint(queryHintsField<<3 | 2)
+	b.EncodeRawBytes(h.Bytes())
+	req := proto.NewBuffer(nil)
+	req.EncodeVarint(readRequestQueriesField<<3 | 2)
+	req.EncodeRawBytes(b.Bytes())
+	return req.Bytes()
+}
+
+// maxOverTime is the query of max_over_time(up[5m]) evaluated every minute
+// from 10m to 20m.
+func maxOverTime() *prompb.Query {
+	return &prompb.Query{
+		StartTimestampMs: 300000,
+		EndTimestampMs:   1200000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+		Hints:            &prompb.ReadHints{StepMs: 60000, Func: "max_over_time", StartMs: 300000, EndMs: 1200000},
+	}
+}
+
+func TestContextWithHintRanges(t *testing.T) {
+	q := maxOverTime()
+	ctx := ContextWithHintRanges(context.Background(), hintedReadRequest(t, q, 300000))
+	if got := hintRange(ctx, q); got != 300000 {
+		t.Fatalf("hinted range = %d, want 300000", got)
+	}
+	other := maxOverTime()
+	other.Hints.Func = "min_over_time"
+	if got := hintRange(ctx, other); got != 0 {
+		t.Fatalf("hinted range of another query = %d, want 0", got)
+	}
+	if got := hintRange(context.Background(), q); got != 0 {
+		t.Fatalf("hinted range without hints = %d, want 0", got)
+	}
+}
+
+func TestDownsamplingPushDown(t *testing.T) {
+	ds := Downsampling{Enabled: true, PushDown: true, rangeMs: 300000}
+	for _, c := range []struct {
+		name   string
+		modify func(q *prompb.Query, ds *Downsampling)
+		want   string
+	}{
+		{"max_over_time", func(q *prompb.Query, ds *Downsampling) {}, "max"},
+		{"min_over_time", func(q *prompb.Query, ds *Downsampling) { q.Hints.Func = "min_over_time" }, "min"},
+		{"avg_over_time", func(q *prompb.Query, ds *Downsampling) { q.Hints.Func = "avg_over_time" }, ""},
+		{"range not a multiple of the step", func(q *prompb.Query, ds *Downsampling) { ds.rangeMs = 90000 }, ""},
+		{"evaluation times off the step", func(q *prompb.Query, ds *Downsampling) { q.Hints.StartMs += 15000 }, ""},
+		{"end off the step", func(q *prompb.Query, ds *Downsampling) { q.Hints.EndMs += 15000 }, ""},
+		{"step below the finest span", func(q *prompb.Query, ds *Downsampling) { q.Hints.StepMs = 5000; ds.rangeMs = 60000 }, ""},
+		{"fractional step", func(q *prompb.Query, ds *Downsampling) { q.Hints.StepMs = 60500 }, ""},
+		{"no range hint", func(q *prompb.Query, ds *Downsampling) { ds.rangeMs = 0 }, ""},
+		{"push down off", func(q *prompb.Query, ds *Downsampling) { ds.PushDown = false }, ""},
+		{"downsampling off", func(q *prompb.Query, ds *Downsampling) { ds.Enabled = false }, ""},
+		{"coarser auto span", func(q *prompb.Query, ds *Downsampling) {
+			ds.AutoSpan = AutoSpanRules{{MinRange: 0, Span: 300000000000}}
+		}, ""},
+	} {
+		q, d := maxOverTime(), ds
+		c.modify(q, &d)
+		fn, ok := d.pushDown(q)
+		if fn != c.want || ok != (c.want != "") {
+			t.Errorf("%s: pushed down %q, %t, want %q", c.name, fn, ok, c.want)
+		}
+	}
+}
+
+func TestReadPushesDownMaxOverTime(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		// the aggregates of the spans around the start of the first range
+		return metricRows(), [][]string{
+			{rfc3339(240000), "up", "5"},
+			{rfc3339(300000), "up", "7"},
+			{rfc3339(360000), "up", "3"},
+		}
+	})
+	defer f.Close()
+	q := maxOverTime()
+	for _, pushDown := range []bool{true, false} {
+		c := f.client(WithDownsampling(Downsampling{Enabled: true, PushDown: pushDown}))
+		ctx := ContextWithHintRanges(context.Background(), hintedReadRequest(t, q, 300000))
+		resp, err := c.Read(ctx, &prompb.ReadRequest{Queries: []*prompb.Query{q}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		search := f.lastSearch()
+		if got := strings.Contains(search, "| mstats max(_value)"); got != pushDown || !strings.Contains(search, "span=60s") {
+			t.Errorf("push down %t searched %s", pushDown, search)
+		}
+		samples := resp.Results[0].Timeseries[0].Samples
+		if !pushDown {
+			if len(samples) != 2 || samples[0].Timestamp != 300000 {
+				t.Errorf("samples = %v, want them stamped at the start of their spans", samples)
+			}
+			continue
+		}
+		// stamped at the last millisecond of their span, the span before
+		// the start of the first range drops out
+		want := []prompb.Sample{{Timestamp: 359999, Value: 7}, {Timestamp: 419999, Value: 3}}
+		if len(samples) != 2 || samples[0] != want[0] || samples[1] != want[1] {
+			t.Errorf("samples = %v, want %v", samples, want)
+		}
+	}
+}
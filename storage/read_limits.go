@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// ReadLimits bound the series and samples a read request may return, 0
+// means no limit.
+type ReadLimits struct {
+	MaxSeries  int
+	MaxSamples int
+}
+
+type readLimitsKey struct{}
+
+// ContextWithReadLimits overrides the read limits of the client for a read.
+func ContextWithReadLimits(ctx context.Context, limits ReadLimits) context.Context {
+	return context.WithValue(ctx, readLimitsKey{}, limits)
+}
+
+// WithReadLimits sets the default read limits.
+func WithReadLimits(limits ReadLimits) Option {
+	return func(c *Client) {
+		c.readLimits = limits
+	}
+}
+
+// readBudget counts the series and samples of all queries of a read request
+// against its limits.
+type readBudget struct {
+	limits  ReadLimits
+	series  int64
+	samples int64
+}
+
+func (c *Client) newReadBudget(ctx context.Context) *readBudget {
+	limits, ok := ctx.Value(readLimitsKey{}).(ReadLimits)
+	if !ok {
+		limits = c.readLimits
+	}
+	return &readBudget{limits: limits}
+}
+
+func (b *readBudget) addSeries() error {
+	if b.limits.MaxSeries > 0 && atomic.AddInt64(&b.series, 1) > int64(b.limits.MaxSeries) {
+		return &LimitError{msg: fmt.Sprintf("read returns more than %d series, narrow the query", b.limits.MaxSeries)}
+	}
+	return nil
+}
+
+func (b *readBudget) addSample() error {
+	if b.limits.MaxSamples > 0 && atomic.AddInt64(&b.samples, 1) > int64(b.limits.MaxSamples) {
+		return &LimitError{msg: fmt.Sprintf("read returns more than %d samples, narrow the query or its time range", b.limits.MaxSamples)}
+	}
+	return nil
+}
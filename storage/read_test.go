@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"strings"
+	"testing"
+)
+
+// readQuery reads one query of up between 0 and 60s with matchers.
+func readQuery(t *testing.T, c *Client, matchers ...*prompb.LabelMatcher) *prompb.QueryResult {
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         append([]*prompb.LabelMatcher{{Name: "__name__", Value: "up"}}, matchers...),
+	}}}
+	resp, err := c.Read(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 {
+		t.Fatalf("got %d results of one query", len(resp.Results))
+	}
+	return resp.Results[0]
+}
+
+func seriesLabel(ts *prompb.TimeSeries, name string) string {
+	for _, l := range ts.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func TestReadNegativeMatchers(t *testing.T) {
+	for _, c := range []struct {
+		matcher *prompb.LabelMatcher
+		// filter is the where stage the search has to carry
+		filter string
+	}{
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "canary-1"}, `| where isnull(instance) OR instance!="canary-1"`},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: "canary.*"}, `| where isnull(instance) OR NOT match(instance, "^(?:canary.*)\\z")`},
+	} {
+		// the fake applies the filter it finds: canaries are dropped, the
+		// series without instance is kept as Prometheus keeps it
+		f := newFakeSplunk(func(search string) ([]string, [][]string) {
+			rows := [][]string{
+				{rfc3339(1000), "up", "1", "web-1"},
+				{rfc3339(1000), "up", "1", ""},
+			}
+			if !strings.Contains(search, c.filter) {
+				rows = append(rows, []string{rfc3339(1000), "up", "1", "canary-1"})
+			}
+			return metricRows("instance"), rows
+		})
+		f.dimensions = []string{"instance"}
+		res := readQuery(t, f.client(), c.matcher)
+		f.Close()
+		if !strings.Contains(f.lastSearch(), c.filter) {
+			t.Errorf("search %s lacks %s", f.lastSearch(), c.filter)
+		}
+		instances := make([]string, 0)
+		for _, ts := range res.Timeseries {
+			instances = append(instances, seriesLabel(ts, "instance"))
+		}
+		if len(instances) != 2 {
+			t.Errorf("%s read the instances %q, want web-1 and the series without instance", c.matcher.String(), instances)
+		}
+	}
+}
+
+func TestReadMatchesCaseSensitively(t *testing.T) {
+	// like Splunk, the fake's mstats matches dimension values regardless of
+	// case, only the where stage tells api and API apart
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		rows := [][]string{{rfc3339(1000), "up", "1", "api"}}
+		if !strings.Contains(search, `| where job="api"`) {
+			rows = append(rows, []string{rfc3339(1000), "up", "0", "API"})
+		}
+		return metricRows("job"), rows
+	})
+	defer f.Close()
+	f.dimensions = []string{"job"}
+	res := readQuery(t, f.client(), &prompb.LabelMatcher{Name: "job", Value: "api"})
+	if !strings.Contains(f.lastSearch(), ` AND job="api"`) {
+		t.Errorf("search %s doesn't prune the dimension in mstats", f.lastSearch())
+	}
+	if len(res.Timeseries) != 1 || seriesLabel(res.Timeseries[0], "job") != "api" {
+		t.Errorf(`job="api" read %v, want only the series of job api`, res.Timeseries)
+	}
+}
+
+func TestReadZeroResults(t *testing.T) {
+	for name, results := range map[string]func(string) ([]string, [][]string){
+		// the metric isn't in the index at all
+		"no fields": func(string) ([]string, [][]string) { return nil, nil },
+		// the index has the metric, but no events in the window
+		"no rows": func(string) ([]string, [][]string) { return metricRows("instance"), nil },
+	} {
+		for _, mode := range []string{SearchModeJob, SearchModeExport} {
+			f := newFakeSplunk(results)
+			res := readQuery(t, f.client(WithSearchMode(mode)))
+			f.Close()
+			if res == nil || len(res.Timeseries) != 0 {
+				t.Errorf("%s of a %s search: result %v, want an empty one", name, mode, res)
+			}
+		}
+	}
+}
+
+func TestReadSortsShuffledResults(t *testing.T) {
+	timestamps := []int64{40000, 10000, 50000, 0, 30000, 20000}
+	f := newFakeSplunk(func(string) ([]string, [][]string) {
+		rows := make([][]string, 0)
+		for _, ts := range timestamps {
+			for _, instance := range []string{"a", "b"} {
+				rows = append(rows, []string{rfc3339(ts), "up", "1", instance})
+			}
+		}
+		return metricRows("instance"), rows
+	})
+	defer f.Close()
+	f.dimensions = []string{"instance"}
+	for _, mode := range []string{SearchModeJob, SearchModeExport} {
+		res := readQuery(t, f.client(WithSearchMode(mode)))
+		if len(res.Timeseries) != 2 {
+			t.Fatalf("%s search read %d series, want 2", mode, len(res.Timeseries))
+		}
+		for _, ts := range res.Timeseries {
+			if len(ts.Samples) != len(timestamps) {
+				t.Errorf("%s search read %d samples of %s, want %d", mode, len(ts.Samples), seriesLabel(ts, "instance"), len(timestamps))
+			}
+			for i := 1; i < len(ts.Samples); i++ {
+				if ts.Samples[i].Timestamp <= ts.Samples[i-1].Timestamp {
+					t.Errorf("%s search read samples of %s out of order: %v", mode, seriesLabel(ts, "instance"), ts.Samples)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestReadWithoutMetricName(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) {
+		return metricRows("job"), [][]string{
+			{rfc3339(1000), "probe_success", "1", "blackbox"},
+			{rfc3339(1000), "probe_duration_seconds", "0.2", "blackbox"},
+		}
+	})
+	defer f.Close()
+	f.dimensions = []string{"job"}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "blackbox"}},
+	}}}
+	resp, err := f.client().Read(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := f.lastSearch()
+	if !strings.Contains(search, `metric_name="*"`) || !strings.Contains(search, "by metric_name") {
+		t.Errorf("search %s doesn't search all metrics by name", search)
+	}
+	names := make(map[string]bool)
+	for _, ts := range resp.Results[0].Timeseries {
+		names[seriesLabel(ts, "__name__")] = true
+	}
+	if len(names) != 2 || !names["probe_success"] || !names["probe_duration_seconds"] {
+		t.Errorf("read the metrics %v, want probe_success and probe_duration_seconds", names)
+	}
+
+	// such reads are bounded by the series limit
+	_, err = f.client(WithReadLimits(ReadLimits{MaxSeries: 1})).Read(context.Background(), req)
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("read of 2 series with a limit of 1: err = %v, want a LimitError", err)
+	}
+}
+
+// mixedRows are rows of up of which only the first two are metric data.
+var mixedRows = [][]string{
+	{rfc3339(1000), "up", "1", "web-1"},
+	{rfc3339(2000), "up", "2", "web-1"},
+	{rfc3339(3000), "up", "n/a", "web-1"},
+	{rfc3339(4000), "up", "", "web-1"},
+	{rfc3339(5000), "", "1", "web-1"},
+	{rfc3339(6000), "up"},
+}
+
+func TestReadSkipsInvalidRows(t *testing.T) {
+	registry := metrics.NewRegistry()
+	skipped := func() map[string]float64 {
+		snapshot, err := metrics.Snapshot(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]float64)
+		for _, reason := range []string{skipInvalidValue, skipMissingValue, skipMissingMetricName, skipMalformedRow} {
+			res[reason] = snapshot[`ropee_read_skipped_events_count{reason="`+reason+`"}`]
+		}
+		return res
+	}
+	before := skipped()
+	f := newFakeSplunk(func(string) ([]string, [][]string) { return metricRows("instance"), mixedRows })
+	defer f.Close()
+	f.dimensions = []string{"instance"}
+	for _, strict := range []bool{false, true} {
+		res := readQuery(t, f.client(WithStrictRead(strict)))
+		if len(res.Timeseries) != 1 {
+			t.Fatalf("strict=%t: got %d series, want 1", strict, len(res.Timeseries))
+		}
+		samples := res.Timeseries[0].Samples
+		if len(samples) != 2 || samples[0].Value != 1 || samples[1].Value != 2 {
+			t.Errorf("strict=%t: samples = %v, want the two valid rows", strict, samples)
+		}
+	}
+	after := skipped()
+	for reason, n := range after {
+		if n-before[reason] != 2 {
+			t.Errorf("skipped %v rows for %s, want one per read", n-before[reason], reason)
+		}
+	}
+}
+
+func TestReadStrictFailsIfAllRowsSkipped(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) { return metricRows("instance"), mixedRows[2:] })
+	defer f.Close()
+	f.dimensions = []string{"instance"}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}}
+	if _, err := f.client(WithStrictRead(true)).Read(context.Background(), req); err == nil {
+		t.Error("strict read of only skipped rows succeeded, want an error")
+	}
+	res := readQuery(t, f.client())
+	if len(res.Timeseries) != 0 {
+		t.Errorf("read of only skipped rows returned %d series, want none", len(res.Timeseries))
+	}
+}
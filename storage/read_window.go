@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"time"
+)
+
+// ReadWindow adjusts the time range searched for a query.
+type ReadWindow struct {
+	// StartBuffer and EndBuffer widen the searched range, samples returned
+	// are still limited to the range of the query.
+	StartBuffer, EndBuffer time.Duration
+	// IngestDelay moves the end of queries reaching closer to now back to
+	// now-IngestDelay, the newest data may not be searchable yet.
+	IngestDelay time.Duration
+	// MaxRangePerSearch splits searches over longer ranges into sequential
+	// searches of at most this range, so none runs into the job runtime
+	// quota. 0 searches any range at once.
+	MaxRangePerSearch time.Duration
+}
+
+// WithReadWindow sets how the searched time range of queries is adjusted.
+func WithReadWindow(w ReadWindow) Option {
+	return func(c *Client) {
+		c.readWindow = w
+	}
+}
+
+// bounds returns the range samples of a query are returned for and the
+// range searched for them, all in milliseconds.
+func (w ReadWindow) bounds(start, end int64, now time.Time) (int64, int64, int64, int64) {
+	if w.IngestDelay > 0 {
+		if latest := now.Add(-w.IngestDelay).UnixNano() / int64(time.Millisecond); end > latest {
+			end = latest
+		}
+	}
+	return start, end, start - int64(w.StartBuffer/time.Millisecond), end + int64(w.EndBuffer/time.Millisecond)
+}
+
+// chunks splits the searched range [start, end] into ranges of at most
+// MaxRangePerSearch. They start at multiples of spanMs, so no span is
+// aggregated partially by two searches.
+func (w ReadWindow) chunks(start, end, spanMs int64) [][2]int64 {
+	size := int64(w.MaxRangePerSearch / time.Millisecond)
+	if spanMs > 0 {
+		size -= size % spanMs
+		if size < spanMs {
+			size = spanMs
+		}
+	}
+	if w.MaxRangePerSearch <= 0 || end-start < size {
+		return [][2]int64{{start, end}}
+	}
+	res := make([][2]int64, 0)
+	for chunkStart := start; chunkStart <= end; {
+		chunkEnd := chunkStart - chunkStart%size + size - 1
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		res = append(res, [2]int64{chunkStart, chunkEnd})
+		chunkStart = chunkEnd + 1
+	}
+	return res
+}
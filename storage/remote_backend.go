@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// RemoteBackend talks the Prometheus remote read/write protocol to another
+// storage such as Thanos receive or another ropee.
+type RemoteBackend struct {
+	writeUrl string
+	readUrl  string
+	client   *http.Client
+	timeout  time.Duration
+}
+
+// NewRemoteBackend returns a backend for the given remote write and remote
+// read urls, either of them may be empty to skip that direction.
+func NewRemoteBackend(writeUrl, readUrl string, timeout time.Duration) *RemoteBackend {
+	return &RemoteBackend{
+		writeUrl: writeUrl,
+		readUrl:  readUrl,
+		client:   &http.Client{},
+		timeout:  timeout,
+	}
+}
+
+func (b *RemoteBackend) post(ctx context.Context, reqUrl string, msg proto.Message, headers map[string]string) ([]byte, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", reqUrl, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "ropee client/1.0")
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	httpResp, err := b.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("backend %s returned %s: %s", reqUrl, httpResp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+func (b *RemoteBackend) Write(req *prompb.WriteRequest) error {
+	return b.WriteContext(context.Background(), req)
+}
+
+func (b *RemoteBackend) WriteContext(ctx context.Context, req *prompb.WriteRequest) error {
+	if b.writeUrl == "" {
+		return nil
+	}
+	headers := map[string]string{
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	}
+	if id := requestID(ctx); id != "" {
+		headers["X-Request-ID"] = id
+	}
+	_, err := b.post(ctx, b.writeUrl, req, headers)
+	return err
+}
+
+func (b *RemoteBackend) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	if b.readUrl == "" {
+		return &prompb.ReadResponse{}, nil
+	}
+	compressed, err := b.post(ctx, b.readUrl, req, map[string]string{
+		"X-Prometheus-Remote-Read-Version": "0.1.0",
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var resp prompb.ReadResponse
+	if err := proto.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (b *RemoteBackend) MetricLabels(string) []string {
+	return nil
+}
+
+func (b *RemoteBackend) LabelValues(string) []string {
+	return nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"strconv"
+	"sync/atomic"
+)
+
+// Formats of request IDs generated by RequestIDGenerator.
+const (
+	RequestIDUUID4   = "uuid4"
+	RequestIDCounter = "counter"
+)
+
+type requestIDKey struct{}
+
+// ContextWithRequestID attaches the ID of the HTTP request a read or write
+// serves. It is logged with the searches run for a read and sent to HEC as
+// X-Request-ID with the events of a write.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDGenerator returns a func generating request IDs of format,
+// random UUIDs or the decimal numbers counting up from 1.
+func RequestIDGenerator(format string) (func() string, error) {
+	switch format {
+	case RequestIDUUID4:
+		return NewUUID, nil
+	case RequestIDCounter:
+		var n uint64
+		return func() string {
+			return strconv.FormatUint(atomic.AddUint64(&n, 1), 10)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown request id format %q, must be %s or %s", format, RequestIDUUID4, RequestIDCounter)
+}
+
+// WithRequestIDs sets how the IDs of writes without one, e.g. coalesced
+// ones, are generated. By default they are random UUIDs.
+func WithRequestIDs(generate func() string) Option {
+	return func(c *Client) {
+		c.newRequestID = generate
+	}
+}
+
+// ContextWriter is implemented by clients taking a context with writes, e.g.
+// to pass on their request ID.
+type ContextWriter interface {
+	WriteContext(context.Context, *prompb.WriteRequest) error
+}
+
+// WriteContext writes req with rc, passing ctx on if rc is a ContextWriter.
+func WriteContext(ctx context.Context, rc RemoteClient, req *prompb.WriteRequest) error {
+	if cw, ok := rc.(ContextWriter); ok {
+		return cw.WriteContext(ctx, req)
+	}
+	return rc.Write(req)
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"regexp"
+	"strings"
+)
+
+// RequiredMatchers refuses read queries not constraining any, or all, of
+// Labels, so nobody scans whole indexes by accident. A label is constrained
+// by = on a non-empty value or =~ on a regex not matching the empty string.
+type RequiredMatchers struct {
+	Labels []string
+	// All requires every label to be constrained instead of any of them.
+	All bool
+}
+
+// WithRequiredMatchers sets the labels read queries have to constrain.
+func WithRequiredMatchers(m RequiredMatchers) Option {
+	return func(c *Client) {
+		c.requiredMatchers = m
+	}
+}
+
+type requiredMatchersExemptKey struct{}
+
+// ContextWithoutRequiredMatchers exempts a read from the required matchers,
+// e.g. of admin tooling.
+func ContextWithoutRequiredMatchers(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requiredMatchersExemptKey{}, true)
+}
+
+// check returns a LimitError naming the labels q lacks matchers on, they are
+// counted in ropee_read_required_matcher_rejections_count.
+func (m RequiredMatchers) check(ctx context.Context, q *prompb.Query) error {
+	if len(m.Labels) == 0 {
+		return nil
+	}
+	if exempt, _ := ctx.Value(requiredMatchersExemptKey{}).(bool); exempt {
+		return nil
+	}
+	missing := make([]string, 0, len(m.Labels))
+	for _, label := range m.Labels {
+		if !constrains(q.Matchers, label) {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) == 0 || !m.All && len(missing) < len(m.Labels) {
+		return nil
+	}
+	for _, label := range missing {
+		metrics.ReadRequiredMatcherRejections.WithLabelValues(label).Inc()
+	}
+	if m.All {
+		return &LimitError{msg: fmt.Sprintf("query must have a matcher on each of %s, missing %s", strings.Join(m.Labels, ", "), strings.Join(missing, ", "))}
+	}
+	return &LimitError{msg: fmt.Sprintf("query must have a matcher on any of %s", strings.Join(m.Labels, ", "))}
+}
+
+func constrains(matchers []*prompb.LabelMatcher, label string) bool {
+	for _, m := range matchers {
+		if m.Name != label {
+			continue
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if m.Value != "" {
+				return true
+			}
+		case prompb.LabelMatcher_RE:
+			if re, err := regexp.Compile("^(?:" + m.Value + ")$"); err == nil && !re.MatchString("") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reasons search result rows are skipped for, the reason label of
+// ropee_read_skipped_events_count. Non-metric events that got into a metrics
+// index lack the value or the metric name.
+const (
+	skipMissingValue      = "missing_value"
+	skipInvalidValue      = "invalid_value"
+	skipMissingMetricName = "missing_metric_name"
+	skipMalformedRow      = "malformed_row"
+)
+
+// WithStrictRead fails queries all of whose result rows were skipped, e.g.
+// when searching an index holding no metrics at all. Otherwise such a query
+// just returns no series.
+func WithStrictRead(strict bool) Option {
+	return func(c *Client) {
+		c.strictRead = strict
+	}
+}
+
+// resultRow is a row of json_rows search results. Cells are strings, null
+// for missing fields or arrays of multivalue fields, which are joined by
+// commas as of export search results.
+type resultRow []string
+
+func (r *resultRow) UnmarshalJSON(data []byte) error {
+	var cells []json.RawMessage
+	if err := json.Unmarshal(data, &cells); err != nil {
+		return err
+	}
+	row := make(resultRow, len(cells))
+	for i, cell := range cells {
+		var s string
+		if err := json.Unmarshal(cell, &s); err == nil {
+			row[i] = s
+			continue
+		}
+		var values []interface{}
+		if err := json.Unmarshal(cell, &values); err == nil {
+			vs := make([]string, len(values))
+			for j := range values {
+				vs[j] = fmt.Sprint(values[j])
+			}
+			row[i] = strings.Join(vs, ",")
+			continue
+		}
+		if string(cell) != "null" {
+			row[i] = string(cell)
+		}
+	}
+	*r = row
+	return nil
+}
+
+// parseSampleValue parses the value of a search result row. Surrounding
+// whitespace is ignored and of multivalue fields the first non-empty value
+// is used. Besides decimal and scientific notation strconv accepts the
+// inf, +inf, -inf, infinity and nan spellings in any case. If the value
+// can't be parsed the reason is returned.
+func parseSampleValue(s string) (float64, string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, skipInvalidValue
+			}
+			return f, ""
+		}
+	}
+	return 0, skipMissingValue
+}
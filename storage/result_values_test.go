@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseSampleValue(t *testing.T) {
+	for _, c := range []struct {
+		value  string
+		want   float64
+		reason string
+	}{
+		{"1", 1, ""},
+		{"-0.5", -0.5, ""},
+		{"1e3", 1000, ""},
+		{"1.5E-3", 0.0015, ""},
+		{"+2e+2", 200, ""},
+		{" 42 ", 42, ""},
+		{"\t7\n", 7, ""},
+		{"inf", math.Inf(1), ""},
+		{"+Inf", math.Inf(1), ""},
+		{"-inf", math.Inf(-1), ""},
+		{"Infinity", math.Inf(1), ""},
+		{"-INFINITY", math.Inf(-1), ""},
+		{"NaN", math.NaN(), ""},
+		{"nan", math.NaN(), ""},
+		{"3,4", 3, ""},
+		{",,5", 5, ""},
+		{" , 6 ,x", 6, ""},
+		{"", 0, skipMissingValue},
+		{"   ", 0, skipMissingValue},
+		{",,", 0, skipMissingValue},
+		{"abc", 0, skipInvalidValue},
+		{"1.2.3", 0, skipInvalidValue},
+		{"0x", 0, skipInvalidValue},
+		{"12ms", 0, skipInvalidValue},
+		{"x,1", 0, skipInvalidValue},
+	} {
+		got, reason := parseSampleValue(c.value)
+		if reason != c.reason {
+			t.Errorf("parseSampleValue(%q) reason = %q, want %q", c.value, reason, c.reason)
+			continue
+		}
+		if math.IsNaN(c.want) {
+			if !math.IsNaN(got) {
+				t.Errorf("parseSampleValue(%q) = %v, want NaN", c.value, got)
+			}
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseSampleValue(%q) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestResultRowUnmarshal(t *testing.T) {
+	for _, c := range []struct {
+		cells string
+		want  resultRow
+	}{
+		{`["1", "a"]`, resultRow{"1", "a"}},
+		{`[null, "a"]`, resultRow{"", "a"}},
+		{`[["1", "2"], "a"]`, resultRow{"1,2", "a"}},
+		{`[[1.5, "x"]]`, resultRow{"1.5,x"}},
+		{`[3, true]`, resultRow{"3", "true"}},
+	} {
+		var row resultRow
+		if err := json.Unmarshal([]byte(c.cells), &row); err != nil {
+			t.Errorf("unmarshal %s: %v", c.cells, err)
+			continue
+		}
+		if len(row) != len(c.want) {
+			t.Errorf("unmarshal %s = %q, want %q", c.cells, row, c.want)
+			continue
+		}
+		for i := range row {
+			if row[i] != c.want[i] {
+				t.Errorf("unmarshal %s = %q, want %q", c.cells, row, c.want)
+				break
+			}
+		}
+	}
+	var row resultRow
+	if err := json.Unmarshal([]byte(`{"a": 1}`), &row); err == nil {
+		t.Error("unmarshal of an object succeeded, want an error")
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SavedSearches answers queries of some metrics with Splunk saved searches
+// instead of generated SPL, for data that doesn't translate well to mstats.
+type SavedSearches struct {
+	rules []savedSearchRule
+}
+
+type savedSearchRule struct {
+	metric      *regexp.Regexp
+	savedSearch string
+}
+
+type savedSearchFile struct {
+	SavedSearches []struct {
+		Metric      string `yaml:"metric"`
+		SavedSearch string `yaml:"savedsearch"`
+	} `yaml:"savedsearches"`
+}
+
+// LoadSavedSearches reads the mapping from a YAML file like
+//
+//	savedsearches:
+//	  - metric: "node_disk_.*"
+//	    savedsearch: ropee_node_disk
+//
+// metric is a regex matching the whole metric name, the first match wins.
+func LoadSavedSearches(filename string) (*SavedSearches, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f savedSearchFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	res := &SavedSearches{}
+	for i, s := range f.SavedSearches {
+		if s.SavedSearch == "" {
+			return nil, fmt.Errorf("savedsearch %d: savedsearch is required", i+1)
+		}
+		re, err := regexp.Compile("^(?:" + s.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("savedsearch %d: %s", i+1, err)
+		}
+		res.rules = append(res.rules, savedSearchRule{metric: re, savedSearch: s.SavedSearch})
+	}
+	return res, nil
+}
+
+// WithSavedSearches answers queries of metrics mapped by s with their saved
+// search.
+func WithSavedSearches(s *SavedSearches) Option {
+	return func(c *Client) {
+		c.savedSearches = s
+	}
+}
+
+// find returns the saved search answering query and the queried metric
+// name, an empty name if there is none.
+func (s *SavedSearches) find(query *prompb.Query) (string, string) {
+	if s == nil {
+		return "", ""
+	}
+	for _, m := range query.Matchers {
+		if m.Name != "__name__" || m.Type != prompb.LabelMatcher_EQ {
+			continue
+		}
+		for _, r := range s.rules {
+			if r.metric.MatchString(m.Value) {
+				return r.savedSearch, m.Value
+			}
+		}
+	}
+	return "", ""
+}
+
+// runSavedSearch dispatches the saved search name over [start, end] and
+// returns its results. The Splunk name of the metric is passed as
+// $metric_name$, the search has to return _time, ropee_metric_name,
+// ropee_metric_value and the labels as fields.
+func (c *Client) runSavedSearch(ctx context.Context, name, metricName string, start, end int64) (*jobResultPreview, error) {
+	// the name is substituted into the saved search as is
+	if !isLabelName(metricName, true) {
+		return nil, queryErrorf("invalid metric name %q", metricName)
+	}
+	body := map[string]string{
+		"dispatch.earliest_time": splunkTime(start),
+		"dispatch.latest_time":   splunkTime(end + 1),
+		"dispatch.ttl":           strconv.Itoa(int(c.sidCache.dispatchTTL() / time.Second)),
+		"args.metric_name":       c.metricNames.splunk(metricName),
+	}
+	c.dispatchOptions.apply(body, "dispatch.", "dispatch.ttl", 0)
+	if c.maxResultRows > 0 {
+		body["dispatch.max_count"] = strconv.Itoa(c.maxResultRows + 1)
+	}
+	started := time.Now()
+	res, err := c.splunkRESTRequest(ctx, "POST", "/servicesNS/-/-/saved/searches/"+url.PathEscape(name)+"/dispatch", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ReadPhaseSeconds.WithLabelValues("dispatch").Observe(time.Since(started).Seconds())
+	var result map[string]string
+	json.Unmarshal(res, &result)
+	if result["sid"] == "" {
+		return nil, searchError("dispatch saved search "+name+" failed", splunkMessages(res))
+	}
+	return c.jobResults(ctx, result["sid"], false)
+}
+
+// matchSeries drops the series not matching all label matchers of query,
+// saved searches don't filter by them.
+func matchSeries(res *prompb.QueryResult, query *prompb.Query) error {
+	matchers := make([]func(map[string]string) bool, 0, len(query.Matchers))
+	for _, m := range query.Matchers {
+		if m.Name == "__name__" {
+			continue
+		}
+		name, value := m.Name, m.Value
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			matchers = append(matchers, func(ls map[string]string) bool { return ls[name] == value })
+		case prompb.LabelMatcher_NEQ:
+			matchers = append(matchers, func(ls map[string]string) bool { return ls[name] != value })
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return queryErrorf("invalid regex %q of label %s: %s", value, name, err)
+			}
+			want := m.Type == prompb.LabelMatcher_RE
+			matchers = append(matchers, func(ls map[string]string) bool { return re.MatchString(ls[name]) == want })
+		}
+	}
+	kept := res.Timeseries[:0]
+	for _, ts := range res.Timeseries {
+		ls := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			ls[l.Name] = l.Value
+		}
+		matched := true
+		for _, match := range matchers {
+			if !match(ls) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			kept = append(kept, ts)
+		}
+	}
+	res.Timeseries = kept
+	return nil
+}
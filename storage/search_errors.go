@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log/level"
+	"strings"
+)
+
+// splunkMessage is a message Splunk attaches to a search job or to the
+// response of a failed REST call.
+type splunkMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func (m splunkMessage) isError() bool {
+	return m.Type == "ERROR" || m.Type == "FATAL"
+}
+
+// splunkMessages returns the messages of the REST response body, the body
+// itself if it has none.
+func splunkMessages(body []byte) []splunkMessage {
+	var res struct {
+		Messages []splunkMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || len(res.Messages) == 0 {
+		return []splunkMessage{{Type: "ERROR", Text: strings.TrimSpace(string(body))}}
+	}
+	return res.Messages
+}
+
+// searchErrorMarkers map the texts of Splunk's error messages to the errors
+// of their cause, the first match wins.
+var searchErrorMarkers = []struct {
+	markers []string
+	err     func(msg string) error
+}{
+	{
+		// "Search not executed: The maximum number of concurrent historical
+		// searches ...", disk and search quotas
+		markers: []string{"maximum number of concurrent", "quota", "too many"},
+		err:     func(msg string) error { return &ThrottleError{msg: msg} },
+	},
+	{
+		markers: []string{"permission", "not authorized", "insufficient privileges", "does not have the capability"},
+		err:     func(msg string) error { return &ForbiddenError{msg: msg} },
+	},
+	{
+		// malformed SPL
+		markers: []string{"error in '", "unknown search command", "unbalanced", "parsing"},
+		err:     func(msg string) error { return &QueryError{msg: msg} },
+	},
+}
+
+// searchError returns an error with the error messages of a failed search,
+// of the type matching their cause so the read is answered with a fitting
+// status. Without error messages all messages are included.
+func searchError(prefix string, msgs []splunkMessage) error {
+	texts := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		if m.isError() {
+			texts = append(texts, m.Type+": "+m.Text)
+		}
+	}
+	if len(texts) == 0 {
+		for _, m := range msgs {
+			texts = append(texts, m.Type+": "+m.Text)
+		}
+	}
+	msg := prefix + ": " + strings.Join(texts, "; ")
+	lower := strings.ToLower(msg)
+	for _, m := range searchErrorMarkers {
+		for _, marker := range m.markers {
+			if strings.Contains(lower, marker) {
+				return m.err(msg)
+			}
+		}
+	}
+	return &SearchError{msg: msg}
+}
+
+// logSearchWarnings logs the warnings of a successful search.
+func (c *Client) logSearchWarnings(ctx context.Context, sid string, msgs []splunkMessage) {
+	for _, m := range msgs {
+		if m.Type == "WARN" || m.isError() {
+			level.Warn(c.log).Log("msg", "splunk search message", "request_id", requestID(ctx), "sid", sid, "type", m.Type, "text", m.Text)
+		}
+	}
+}
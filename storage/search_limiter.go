@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/kebe7jun/ropee/metrics"
+	"golang.org/x/sync/semaphore"
+	"time"
+)
+
+// SearchLimiter bounds the searches all reads of the process run in Splunk
+// at the same time, staying below the concurrent search quota of the role.
+// Catalog REST calls take a slot too, they run searches in Splunk. Searches
+// wait at most timeout for a free slot.
+type SearchLimiter struct {
+	sem     *semaphore.Weighted
+	timeout time.Duration
+}
+
+func NewSearchLimiter(max int, timeout time.Duration) *SearchLimiter {
+	return &SearchLimiter{
+		sem:     semaphore.NewWeighted(int64(max)),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free search slot and returns the function releasing it.
+func (l *SearchLimiter) acquire(ctx context.Context) (func(), error) {
+	started := time.Now()
+	waitCtx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	err := l.sem.Acquire(waitCtx, 1)
+	metrics.SplunkSearchQueueWait.Observe(time.Since(started).Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &ThrottleError{msg: fmt.Sprintf("no free Splunk search slot within %s, retry later", l.timeout)}
+	}
+	metrics.AddConcurrentSearches(1)
+	return func() {
+		metrics.AddConcurrentSearches(-1)
+		l.sem.Release(1)
+	}, nil
+}
+
+// WithSearchLimiter makes searches of the client take a slot of l.
+func WithSearchLimiter(l *SearchLimiter) Option {
+	return func(c *Client) {
+		c.searchLimiter = l
+	}
+}
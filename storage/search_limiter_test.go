@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"github.com/kebe7jun/ropee/metrics"
+	"testing"
+	"time"
+)
+
+func TestSearchLimiterPeakPerScrape(t *testing.T) {
+	l := NewSearchLimiter(2, time.Second)
+	registry := metrics.NewRegistry()
+	peak := func() float64 {
+		snapshot, err := metrics.Snapshot(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshot["ropee_splunk_concurrent_searches_peak"]
+	}
+	first, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second()
+	if got := peak(); got != 2 {
+		t.Fatalf("peak = %v after a burst, want 2", got)
+	}
+	if got := peak(); got != 1 {
+		t.Fatalf("peak = %v the scrape after the burst, want the 1 running", got)
+	}
+	first()
+}
+
+func TestCatalogTakesASearchSlot(t *testing.T) {
+	f := newFakeSplunk(func(string) ([]string, [][]string) { return nil, nil })
+	defer f.Close()
+	f.dimensions = []string{"job"}
+	l := NewSearchLimiter(1, 10*time.Millisecond)
+	c := f.client(WithSearchLimiter(l))
+	if got := c.MetricLabels("up"); len(got) != 1 {
+		t.Fatalf("labels = %v, want job", got)
+	}
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if got := c.MetricLabels("up"); len(got) != 0 {
+		t.Fatalf("labels = %v while all search slots are taken, want none", got)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateSearchPrefix checks that prefix can replace the index filter of
+// read searches, e.g. a macro like `prom_metrics` expanding to
+// index=metrics sourcetype=prometheus. Reads are mstats searches, prefix
+// becomes part of their where clause, so it has to be a filter expression:
+// pipes, which would start another command like | savedsearch, are refused
+// as are unbalanced backticks, quotes and parentheses.
+func ValidateSearchPrefix(prefix string) error {
+	if strings.TrimSpace(prefix) == "" {
+		return fmt.Errorf("search prefix is empty")
+	}
+	depth, inQuote, inMacro := 0, false, false
+	for i, c := range prefix {
+		switch {
+		case c == '"' && !inMacro && (i == 0 || prefix[i-1] != '\\'):
+			inQuote = !inQuote
+		case inQuote:
+		case c == '`':
+			inMacro = !inMacro
+		case c == '|':
+			return fmt.Errorf("search prefix %q must be a filter of the mstats where clause, it can't contain a pipe", prefix)
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth < 0 {
+				return fmt.Errorf("search prefix %q has unbalanced parentheses", prefix)
+			}
+		}
+	}
+	switch {
+	case inQuote:
+		return fmt.Errorf("search prefix %q has an unterminated quote", prefix)
+	case inMacro:
+		return fmt.Errorf("search prefix %q has an unterminated macro", prefix)
+	case depth != 0:
+		return fmt.Errorf("search prefix %q has unbalanced parentheses", prefix)
+	}
+	return nil
+}
+
+// WithSearchPrefix searches the metrics matching prefix, see
+// ValidateSearchPrefix, instead of those of the indexes. Dimensions of
+// metrics are still looked up in the catalog of the indexes.
+func WithSearchPrefix(prefix string) Option {
+	return func(c *Client) {
+		c.searchPrefix = strings.TrimSpace(prefix)
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/prompb"
+	"sync"
+)
+
+// SearchTrace collects the searches run for the queries of a read, e.g. for
+// a query log. Queries answered from the read cache have none.
+type SearchTrace struct {
+	mtx      sync.Mutex
+	searches map[*prompb.Query]*TracedSearch
+}
+
+// TracedSearch is the search or saved search run for a query and the sids of
+// its search jobs, one per chunk of its range. Oneshot and export searches
+// have no job.
+type TracedSearch struct {
+	Search string
+	SIDs   []string
+}
+
+type searchTraceKey struct{}
+
+type tracedQueryKey struct{}
+
+// ContextWithSearchTrace records the searches of reads with ctx in t.
+func ContextWithSearchTrace(ctx context.Context, t *SearchTrace) context.Context {
+	return context.WithValue(ctx, searchTraceKey{}, t)
+}
+
+// Search returns the search run for q, one of the queries of the read, false
+// if there was none.
+func (t *SearchTrace) Search(q *prompb.Query) (TracedSearch, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s, ok := t.searches[q]
+	if !ok {
+		return TracedSearch{}, false
+	}
+	return TracedSearch{Search: s.Search, SIDs: append([]string(nil), s.SIDs...)}, true
+}
+
+// withTracedQuery returns ctx of the searches of q, which are recorded in the
+// trace of ctx, if any.
+func withTracedQuery(ctx context.Context, q *prompb.Query) context.Context {
+	if _, ok := ctx.Value(searchTraceKey{}).(*SearchTrace); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, tracedQueryKey{}, q)
+}
+
+// traced updates the search of the query of ctx in its trace, if ctx has
+// one.
+func traced(ctx context.Context, update func(*TracedSearch)) {
+	t, ok := ctx.Value(searchTraceKey{}).(*SearchTrace)
+	q, _ := ctx.Value(tracedQueryKey{}).(*prompb.Query)
+	if !ok || q == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.searches == nil {
+		t.searches = make(map[*prompb.Query]*TracedSearch)
+	}
+	s, ok := t.searches[q]
+	if !ok {
+		s = &TracedSearch{}
+		t.searches[q] = s
+	}
+	update(s)
+}
+
+func traceSearch(ctx context.Context, search string) {
+	traced(ctx, func(s *TracedSearch) { s.Search = search })
+}
+
+func traceSID(ctx context.Context, sid string) {
+	traced(ctx, func(s *TracedSearch) { s.SIDs = append(s.SIDs, sid) })
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"strconv"
+	"strings"
+)
+
+var matcherTypes = []struct {
+	op string
+	t  prompb.LabelMatcher_Type
+}{
+	// two character operators first, = is a prefix of =~
+	{"!=", prompb.LabelMatcher_NEQ},
+	{"=~", prompb.LabelMatcher_RE},
+	{"!~", prompb.LabelMatcher_NRE},
+	{"=", prompb.LabelMatcher_EQ},
+}
+
+// ParseSelector parses a PromQL series selector like
+// up{job="node",instance=~"10\\..*"} into label matchers.
+func ParseSelector(s string) ([]*prompb.LabelMatcher, error) {
+	s = strings.TrimSpace(s)
+	matchers := make([]*prompb.LabelMatcher, 0)
+	name := s
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		if !strings.HasSuffix(s, "}") {
+			return nil, queryErrorf("selector %q: missing closing }", s)
+		}
+		name = strings.TrimSpace(s[:i])
+		ms, err := parseMatchers(s[i+1 : len(s)-1])
+		if err != nil {
+			return nil, queryErrorf("selector %q: %s", s, err)
+		}
+		matchers = append(matchers, ms...)
+	}
+	if name != "" {
+		if !isLabelName(name, true) {
+			return nil, queryErrorf("selector %q: invalid metric name %q", s, name)
+		}
+		matchers = append([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name}}, matchers...)
+	}
+	if len(matchers) == 0 {
+		return nil, queryErrorf("selector %q: matches everything", s)
+	}
+	return matchers, nil
+}
+
+func parseMatchers(s string) ([]*prompb.LabelMatcher, error) {
+	res := make([]*prompb.LabelMatcher, 0)
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return res, nil
+		}
+		i := strings.IndexAny(s, "=!")
+		if i < 0 {
+			return nil, fmt.Errorf("expected operator after %q", s)
+		}
+		name := strings.TrimSpace(s[:i])
+		if !isLabelName(name, false) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		s = s[i:]
+		m := &prompb.LabelMatcher{Name: name}
+		found := false
+		for _, mt := range matcherTypes {
+			if strings.HasPrefix(s, mt.op) {
+				m.Type = mt.t
+				s = strings.TrimSpace(s[len(mt.op):])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid operator for label %s", name)
+		}
+		value, rest, err := unquotePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %s", name, err)
+		}
+		m.Value = value
+		res = append(res, m)
+		s = strings.TrimSpace(rest)
+		if s != "" {
+			if s[0] != ',' {
+				return nil, fmt.Errorf("expected , after matcher of label %s", name)
+			}
+			s = s[1:]
+		}
+	}
+}
+
+// unquotePrefix unquotes the string literal s starts with and returns the
+// remainder of s.
+func unquotePrefix(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'' && s[0] != '`') {
+		return "", "", fmt.Errorf("expected quoted value")
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			lit := s[:i+1]
+			if quote == '\'' {
+				// Go only knows single quotes for runes
+				lit = `"` + strings.Replace(lit[1:i], `"`, `\"`, -1) + `"`
+			}
+			v, err := strconv.Unquote(lit)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid quoted value %s", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted value")
+}
+
+func isLabelName(s string, metric bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' || metric && c == ':' {
+			continue
+		}
+		return false
+	}
+	return true
+}
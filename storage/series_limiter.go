@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SeriesLimiter guards Splunk against cardinality storms. It remembers the
+// series seen in the current and the previous window; once more than max
+// distinct series were seen in the current window, samples of series that
+// appear in neither window are rejected while known series keep flowing.
+// Memory is bounded by 2*max hashes.
+type SeriesLimiter struct {
+	mtx         sync.Mutex
+	max         int
+	window      time.Duration
+	windowStart time.Time
+	current     map[uint64]struct{}
+	previous    map[uint64]struct{}
+}
+
+func NewSeriesLimiter(max int, window time.Duration) *SeriesLimiter {
+	return &SeriesLimiter{
+		max:         max,
+		window:      window,
+		windowStart: time.Now(),
+		current:     make(map[uint64]struct{}),
+		previous:    make(map[uint64]struct{}),
+	}
+}
+
+// Allow reports whether samples of the given series may be written.
+func (l *SeriesLimiter) Allow(labels []prompb.Label) bool {
+	h := seriesHash(labels)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if now := time.Now(); now.Sub(l.windowStart) >= l.window {
+		l.previous = l.current
+		l.current = make(map[uint64]struct{})
+		l.windowStart = now
+	}
+	if _, ok := l.current[h]; ok {
+		return true
+	}
+	_, known := l.previous[h]
+	if len(l.current) >= l.max && !known {
+		return false
+	}
+	l.current[h] = struct{}{}
+	return true
+}
+
+func seriesHash(labels []prompb.Label) uint64 {
+	ls := make([]prompb.Label, len(labels))
+	copy(ls, labels)
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	h := fnv.New64a()
+	for _, l := range ls {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
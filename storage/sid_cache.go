@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// sidCache remembers the jobs of recent searches, so an identical search of
+// the same user fetches the results of the finished job again instead of
+// dispatching a new one.
+type sidCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]sidCacheEntry
+}
+
+type sidCacheEntry struct {
+	sid     string
+	expires time.Time
+}
+
+// WithSIDCache reuses the job of an identical search run at most ttl ago,
+// 0 disables reuse. Splunk keeps the results of jobs at least that long.
+func WithSIDCache(ttl time.Duration) Option {
+	return func(c *Client) {
+		if ttl > 0 {
+			c.sidCache = &sidCache{ttl: ttl, entries: make(map[string]sidCacheEntry)}
+		}
+	}
+}
+
+// sidCacheKey identifies the search with body of the user of c.
+func (c *Client) sidCacheKey(body map[string]string) string {
+	return c.credentials().cacheKey() + "\xff" + body["search"] + "\xff" + body["earliest_time"] + "\xff" + body["latest_time"] + "\xff" + body["max_count"]
+}
+
+// dispatchTTL is how long Splunk keeps the results of jobs.
+func (sc *sidCache) dispatchTTL() time.Duration {
+	if sc != nil && sc.ttl > jobDispatchTTL {
+		return sc.ttl
+	}
+	return jobDispatchTTL
+}
+
+func (sc *sidCache) get(key string) (string, bool) {
+	if sc == nil {
+		return "", false
+	}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	e, ok := sc.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.sid, true
+}
+
+func (sc *sidCache) put(key, sid string) {
+	if sc == nil {
+		return
+	}
+	now := time.Now()
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	for k, e := range sc.entries {
+		if now.After(e.expires) {
+			delete(sc.entries, k)
+		}
+	}
+	sc.entries[key] = sidCacheEntry{sid: sid, expires: now.Add(sc.ttl)}
+}
+
+func (sc *sidCache) remove(key string) {
+	if sc == nil {
+		return
+	}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	delete(sc.entries, key)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"github.com/kebe7jun/ropee/metrics"
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+	"time"
+)
+
+func TestSIDCacheKeyedByPassword(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		return []string{"value"}, [][]string{{"up"}}
+	})
+	defer f.Close()
+	c := f.client(WithSIDCache(time.Minute))
+	q := LabelQuery{Start: 0, End: 60000}
+	search := func(password string) {
+		if _, err := c.SearchLabelValues(ContextWithCredentials(context.Background(), "alice", password), "__name__", q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search("secret")
+	search("secret")
+	if f.dispatched != 1 {
+		t.Fatalf("dispatched %d jobs for a repeated search, want 1", f.dispatched)
+	}
+	search("other")
+	if f.dispatched != 2 {
+		t.Fatalf("dispatched %d jobs, the job of another password was reused", f.dispatched)
+	}
+}
+
+func TestSIDCacheReuseNotObservedAgain(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		return metricRows(), [][]string{{rfc3339(1000), "up", "1"}}
+	})
+	defer f.Close()
+	c := f.client(WithSIDCache(time.Minute))
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}}
+	registry := metrics.NewRegistry()
+	scanned := func() float64 {
+		snapshot, err := metrics.Snapshot(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshot["ropee_read_scanned_events_count"]
+	}
+	before := scanned()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Read(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.dispatched != 1 {
+		t.Fatalf("dispatched %d jobs for a repeated read, want 1", f.dispatched)
+	}
+	if got := scanned() - before; got != 1 {
+		t.Fatalf("observed the scanned events of %v jobs, want only the dispatched one", got)
+	}
+}
+
+func TestSIDCacheKeepsJobsOverTheReadBudget(t *testing.T) {
+	f := newFakeSplunk(func(search string) ([]string, [][]string) {
+		return metricRows(), [][]string{{rfc3339(1000), "up", "1"}, {rfc3339(2000), "up", "2"}}
+	})
+	defer f.Close()
+	c := f.client(WithSIDCache(time.Minute), WithReadLimits(ReadLimits{MaxSamples: 1}))
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   60000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}}}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Read(context.Background(), req); err == nil {
+			t.Fatal("a read over the budget succeeded")
+		}
+	}
+	if len(f.cancelled) != 0 {
+		t.Fatalf("cancelled the done jobs %v", f.cancelled)
+	}
+	if f.dispatched != 1 {
+		t.Fatalf("dispatched %d jobs, the job of the first read wasn't reused", f.dispatched)
+	}
+}
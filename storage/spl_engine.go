@@ -1,54 +1,323 @@
 package storage
 
 import (
-	"fmt"
+	"github.com/kebe7jun/ropee/transform"
 	"github.com/prometheus/prometheus/prompb"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func MakeSPL(query *prompb.Query, c RemoteClient, index string) (string, error) {
-	metricName := ""
+// minSpanSeconds is the finest mstats span searched, samples are never
+// returned at a higher resolution than this.
+const minSpanSeconds = 10
+
+// Downsampling controls how MakeSPL aggregates samples of a query, at the
+// step hint and, with PushDown, by the function hint.
+type Downsampling struct {
+	// Enabled aggregates samples at the step hinted by the PromQL query
+	// instead of at minSpanSeconds.
+	Enabled bool
+	// Aggregation is the mstats function applied per span, latest, avg,
+	// max or min. Counters always use latest, aggregating them otherwise
+	// breaks rate() on resets, and so do queries without a metric name which
+	// may match counters.
+	Aggregation string
+	// AutoSpan aggregates samples of long queries at a coarser span than
+	// their step when Enabled.
+	AutoSpan AutoSpanRules
+	// PushDown aggregates samples of max_over_time and min_over_time
+	// selectors by the function per step when Enabled, see pushDown.
+	PushDown bool
+
+	// rangeMs is the range hinted for the query translated.
+	rangeMs int64
+}
+
+// pushDown returns the mstats function a query's samples can be aggregated
+// by per step without changing the result of its function hint. That is the
+// case for max_over_time and min_over_time if their range is a whole
+// multiple of the step and the evaluation times are multiples of it: every
+// range then covers whole spans. The aggregate of a span is stamped at its
+// last millisecond, inside the ranges covering the span. Only a sample
+// stamped exactly on an evaluation time counts towards the next one.
+func (d Downsampling) pushDown(query *prompb.Query) (string, bool) {
+	if !d.Enabled || !d.PushDown || query.Hints == nil || d.rangeMs <= 0 {
+		return "", false
+	}
+	fn, ok := pushDownFuncs[query.Hints.Func]
+	step := query.Hints.StepMs
+	if !ok || step%1000 != 0 || step/1000 != d.span(query) || d.rangeMs%step != 0 {
+		return "", false
+	}
+	if query.Hints.StartMs%step != 0 || query.Hints.EndMs%step != 0 {
+		return "", false
+	}
+	return fn, true
+}
+
+func (d Downsampling) span(query *prompb.Query) int64 {
+	step := int64(minSpanSeconds)
+	if d.Enabled && query.Hints != nil && query.Hints.StepMs/1000 > step {
+		step = query.Hints.StepMs / 1000
+	}
+	if span := int64(d.AutoSpan.Span(query) / time.Second); d.Enabled && span > step {
+		step = span
+	}
+	return step
+}
+
+func (d Downsampling) aggregation(metricName string) string {
+	if !d.Enabled || d.Aggregation == "" || metricName == "" || isCounterName(metricName) {
+		return "latest"
+	}
+	return d.Aggregation
+}
+
+// isCounterName reports whether metricName follows the naming conventions of
+// counters and the cumulative series of histograms and summaries.
+func isCounterName(metricName string) bool {
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if strings.HasSuffix(metricName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeSPL translates query into an mstats search of the metrics matching
+// base, e.g. the indexFilter of the indexes searched. The metric name is just
+// another label: without an = matcher on __name__ all metrics of base are
+// searched, or those matching the wildcards a =~ matcher narrows to, and the
+// name is one of the labels telling series apart. Such queries can match a
+// lot of series, they are bounded by the read limits. Dimensions without the
+// field prefix fields aren't labels.
+func MakeSPL(query *prompb.Query, c RemoteClient, base string, ds Downsampling, names MetricNames, fields FieldPrefix) (string, error) {
+	var nameMatcher *prompb.LabelMatcher
 	for _, m := range query.Matchers {
-		if m.Name == "__name__" {
-			if m.Type != prompb.LabelMatcher_EQ {
-				return "", fmt.Errorf("metric_name label macher type error, only euqals supported")
-			}
-			metricName = m.Value
+		if m.Name == "__name__" && m.Type == prompb.LabelMatcher_EQ && m.Value != "" && !strings.Contains(m.Value, "*") {
+			nameMatcher = m
 			break
 		}
 	}
-	if metricName == "" {
-		return "", fmt.Errorf("__name__ is required")
+	for _, m := range query.Matchers {
+		if m.Name != "__name__" && !isLabelName(m.Name, false) {
+			return "", queryErrorf("invalid label name %q", m.Name)
+		}
 	}
-	step := query.Hints.StepMs / 1000
-	if step < 10 {
-		step = 10
+	metricName := ""
+	patterns := []string{"*"}
+	if nameMatcher != nil {
+		metricName = nameMatcher.Value
+		patterns = []string{metricName}
+	} else {
+		for _, m := range query.Matchers {
+			if m.Name == "__name__" && m.Type == prompb.LabelMatcher_RE {
+				patterns = namePatterns(m.Value)
+				break
+			}
+		}
 	}
-	ls := strings.Join(c.MetricLabels(metricName), " ")
-	search := "| mstats latest(_value) as " + CommonMetricValue + " where index=" + index + " AND metric_name=" + metricName + " span=" + strconv.FormatInt(step, 10) + "s by metric_name " + ls
-	for _, m := range query.Matchers {
+	// the metrics searched, a =~ matcher narrowed to wildcards is still
+	// applied exactly by a where stage
+	nameFilters := make([]string, 0, len(patterns))
+	dimensions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, p := range patterns {
+		splunkName := names.splunk(p)
+		nameFilters = append(nameFilters, "metric_name="+splString(splunkName))
+		for _, d := range c.MetricLabels(splunkName) {
+			if _, ok := fields.prometheus(d); ok && isSplunkFieldName(d) && !seen[d] {
+				seen[d] = true
+				dimensions = append(dimensions, d)
+			}
+		}
+	}
+	nameFilter := nameFilters[0]
+	if len(nameFilters) > 1 {
+		nameFilter = "(" + strings.Join(nameFilters, " OR ") + ")"
+	}
+	ls := strings.Join(dimensions, " ")
+	// = matchers on search terms also prune the dimensions in mstats
+	// itself, every matcher is a where stage on the aggregated rows with
+	// Prometheus' semantics for missing labels.
+	dims := ""
+	filters := ""
+	for _, matcher := range query.Matchers {
+		if matcher == nameMatcher {
+			continue
+		}
+		// copy, the request may be shared with other backends
+		m := *matcher
 		if m.Name == "__name__" {
-			m.Name = "metric_name"
+			m = metricNameMatcher(m, names)
+		} else {
+			m.Name = fields.splunk(m.Name)
 		}
+		field := m.Name
+		m.Name = evalField(field)
 		switch m.Type {
-		case prompb.LabelMatcher_RE:
-			search += "| regex " + m.Name + "=" + strconv.Quote(m.Value)
-		case prompb.LabelMatcher_NRE:
-			search += "| regex " + m.Name + "!=" + strconv.Quote(m.Value)
 		case prompb.LabelMatcher_EQ:
-			search += "| where " + m.Name + "=" + strconv.Quote(m.Value)
+			// the mstats where clause prunes the dimension values searched
+			// but compares them case-insensitively, the where stage
+			// compares exactly
+			if isSearchTerm(m.Value) {
+				dims += " AND " + field + "=" + splString(m.Value)
+			}
+			filters += equalityFilter(&m)
 		case prompb.LabelMatcher_NEQ:
-			search += "| where " + m.Name + "!=" + strconv.Quote(m.Value)
+			filters += equalityFilter(&m)
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			filter, err := regexFilter(&m)
+			if err != nil {
+				return "", err
+			}
+			filters += filter
 		}
 	}
+	aggregation := ds.aggregation(metricName)
+	if fn, ok := ds.pushDown(query); ok {
+		aggregation = fn
+	}
+	search := "| mstats " + aggregation + "(_value) as " + CommonMetricValue + " where " + base + " AND " + nameFilter + dims + " span=" + strconv.FormatInt(ds.span(query), 10) + "s by metric_name " + ls
+	search += filters
 	search += "| rename metric_name as " + CommonMetricName
 	return search, nil
 }
 
+// metricNameMatcher turns a matcher on __name__ into one on the Splunk
+// metric_name field, matching the Prometheus names as mapped by names.
+func metricNameMatcher(m prompb.LabelMatcher, names MetricNames) prompb.LabelMatcher {
+	m.Name = "metric_name"
+	switch {
+	case m.Type == prompb.LabelMatcher_RE || m.Type == prompb.LabelMatcher_NRE:
+		m.Value = regexp.QuoteMeta(names.Prefix) + "(?:" + m.Value + ")" + regexp.QuoteMeta(names.Suffix)
+	case m.Value != "":
+		m.Value = names.splunk(m.Value)
+	}
+	return m
+}
+
+// searchBase returns the filter of the metrics searched, the search prefix
+// or the index filter of the indexes.
+func (c *Client) searchBase() string {
+	if c.searchPrefix != "" {
+		return "(" + c.searchPrefix + ")"
+	}
+	return indexFilter(c.indexes())
+}
+
+// indexFilter restricts a search to any of indexes.
+func indexFilter(indexes []string) string {
+	if len(indexes) == 1 {
+		return "index=" + indexes[0]
+	}
+	return "index IN (" + strings.Join(indexes, ", ") + ")"
+}
+
+// isSplunkFieldName reports whether s can be used as a field name in SPL
+// unquoted. Besides Prometheus label names that includes dotted names, e.g.
+// of dimensions other clients write.
+func isSplunkFieldName(s string) bool {
+	for i, c := range s {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && (c >= '0' && c <= '9' || c == '.') {
+			continue
+		}
+		return false
+	}
+	return s != ""
+}
+
+// splString quotes s as an SPL string literal. Label values only ever get
+// into searches through it, field names have to be checked by
+// isLabelName or isSplunkFieldName.
+func splString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isSearchTerm reports whether = compares value exactly in the where clause
+// of mstats, which has search syntax. * is a wildcard there, and values with
+// a leading sign, like le="+Inf" of histogram buckets, or that parse as
+// numbers, like le="1" or "NaN", are taken as numbers and may match other
+// spellings, e.g. "1.0", or none. Where stages compare them as strings.
+func isSearchTerm(value string) bool {
+	if value == "" || strings.Contains(value, "*") || value[0] == '+' || value[0] == '-' {
+		return false
+	}
+	_, err := strconv.ParseFloat(value, 64)
+	return err != nil
+}
+
+// equalityFilter translates a = or != matcher into a where stage. As in
+// Prometheus a missing label equals the empty string: l!="v" keeps series
+// without l, l="" matches only them and l!="" requires l to be set.
+func equalityFilter(m *prompb.LabelMatcher) string {
+	value := splString(m.Value)
+	switch {
+	case m.Type == prompb.LabelMatcher_EQ && m.Value == "":
+		return "| where isnull(" + m.Name + ") OR " + m.Name + "=\"\""
+	case m.Type == prompb.LabelMatcher_EQ:
+		return "| where " + m.Name + "=" + value
+	case m.Value == "":
+		return "| where isnotnull(" + m.Name + ") AND " + m.Name + "!=\"\""
+	}
+	return "| where isnull(" + m.Name + ") OR " + m.Name + "!=" + value
+}
+
+// regexFilter translates a =~ or !~ matcher into a where stage. Prometheus
+// regexes are fully anchored and a missing label counts as empty value, so
+// series without the field pass whenever the empty string matches. RE2, which
+// Prometheus uses, is a subset of Splunk's PCRE, so anything that compiles
+// here means the same to Splunk.
+func regexFilter(m *prompb.LabelMatcher) (string, error) {
+	// \z and not $, which in the PCRE of Splunk matches before a trailing
+	// newline too
+	re, err := regexp.Compile(`^(?:` + m.Value + `)\z`)
+	if err != nil {
+		return "", queryErrorf("invalid regex %q for label %s: %s", m.Value, m.Name, err)
+	}
+	anchored := splString(re.String())
+	matchesEmpty := re.MatchString("")
+	if m.Type == prompb.LabelMatcher_RE {
+		if matchesEmpty {
+			return "| where isnull(" + m.Name + ") OR match(" + m.Name + ", " + anchored + ")", nil
+		}
+		return "| where match(" + m.Name + ", " + anchored + ")", nil
+	}
+	if matchesEmpty {
+		return "| where isnotnull(" + m.Name + ") AND NOT match(" + m.Name + ", " + anchored + ")", nil
+	}
+	return "| where isnull(" + m.Name + ") OR NOT match(" + m.Name + ", " + anchored + ")", nil
+}
+
 type SplunkMetricEvent struct {
 	Time      int64
 	MetricStr string
+	// Fields, when set, are sent as the fields of a HEC metric event
+	// instead of MetricStr being parsed by the sourcetype.
+	Fields map[string]interface{}
+	// Sourcetype is the sourcetype the event is written with and routed
+	// by, see WithSourcetypeDestinations, that of the client if empty.
+	Sourcetype string
+}
+
+// SummaryQuantilesToEvent returns one multiple-measurement HEC metric event
+// of q, with its labels as dimensions and a metric name.pXX per percentile.
+func SummaryQuantilesToEvent(q transform.SummaryQuantiles) SplunkMetricEvent {
+	fields := make(map[string]interface{}, len(q.Labels)+len(q.Percentiles))
+	metricName := ""
+	for _, label := range q.Labels {
+		if label.Name == "__name__" {
+			metricName = label.Value
+			continue
+		}
+		fields[label.Name] = label.Value
+	}
+	for percentile, value := range q.Percentiles {
+		fields["metric_name:"+metricName+"."+percentile] = value
+	}
+	return SplunkMetricEvent{Time: q.Timestamp, MetricStr: "metric", Fields: fields}
 }
 
 func TimeSeriesToPromMetrics(series prompb.TimeSeries) []SplunkMetricEvent {
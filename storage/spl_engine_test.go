@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRegexFilter(t *testing.T) {
+	for _, c := range []struct {
+		matcher prompb.LabelMatcher
+		want    string
+	}{
+		{
+			prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|web"},
+			`| where match(job, "^(?:api|web)\\z")`,
+		},
+		{
+			prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|"},
+			`| where isnull(job) OR match(job, "^(?:api|)\\z")`,
+		},
+		{
+			prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "api.*"},
+			`| where isnull(job) OR NOT match(job, "^(?:api.*)\\z")`,
+		},
+		{
+			prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: ".*"},
+			`| where isnotnull(job) AND NOT match(job, "^(?:.*)\\z")`,
+		},
+	} {
+		got, err := regexFilter(&c.matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s: filter = %s, want %s", c.matcher.String(), got, c.want)
+		}
+	}
+}
+
+func TestRegexFilterAnchorsAtEnd(t *testing.T) {
+	filter, err := regexFilter(&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pattern between the quotes, unescaped as Splunk reads it
+	pattern := filter[strings.Index(filter, `"`)+1 : strings.LastIndex(filter, `"`)]
+	pattern = strings.Replace(pattern, `\\`, `\`, -1)
+	re := regexp.MustCompile(pattern)
+	if !re.MatchString("api") {
+		t.Errorf("%s doesn't match api", pattern)
+	}
+	if re.MatchString("api\n") {
+		t.Errorf("%s matches a value with a trailing newline", pattern)
+	}
+}
+
+func TestRegexFilterInvalid(t *testing.T) {
+	_, err := regexFilter(&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "(api"})
+	if _, ok := err.(*QueryError); !ok {
+		t.Fatalf("err = %v, want a QueryError", err)
+	}
+}
+
+// dimensionsClient has the same dimensions for every metric.
+type dimensionsClient struct {
+	RemoteClient
+	dimensions []string
+}
+
+func (c dimensionsClient) MetricLabels(string) []string {
+	return c.dimensions
+}
+
+func TestMakeSPLHostileValues(t *testing.T) {
+	for _, c := range []struct {
+		matcher prompb.LabelMatcher
+		// want is in the search, the value compared as a string
+		want string
+	}{
+		// a leading sign makes mstats compare numbers
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "+Inf"}, `| where le="+Inf"`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "le", Value: "+Inf"}, `| where isnull(le) OR le!="+Inf"`},
+		// mstats would match numbers of other spellings, e.g. le="1.0"
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "1"}, `| where le="1"`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "NaN"}, `| where le="NaN"`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "path", Value: "/api/v1/query"}, ` AND path="/api/v1/query"`},
+		// mstats compares case-insensitively, the where stage exactly
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "path", Value: "/api/v1/query"}, `| where path="/api/v1/query"`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "path", Value: `/search?q="a b"`}, ` AND path="/search?q=\"a b\""`},
+		// a regex used as a value has wildcards and backslashes
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "pattern", Value: `^/api/.*\d+$`}, `| where pattern="^/api/.*\\d+$"`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "path", Value: `/api/v[12]/.+`}, `| where match(path, "^(?:/api/v[12]/.+)\\z")`},
+	} {
+		q := &prompb.Query{
+			StartTimestampMs: 0,
+			EndTimestampMs:   60000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"}, &c.matcher},
+		}
+		search, err := MakeSPL(q, dimensionsClient{dimensions: []string{"le", "path", "pattern"}}, "index=metrics", Downsampling{}, MetricNames{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(search, c.want) {
+			t.Errorf("search of %s = %s, want it to contain %s", c.matcher.String(), search, c.want)
+		}
+	}
+}
+
+func TestIsSearchTerm(t *testing.T) {
+	for value, want := range map[string]bool{
+		"api":   true,
+		"1x":    true,
+		"1":     false,
+		"1.0":   false,
+		"1e3":   false,
+		"0.005": false,
+		"Inf":   false,
+		"nan":   false,
+		"+Inf":  false,
+		"-1":    false,
+		"api*":  false,
+		"":      false,
+	} {
+		if got := isSearchTerm(value); got != want {
+			t.Errorf("isSearchTerm(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestSelectorsFilterHostileValues(t *testing.T) {
+	c := &Client{}
+	for _, m := range []struct {
+		matcher prompb.LabelMatcher
+		want    string
+	}{
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "+Inf"}, ` AND ((le="+Inf"))`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "path", Value: "/api/v1/query"}, ` AND ((NOT path="/api/v1/query"))`},
+		{prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "pattern", Value: `^/api/\d+$`}, ` AND ((pattern="^/api/\\d+$"))`},
+	} {
+		got, err := c.selectorsFilter([][]*prompb.LabelMatcher{{&m.matcher}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != m.want {
+			t.Errorf("filter of %s = %s, want %s", m.matcher.String(), got, m.want)
+		}
+	}
+	// * is a wildcard of mcatalog, a regex with it can't be matched exactly
+	if _, err := c.selectorsFilter([][]*prompb.LabelMatcher{{{Type: prompb.LabelMatcher_EQ, Name: "pattern", Value: "/api/.*"}}}); err == nil {
+		t.Error("a value with * was searched")
+	}
+}
+
+// splSkeleton returns search with the contents of its string literals
+// removed, what is left is the structure of the search.
+func splSkeleton(search string) string {
+	var b strings.Builder
+	quoted, escaped := false, false
+	for _, r := range search {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case !quoted:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func TestMakeSPLHostileValuesStayQuoted(t *testing.T) {
+	hostile := []string{
+		`foo" | delete`,
+		`foo\" | delete`,
+		`foo\\" | delete index=main`,
+		`\`,
+		`"`,
+		`""`,
+		"foo\n| delete",
+		"foo`| delete`",
+		`foo' | outputlookup x.csv`,
+		`[| makeresults]`,
+		`$token$`,
+		`foo) OR (index=*`,
+		`*`,
+		`+Inf`,
+	}
+	// random values of the characters SPL treats specially
+	rnd := rand.New(rand.NewSource(1))
+	special := []rune("\"\\|[]()'`=*+-$ \n\tab")
+	for i := 0; i < 500; i++ {
+		value := make([]rune, 1+rnd.Intn(12))
+		for j := range value {
+			value[j] = special[rnd.Intn(len(special))]
+		}
+		hostile = append(hostile, string(value))
+	}
+	search := func(m *prompb.LabelMatcher) string {
+		q := &prompb.Query{EndTimestampMs: 60000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}, m}}
+		s, err := MakeSPL(q, dimensionsClient{dimensions: []string{"job"}}, "index=metrics", Downsampling{}, MetricNames{}, "")
+		if err != nil {
+			t.Fatalf("%s: %s", m.String(), err)
+		}
+		return s
+	}
+	for _, value := range hostile {
+		for _, typ := range []prompb.LabelMatcher_Type{prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ, prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE} {
+			m := &prompb.LabelMatcher{Type: typ, Name: "job", Value: value}
+			// a value of the same kind, compared the same way
+			benign := &prompb.LabelMatcher{Type: typ, Name: "job", Value: "x"}
+			switch {
+			case typ == prompb.LabelMatcher_RE || typ == prompb.LabelMatcher_NRE:
+				m.Value = regexp.QuoteMeta(value)
+			case typ == prompb.LabelMatcher_EQ && !isSearchTerm(value):
+				benign.Value = "+x"
+			}
+			if value == "" {
+				benign.Value = ""
+			}
+			if got, want := splSkeleton(search(m)), splSkeleton(search(benign)); got != want {
+				t.Errorf("%q changed the search to %s, want %s", m.String(), got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// TimePartitionRules route writes to indexes by the UTC time of day they
+// happen at, for Splunk setups partitioning indexes by time.
+type TimePartitionRules struct {
+	rules []timePartitionRule
+}
+
+type timePartitionRule struct {
+	// start and end are minutes since midnight, end is exclusive and may be
+	// less than start for ranges spanning midnight.
+	start, end int
+	index      string
+}
+
+type timePartitionFile struct {
+	Rules []struct {
+		Time  string `yaml:"time"`
+		Index string `yaml:"index"`
+	} `yaml:"rules"`
+}
+
+// LoadTimePartitionRules reads rules from a YAML file like
+//
+//	rules:
+//	  - time: "00:00-06:00"
+//	    index: metrics_night
+//
+// The first rule whose range contains the time wins.
+func LoadTimePartitionRules(filename string) (*TimePartitionRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f timePartitionFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	res := &TimePartitionRules{}
+	for i, r := range f.Rules {
+		if r.Index == "" {
+			return nil, fmt.Errorf("rule %d: index is required", i+1)
+		}
+		bounds := strings.Split(r.Time, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("rule %d: time must look like 00:00-06:00, got %q", i+1, r.Time)
+		}
+		start, err := minuteOfDay(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		end, err := minuteOfDay(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		res.rules = append(res.rules, timePartitionRule{start: start, end: end, index: r.Index})
+	}
+	return res, nil
+}
+
+// minuteOfDay parses hh:mm, 24:00 is accepted as end of the day.
+func minuteOfDay(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Index returns the index of the rule matching the UTC time of day of t, or
+// fallback when none does.
+func (r *TimePartitionRules) Index(t time.Time, fallback string) string {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	for _, rule := range r.rules {
+		if rule.start <= rule.end && m >= rule.start && m < rule.end {
+			return rule.index
+		}
+		if rule.start > rule.end && (m >= rule.start || m < rule.end) {
+			return rule.index
+		}
+	}
+	return fallback
+}
+
+// Indexes returns the indexes of the rules, each once.
+func (r *TimePartitionRules) Indexes() []string {
+	res := make([]string, 0, len(r.rules))
+	seen := make(map[string]bool, len(r.rules))
+	for _, rule := range r.rules {
+		if !seen[rule.index] {
+			seen[rule.index] = true
+			res = append(res, rule.index)
+		}
+	}
+	return res
+}
+
+// WithTimePartitionRules writes events to the index r picks for the current
+// time instead of the client's index, reads search the indexes of r too.
+func WithTimePartitionRules(r *TimePartitionRules) Option {
+	return func(c *Client) {
+		c.timePartitions = r
+	}
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimePartitionIndexesAreRead(t *testing.T) {
+	f, err := ioutil.TempFile("", "time-partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`rules:
+  - time: "00:00-06:00"
+    index: metrics_night
+  - time: "22:00-24:00"
+    index: metrics_night
+  - time: "12:00-13:00"
+    index: metrics
+`)
+	f.Close()
+	rules, err := LoadTimePartitionRules(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := rules.Index(time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), "metrics"); index != "metrics_night" {
+		t.Fatalf("Index() = %q at 23:00, want metrics_night", index)
+	}
+	c := &Client{index: "metrics", timePartitions: rules}
+	if indexes := c.indexes(); !reflect.DeepEqual(indexes, []string{"metrics", "metrics_night"}) {
+		t.Fatalf("indexes() = %v, want [metrics metrics_night]", indexes)
+	}
+	if filter := c.searchBase(); filter != "index IN (metrics, metrics_night)" {
+		t.Fatalf("searchBase() = %q", filter)
+	}
+}
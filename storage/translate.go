@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"net/http"
+	"time"
+)
+
+// Translation is what a read runs for a query, without running it.
+type Translation struct {
+	// Search is the generated SPL, empty if SavedSearch answers the query.
+	Search       string   `json:"search,omitempty"`
+	SavedSearch  string   `json:"savedsearch,omitempty"`
+	SearchMode   string   `json:"search_mode"`
+	Indexes      []string `json:"indexes"`
+	SearchPrefix string   `json:"search_prefix,omitempty"`
+	Sourcetype   string   `json:"sourcetype"`
+	EarliestTime string   `json:"earliest_time"`
+	LatestTime   string   `json:"latest_time"`
+}
+
+// Translate returns the search q is read with, as the Splunk user of ctx.
+// Only the metric catalog is looked up, no search is dispatched.
+func (c *Client) Translate(ctx context.Context, q *prompb.Query) (*Translation, error) {
+	c = c.withCredentials(ctx)
+	if err := c.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	q, _ = c.ignoredLabels.strip(q)
+	q, _ = c.metricAliases.translate(q)
+	t := &Translation{
+		SearchMode: c.searchMode,
+		Indexes:    c.indexes(),
+		Sourcetype: c.sourcetype,
+	}
+	t.SearchPrefix = c.searchPrefix
+	if savedSearch, _ := c.savedSearches.find(q); savedSearch != "" {
+		t.SavedSearch = savedSearch
+		t.SearchMode = SearchModeJob
+	} else {
+		search, err := MakeSPL(q, c, c.searchBase(), c.downsampling, c.metricNames, c.fieldPrefix)
+		if err != nil {
+			return nil, err
+		}
+		t.Search = search
+	}
+	_, _, searchStart, searchEnd := c.readWindow.bounds(q.StartTimestampMs, q.EndTimestampMs, time.Now())
+	t.EarliestTime = splunkTime(searchStart)
+	t.LatestTime = splunkTime(searchEnd + 1)
+	return t, nil
+}
+
+// Authenticate checks that Splunk accepts the credentials of ctx.
+func (c *Client) Authenticate(ctx context.Context) error {
+	return c.withCredentials(ctx).authenticate(ctx)
+}
+
+// authenticate checks that Splunk accepts the credentials of c.
+func (c *Client) authenticate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	httpResp, err := c.splunkRESTResponse(ctx, "GET", "/services/authentication/current-context", nil, nil)
+	if err != nil {
+		return err
+	}
+	httpResp.Body.Close()
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized:
+		return &AuthError{msg: "splunk rejected the credentials"}
+	case httpResp.StatusCode >= 400:
+		return fmt.Errorf("check credentials: splunk returned %s", httpResp.Status)
+	}
+	return nil
+}
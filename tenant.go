@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kebe7jun/ropee/metrics"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const tenantHeader = "X-Scope-OrgID"
+
+// tenantLimit is an entry of the -tenant-limits-file.
+type tenantLimit struct {
+	Tenant   string  `yaml:"tenant"`
+	WriteRPS float64 `yaml:"write_rps"`
+	ReadRPS  float64 `yaml:"read_rps"`
+}
+
+// tenantLimiters rate limit the requests of the tenants named in the
+// X-Scope-OrgID header. Tenants without limits aren't limited.
+type tenantLimiters struct {
+	write map[string]*rate.Limiter
+	read  map[string]*rate.Limiter
+	log   log.Logger
+}
+
+func loadTenantLimiters(filename string, l log.Logger) (*tenantLimiters, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var limits []tenantLimit
+	if err := yaml.UnmarshalStrict(data, &limits); err != nil {
+		return nil, err
+	}
+	res := &tenantLimiters{
+		write: make(map[string]*rate.Limiter),
+		read:  make(map[string]*rate.Limiter),
+		log:   l,
+	}
+	for _, t := range limits {
+		if t.Tenant == "" {
+			return nil, fmt.Errorf("tenant is required")
+		}
+		if t.WriteRPS > 0 {
+			res.write[t.Tenant] = rate.NewLimiter(rate.Limit(t.WriteRPS), int(math.Ceil(t.WriteRPS)))
+		}
+		if t.ReadRPS > 0 {
+			res.read[t.Tenant] = rate.NewLimiter(rate.Limit(t.ReadRPS), int(math.Ceil(t.ReadRPS)))
+		}
+	}
+	return res, nil
+}
+
+// wrapWrite limits next by the write_rps of the request's tenant.
+func (t *tenantLimiters) wrapWrite(next http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return next
+	}
+	return t.wrap(t.write, "write", next)
+}
+
+// wrapRead limits next by the read_rps of the request's tenant.
+func (t *tenantLimiters) wrapRead(next http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return next
+	}
+	return t.wrap(t.read, "read", next)
+}
+
+func (t *tenantLimiters) wrap(limiters map[string]*rate.Limiter, handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(tenantHeader)
+		if limiter, ok := limiters[tenant]; ok {
+			reservation := limiter.Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				metrics.TenantRateLimitTotal.WithLabelValues(tenant).Inc()
+				level.Warn(t.log).Log("msg", "tenant rate limited", "tenant", tenant, "path", r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				httpError(w, handler, errorTypeLimit, "rate limit of tenant "+tenant+" exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,57 @@
+package transform
+
+import (
+	"github.com/kebe7jun/ropee/ingest"
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+	"strings"
+)
+
+// kubernetesStripPrefixes are removed from label names entirely, so
+// app.kubernetes.io/name becomes name.
+var kubernetesStripPrefixes = []string{
+	"app.kubernetes.io/",
+	"beta.kubernetes.io/",
+}
+
+// FlattenKubernetesLabels returns ts with hierarchical Kubernetes label
+// names, which can't be matched on reads, made valid Prometheus label names
+// and its labels sorted by name. ts isn't modified, the samples are shared.
+// The app.kubernetes.io/ and beta.kubernetes.io/ prefixes are stripped and
+// every other character not allowed in label names, e.g. '/', '.' and '-',
+// is replaced by '_'. When stripping would collide with another label the
+// prefix is kept, e.g. app_kubernetes_io_name. Labels that still collide,
+// like a/b next to a.b, are dropped but for the first of them in name order.
+func FlattenKubernetesLabels(ts *prompb.TimeSeries) *prompb.TimeSeries {
+	res := make([]prompb.Label, 0, len(ts.Labels))
+	names := make(map[string]bool, len(ts.Labels))
+	invalid := make([]prompb.Label, 0)
+	for _, l := range ts.Labels {
+		if ingest.SanitizeName(l.Name) == l.Name {
+			names[l.Name] = true
+			res = append(res, l)
+			continue
+		}
+		invalid = append(invalid, l)
+	}
+	sort.Slice(invalid, func(i, j int) bool { return invalid[i].Name < invalid[j].Name })
+	for _, l := range invalid {
+		name := ingest.SanitizeName(l.Name)
+		for _, prefix := range kubernetesStripPrefixes {
+			if !strings.HasPrefix(l.Name, prefix) {
+				continue
+			}
+			if stripped := ingest.SanitizeName(strings.TrimPrefix(l.Name, prefix)); stripped != "" && !names[stripped] {
+				name = stripped
+			}
+			break
+		}
+		if names[name] {
+			continue
+		}
+		names[name] = true
+		res = append(res, prompb.Label{Name: name, Value: l.Value})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return &prompb.TimeSeries{Labels: res, Samples: ts.Samples}
+}
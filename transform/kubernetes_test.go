@@ -0,0 +1,97 @@
+package transform
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenKubernetesLabels(t *testing.T) {
+	// the well-known labels, annotations and taints of Kubernetes
+	for name, want := range map[string]string{
+		"app.kubernetes.io/name":                   "name",
+		"app.kubernetes.io/instance":               "instance",
+		"app.kubernetes.io/version":                "version",
+		"app.kubernetes.io/component":              "component",
+		"app.kubernetes.io/part-of":                "part_of",
+		"app.kubernetes.io/managed-by":             "managed_by",
+		"app.kubernetes.io/created-by":             "created_by",
+		"beta.kubernetes.io/arch":                  "arch",
+		"beta.kubernetes.io/os":                    "os",
+		"beta.kubernetes.io/instance-type":         "instance_type",
+		"kubernetes.io/arch":                       "kubernetes_io_arch",
+		"kubernetes.io/os":                         "kubernetes_io_os",
+		"kubernetes.io/hostname":                   "kubernetes_io_hostname",
+		"kubernetes.io/metadata.name":              "kubernetes_io_metadata_name",
+		"node.kubernetes.io/instance-type":         "node_kubernetes_io_instance_type",
+		"topology.kubernetes.io/region":            "topology_kubernetes_io_region",
+		"topology.kubernetes.io/zone":              "topology_kubernetes_io_zone",
+		"failure-domain.beta.kubernetes.io/region": "failure_domain_beta_kubernetes_io_region",
+		"failure-domain.beta.kubernetes.io/zone":   "failure_domain_beta_kubernetes_io_zone",
+		"node-role.kubernetes.io/control-plane":    "node_role_kubernetes_io_control_plane",
+		"pod-template-hash":                        "pod_template_hash",
+		"job":                                      "job",
+	} {
+		ts := FlattenKubernetesLabels(&prompb.TimeSeries{Labels: []prompb.Label{{Name: name, Value: "v"}}})
+		if got := ts.Labels[0].Name; got != want {
+			t.Errorf("%s flattened to %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestFlattenKubernetesLabelsKeepsPrefixOnCollision(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: "app.kubernetes.io/name", Value: "api"},
+		{Name: "name", Value: "scraped"},
+	}
+	got := FlattenKubernetesLabels(&prompb.TimeSeries{Labels: labels}).Labels
+	want := []prompb.Label{
+		{Name: "app_kubernetes_io_name", Value: "api"},
+		{Name: "name", Value: "scraped"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("flattened to %v, want %v", got, want)
+	}
+	if labels[0].Name != "app.kubernetes.io/name" {
+		t.Fatalf("the labels flattened were modified: %v", labels)
+	}
+}
+
+func TestFlattenKubernetesLabelsSorted(t *testing.T) {
+	got := FlattenKubernetesLabels(&prompb.TimeSeries{Labels: []prompb.Label{
+		{Name: "__name__", Value: "kube_pod_labels"},
+		{Name: "app.kubernetes.io/name", Value: "api"},
+		{Name: "job", Value: "kube-state-metrics"},
+		{Name: "pod", Value: "api-0"},
+	}}).Labels
+	want := []prompb.Label{
+		{Name: "__name__", Value: "kube_pod_labels"},
+		{Name: "job", Value: "kube-state-metrics"},
+		{Name: "name", Value: "api"},
+		{Name: "pod", Value: "api-0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("flattened to %v, want %v", got, want)
+	}
+}
+
+func TestFlattenKubernetesLabelsDropsCollisions(t *testing.T) {
+	got := FlattenKubernetesLabels(&prompb.TimeSeries{Labels: []prompb.Label{
+		{Name: "example.com/team", Value: "b"},
+		{Name: "example.com.team", Value: "c"},
+		{Name: "example_com_team", Value: "a"},
+	}}).Labels
+	want := []prompb.Label{{Name: "example_com_team", Value: "a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("flattened to %v, want %v", got, want)
+	}
+	got = FlattenKubernetesLabels(&prompb.TimeSeries{Labels: []prompb.Label{
+		{Name: "a/b", Value: "slash"},
+		{Name: "a.b", Value: "dot"},
+	}}).Labels
+	// '.' sorts before '/'
+	want = []prompb.Label{{Name: "a_b", Value: "dot"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("flattened to %v, want %v", got, want)
+	}
+}
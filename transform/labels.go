@@ -0,0 +1,20 @@
+package transform
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"sort"
+)
+
+// SetLabel sets the label name of ts to value in place, keeping the labels
+// sorted by name, and returns ts.
+func SetLabel(ts *prompb.TimeSeries, name, value string) *prompb.TimeSeries {
+	i := sort.Search(len(ts.Labels), func(i int) bool { return ts.Labels[i].Name >= name })
+	if i < len(ts.Labels) && ts.Labels[i].Name == name {
+		ts.Labels[i].Value = value
+		return ts
+	}
+	ts.Labels = append(ts.Labels, prompb.Label{})
+	copy(ts.Labels[i+1:], ts.Labels[i:])
+	ts.Labels[i] = prompb.Label{Name: name, Value: value}
+	return ts
+}
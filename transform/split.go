@@ -0,0 +1,158 @@
+package transform
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"sort"
+)
+
+// SplitRules split the series of high cardinality metrics with SplitMetric.
+type SplitRules struct {
+	rules []splitRule
+}
+
+type splitRule struct {
+	match   *regexp.Regexp
+	splitOn []string
+}
+
+type splitRulesFile struct {
+	Rules []struct {
+		Match   string   `yaml:"match"`
+		SplitOn []string `yaml:"split_on"`
+	} `yaml:"rules"`
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LoadSplitRules reads split rules from a YAML file like
+//
+//	rules:
+//	  - match: "http_requests_.*"
+//	    split_on: [path, user_agent]
+//
+// match is a fully anchored regex of metric names. The first matching rule
+// wins.
+func LoadSplitRules(filename string) (*SplitRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f splitRulesFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	rules := &SplitRules{}
+	for i, r := range f.Rules {
+		if r.Match == "" || len(r.SplitOn) == 0 {
+			return nil, fmt.Errorf("rule %d: match and split_on are required", i+1)
+		}
+		match, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		for _, name := range r.SplitOn {
+			if !labelNameRE.MatchString(name) || name == "__name__" {
+				return nil, fmt.Errorf("rule %d: invalid label name %q", i+1, name)
+			}
+		}
+		rules.rules = append(rules.rules, splitRule{match: match, splitOn: r.SplitOn})
+	}
+	return rules, nil
+}
+
+// Split returns series with the series of metrics matching a rule replaced
+// by those SplitMetric splits them into. Series differing only in other
+// labels of split_on split into series with the same labels, their samples
+// are summed by timestamp into one series, the total per value of the label.
+// Only series of one request are summed, the series of a metric have to be
+// written together, as Prometheus does each scrape, for the totals to be
+// complete.
+func (r *SplitRules) Split(series []prompb.TimeSeries) []prompb.TimeSeries {
+	res := make([]prompb.TimeSeries, 0, len(series))
+	// the split series by labels, and their samples by timestamp
+	parts := make(map[string]int)
+	sums := make(map[string]map[int64]float64)
+	for _, ts := range series {
+		name := ""
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+			}
+		}
+		var rule *splitRule
+		for i := range r.rules {
+			if r.rules[i].match.MatchString(name) {
+				rule = &r.rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			res = append(res, ts)
+			continue
+		}
+		for _, part := range SplitMetric(ts, rule.splitOn) {
+			key := labelsKey(part.Labels)
+			if _, ok := parts[key]; !ok {
+				parts[key] = len(res)
+				sums[key] = make(map[int64]float64, len(part.Samples))
+				res = append(res, prompb.TimeSeries{Labels: part.Labels})
+			}
+			for _, sample := range part.Samples {
+				sums[key][sample.Timestamp] += sample.Value
+			}
+		}
+	}
+	for key, i := range parts {
+		samples := make([]prompb.Sample, 0, len(sums[key]))
+		for timestamp, value := range sums[key] {
+			samples = append(samples, prompb.Sample{Timestamp: timestamp, Value: value})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		res[i].Samples = samples
+	}
+	return res
+}
+
+// SplitMetric splits ts into a series per label of splitOn it has, which
+// keeps that label and the labels not in splitOn, e.g. job and instance, to
+// filter by. Each is named after the label in the style of recording rules,
+// path:http_requests_total for path, so the series of different labels don't
+// add up in queries of one name. A series of each label value combination
+// becomes a series per value of each label, far fewer than the
+// combinations. ts is returned as it is if it has none of the labels.
+func SplitMetric(ts prompb.TimeSeries, splitOn []string) []prompb.TimeSeries {
+	split := make(map[string]bool, len(splitOn))
+	for _, name := range splitOn {
+		split[name] = true
+	}
+	common := make([]prompb.Label, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		if !split[l.Name] {
+			common = append(common, l)
+		}
+	}
+	if len(common) == len(ts.Labels) {
+		return []prompb.TimeSeries{ts}
+	}
+	res := make([]prompb.TimeSeries, 0, len(splitOn))
+	for _, name := range splitOn {
+		for _, l := range ts.Labels {
+			if l.Name != name {
+				continue
+			}
+			part := prompb.TimeSeries{Labels: append([]prompb.Label(nil), common...), Samples: ts.Samples}
+			for i := range part.Labels {
+				if part.Labels[i].Name == "__name__" {
+					part.Labels[i].Value = name + ":" + part.Labels[i].Value
+				}
+			}
+			SetLabel(&part, l.Name, l.Value)
+			res = append(res, part)
+		}
+	}
+	return res
+}
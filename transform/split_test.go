@@ -0,0 +1,36 @@
+package transform
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func series(value float64, labels ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Samples: []prompb.Sample{{Timestamp: 1000, Value: value}}}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func TestSplitSumsSeriesOfOneValue(t *testing.T) {
+	rules := &SplitRules{rules: []splitRule{{match: regexp.MustCompile("^http_requests_total$"), splitOn: []string{"path", "user_agent"}}}}
+	res := rules.Split([]prompb.TimeSeries{
+		series(1, "__name__", "http_requests_total", "job", "api", "path", "/login", "user_agent", "curl"),
+		series(2, "__name__", "http_requests_total", "job", "api", "path", "/login", "user_agent", "firefox"),
+		series(4, "__name__", "http_requests_total", "job", "api", "path", "/logout", "user_agent", "curl"),
+		series(8, "__name__", "up", "job", "api"),
+	})
+	want := []prompb.TimeSeries{
+		series(3, "__name__", "path:http_requests_total", "job", "api", "path", "/login"),
+		series(5, "__name__", "user_agent:http_requests_total", "job", "api", "user_agent", "curl"),
+		series(2, "__name__", "user_agent:http_requests_total", "job", "api", "user_agent", "firefox"),
+		series(4, "__name__", "path:http_requests_total", "job", "api", "path", "/logout"),
+		series(8, "__name__", "up", "job", "api"),
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("Split() = %v, want %v", res, want)
+	}
+}
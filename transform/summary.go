@@ -0,0 +1,98 @@
+package transform
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SummaryQuantiles are the quantiles of one summary at one timestamp, keyed
+// by percentile name, e.g. p50 and p99 of quantile="0.5" and "0.99".
+type SummaryQuantiles struct {
+	// Labels are those of the quantile series without quantile, sorted by
+	// name.
+	Labels      []prompb.Label
+	Timestamp   int64
+	Percentiles map[string]float64
+}
+
+// MergeSummaryQuantiles groups the series of series carrying a quantile label
+// in [0, 1] by metric name and other labels and returns the samples of each
+// group as one SummaryQuantiles per timestamp, and the other series. Every
+// such series is taken as a quantile of a summary, whichever series are
+// written along with it, so a metric is merged in every write or in none.
+// NaN and infinite quantiles, of summaries without observations, are left
+// out.
+func MergeSummaryQuantiles(series []prompb.TimeSeries) ([]prompb.TimeSeries, []SummaryQuantiles) {
+	rest := make([]prompb.TimeSeries, 0, len(series))
+	groups := make(map[string]map[int64]*SummaryQuantiles)
+	// keys keeps the groups in the order of their first series
+	keys := make([]string, 0)
+	for _, ts := range series {
+		percentile, labels, ok := splitQuantile(ts.Labels)
+		if !ok {
+			rest = append(rest, ts)
+			continue
+		}
+		key := labelsKey(labels)
+		byTime, ok := groups[key]
+		if !ok {
+			byTime = make(map[int64]*SummaryQuantiles)
+			groups[key] = byTime
+			keys = append(keys, key)
+		}
+		for _, s := range ts.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			q, ok := byTime[s.Timestamp]
+			if !ok {
+				q = &SummaryQuantiles{Labels: labels, Timestamp: s.Timestamp, Percentiles: make(map[string]float64)}
+				byTime[s.Timestamp] = q
+			}
+			q.Percentiles[percentile] = s.Value
+		}
+	}
+	merged := make([]SummaryQuantiles, 0)
+	for _, key := range keys {
+		group := make([]SummaryQuantiles, 0, len(groups[key]))
+		for _, q := range groups[key] {
+			group = append(group, *q)
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Timestamp < group[j].Timestamp })
+		merged = append(merged, group...)
+	}
+	return rest, merged
+}
+
+// splitQuantile returns the percentile name of the quantile label of labels
+// and the other labels, sorted by name. ok is false without a quantile label
+// in [0, 1].
+func splitQuantile(labels []prompb.Label) (percentile string, rest []prompb.Label, ok bool) {
+	rest = make([]prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Name != "quantile" {
+			rest = append(rest, l)
+			continue
+		}
+		q, err := strconv.ParseFloat(l.Value, 64)
+		if err != nil || q < 0 || q > 1 {
+			return "", nil, false
+		}
+		// rounded to drop float noise, 0.999 is p99.9
+		percentile = "p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+		ok = true
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Name < rest[j].Name })
+	return percentile, rest, ok
+}
+
+func labelsKey(labels []prompb.Label) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Name+"\xff"+l.Value)
+	}
+	return strings.Join(parts, "\xff")
+}
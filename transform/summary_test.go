@@ -0,0 +1,65 @@
+package transform
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+)
+
+func summarySeries(name string, value float64, labels ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: name}},
+		Samples: []prompb.Sample{{Value: value, Timestamp: 1000}},
+	}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func TestMergeSummaryQuantiles(t *testing.T) {
+	rest, merged := MergeSummaryQuantiles([]prompb.TimeSeries{
+		summarySeries("rpc_duration_seconds", 0.1, "job", "api", "quantile", "0.5"),
+		summarySeries("rpc_duration_seconds", 0.9, "job", "api", "quantile", "0.99"),
+		summarySeries("rpc_duration_seconds_sum", 12, "job", "api"),
+		summarySeries("rpc_duration_seconds_count", 40, "job", "api"),
+	})
+	if len(rest) != 2 {
+		t.Errorf("rest = %v, want _sum and _count", rest)
+	}
+	if len(merged) != 1 {
+		t.Fatalf("merged = %v, want one event", merged)
+	}
+	if p := merged[0].Percentiles; p["p50"] != 0.1 || p["p99"] != 0.9 || len(p) != 2 {
+		t.Errorf("percentiles = %v", p)
+	}
+}
+
+func TestMergeSummaryQuantilesWithoutSiblings(t *testing.T) {
+	// the quantiles of a write without the _sum and _count of their
+	// summary, which Prometheus may send in another one
+	rest, merged := MergeSummaryQuantiles([]prompb.TimeSeries{
+		summarySeries("rpc_duration_seconds", 0.1, "job", "api", "quantile", "0.5"),
+		summarySeries("rpc_duration_seconds", 0.9, "job", "api", "quantile", "0.99"),
+		summarySeries("up", 1, "job", "api"),
+	})
+	if len(rest) != 1 || rest[0].Labels[0].Value != "up" {
+		t.Errorf("rest = %v, want up", rest)
+	}
+	if len(merged) != 1 || len(merged[0].Percentiles) != 2 {
+		t.Errorf("merged = %v, want one event of p50 and p99", merged)
+	}
+}
+
+func TestMergeSummaryQuantilesOutOfRange(t *testing.T) {
+	series := []prompb.TimeSeries{
+		summarySeries("model_error", 0.2, "quantile", "high"),
+		summarySeries("model_error", 0.3, "quantile", "1.5"),
+	}
+	rest, merged := MergeSummaryQuantiles(series)
+	if len(merged) != 0 {
+		t.Errorf("merged = %v, want none", merged)
+	}
+	if len(rest) != len(series) {
+		t.Errorf("rest = %v, want all series", rest)
+	}
+}